@@ -0,0 +1,407 @@
+//
+// addrbook.go -- persisted book of known hubs
+//
+
+package arc
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "log/slog"
+  "math"
+  "net"
+  "os"
+  "sort"
+  "strconv"
+  "sync"
+  "text/tabwriter"
+  "time"
+)
+
+// max number of hubs we remember
+const maxAddrBookEntries = 1024
+
+// default number of outbound connections to keep
+const defaultTargetOutbound = 4
+
+// seconds to wait before retrying a hub
+const addrRetryCooldown = 60
+
+// max number of times the retry cooldown doubles
+const addrMaxBackoff = 6
+
+// failures in a row before a hub may be retired
+const addrRetireFailures = 10
+
+// seconds without a connection before a failing hub is retired
+const addrRetireAge = 7 * 24 * 60 * 60
+
+// a hub we know about
+type addrEntry struct {
+  RemoteHubConfig
+  // where we learned about it: config, pex, discovery
+  Source string
+  // number of successful connections
+  Success int
+  // number of failed connections
+  Failure int
+  // number of failed connections since the last success
+  FailStreak int
+  // unix time we were last connected
+  LastSeen int64
+  // unix time we last tried to connect
+  LastTry int64
+  // average time to connect in milliseconds
+  Latency int64
+  // number of messages we got from this hub
+  Delivered uint64
+  // we gave up on this hub
+  Retired bool
+  // are we connected right now
+  connected bool
+  // current connection
+  conn Connection
+}
+
+// key of this entry in the book
+func (e addrEntry) key() string {
+  return net.JoinHostPort(e.Addr, strconv.Itoa(e.Port))
+}
+
+// ranking of this entry, higher is better
+func (e addrEntry) score() float64 {
+  if e.Retired {
+    return -1
+  }
+  // fraction of connections that worked, unknown hubs get the benefit of the doubt
+  s := float64(e.Success + 1) / float64(e.Success + e.Failure + 2)
+  // hubs failing right now are worse
+  s /= float64(e.FailStreak + 1)
+  // hubs that deliver messages are better
+  if e.Delivered > 0 {
+    s *= 1.0 + math.Log10(float64(e.Delivered)) / 10.0
+  }
+  // slow hubs are worse
+  if e.Latency > 0 {
+    s *= 1000.0 / float64(e.Latency + 1000)
+  }
+  return s
+}
+
+// seconds to wait before trying this hub again
+func (e addrEntry) cooldown() int64 {
+  n := e.FailStreak
+  if n > addrMaxBackoff {
+    n = addrMaxBackoff
+  }
+  return addrRetryCooldown << uint(n)
+}
+
+// should we give up on this hub
+func (e addrEntry) dead(now int64) bool {
+  return e.FailStreak >= addrRetireFailures && now - e.LastSeen > addrRetireAge
+}
+
+type addrBook struct {
+  // file we save to
+  fname string
+  access sync.Mutex
+  entries map[string]*addrEntry
+  // entries changed since we last saved
+  dirty bool
+  log *slog.Logger
+}
+
+// load address book from file, start a new one if it does not exist
+func loadAddrBook(fname string, logger *slog.Logger) (book *addrBook, err error) {
+  book = &addrBook{
+    fname: fname,
+    entries: make(map[string]*addrEntry),
+    log: logger,
+  }
+  if checkFile(fname) {
+    var f *os.File
+    f, err = os.Open(fname)
+    if err == nil {
+      var entries []*addrEntry
+      err = json.NewDecoder(f).Decode(&entries)
+      f.Close()
+      for _, e := range entries {
+        book.entries[e.key()] = e
+      }
+    }
+  }
+  return
+}
+
+// save to file if anything changed since we last did
+func (b *addrBook) Save() error {
+  b.access.Lock()
+  if ! b.dirty {
+    b.access.Unlock()
+    return nil
+  }
+  var entries []addrEntry
+  for _, e := range b.entries {
+    entries = append(entries, *e)
+  }
+  b.dirty = false
+  b.access.Unlock()
+  data, err := json.MarshalIndent(entries, "", "  ")
+  if err == nil {
+    err = writeFileAtomic(b.fname, append(data, '\n'), 0600)
+  }
+  if err != nil {
+    // try again next time
+    b.access.Lock()
+    b.dirty = true
+    b.access.Unlock()
+  }
+  return err
+}
+
+// add a hub if we don't already know it
+func (b *addrBook) Add(c RemoteHubConfig, source string) {
+  e := &addrEntry{
+    RemoteHubConfig: c,
+    Source: source,
+  }
+  b.access.Lock()
+  defer b.access.Unlock()
+  k := e.key()
+  if old, ok := b.entries[k]; ok {
+    if source == "config" {
+      // configured hubs get another chance
+      old.RemoteHubConfig = c
+      old.Source = source
+      old.Retired = false
+      b.dirty = true
+    }
+    return
+  }
+  if len(b.entries) >= maxAddrBookEntries && ! b.evict(source) {
+    return
+  }
+  b.log.Info("add hub to address book", "peer", k, "source", source)
+  b.entries[k] = e
+  b.dirty = true
+}
+
+// make the configured hubs match remotes
+// configured hubs not in remotes are removed and disconnected, hubs from pex and discovery stay
+func (b *addrBook) Configure(remotes []RemoteHubConfig) {
+  want := make(map[string]bool)
+  for _, r := range remotes {
+    e := addrEntry{RemoteHubConfig: r}
+    want[e.key()] = true
+  }
+  b.access.Lock()
+  for k, e := range b.entries {
+    if e.Source == "config" && ! want[k] {
+      b.log.Info("remove hub from address book", "peer", k)
+      delete(b.entries, k)
+      b.dirty = true
+      if e.conn != nil {
+        e.conn.Close()
+      }
+    }
+  }
+  b.access.Unlock()
+  for _, r := range remotes {
+    b.Add(r, "config")
+  }
+}
+
+// drop a hub we learned about from source unless it worked or we are connecting to it
+func (b *addrBook) Forget(k, source string) {
+  b.access.Lock()
+  defer b.access.Unlock()
+  e, ok := b.entries[k]
+  if ok && e.Source == source && e.Success == 0 && ! e.connected {
+    b.log.Info("remove hub from address book", "peer", k)
+    delete(b.entries, k)
+    b.dirty = true
+  }
+}
+
+// return true if we ever connected to a hub
+func (b *addrBook) Worked(k string) bool {
+  b.access.Lock()
+  defer b.access.Unlock()
+  e, ok := b.entries[k]
+  return ok && e.Success > 0
+}
+
+// drop the worst hub that never worked to make room for one from source, call with lock held
+// retired hubs that once worked only make room for hubs we did not get from pex
+func (b *addrBook) evict(source string) bool {
+  var worst *addrEntry
+  for _, e := range b.entries {
+    if (e.Success == 0 || (e.Retired && source != "pex")) && ! e.connected && e.Source != "config" {
+      if worst == nil || e.score() < worst.score() {
+        worst = e
+      }
+    }
+  }
+  if worst == nil {
+    return false
+  }
+  delete(b.entries, worst.key())
+  return true
+}
+
+// pick the best hub we are not connected to and mark it connected
+// returns nil if there is nothing to connect to
+func (b *addrBook) Pick() *addrEntry {
+  b.access.Lock()
+  defer b.access.Unlock()
+  now := time.Now().Unix()
+  var best *addrEntry
+  for _, e := range b.entries {
+    if e.Retired || e.connected || now - e.LastTry < e.cooldown() {
+      continue
+    }
+    if best == nil || e.score() > best.score() {
+      best = e
+    }
+  }
+  if best == nil {
+    return nil
+  }
+  best.connected = true
+  best.LastTry = now
+  b.dirty = true
+  e := *best
+  return &e
+}
+
+// number of hubs we are connected to
+func (b *addrBook) Connected() (n int) {
+  b.access.Lock()
+  for _, e := range b.entries {
+    if e.connected {
+      n++
+    }
+  }
+  b.access.Unlock()
+  return
+}
+
+// mark a connection attempt as succeeded after taking latency to connect
+// returns false if the hub was removed while we were connecting
+func (b *addrBook) Good(k string, latency time.Duration, conn Connection) bool {
+  b.access.Lock()
+  e, ok := b.entries[k]
+  if ok {
+    b.dirty = true
+    e.conn = conn
+    e.Success++
+    e.FailStreak = 0
+    e.LastSeen = time.Now().Unix()
+    ms := int64(latency / time.Millisecond)
+    if e.Latency == 0 {
+      e.Latency = ms
+    } else {
+      // moving average
+      e.Latency = (e.Latency * 3 + ms) / 4
+    }
+  }
+  b.access.Unlock()
+  return ok
+}
+
+// mark a connection attempt as failed
+func (b *addrBook) Bad(k string) {
+  b.access.Lock()
+  e, ok := b.entries[k]
+  if ok {
+    b.dirty = true
+    e.Failure++
+    e.FailStreak++
+    e.connected = false
+    if e.dead(time.Now().Unix()) {
+      b.log.Info("retiring hub", "peer", k, "failures", e.FailStreak)
+      e.Retired = true
+    }
+  }
+  b.access.Unlock()
+}
+
+// mark a connection as closed after delivering n messages
+func (b *addrBook) Disconnected(k string, n uint64) {
+  b.access.Lock()
+  e, ok := b.entries[k]
+  if ok {
+    b.dirty = true
+    e.connected = false
+    e.conn = nil
+    e.Delivered += n
+    e.LastSeen = time.Now().Unix()
+  }
+  b.access.Unlock()
+}
+
+// get all entries best first
+func (b *addrBook) Ranked() (entries []addrEntry) {
+  b.access.Lock()
+  for _, e := range b.entries {
+    entries = append(entries, *e)
+  }
+  b.access.Unlock()
+  sort.Slice(entries, func(i, j int) bool {
+    return entries[i].score() > entries[j].score()
+  })
+  return
+}
+
+// get up to n addresses of hubs that worked for us, best first
+func (b *addrBook) Share(n int) (addrs []string) {
+  b.access.Lock()
+  var good []*addrEntry
+  for _, e := range b.entries {
+    if e.Success > 0 && ! e.Retired {
+      good = append(good, e)
+    }
+  }
+  sort.Slice(good, func(i, j int) bool {
+    return good[i].score() > good[j].score()
+  })
+  for _, e := range good {
+    if len(addrs) >= n {
+      break
+    }
+    addrs = append(addrs, e.key())
+  }
+  b.access.Unlock()
+  return
+}
+
+// print the address book in a file ranked best first
+func PrintAddrBook(fname string, w io.Writer) error {
+  if ! checkFile(fname) {
+    return fmt.Errorf("no address book at %s", fname)
+  }
+  book, err := loadAddrBook(fname, slog.Default())
+  if err != nil {
+    return err
+  }
+  tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+  fmt.Fprintln(tw, "RANK\tHUB\tSCORE\tSOURCE\tOK\tFAIL\tSTREAK\tLATENCY\tDELIVERED\tLAST SEEN\tSTATUS")
+  for n, e := range book.Ranked() {
+    seen := "never"
+    if e.LastSeen > 0 {
+      seen = time.Unix(e.LastSeen, 0).Format(time.RFC3339)
+    }
+    status := "ok"
+    if e.Retired {
+      status = "retired"
+    } else if e.FailStreak > 0 {
+      status = "failing"
+    } else if e.Success == 0 {
+      status = "untried"
+    }
+    fmt.Fprintf(tw, "%d\t%s\t%.3f\t%s\t%d\t%d\t%d\t%dms\t%d\t%s\t%s\n", n + 1, e.key(), e.score(), e.Source, e.Success, e.Failure, e.FailStreak, e.Latency, e.Delivered, seen, status)
+  }
+  return tw.Flush()
+}
@@ -0,0 +1,298 @@
+//
+// addrbook_test.go -- tests for the address book of known hubs
+//
+
+package arc
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+// reloading config only touches hubs that came from config
+func TestAddrBookConfigure(t *testing.T) {
+  book := &addrBook{
+    entries: make(map[string]*addrEntry),
+    log: testLogger,
+  }
+  kept := RemoteHubConfig{Addr: "203.0.113.1", Port: 6789}
+  dropped := RemoteHubConfig{Addr: "203.0.113.2", Port: 6789}
+  discovered := RemoteHubConfig{Addr: "192.168.1.3", Port: 6789}
+  exchanged := RemoteHubConfig{Addr: "203.0.113.4", Port: 6789}
+  added := RemoteHubConfig{Addr: "203.0.113.5", Port: 6789}
+  book.Add(kept, "config")
+  book.Add(dropped, "config")
+  book.Add(discovered, "discovery")
+  book.Add(exchanged, "pex")
+  book.Configure([]RemoteHubConfig{kept, added})
+  want := map[RemoteHubConfig]string{
+    kept: "config",
+    discovered: "discovery",
+    exchanged: "pex",
+    added: "config",
+  }
+  if len(book.entries) != len(want) {
+    t.Errorf("book has %d hubs, want %d", len(book.entries), len(want))
+  }
+  for c, source := range want {
+    e, ok := book.entries[addrEntry{RemoteHubConfig: c}.key()]
+    if ! ok {
+      t.Errorf("lost %s hub %s", source, c.Addr)
+    } else if e.Source != source {
+      t.Errorf("hub %s has source %s, want %s", c.Addr, e.Source, source)
+    }
+  }
+  if _, ok := book.entries[addrEntry{RemoteHubConfig: dropped}.key()]; ok {
+    t.Error("kept a hub that was removed from config")
+  }
+  // configuring a hub we discovered makes it a configured hub
+  book.Configure([]RemoteHubConfig{discovered})
+  if e := book.entries[addrEntry{RemoteHubConfig: discovered}.key()]; e == nil || e.Source != "config" {
+    t.Error("configured hub is not from config")
+  }
+}
+
+// a full book of hubs that all worked once but are retired now
+func newFullTestBook() *addrBook {
+  book := &addrBook{
+    entries: make(map[string]*addrEntry),
+    log: testLogger,
+  }
+  for i := 0; i < maxAddrBookEntries; i++ {
+    e := &addrEntry{
+      RemoteHubConfig: RemoteHubConfig{Addr: fmt.Sprintf("198.51.%d.%d", i / 256, i % 256), Port: 6789},
+      Source: "pex",
+      Success: 1,
+      Retired: true,
+    }
+    book.entries[e.key()] = e
+  }
+  return book
+}
+
+// hubs from pex never push out hubs that worked
+func TestAddrBookPEXEvict(t *testing.T) {
+  book := newFullTestBook()
+  book.Add(RemoteHubConfig{Addr: "203.0.113.1", Port: 6789}, "pex")
+  if _, ok := book.entries["203.0.113.1:6789"]; ok {
+    t.Error("pex hub pushed out a hub that worked")
+  }
+  book.Add(RemoteHubConfig{Addr: "192.168.1.1", Port: 6789}, "discovery")
+  if _, ok := book.entries["192.168.1.1:6789"]; ! ok {
+    t.Error("discovered hub did not replace a retired one")
+  }
+  if n := len(book.entries); n != maxAddrBookEntries {
+    t.Errorf("book has %d hubs, want %d", n, maxAddrBookEntries)
+  }
+}
+
+func TestAddrEntryScore(t *testing.T) {
+  tests := []struct {
+    name string
+    better, worse addrEntry
+  }{
+    {"works more often", addrEntry{Success: 9, Failure: 1}, addrEntry{Success: 1, Failure: 9}},
+    {"untried over failing", addrEntry{}, addrEntry{Failure: 3, FailStreak: 3}},
+    {"not failing right now", addrEntry{Success: 5, Failure: 5}, addrEntry{Success: 5, Failure: 5, FailStreak: 2}},
+    {"delivers messages", addrEntry{Success: 1, Delivered: 1000}, addrEntry{Success: 1}},
+    {"faster", addrEntry{Success: 1, Latency: 50}, addrEntry{Success: 1, Latency: 2000}},
+    {"not retired", addrEntry{Failure: 100, FailStreak: 100}, addrEntry{Success: 100, Retired: true}},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      if b, w := tt.better.score(), tt.worse.score(); b <= w {
+        t.Errorf("score %f is not above %f", b, w)
+      }
+    })
+  }
+}
+
+func TestAddrEntryCooldown(t *testing.T) {
+  tests := []struct {
+    streak int
+    cooldown int64
+  }{
+    {0, addrRetryCooldown},
+    {1, addrRetryCooldown * 2},
+    {3, addrRetryCooldown * 8},
+    {addrMaxBackoff, addrRetryCooldown << addrMaxBackoff},
+    {addrMaxBackoff + 10, addrRetryCooldown << addrMaxBackoff},
+  }
+  for _, tt := range tests {
+    if got := (addrEntry{FailStreak: tt.streak}).cooldown(); got != tt.cooldown {
+      t.Errorf("cooldown after %d failures is %d, want %d", tt.streak, got, tt.cooldown)
+    }
+  }
+}
+
+// a book with one hub for each entry
+func newTestBook(entries ...*addrEntry) *addrBook {
+  book := &addrBook{
+    entries: make(map[string]*addrEntry),
+    log: testLogger,
+  }
+  for n, e := range entries {
+    if len(e.Addr) == 0 {
+      e.Addr = fmt.Sprintf("203.0.113.%d", n + 1)
+      e.Port = 6789
+    }
+    book.entries[e.key()] = e
+  }
+  return book
+}
+
+func TestAddrBookPick(t *testing.T) {
+  now := time.Now().Unix()
+  tests := []struct {
+    name string
+    entry addrEntry
+    picked bool
+  }{
+    {"untried", addrEntry{}, true},
+    {"tried a while ago", addrEntry{LastTry: now - addrRetryCooldown - 1}, true},
+    {"tried just now", addrEntry{LastTry: now - 1}, false},
+    {"backing off", addrEntry{FailStreak: 2, LastTry: now - addrRetryCooldown * 2}, false},
+    {"backed off long enough", addrEntry{FailStreak: 2, LastTry: now - addrRetryCooldown * 4 - 1}, true},
+    {"connected", addrEntry{connected: true}, false},
+    {"retired", addrEntry{Retired: true}, false},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      e := tt.entry
+      book := newTestBook(&e)
+      got := book.Pick()
+      if (got != nil) != tt.picked {
+        t.Fatalf("picked %v, want %v", got != nil, tt.picked)
+      }
+      if got != nil && (! e.connected || e.LastTry < now) {
+        t.Error("picked hub not marked connected and tried")
+      }
+    })
+  }
+}
+
+func TestAddrBookPickBest(t *testing.T) {
+  best := &addrEntry{Success: 10}
+  book := newTestBook(&addrEntry{Success: 1, Failure: 5}, best, &addrEntry{Failure: 2, FailStreak: 2})
+  if e := book.Pick(); e == nil || e.key() != best.key() {
+    t.Errorf("picked %v, want %s", e, best.key())
+  }
+}
+
+func TestAddrBookBadRetires(t *testing.T) {
+  now := time.Now().Unix()
+  tests := []struct {
+    name string
+    entry addrEntry
+    retired bool
+  }{
+    {"first failure", addrEntry{}, false},
+    {"failing but seen lately", addrEntry{FailStreak: addrRetireFailures, LastSeen: now}, false},
+    {"not failing enough", addrEntry{FailStreak: addrRetireFailures - 2}, false},
+    {"failing and gone for long", addrEntry{FailStreak: addrRetireFailures - 1, LastSeen: now - addrRetireAge - 1}, true},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      e := tt.entry
+      e.connected = true
+      book := newTestBook(&e)
+      book.Bad(e.key())
+      if e.Retired != tt.retired {
+        t.Errorf("retired is %v, want %v", e.Retired, tt.retired)
+      }
+      if e.connected {
+        t.Error("failed hub still marked connected")
+      }
+    })
+  }
+}
+
+func TestAddrBookEvict(t *testing.T) {
+  tests := []struct {
+    name string
+    entry addrEntry
+    source string
+    evicted bool
+  }{
+    {"never worked", addrEntry{Source: "pex"}, "pex", true},
+    {"worked", addrEntry{Source: "pex", Success: 1}, "discovery", false},
+    {"retired for discovery", addrEntry{Source: "pex", Success: 1, Retired: true}, "discovery", true},
+    {"retired for pex", addrEntry{Source: "pex", Success: 1, Retired: true}, "pex", false},
+    {"connected", addrEntry{Source: "pex", connected: true}, "discovery", false},
+    {"configured", addrEntry{Source: "config"}, "discovery", false},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      e := tt.entry
+      book := newTestBook(&e)
+      if got := book.evict(tt.source); got != tt.evicted {
+        t.Errorf("evicted %v, want %v", got, tt.evicted)
+      }
+      if _, ok := book.entries[e.key()]; ok == tt.evicted {
+        t.Error("book does not match what evict returned")
+      }
+    })
+  }
+}
+
+// the worst of the hubs that may go is the one that goes
+func TestAddrBookEvictWorst(t *testing.T) {
+  worst := &addrEntry{Source: "pex", Failure: 5, FailStreak: 5}
+  book := newTestBook(&addrEntry{Source: "pex"}, worst, &addrEntry{Source: "pex", Failure: 1, FailStreak: 1})
+  book.evict("pex")
+  if _, ok := book.entries[worst.key()]; ok {
+    t.Error("kept the worst hub")
+  }
+  if n := len(book.entries); n != 2 {
+    t.Errorf("book has %d hubs, want 2", n)
+  }
+}
+
+// the book is only written when it changed and never left half written
+func TestAddrBookSave(t *testing.T) {
+  dir := t.TempDir()
+  fname := filepath.Join(dir, "peers.json")
+  book, err := loadAddrBook(fname, testLogger)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err = book.Save(); err != nil {
+    t.Fatal(err)
+  }
+  if checkFile(fname) {
+    t.Error("saved a book that did not change")
+  }
+  book.Add(RemoteHubConfig{Addr: "203.0.113.1", Port: 6789}, "config")
+  if err = book.Save(); err != nil {
+    t.Fatal(err)
+  }
+  st, err := os.Stat(fname)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if st.Mode().Perm() != 0600 {
+    t.Errorf("book saved with mode %o", st.Mode().Perm())
+  }
+  // not dirty again until something changes
+  os.Remove(fname)
+  book.Save()
+  if checkFile(fname) {
+    t.Error("saved the book again without a change")
+  }
+  book.Bad("203.0.113.1:6789")
+  book.Save()
+  loaded, err := loadAddrBook(fname, testLogger)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if e := loaded.entries["203.0.113.1:6789"]; e == nil || e.Failure != 1 {
+    t.Errorf("loaded %+v", e)
+  }
+  files, _ := os.ReadDir(dir)
+  if len(files) != 1 {
+    t.Errorf("left %d files behind", len(files))
+  }
+}
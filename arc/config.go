@@ -5,9 +5,17 @@
 package arc
 
 import (
+  "bytes"
   "encoding/json"
-  "log"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "log/slog"
   "os"
+  "path/filepath"
+  "strings"
+  "github.com/BurntSushi/toml"
+  "gopkg.in/yaml.v3"
 )
 
 type RemoteHubConfig struct {
@@ -15,69 +23,309 @@ type RemoteHubConfig struct {
   Port int
   ProxyAddr string
   ProxyPort int
+  // "socks" for socks proxy, "i2p-sam" for i2p sam bridge or empty for direct
   ProxyType string
+  // use tls on this link
+  TLS bool
+  // hex encoded identity key we expect the hub to have when using tls
+  PinKey string
+  // link to this hub over websocket instead of urc over tcp
+  WebSocket bool
+  // http path of the websocket hub, defaults to /urc
+  WebSocketPath string
 }
 
 type LocalHubConfig struct {
   Bind string
+  // identity key file, empty uses a new identity every run
   Keys string
   EtherBind string
+  // udp hub port, 0 disables the udp hub
+  UDPPort int
+  // ipv4 broadcast address for the udp hub
+  UDPBroadcast string
+  // ipv6 link local multicast group for the udp hub
+  UDPGroup string
+  // network interface for ipv6 multicast
+  UDPInterface string
+  // don't announce or discover hubs on the local link
+  NoDiscovery bool
+  // seconds between discovery beacons
+  DiscoveryInterval int
+  // max number of hubs to persist from discovery
+  MaxAutoPeers int
+  // address book file, empty means only use persisted hubs
+  AddrBook string
+  // number of outbound connections to keep from the address book
+  TargetOutbound int
+  // socks proxy used for onion hubs learned via pex
+  SocksAddr string
+  SocksPort int
+  // our public hub addresses shared with peers via pex
+  Announce []string
+  // i2p sam bridge address for accepting i2p inbound, empty disables
+  I2PSAM string
+  // file holding our persistent i2p destination
+  I2PKeys string
+  // tor control port address for publishing an onion service, empty disables
+  TorControl string
+  // tor control port password, uses cookie auth if empty
+  TorPassword string
+  // tor control auth cookie file, asks tor where it is if empty
+  TorCookie string
+  // file holding our onion service key, defaults to onion.key next to Keys
+  OnionKeys string
+  // tls listener address, empty disables
+  TLSBind string
+  // hex encoded identity keys of hubs allowed to connect over tls, empty allows any
+  TLSPeers []string
+  // http listen address for the websocket hub, empty disables
+  WebSocketBind string
+  // http path for the websocket hub, defaults to /urc
+  WebSocketPath string
+  // browser origins allowed to use the websocket hub, empty allows any
+  WebSocketOrigins []string
+  // log level: debug, info, warn or error, defaults to info
+  LogLevel string
+  // keep secret keys in guarded memory that is never swapped, see nacl.SetSecureMemory
+  SecureMemory bool
+  // what to do with inbound messages over a rate limit: drop, throttle or disconnect, defaults to drop
+  RateLimitAction string
+  // messages a minute and burst allowed from each hub link, 0 rate is no limit
+  // burst defaults to a tenth of the rate
+  PeerRate int
+  PeerBurst int
+  // messages a minute and burst allowed from each irc prefix, 0 rate is no limit
+  SenderRate int
+  SenderBurst int
+  // messages a minute and burst allowed from all hub links together, 0 rate is no limit
+  GlobalRate int
+  GlobalBurst int
+  // http listen address serving metrics at /debug/vars, empty disables
+  MetricsBind string
+  // bits of proof of work messages need for us to relay them, 0 relays messages without any
+  StampBits int
+  // content filter rules file applied before relaying, json, toml or yaml by extension, empty relays everything
+  FilterRules string
 }
 
 type Config struct {
   Remote []RemoteHubConfig
   Local LocalHubConfig
 }
- 
-// save to file
-func (cfg Config) Save(fname string) error {
-  f, err := os.Create(fname)
-  if err == nil {
-    enc := json.NewEncoder(f)
-    err = enc.Encode(cfg)
-    f.Close()
+
+// get config file format from file extension: json, toml or yaml
+func configFormat(fname string) string {
+  switch strings.ToLower(filepath.Ext(fname)) {
+  case ".toml":
+    return "toml"
+  case ".yaml", ".yml":
+    return "yaml"
   }
-  return err
+  return "json"
 }
 
-// generate default config
-func genConfig() (cfg Config) {
+// turn a toml or yaml config into json so every format goes through the same decoder
+func configToJSON(format string, data []byte) ([]byte, error) {
+  var v map[string]interface{}
+  var err error
+  if format == "toml" {
+    _, err = toml.Decode(string(data), &v)
+  } else {
+    err = yaml.Unmarshal(data, &v)
+  }
+  if err != nil {
+    return nil, err
+  }
+  return json.Marshal(v)
+}
 
-  // urc hub for ayb
-  aybHub := RemoteHubConfig{
-    Addr: "allyour4nert7pkh.onion",
-    Port: 6789,
-    ProxyType: "socks",
-    ProxyAddr: "127.0.0.1",
-    ProxyPort: 9050,
+// turn json numbers back into ints and floats so yaml doesn't quote them, drops nulls
+func jsonNumbers(v interface{}) interface{} {
+  switch x := v.(type) {
+  case map[string]interface{}:
+    for k, e := range x {
+      if e == nil {
+        delete(x, k)
+      } else {
+        x[k] = jsonNumbers(e)
+      }
+    }
+  case []interface{}:
+    for i, e := range x {
+      x[i] = jsonNumbers(e)
+    }
+  case json.Number:
+    if i, err := x.Int64(); err == nil {
+      return i
+    }
+    f, _ := x.Float64()
+    return f
+  }
+  return v
+}
+
+// save to file, format by extension
+func (cfg Config) Save(fname string) (err error) {
+  var data []byte
+  switch configFormat(fname) {
+  case "toml":
+    var buff bytes.Buffer
+    err = toml.NewEncoder(&buff).Encode(cfg)
+    data = buff.Bytes()
+  case "yaml":
+    // go through json to keep the field names we use everywhere else
+    data, err = json.Marshal(cfg)
+    if err == nil {
+      dec := json.NewDecoder(bytes.NewReader(data))
+      dec.UseNumber()
+      var v interface{}
+      err = dec.Decode(&v)
+      if err == nil {
+        data, err = yaml.Marshal(jsonNumbers(v))
+      }
+    }
+  default:
+    data, err = json.MarshalIndent(cfg, "", "  ")
   }
+  if err == nil {
+    // configs can hold the tor control password, keep them to ourselves
+    err = writeFileAtomic(fname, data, 0600)
+  }
+  return
+}
 
-  
-  cfg.Remote = append(cfg.Remote, aybHub)
+// returned by LoadConfig when the config file does not exist
+var ErrNoConfig = errors.New("no config file")
+
+// default config, it uses no files and connects to no hubs
+func DefaultConfig() (cfg Config) {
   cfg.Local.Bind = "[::]:6789"
-  cfg.Local.Keys = "privkey.dat"
+  cfg.Local.TargetOutbound = defaultTargetOutbound
+  cfg.Local.SocksAddr = "127.0.0.1"
+  cfg.Local.SocksPort = 9050
+  cfg.Local.RateLimitAction = rateLimitDrop
+  cfg.Local.PeerRate = 1200
+  cfg.Local.SenderRate = 120
+  cfg.Local.GlobalRate = 6000
+  return cfg
+}
 
-  return cfg  
+// get a log level by name, empty is info
+func ParseLogLevel(name string) (level slog.Level, err error) {
+  if len(name) > 0 {
+    err = level.UnmarshalText([]byte(name))
+  }
+  return
 }
 
-func LoadConfig(fname string) (cfg Config) {
-  if ! checkFile(fname) {
-    cfg = genConfig()
-    err := cfg.Save(fname)
-    if err != nil {
-      log.Fatal("failed to save initial config", err)
+// write a new config file with default settings and make our identity key
+// key file and address book go next to the config file unless set
+// ARCD_* environment overrides are applied then overrides in order
+// refuses to overwrite an existing config file
+func InitConfig(fname string, logger *slog.Logger, overrides ...func(*Config)) (cfg Config, err error) {
+  return InitConfigPassphrase(fname, nil, logger, overrides...)
+}
+
+// like InitConfig but a new identity key is encrypted with passphrase before it is written
+// an existing key file is re-encrypted with it
+// an empty passphrase uses the one from SetNewKeyPassphraseFunc for a new key, if there is none the key is left in the clear
+func InitConfigPassphrase(fname string, passphrase []byte, logger *slog.Logger, overrides ...func(*Config)) (cfg Config, err error) {
+  if checkFile(fname) {
+    err = fmt.Errorf("%s already exists", fname)
+    return
+  }
+  cfg, err = LoadConfig("", logger, overrides...)
+  if err != nil {
+    return
+  }
+  dir := filepath.Dir(fname)
+  if len(cfg.Local.Keys) == 0 {
+    cfg.Local.Keys = filepath.Join(dir, "privkey.dat")
+  }
+  if len(cfg.Local.AddrBook) == 0 {
+    cfg.Local.AddrBook = filepath.Join(dir, "peers.json")
+  }
+  if checkFile(cfg.Local.Keys) {
+    _, err = loadIdentity(cfg.Local.Keys)
+    if err == nil && len(passphrase) > 0 {
+      err = ChangeKeyPassphrase(cfg.Local.Keys, passphrase)
+    }
+  } else {
+    if len(passphrase) == 0 && newKeyPassphrase != nil {
+      passphrase, err = newKeyPassphrase()
+    }
+    if err == nil {
+      err = createIdentity(cfg.Local.Keys, passphrase)
     }
   }
-  f, err := os.Open(fname)
   if err == nil {
-    dec := json.NewDecoder(f)
-    
-    err = dec.Decode(&cfg)
-    if err == nil {
-      return cfg
+    logger.Info("writing config", "file", fname, "keys", cfg.Local.Keys)
+    err = cfg.Save(fname)
+  }
+  return
+}
+
+// load config from file
+// an empty file name loads the default config, a missing file gives ErrNoConfig
+// the format is json, toml or yaml by file extension
+// ARCD_* environment overrides are applied then overrides in order
+// returns ConfigErrors if the config is not valid
+func LoadConfig(fname string, logger *slog.Logger, overrides ...func(*Config)) (cfg Config, err error) {
+  if len(fname) == 0 {
+    logger.Debug("using default config")
+    cfg = DefaultConfig()
+  } else {
+    logger.Debug("loading config", "file", fname, "format", configFormat(fname))
+    cfg, err = readConfig(fname)
+    if err != nil {
+      return
     }
   }
-  log.Fatal("failed to load config", err)
+  var used []string
+  used, err = cfg.applyEnv(os.Environ())
+  if err != nil {
+    return
+  }
+  for _, name := range used {
+    logger.Info("config override from environment", "var", name)
+  }
+  for _, override := range overrides {
+    override(&cfg)
+  }
+  err = cfg.Validate()
   return
 }
 
+// read config file as is
+func readConfig(fname string) (cfg Config, err error) {
+  if ! checkFile(fname) {
+    err = fmt.Errorf("%s: %w", fname, ErrNoConfig)
+    return
+  }
+  var data []byte
+  data, err = ioutil.ReadFile(fname)
+  if err != nil {
+    return
+  }
+  format := configFormat(fname)
+  if format != "json" {
+    data, err = configToJSON(format, data)
+    if err != nil {
+      err = fmt.Errorf("%s: %s", fname, err.Error())
+      return
+    }
+  }
+  dec := json.NewDecoder(bytes.NewReader(data))
+  // catch typos in field names
+  dec.DisallowUnknownFields()
+  err = dec.Decode(&cfg)
+  if err != nil {
+    if format != "json" {
+      // positions in the converted json mean nothing to the user
+      data = nil
+    }
+    err = jsonError(fname, data, err)
+  }
+  return
+}
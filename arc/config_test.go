@@ -0,0 +1,132 @@
+//
+// config_test.go -- config file tests
+//
+
+package arc
+
+import (
+  "encoding/json"
+  "os"
+  "path/filepath"
+  "reflect"
+  "strings"
+  "testing"
+)
+
+// saved configs are only readable by us whatever the format
+func TestConfigSaveMode(t *testing.T) {
+  dir := t.TempDir()
+  for _, name := range []string{"arcd.json", "arcd.toml", "arcd.yaml"} {
+    t.Run(name, func(t *testing.T) {
+      fname := filepath.Join(dir, name)
+      // an existing file loses its wider mode too
+      err := os.WriteFile(fname, nil, 0644)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if err = DefaultConfig().Save(fname); err != nil {
+        t.Fatal(err)
+      }
+      st, err := os.Stat(fname)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if st.Mode().Perm() != 0600 {
+        t.Errorf("config saved with mode %o", st.Mode().Perm())
+      }
+    })
+  }
+}
+
+// a config with every kind of field set
+func testFullConfig() Config {
+  cfg := DefaultConfig()
+  cfg.Remote = []RemoteHubConfig{
+    {Addr: "192.0.2.1", Port: 6789},
+    {Addr: "example.onion", Port: 6789, ProxyAddr: "127.0.0.1", ProxyPort: 9050, ProxyType: "socks"},
+    {Addr: "192.0.2.2", Port: 6697, TLS: true, PinKey: strings.Repeat("ab", 32)},
+    {Addr: "hub.example", Port: 443, WebSocket: true, WebSocketPath: "/urc", PinKey: strings.Repeat("cd", 32)},
+  }
+  cfg.Local.Bind = "[::]:6789"
+  cfg.Local.UDPPort = 6790
+  cfg.Local.NoDiscovery = true
+  cfg.Local.Announce = []string{"a.onion:6789", "b.i2p"}
+  cfg.Local.TLSPeers = []string{strings.Repeat("ef", 32)}
+  cfg.Local.RateLimitAction = rateLimitThrottle
+  cfg.Local.PeerRate = 600
+  cfg.Local.StampBits = 12
+  return cfg
+}
+
+// every format reads back what it saved
+func TestConfigRoundTrip(t *testing.T) {
+  dir := t.TempDir()
+  for _, cfg := range []Config{DefaultConfig(), testFullConfig()} {
+    for _, name := range []string{"arcd.json", "arcd.toml", "arcd.yaml", "arcd.yml", "arcd.conf"} {
+      t.Run(name, func(t *testing.T) {
+        fname := filepath.Join(dir, name)
+        if err := cfg.Save(fname); err != nil {
+          t.Fatal(err)
+        }
+        got, err := readConfig(fname)
+        if err != nil {
+          t.Fatal(err)
+        }
+        if ! reflect.DeepEqual(got, cfg) {
+          t.Errorf("read %+v, saved %+v", got, cfg)
+        }
+      })
+    }
+  }
+}
+
+func TestConfigToJSON(t *testing.T) {
+  tests := []struct {
+    name, format, data, want string
+  }{
+    {"toml", "toml", "[Local]\nBind = \":6789\"\nUDPPort = 6790\n\n[[Remote]]\nAddr = \"a\"\nTLS = true\n", `{"Local":{"Bind":":6789","UDPPort":6790},"Remote":[{"Addr":"a","TLS":true}]}`},
+    {"yaml", "yaml", "Local:\n  Bind: :6789\n  Announce: [a, b]\nRemote:\n  - Addr: a\n    Port: 6789\n", `{"Local":{"Announce":["a","b"],"Bind":":6789"},"Remote":[{"Addr":"a","Port":6789}]}`},
+    {"empty yaml", "yaml", "", `null`},
+    {"bad toml", "toml", "[Local\n", ""},
+    {"bad yaml", "yaml", "Local: [\n", ""},
+    {"yaml list", "yaml", "- a\n", ""},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      got, err := configToJSON(tt.format, []byte(tt.data))
+      if len(tt.want) == 0 {
+        if err == nil {
+          t.Errorf("converted to %s", got)
+        }
+        return
+      }
+      if err != nil {
+        t.Fatal(err)
+      }
+      if string(got) != tt.want {
+        t.Errorf("got %s, want %s", got, tt.want)
+      }
+    })
+  }
+}
+
+func TestJSONNumbers(t *testing.T) {
+  tests := []struct {
+    name string
+    in, want interface{}
+  }{
+    {"int", json.Number("6789"), int64(6789)},
+    {"negative", json.Number("-1"), int64(-1)},
+    {"float", json.Number("1.5"), 1.5},
+    {"string", "6789", "6789"},
+    {"list", []interface{}{json.Number("1"), "a"}, []interface{}{int64(1), "a"}},
+    {"nulls dropped", map[string]interface{}{"a": nil, "b": json.Number("2"), "c": map[string]interface{}{"d": nil}}, map[string]interface{}{"b": int64(2), "c": map[string]interface{}{}}},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      if got := jsonNumbers(tt.in); ! reflect.DeepEqual(got, tt.want) {
+        t.Errorf("got %#v, want %#v", got, tt.want)
+      }
+    })
+  }
+}
@@ -12,6 +12,14 @@ import (
 
 type Connection io.ReadWriteCloser
 
+// remote address of a connection for logging
+func connAddr(c Connection) string {
+  if nc, ok := c.(net.Conn); ok {
+    return nc.RemoteAddr().String()
+  }
+  return "unknown"
+}
+
 
 func socksConnect(socksaddr string, socksport int, remoteaddr string, remoteport int) (conn Connection, err error) {
   conn, err = net.Dial("tcp", fmt.Sprintf("%s:%d",socksaddr, socksport))
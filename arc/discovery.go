@@ -0,0 +1,330 @@
+//
+// discovery.go -- local peer discovery beacons
+//
+
+package arc
+
+import (
+  "bytes"
+  "encoding/binary"
+  "encoding/hex"
+  "errors"
+  "log/slog"
+  "net"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+  "github.com/majestrate/arcd/nacl"
+)
+
+// default seconds between beacons
+const defaultDiscoveryInterval = 30
+
+// default limit on peers found via discovery
+const defaultMaxAutoPeers = 8
+
+// seconds a beacon may be away from our clock, either way
+const beaconMaxAge = 5 * 60
+
+// seconds a discovered hub has to connect before we forget it and make room for another
+const discoveredHubExpiry = 10 * 60
+
+// a hub that keeps discovered hubs apart from configured ones
+type discoveryHub interface {
+  persistDiscovered(c RemoteHubConfig)
+  // return true if we ever connected to a discovered hub
+  discoveredConnected(c RemoteHubConfig) bool
+  // stop persisting a discovered hub
+  forgetDiscovered(c RemoteHubConfig)
+}
+
+// a hub we persisted from a beacon
+type discoveredPeer struct {
+  remote RemoteHubConfig
+  // when we persisted it
+  found time.Time
+  // it connected at least once, we keep it for good
+  connected bool
+}
+
+// announces our hub on the local link and persists hubs that others announce
+// sits in front of another router and passes through everything that isn't a beacon
+type discoveryRouter struct {
+  ib chan Message
+  // router we pass non beacon messages to
+  router Router
+  // hub we persist discovered peers on
+  hub Hub
+  // our identity
+  keys *nacl.KeyPair
+  // addresses we announce
+  addrs []string
+  interval time.Duration
+  maxPeers int
+  // peers we persisted by public key
+  peers map[string]*discoveredPeer
+  log *slog.Logger
+}
+
+func (d discoveryRouter) InboundChan() chan Message {
+  return d.ib
+}
+
+// local link hubs share the limits of the router we pass to
+func (d discoveryRouter) rateLimiter() *rateLimiter {
+  return routerLimiter(d.router)
+}
+
+// send beacons on hubs and handle inbound beacons
+func (d discoveryRouter) Run(hubs ...Hub) {
+  d.log.Info("run discovery", "announce", d.addrs)
+  ticker := time.NewTicker(d.interval)
+  defer ticker.Stop()
+  d.announce(hubs)
+  for {
+    select {
+    case <- ticker.C:
+      d.expire(time.Now())
+      d.announce(hubs)
+    case m, ok := <- d.ib:
+      if ok {
+        if m.Type() == urcTypeBeacon {
+          d.handleBeacon(m)
+        } else {
+          d.router.InboundChan() <- m
+        }
+      }
+    }
+  }
+}
+
+// send a beacon on every hub
+func (d *discoveryRouter) announce(hubs []Hub) {
+  if len(d.addrs) == 0 {
+    return
+  }
+  m := d.beacon()
+  for _, h := range hubs {
+    h.Send(m)
+  }
+}
+
+// make a signed beacon message
+// BEACON <pubkey> <signature> <addr> [<addr> ...]
+// tls addresses start with tls:, the signature covers the header timestamp and the addresses
+func (d *discoveryRouter) beacon() urcMessage {
+  return d.beaconAt(timeNow())
+}
+
+// make a signed beacon message with header timestamp sent
+func (d *discoveryRouter) beaconAt(sent uint64) urcMessage {
+  addrs := strings.Join(d.addrs, " ")
+  sig := d.keys.SignDetached(beaconSigned(sent, addrs))
+  body := "BEACON " + hex.EncodeToString(d.keys.Public()) + " " + hex.EncodeToString(sig) + " " + addrs
+  m := newURCMessage(urcTypeBeacon, []byte(body))
+  binary.BigEndian.PutUint64(m.hdr[2:10], sent)
+  return m
+}
+
+// what a beacon signature covers
+func beaconSigned(sent uint64, addrs string) []byte {
+  b := make([]byte, 8, 8 + len(addrs))
+  binary.BigEndian.PutUint64(b, sent)
+  return append(b, addrs...)
+}
+
+// handle a beacon from another node
+func (d *discoveryRouter) handleBeacon(m Message) {
+  if ! sentWithin(m, timeNow(), beaconMaxAge) {
+    // replayed or from a node with a broken clock
+    d.log.Debug("stale discovery beacon", "sent", m.Sent())
+    return
+  }
+  pk, addrs, err := parseBeacon(m.Sent(), m.RawBytes()[len(urcHeader{}):])
+  if err != nil {
+    d.log.Debug("bad discovery beacon", "err", err)
+    return
+  }
+  if bytes.Equal(pk, d.keys.Public()) {
+    // our own beacon
+    return
+  }
+  k := hex.EncodeToString(pk)
+  if d.peers[k] != nil {
+    // already persisted
+    return
+  }
+  if len(d.peers) >= d.maxPeers {
+    d.log.Debug("not persisting discovered hub, auto peer limit reached", "key", k)
+    return
+  }
+  for _, addr := range addrs {
+    tls := strings.HasPrefix(addr, "tls:")
+    host, port, err := splitHostPort(strings.TrimPrefix(addr, "tls:"))
+    if err == nil {
+      d.log.Info("discovered hub", "key", k, "peer", addr)
+      c := RemoteHubConfig{
+        Addr: host,
+        Port: port,
+      }
+      if tls {
+        // the beacon is signed by the key the hub's certificate has to carry
+        c.TLS = true
+        c.PinKey = k
+      }
+      d.peers[k] = &discoveredPeer{
+        remote: c,
+        found: time.Now(),
+      }
+      if dh, ok := d.hub.(discoveryHub); ok {
+        dh.persistDiscovered(c)
+      } else {
+        d.hub.Persist(c)
+      }
+      return
+    }
+  }
+}
+
+// forget discovered hubs that did not connect within discoveredHubExpiry so others can take their place
+func (d *discoveryRouter) expire(now time.Time) {
+  dh, ok := d.hub.(discoveryHub)
+  if ! ok {
+    // we can't tell if they connected or stop them
+    return
+  }
+  for k, p := range d.peers {
+    if p.connected {
+      continue
+    }
+    if dh.discoveredConnected(p.remote) {
+      p.connected = true
+    } else if now.Sub(p.found) > discoveredHubExpiry * time.Second {
+      d.log.Info("forgetting discovered hub that never connected", "key", k, "peer", net.JoinHostPort(p.remote.Addr, strconv.Itoa(p.remote.Port)))
+      dh.forgetDiscovered(p.remote)
+      delete(d.peers, k)
+    }
+  }
+}
+
+// parse and verify a beacon body sent at the header timestamp sent
+func parseBeacon(sent uint64, body []byte) (pk []byte, addrs []string, err error) {
+  parts := strings.Fields(string(body))
+  if len(parts) < 4 || parts[0] != "BEACON" {
+    err = errors.New("malformed beacon")
+    return
+  }
+  var sig []byte
+  pk, err = hex.DecodeString(parts[1])
+  if err == nil && len(pk) != nacl.CryptoSignPubKeySize() {
+    err = errors.New("invalid beacon public key")
+  }
+  if err == nil {
+    sig, err = hex.DecodeString(parts[2])
+  }
+  if err != nil {
+    return
+  }
+  addrs = parts[3:]
+  if ! nacl.CryptoVerifyDetached(beaconSigned(sent, strings.Join(addrs, " ")), sig, pk) {
+    err = errors.New("invalid beacon signature")
+  }
+  return
+}
+
+// split host:port with numeric port
+func splitHostPort(addr string) (host string, port int, err error) {
+  var p string
+  host, p, err = net.SplitHostPort(addr)
+  if err == nil {
+    port, err = strconv.Atoi(p)
+    if err == nil && (port <= 0 || port > 65535) {
+      err = errors.New("invalid port in "+addr)
+    }
+  }
+  return
+}
+
+// get the addresses to announce for a bind address
+// if the bind host is unspecified use the addresses of our network interfaces
+func announceAddrs(bind, iface string, logger *slog.Logger) (addrs []string) {
+  host, port, err := net.SplitHostPort(bind)
+  if err != nil {
+    logger.Warn("cannot announce bind address", "bind", bind, "err", err)
+    return
+  }
+  ip := net.ParseIP(host)
+  if ip != nil && ! ip.IsUnspecified() {
+    addrs = append(addrs, bind)
+    return
+  }
+  var ifaces []net.Interface
+  if len(iface) > 0 {
+    ifi, err := net.InterfaceByName(iface)
+    if err == nil {
+      ifaces = append(ifaces, *ifi)
+    }
+  } else {
+    ifaces, _ = net.Interfaces()
+  }
+  for _, ifi := range ifaces {
+    ifaddrs, _ := ifi.Addrs()
+    for _, a := range ifaddrs {
+      ipnet, ok := a.(*net.IPNet)
+      if ok && ipnet.IP.IsGlobalUnicast() {
+        if ip != nil && ip.To4() != nil && ipnet.IP.To4() == nil {
+          // bound to ipv4 only
+          continue
+        }
+        addrs = append(addrs, net.JoinHostPort(ipnet.IP.String(), port))
+      }
+    }
+  }
+  return
+}
+
+// create a discovery router that announces our hub on local link hubs
+// and persists discovered hubs on hub
+// passes everything else to router
+func NewDiscoveryRouter(cfg LocalHubConfig, hub Hub, r Router, logger *slog.Logger) Router {
+  logger = logger.With("router", "discovery")
+  keys, err := loadIdentity(cfg.Keys)
+  if err != nil {
+    logger.Error("failed to load identity for discovery", "keys", cfg.Keys, "err", err)
+    os.Exit(1)
+  }
+  iface := cfg.EtherBind
+  if len(iface) == 0 {
+    iface = cfg.UDPInterface
+  }
+  interval := cfg.DiscoveryInterval
+  if interval <= 0 {
+    interval = defaultDiscoveryInterval
+  }
+  maxPeers := cfg.MaxAutoPeers
+  if maxPeers <= 0 {
+    maxPeers = defaultMaxAutoPeers
+  }
+  var addrs []string
+  if len(cfg.TLSBind) > 0 {
+    // tls first so peers try it first
+    for _, addr := range announceAddrs(cfg.TLSBind, iface, logger) {
+      addrs = append(addrs, "tls:" + addr)
+    }
+  }
+  if len(cfg.Bind) > 0 {
+    addrs = append(addrs, announceAddrs(cfg.Bind, iface, logger)...)
+  }
+  return discoveryRouter{
+    ib: make(chan Message, 32),
+    router: r,
+    hub: hub,
+    keys: keys,
+    addrs: addrs,
+    interval: time.Duration(interval) * time.Second,
+    maxPeers: maxPeers,
+    peers: make(map[string]*discoveredPeer),
+    log: logger,
+  }
+}
@@ -0,0 +1,198 @@
+//
+// discovery_test.go -- local peer discovery tests
+//
+
+package arc
+
+import (
+  "encoding/hex"
+  "net"
+  "testing"
+  "time"
+  "github.com/majestrate/arcd/nacl"
+)
+
+// a hub that records what discovery persists
+type testDiscoveryHub struct {
+  persisted []RemoteHubConfig
+  connected map[string]bool
+  forgotten []RemoteHubConfig
+}
+
+func (h *testDiscoveryHub) Send(m Message) {}
+func (h *testDiscoveryHub) Persist(c RemoteHubConfig) {}
+func (h *testDiscoveryHub) Run() {}
+func (h *testDiscoveryHub) Close() {}
+
+func (h *testDiscoveryHub) persistDiscovered(c RemoteHubConfig) {
+  h.persisted = append(h.persisted, c)
+}
+
+func (h *testDiscoveryHub) discoveredConnected(c RemoteHubConfig) bool {
+  return h.connected[c.Addr]
+}
+
+func (h *testDiscoveryHub) forgetDiscovered(c RemoteHubConfig) {
+  h.forgotten = append(h.forgotten, c)
+}
+
+// a discovery router announcing addrs with a new key
+func newTestDiscovery(t *testing.T, hub Hub, addrs ...string) discoveryRouter {
+  t.Helper()
+  kp := nacl.GenSignKeypair()
+  if kp == nil {
+    t.Fatal("failed to generate key")
+  }
+  t.Cleanup(kp.Free)
+  return discoveryRouter{
+    hub: hub,
+    keys: kp,
+    addrs: addrs,
+    maxPeers: defaultMaxAutoPeers,
+    peers: make(map[string]*discoveredPeer),
+    log: testLogger,
+  }
+}
+
+func TestParseBeacon(t *testing.T) {
+  d := newTestDiscovery(t, nil, "192.0.2.1:6667", "tls:192.0.2.1:6697")
+  m := d.beacon()
+  pk := hex.EncodeToString(d.keys.Public())
+  tests := []struct {
+    name string
+    sent uint64
+    body string
+    ok bool
+  }{
+    {"valid", m.Sent(), string(m.body), true},
+    {"other timestamp", m.Sent() + 1, string(m.body), false},
+    {"other addresses", m.Sent(), string(m.body) + " 192.0.2.2:6667", false},
+    {"not a beacon", m.Sent(), "HELLO " + pk + " 00 192.0.2.1:6667", false},
+    {"too short", m.Sent(), "BEACON " + pk, false},
+    {"bad key", m.Sent(), "BEACON zz 00 192.0.2.1:6667", false},
+    {"short key", m.Sent(), "BEACON abcd 00 192.0.2.1:6667", false},
+    {"bad signature", m.Sent(), "BEACON " + pk + " zz 192.0.2.1:6667", false},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      key, addrs, err := parseBeacon(tt.sent, []byte(tt.body))
+      if tt.ok != (err == nil) {
+        t.Fatalf("got %v", err)
+      }
+      if tt.ok && (hex.EncodeToString(key) != pk || len(addrs) != 2 || addrs[1] != "tls:192.0.2.1:6697") {
+        t.Errorf("parsed %x %v", key, addrs)
+      }
+    })
+  }
+}
+
+func TestHandleBeacon(t *testing.T) {
+  now := timeNow()
+  tests := []struct {
+    name string
+    addrs []string
+    sent uint64
+    want *RemoteHubConfig
+  }{
+    {"plain", []string{"192.0.2.1:6667"}, now, &RemoteHubConfig{Addr: "192.0.2.1", Port: 6667}},
+    {"tls first", []string{"tls:192.0.2.1:6697", "192.0.2.1:6667"}, now, &RemoteHubConfig{Addr: "192.0.2.1", Port: 6697, TLS: true}},
+    {"skip bad addresses", []string{"nowhere", "192.0.2.1:0", "[2001:db8::1]:6667"}, now, &RemoteHubConfig{Addr: "2001:db8::1", Port: 6667}},
+    {"no good addresses", []string{"nowhere"}, now, nil},
+    {"stale", []string{"192.0.2.1:6667"}, now - beaconMaxAge - 60, nil},
+    {"from the future", []string{"192.0.2.1:6667"}, now + beaconMaxAge + 60, nil},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      hub := &testDiscoveryHub{}
+      d := newTestDiscovery(t, hub)
+      remote := newTestDiscovery(t, nil, tt.addrs...)
+      // signed as a node with that clock would
+      d.handleBeacon(remote.beaconAt(tt.sent))
+      if tt.want == nil {
+        if len(hub.persisted) > 0 {
+          t.Errorf("persisted %+v", hub.persisted)
+        }
+        return
+      }
+      want := *tt.want
+      if want.TLS {
+        want.PinKey = hex.EncodeToString(remote.keys.Public())
+      }
+      if len(hub.persisted) != 1 || hub.persisted[0] != want {
+        t.Errorf("persisted %+v, want %+v", hub.persisted, want)
+      }
+    })
+  }
+}
+
+func TestHandleBeaconOnce(t *testing.T) {
+  hub := &testDiscoveryHub{}
+  d := newTestDiscovery(t, hub, "192.0.2.1:6667")
+  d.maxPeers = 2
+  // our own beacons are ignored
+  d.handleBeacon(d.beacon())
+  var remotes []discoveryRouter
+  for _, addr := range []string{"192.0.2.2:6667", "192.0.2.3:6667", "192.0.2.4:6667"} {
+    remotes = append(remotes, newTestDiscovery(t, nil, addr))
+  }
+  for _, r := range remotes {
+    d.handleBeacon(r.beacon())
+    d.handleBeacon(r.beacon())
+  }
+  if len(hub.persisted) != 2 {
+    t.Fatalf("persisted %+v, want the first two hubs once", hub.persisted)
+  }
+  // the first hub never connects and makes room for the third
+  hub.connected = map[string]bool{"192.0.2.3": true}
+  d.expire(time.Now())
+  if len(hub.forgotten) > 0 {
+    t.Errorf("forgot %+v before it expired", hub.forgotten)
+  }
+  d.expire(time.Now().Add(discoveredHubExpiry * time.Second + time.Second))
+  if len(hub.forgotten) != 1 || hub.forgotten[0].Addr != "192.0.2.2" {
+    t.Fatalf("forgot %+v, want 192.0.2.2", hub.forgotten)
+  }
+  d.handleBeacon(remotes[2].beacon())
+  if n := len(hub.persisted); n != 3 || hub.persisted[2].Addr != "192.0.2.4" {
+    t.Errorf("persisted %+v after expiry", hub.persisted)
+  }
+  // hubs that connected once stay
+  hub.connected = nil
+  d.expire(time.Now().Add(2 * discoveredHubExpiry * time.Second))
+  if len(hub.forgotten) != 2 || hub.forgotten[1].Addr != "192.0.2.4" {
+    t.Errorf("forgot %+v, want 192.0.2.4 too", hub.forgotten)
+  }
+}
+
+func TestAnnounceAddrs(t *testing.T) {
+  tests := []struct {
+    name, bind, iface string
+    want []string
+  }{
+    {"bound address", "192.0.2.1:6667", "", []string{"192.0.2.1:6667"}},
+    {"bound ipv6 address", "[2001:db8::1]:6667", "", []string{"[2001:db8::1]:6667"}},
+    {"no port", "192.0.2.1", "", nil},
+    {"no such interface", "0.0.0.0:6667", "nosuchif0", nil},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      got := announceAddrs(tt.bind, tt.iface, testLogger)
+      if len(got) != len(tt.want) {
+        t.Fatalf("got %v, want %v", got, tt.want)
+      }
+      for n := range got {
+        if got[n] != tt.want[n] {
+          t.Errorf("got %v, want %v", got, tt.want)
+        }
+      }
+    })
+  }
+  // unspecified addresses announce the global addresses of every interface with our port
+  for _, addr := range announceAddrs("0.0.0.0:6667", "", testLogger) {
+    host, port, err := net.SplitHostPort(addr)
+    ip := net.ParseIP(host)
+    if err != nil || port != "6667" || ip == nil || ip.To4() == nil || ! ip.IsGlobalUnicast() {
+      t.Errorf("announced %s for an ipv4 bind", addr)
+    }
+  }
+}
@@ -0,0 +1,134 @@
+//
+// env.go -- config overrides from environment variables
+//
+
+package arc
+
+import (
+  "fmt"
+  "reflect"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+// prefix of environment variables that override config fields
+const configEnvPrefix = "ARCD_"
+
+// set a config field from its string form, lists are comma separated
+func setConfigField(v reflect.Value, s string) (err error) {
+  switch v.Kind() {
+  case reflect.String:
+    v.SetString(s)
+  case reflect.Int:
+    var i int
+    i, err = strconv.Atoi(s)
+    if err == nil {
+      v.SetInt(int64(i))
+    }
+  case reflect.Bool:
+    var b bool
+    b, err = strconv.ParseBool(s)
+    if err == nil {
+      v.SetBool(b)
+    }
+  case reflect.Slice:
+    var list []string
+    for _, e := range strings.Split(s, ",") {
+      e = strings.TrimSpace(e)
+      if len(e) > 0 {
+        list = append(list, e)
+      }
+    }
+    v.Set(reflect.ValueOf(list))
+  default:
+    err = fmt.Errorf("cannot set %s fields", v.Kind())
+  }
+  return
+}
+
+// set fields of struct v from env vars named prefix + upper case field name
+// returns the names of the vars we used
+func applyEnvStruct(v reflect.Value, prefix string, env map[string]string, c *configChecker) (used []string) {
+  t := v.Type()
+  for i := 0; i < t.NumField(); i++ {
+    f := t.Field(i)
+    name := prefix + strings.ToUpper(f.Name)
+    s, ok := env[name]
+    if ! ok {
+      continue
+    }
+    used = append(used, name)
+    err := setConfigField(v.Field(i), s)
+    if err != nil {
+      c.fail(name, "cannot use %q for %s: %s", s, f.Name, err)
+    }
+  }
+  return
+}
+
+// apply ARCD_* environment overrides given as KEY=value pairs
+// fields are named by their path in upper case i.e. ARCD_LOCAL_BIND or ARCD_REMOTE_0_PORT
+// lists are comma separated, remotes past the end of the list are added
+// other ARCD_* vars that don't start with ARCD_LOCAL_ or ARCD_REMOTE_ are left alone
+// returns the names of the vars we applied
+func (cfg *Config) applyEnv(environ []string) (applied []string, err error) {
+  env := make(map[string]string)
+  for _, kv := range environ {
+    idx := strings.Index(kv, "=")
+    if idx > 0 && strings.HasPrefix(kv, configEnvPrefix) {
+      env[kv[:idx]] = kv[idx+1:]
+    }
+  }
+  c := new(configChecker)
+  used := make(map[string]bool)
+  for _, name := range applyEnvStruct(reflect.ValueOf(&cfg.Local).Elem(), configEnvPrefix + "LOCAL_", env, c) {
+    used[name] = true
+    applied = append(applied, name)
+  }
+  // find which remotes are overridden
+  remotePrefix := configEnvPrefix + "REMOTE_"
+  last := -1
+  for name := range env {
+    if ! strings.HasPrefix(name, remotePrefix) {
+      continue
+    }
+    rest := name[len(remotePrefix):]
+    idx := strings.Index(rest, "_")
+    if idx <= 0 {
+      continue
+    }
+    n, err := strconv.Atoi(rest[:idx])
+    if err != nil || n < 0 || n >= maxAddrBookEntries {
+      continue
+    }
+    if n > last {
+      last = n
+    }
+  }
+  for len(cfg.Remote) <= last {
+    cfg.Remote = append(cfg.Remote, RemoteHubConfig{})
+  }
+  for n := 0; n <= last; n++ {
+    prefix := fmt.Sprintf("%s%d_", remotePrefix, n)
+    for _, name := range applyEnvStruct(reflect.ValueOf(&cfg.Remote[n]).Elem(), prefix, env, c) {
+      used[name] = true
+      applied = append(applied, name)
+    }
+  }
+  // catch typos
+  var unknown []string
+  for name := range env {
+    if (strings.HasPrefix(name, configEnvPrefix + "LOCAL_") || strings.HasPrefix(name, remotePrefix)) && ! used[name] {
+      unknown = append(unknown, name)
+    }
+  }
+  sort.Strings(unknown)
+  for _, name := range unknown {
+    c.fail(name, "no such config field")
+  }
+  if len(c.errs) > 0 {
+    err = c.errs
+  }
+  return
+}
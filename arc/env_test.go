@@ -0,0 +1,79 @@
+//
+// env_test.go -- environment config override tests
+//
+
+package arc
+
+import (
+  "reflect"
+  "testing"
+)
+
+func TestApplyEnv(t *testing.T) {
+  base := Config{
+    Remote: []RemoteHubConfig{{Addr: "192.0.2.1", Port: 6789, ProxyType: "socks"}},
+  }
+  tests := []struct {
+    name string
+    environ []string
+    want func(*Config)
+    fields []string
+  }{
+    {"nothing", nil, func(c *Config) {}, nil},
+    {"local fields", []string{"ARCD_LOCAL_BIND=[::]:6789", "ARCD_LOCAL_UDPPORT=6790", "ARCD_LOCAL_NODISCOVERY=true"}, func(c *Config) {
+      c.Local.Bind = "[::]:6789"
+      c.Local.UDPPort = 6790
+      c.Local.NoDiscovery = true
+    }, nil},
+    {"list", []string{"ARCD_LOCAL_ANNOUNCE= a.onion:6789, ,b.i2p"}, func(c *Config) {
+      c.Local.Announce = []string{"a.onion:6789", "b.i2p"}
+    }, nil},
+    {"value with =", []string{"ARCD_LOCAL_TORPASSWORD=a=b"}, func(c *Config) {
+      c.Local.TorPassword = "a=b"
+    }, nil},
+    {"existing remote", []string{"ARCD_REMOTE_0_PORT=6790"}, func(c *Config) {
+      c.Remote[0].Port = 6790
+    }, nil},
+    {"new remotes", []string{"ARCD_REMOTE_2_ADDR=192.0.2.3", "ARCD_REMOTE_2_TLS=1"}, func(c *Config) {
+      c.Remote = append(c.Remote, RemoteHubConfig{}, RemoteHubConfig{Addr: "192.0.2.3", TLS: true})
+    }, nil},
+    {"other vars", []string{"ARCD_PASSPHRASE=secret", "HOME=/root", "arcd_local_bind=:1", "ARCD_LOCAL_BIND"}, func(c *Config) {}, nil},
+    {"bad int", []string{"ARCD_LOCAL_UDPPORT=lots"}, nil, []string{"ARCD_LOCAL_UDPPORT"}},
+    {"bad bool", []string{"ARCD_REMOTE_0_TLS=maybe"}, nil, []string{"ARCD_REMOTE_0_TLS"}},
+    {"unknown local", []string{"ARCD_LOCAL_BINDD=:6789"}, nil, []string{"ARCD_LOCAL_BINDD"}},
+    {"unknown remote field", []string{"ARCD_REMOTE_0_HOST=a"}, nil, []string{"ARCD_REMOTE_0_HOST"}},
+    {"bad remote index", []string{"ARCD_REMOTE_X_ADDR=a", "ARCD_REMOTE_-1_ADDR=a", "ARCD_REMOTE_ADDR=a"}, nil, []string{"ARCD_REMOTE_-1_ADDR", "ARCD_REMOTE_ADDR", "ARCD_REMOTE_X_ADDR"}},
+    {"remote index too big", []string{"ARCD_REMOTE_1024_ADDR=a"}, nil, []string{"ARCD_REMOTE_1024_ADDR"}},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      cfg := base
+      cfg.Remote = append([]RemoteHubConfig(nil), base.Remote...)
+      _, err := cfg.applyEnv(tt.environ)
+      fields := configErrorFields(err)
+      if ! reflect.DeepEqual(fields, tt.fields) {
+        t.Fatalf("failed on %v, want %v", fields, tt.fields)
+      }
+      if tt.want == nil {
+        return
+      }
+      want := base
+      want.Remote = append([]RemoteHubConfig(nil), base.Remote...)
+      tt.want(&want)
+      if ! reflect.DeepEqual(cfg, want) {
+        t.Errorf("got %+v, want %+v", cfg, want)
+      }
+    })
+  }
+}
+
+func TestApplyEnvNames(t *testing.T) {
+  var cfg Config
+  applied, err := cfg.applyEnv([]string{"ARCD_REMOTE_0_ADDR=a", "ARCD_LOCAL_BIND=:6789"})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if ! reflect.DeepEqual(applied, []string{"ARCD_LOCAL_BIND", "ARCD_REMOTE_0_ADDR"}) {
+    t.Errorf("applied %v", applied)
+  }
+}
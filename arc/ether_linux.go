@@ -68,8 +68,9 @@ import "C"
 
 import (
   "errors"
-  "log"
+  "log/slog"
   "net"
+  "os"
   "time"
 )
 
@@ -81,6 +82,9 @@ type etherHub struct {
   ib chan Message
   router Router
   filter bloomFilter
+  // one rate limit for the whole lan, frame sources are easy to fake
+  limit *rateSource
+  log *slog.Logger
 }
 
 // bind to a network interface
@@ -88,7 +92,7 @@ func (eh *etherHub) bind(iface string) (err error) {
   eh.iface, err = net.InterfaceByName(iface)
   if err == nil {
     if len(eh.iface.HardwareAddr) == 6 {
-      log.Println("binding to", eh.iface.HardwareAddr)
+      eh.log.Info("binding to interface", "iface", iface, "hwaddr", eh.iface.HardwareAddr.String())
       for n, c := range eh.iface.HardwareAddr {
         eh.hwaddr[n] = C.uchar(c)
       }
@@ -126,7 +130,7 @@ func (eh *etherHub) broadcast(data []byte) (err error) {
 
 // run main
 func (eh etherHub) Run() {
-  log.Println("run ethernet hub")
+  eh.log.Info("run ethernet hub")
   go eh.sendLoop()
   eh.recvLoop()
 }
@@ -148,11 +152,12 @@ func (eh *etherHub) sendLoop() {
           eh.filter.Add(data)
 
           // broadcast
+          eh.log.Debug("broadcast urc", "type", urcTypeName(msg.Type()), "len", len(data))
           err := eh.broadcast(data)
           if err == nil {
             // we gud
           } else {
-            log.Println("failed to broadcast over ethernet", err)
+            eh.log.Warn("failed to broadcast over ethernet", "err", err)
           }
         }
       }
@@ -181,9 +186,15 @@ func (eh *etherHub) recvLoop() {
         msg.body[i] = byte(c)
       }
       // we got inbound
+      eh.log.Debug("got urc", "type", urcTypeName(msg.Type()), "len", recv_size)
+      if eh.limit.admit(msg) != ratePass {
+        // no link to disconnect
+        eh.log.Debug("dropped urc over rate limit", "type", urcTypeName(msg.Type()))
+        continue
+      }
       eh.ib <- msg
     } else {
-      log.Println("invalid ether_recv size:", recv_size)
+      eh.log.Debug("invalid ether_recv size", "len", recv_size)
       time.Sleep(time.Second)
     }
   }
@@ -193,17 +204,21 @@ func (eh etherHub) Close() {
   C.ether_close(eh.fd)
 }
 
-func CreateEthernetHub(ifname string, r Router) Hub {
-  log.Println("create ethernet hub")
+func CreateEthernetHub(ifname string, r Router, logger *slog.Logger) Hub {
+  logger = logger.With("hub", "ether")
+  logger.Info("create ethernet hub")
   h := etherHub{
     send: make(chan Message),
     ib: make(chan Message),
     router: r,
+    limit: routerLimiter(r).source(),
+    log: logger,
   }
   err := h.bind(ifname)
   if err == nil {
     return h
   }
-  log.Fatal("failed to create ethernet hub: ", err.Error())
+  logger.Error("failed to create ethernet hub", "iface", ifname, "err", err)
+  os.Exit(1)
   return nil
 }
@@ -0,0 +1,20 @@
+//go:build !linux || !cgo
+
+//
+// ether_other.go -- no ethernet hub without linux raw sockets
+//
+
+package arc
+
+import (
+  "log/slog"
+  "os"
+)
+
+// the ethernet hub needs linux and cgo, bail like a failed bind would
+func CreateEthernetHub(ifname string, r Router, logger *slog.Logger) Hub {
+  logger = logger.With("hub", "ether")
+  logger.Error("ethernet hub is not supported by this build", "iface", ifname)
+  os.Exit(1)
+  return nil
+}
@@ -4,9 +4,14 @@
 package arc
 
 import (
+  "errors"
   "fmt"
-  "log"
+  "log/slog"
   "net"
+  "os"
+  "reflect"
+  "strconv"
+  "sync"
   "time"
 )
 
@@ -23,6 +28,18 @@ type Hub interface {
   Close()
 }
 
+// a hub that persists a whole list of remotes at once
+type RemotesPersister interface {
+  // persist remotes and drop configured hubs that are not in it, including ones from the address book
+  PersistAll(remotes []RemoteHubConfig)
+}
+
+// a hub or router that can apply config changes without a restart
+type Reloader interface {
+  // apply new config, persist new remotes and drop removed ones
+  Reload(cfg Config)
+}
+
 type basicHub struct {
   // bind address
   bind string
@@ -30,14 +47,70 @@ type basicHub struct {
   keyfile string
   // send broadcast message channel
   broadcast chan Message
+  // send message to a single connection channel
+  direct chan connMessage
+  // inbound message seen channel
+  ib chan connMessage
   // register connection channel
   registerConn chan Connection
   // register connection channel
   deregisterConn chan Connection
   // connection map
-  conns map[Connection]bloomFilter
+  conns map[Connection]*bloomFilter
   // message router
   router Router
+  // config, remotes and listeners that can change at runtime
+  live *hubLive
+  // known hubs, nil if we only use persisted hubs
+  book *addrBook
+  // i2p sessions
+  sam *samSessions
+  // our onion service
+  onion *onionService
+  // our tls certificate
+  tls *tlsIdentity
+  log *slog.Logger
+}
+
+// a message for a single connection
+type connMessage struct {
+  conn Connection
+  msg Message
+}
+
+// hub state that can change at runtime
+type hubLive struct {
+  access sync.Mutex
+  // local hub config
+  cfg LocalHubConfig
+  // persisted hubs by remoteKey
+  remotes map[string]*persistedHub
+  // listeners by kind
+  listeners map[string]net.Listener
+}
+
+// a hub we keep a connection to
+type persistedHub struct {
+  // where we learned about it: config or discovery
+  source string
+  // closed to stop persisting
+  stop chan struct{}
+  // current connection, nil if not connected
+  conn Connection
+  // we connected at least once
+  connected bool
+}
+
+// key for a persisted hub, changing any setting makes it a different hub
+func remoteKey(c RemoteHubConfig) string {
+  return fmt.Sprintf("%+v", c)
+}
+
+// get current local config
+func (h basicHub) config() LocalHubConfig {
+  h.live.access.Lock()
+  defer h.live.access.Unlock()
+  return h.live.cfg
 }
 
 func (h basicHub) Send(m Message) {
@@ -51,98 +124,534 @@ func (h basicHub) Close() {
 }
 
 // handle a urc connection inbound outbound doesn't matter
-func (h basicHub) handleURC(conn Connection) {
+// returns the number of messages we got from it
+func (h basicHub) handleURC(conn Connection) (n uint64) {
+  // identity of tls links for filter rules
+  key := connKey(conn)
   // register our connection
   h.registerConn <- conn
+  // tell them about other hubs
+  if h.book != nil {
+    h.direct <- connMessage{conn, h.pexMessage()}
+  }
   // new protocol state
   urc := urcProtocol{}
   var err error
-  // get our filter
-  f := h.conns[conn]
+  limit := routerLimiter(h.router).source()
+  clog := h.log.With("peer", connAddr(conn))
+  // when this link last gave us hubs
+  var lastPEX time.Time
   for {
     var umsg urcMessage
     // read a message
     umsg, err = urc.ReadMessage(conn)
     if err == nil {
+      if umsg.Type() == urcTypePEX {
+        // peer exchange is for us only, about one every pexInterval per link
+        if time.Since(lastPEX) < pexInterval * time.Second / 2 {
+          clog.Debug("dropped pex sent too often")
+          continue
+        }
+        lastPEX = time.Now()
+        h.handlePEX(umsg)
+        continue
+      }
+      n++
       b := umsg.RawBytes()
-      // add the raw bytes of this message to our bloom filter
-      f.Add(b)
+      clog.Debug("got urc", "type", urcTypeName(umsg.Type()), "len", len(b))
+      verdict := limit.admit(umsg)
+      if verdict == rateDisconnect {
+        clog.Warn("disconnecting peer over rate limit")
+        break
+      } else if verdict == rateDrop {
+        clog.Debug("dropped urc over rate limit", "type", urcTypeName(umsg.Type()))
+        continue
+      }
+      // mark it as seen on this connection before the router can relay it back
+      h.ib <- connMessage{conn, umsg}
       // tell router of inbound message
-      h.router.InboundChan() <- umsg
+      if len(key) > 0 {
+        h.router.InboundChan() <- linkMessage{umsg, key}
+      } else {
+        h.router.InboundChan() <- umsg
+      }
     } else {
       // error is fatal
-      log.Println("error in urc handler", err)
+      clog.Info("error in urc handler", "err", err)
       break
     }
   }
   // deregister connection we are done
   h.deregisterConn <- conn
+  return
+}
+
+// make a pex message with hubs we know work
+func (h basicHub) pexMessage() urcMessage {
+  addrs := append([]string{}, h.config().Announce...)
+  if local := h.sam.Local(); local != nil {
+    addrs = append(addrs, h.publicAddr(local.Base32()))
+  }
+  if onion := h.onion.Addr(); len(onion) > 0 {
+    addrs = append(addrs, h.publicAddr(onion))
+  }
+  addrs = append(addrs, h.book.Share(maxPEXAddrs - len(addrs))...)
+  return newPEXMessage(addrs)
+}
+
+// add hubs from a pex message to our address book
+func (h basicHub) handlePEX(m urcMessage) {
+  if h.book == nil {
+    return
+  }
+  for _, remote := range parsePEX(m.body, h.config()) {
+    if h.isAnnounced(remote) {
+      // don't connect to ourself
+      continue
+    }
+    h.book.Add(remote, "pex")
+  }
+}
+
+// return true if this remote is one of our public addresses
+func (h basicHub) isAnnounced(c RemoteHubConfig) bool {
+  k := net.JoinHostPort(c.Addr, strconv.Itoa(c.Port))
+  for _, addr := range h.config().Announce {
+    if addr == k {
+      return true
+    }
+  }
+  return false
 }
 
 func (h basicHub) Persist(c RemoteHubConfig) {
-  h.persist(c.Addr, c.Port, c.ProxyType, c.ProxyAddr, c.ProxyPort)
+  h.persistFrom(c, "config")
 }
 
-// persist a connection to a remote hub
-func (h *basicHub) persist(addr string, port int, proxyType, proxyAddr string, proxyPort int) {
-  if proxyType == "socks" {
-    // use socks proxy
-    log.Printf("persist hub %s:%d proxy=%s://%s:%d", addr, port, proxyType, proxyAddr, proxyPort)
-    go func() {
-      for {
-        // cooldown
-        time.Sleep(time.Second)
-        log.Println("connecting to hub", addr)
-        // connect to socks proxy
-        conn, err := socksConnect(proxyAddr, proxyPort, addr, port)
-        if err == nil {
-          log.Println("connected to", addr)
-          // handle connection
-          h.handleURC(conn)
-        } else{ 
-          log.Println("cannot connect to", addr, err)
+// persist a hub we discovered on the local link
+func (h basicHub) persistDiscovered(c RemoteHubConfig) {
+  h.persistFrom(c, "discovery")
+}
+
+// return true if we ever connected to a hub we discovered
+func (h basicHub) discoveredConnected(c RemoteHubConfig) bool {
+  if h.book != nil {
+    return h.book.Worked(addrEntry{RemoteHubConfig: c}.key())
+  }
+  h.live.access.Lock()
+  defer h.live.access.Unlock()
+  p := h.live.remotes[remoteKey(c)]
+  return p != nil && p.connected
+}
+
+// stop persisting a hub we discovered, hubs we also know from elsewhere stay
+func (h basicHub) forgetDiscovered(c RemoteHubConfig) {
+  if h.book != nil {
+    h.book.Forget(addrEntry{RemoteHubConfig: c}.key(), "discovery")
+    return
+  }
+  k := remoteKey(c)
+  h.live.access.Lock()
+  p := h.live.remotes[k]
+  h.live.access.Unlock()
+  if p != nil && p.source == "discovery" {
+    h.unpersist(k)
+  }
+}
+
+// persist a hub we learned about from source
+func (h basicHub) persistFrom(c RemoteHubConfig, source string) {
+  if h.book == nil {
+    h.persist(c, source)
+  } else {
+    h.book.Add(c, source)
+  }
+}
+
+// dial out to a remote hub
+func (h *basicHub) dial(c RemoteHubConfig) (conn Connection, err error) {
+  if c.ProxyType == "socks" {
+    // connect to socks proxy
+    conn, err = socksConnect(c.ProxyAddr, c.ProxyPort, c.Addr, c.Port)
+  } else if c.ProxyType == "i2p-sam" {
+    // stream via sam bridge
+    conn, err = h.sam.Dial(net.JoinHostPort(c.ProxyAddr, strconv.Itoa(c.ProxyPort)), c.Addr)
+  } else {
+    // dial out
+    conn, err = net.Dial("tcp", net.JoinHostPort(c.Addr, strconv.Itoa(c.Port)))
+  }
+  if err == nil && c.TLS {
+    raw := conn
+    conn, err = h.tls.Client(raw, c)
+    if err != nil {
+      raw.Close()
+    }
+  }
+  return
+}
+
+// persist a connection to a remote hub until unpersisted
+func (h *basicHub) persist(c RemoteHubConfig, source string) {
+  k := remoteKey(c)
+  p := &persistedHub{
+    source: source,
+    stop: make(chan struct{}),
+  }
+  h.live.access.Lock()
+  _, exists := h.live.remotes[k]
+  if ! exists {
+    h.live.remotes[k] = p
+  }
+  h.live.access.Unlock()
+  if exists {
+    return
+  }
+  plog := h.log.With("peer", net.JoinHostPort(c.Addr, strconv.Itoa(c.Port)))
+  if len(c.ProxyType) > 0 {
+    plog.Info("persist hub", "proxy", fmt.Sprintf("%s://%s:%d", c.ProxyType, c.ProxyAddr, c.ProxyPort))
+  } else {
+    plog.Info("persist hub")
+  }
+  go func() {
+    for {
+      // cooldown
+      select {
+      case <- p.stop:
+        plog.Info("stopped persisting hub")
+        return
+      case <- time.After(time.Second):
+      }
+      plog.Debug("connecting to hub")
+      conn, err := h.dial(c)
+      if err == nil {
+        h.live.access.Lock()
+        select {
+        case <- p.stop:
+          // unpersisted while we were connecting
+          conn.Close()
+          conn = nil
+        default:
+          p.conn = conn
+          p.connected = true
         }
+        h.live.access.Unlock()
+        if conn == nil {
+          continue
+        }
+        plog.Info("connected to hub")
+        // handle connection
+        h.handleURC(conn)
+        h.live.access.Lock()
+        p.conn = nil
+        h.live.access.Unlock()
+      } else {
+        plog.Warn("cannot connect to hub", "err", err)
       }
-    }()
+    }
+  }()
+}
+
+// stop persisting a remote hub and close the connection to it
+func (h *basicHub) unpersist(k string) {
+  h.live.access.Lock()
+  p, ok := h.live.remotes[k]
+  if ok {
+    delete(h.live.remotes, k)
+    close(p.stop)
+    if p.conn != nil {
+      p.conn.Close()
+    }
+  }
+  h.live.access.Unlock()
+}
+
+// keep enough outbound connections to hubs from our address book
+func (h basicHub) maintain() {
+  ticker := time.NewTicker(10 * time.Second)
+  defer ticker.Stop()
+  pex := time.Now()
+  for {
+    target := h.config().TargetOutbound
+    if target <= 0 {
+      target = defaultTargetOutbound
+    }
+    for h.book.Connected() < target {
+      e := h.book.Pick()
+      if e == nil {
+        // nothing to connect to
+        break
+      }
+      go h.connectOnce(e)
+    }
+    if time.Since(pex) > pexInterval * time.Second {
+      // share hubs with everyone we are connected to
+      h.Send(h.pexMessage())
+      pex = time.Now()
+    }
+    err := h.book.Save()
+    if err != nil {
+      h.log.Warn("failed to save address book", "err", err)
+    }
+    <- ticker.C
+  }
+}
+
+// make a single outbound connection to a hub from our address book
+func (h basicHub) connectOnce(e *addrEntry) {
+  k := e.key()
+  plog := h.log.With("peer", k)
+  plog.Debug("connecting to hub")
+  started := time.Now()
+  conn, err := h.dial(e.RemoteHubConfig)
+  if err == nil {
+    if ! h.book.Good(k, time.Since(started), conn) {
+      // removed from address book
+      conn.Close()
+      return
+    }
+    plog.Info("connected to hub")
+    n := h.handleURC(conn)
+    h.book.Disconnected(k, n)
   } else {
-    log.Printf("persist hub %s:%d", addr, port)
+    plog.Warn("cannot connect to hub", "err", err)
+    h.book.Bad(k)
+  }
+}
+
+// one of our public hostnames as we share it with peers
+func (h basicHub) publicAddr(host string) string {
+  _, port, err := net.SplitHostPort(h.config().Bind)
+  if err != nil {
+    port = "0"
+  }
+  return net.JoinHostPort(host, port)
+}
+
+// accept inbound urc connections on our bind address
+func (h basicHub) listen() {
+  bind := h.config().Bind
+  ln, err := net.Listen("tcp", bind)
+  if err != nil {
+    h.log.Error("cannot listen", "bind", bind, "err", err)
+    return
+  }
+  h.serve("tcp", ln)
+}
+
+// accept inbound urc connections over tls
+func (h basicHub) listenTLS() {
+  cfg := h.config()
+  ln, err := h.tls.Listen(cfg.TLSBind, cfg.TLSPeers)
+  if err != nil {
+    h.log.Error("cannot listen for tls", "bind", cfg.TLSBind, "err", err)
+    return
+  }
+  h.serve("tls", ln)
+}
+
+// accept inbound urc connections from a listener until it is closed
+// replaces any listener we had of the same kind
+func (h basicHub) serve(kind string, ln net.Listener) {
+  h.live.access.Lock()
+  old := h.live.listeners[kind]
+  h.live.listeners[kind] = ln
+  h.live.access.Unlock()
+  if old != nil {
+    old.Close()
+  }
+  h.log.Info("listening", "kind", kind, "bind", ln.Addr().String())
+  for {
+    conn, err := ln.Accept()
+    if errors.Is(err, net.ErrClosed) {
+      h.log.Info("stopped listening", "kind", kind, "bind", ln.Addr().String())
+      return
+    }
+    if err != nil {
+      h.log.Warn("failed to accept", "kind", kind, "err", err)
+      time.Sleep(time.Second)
+      continue
+    }
+    h.log.Info("inbound connection", "kind", kind, "peer", conn.RemoteAddr().String())
     go func() {
+      // links that don't finish the tls handshake never get to the router
+      err := tlsHandshake(conn)
+      if err != nil {
+        h.log.Info("tls handshake failed", "kind", kind, "peer", conn.RemoteAddr().String(), "err", err)
+        conn.Close()
+        return
+      }
+      h.handleURC(conn)
+    }()
+  }
+}
+
+// stop a listener
+func (h basicHub) unlisten(kind string) {
+  h.live.access.Lock()
+  ln := h.live.listeners[kind]
+  delete(h.live.listeners, kind)
+  h.live.access.Unlock()
+  if ln != nil {
+    ln.Close()
+  }
+}
+
+// persist the remotes that are not websocket links and drop configured hubs that are not in them
+func (h basicHub) PersistAll(remotes []RemoteHubConfig) {
+  var links []RemoteHubConfig
+  for _, r := range remotes {
+    if ! r.WebSocket {
+      links = append(links, r)
+    }
+  }
+  if h.book == nil {
+    want := make(map[string]bool)
+    for _, r := range links {
+      want[remoteKey(r)] = true
+    }
+    h.live.access.Lock()
+    var gone []string
+    for k, p := range h.live.remotes {
+      // hubs we discovered are not in the config, keep them
+      if p.source == "config" && ! want[k] {
+        gone = append(gone, k)
+      }
+    }
+    h.live.access.Unlock()
+    for _, k := range gone {
+      h.unpersist(k)
+    }
+    for _, r := range links {
+      h.persist(r, "config")
+    }
+  } else {
+    h.book.Configure(links)
+  }
+}
+
+// apply a new config
+func (h basicHub) Reload(cfg Config) {
+  h.live.access.Lock()
+  old := h.live.cfg
+  h.live.cfg = cfg.Local
+  h.live.access.Unlock()
+
+  h.PersistAll(cfg.Remote)
+
+  // listeners
+  if old.Bind != cfg.Local.Bind {
+    h.unlisten("tcp")
+    if len(cfg.Local.Bind) > 0 {
+      go h.listen()
+    }
+  }
+  if old.TLSBind != cfg.Local.TLSBind || ! reflect.DeepEqual(old.TLSPeers, cfg.Local.TLSPeers) {
+    h.unlisten("tls")
+    if len(cfg.Local.TLSBind) > 0 {
+      go h.listenTLS()
+    }
+  }
+  h.log.Info("hub config reloaded")
+}
+
+// keep our onion service published
+func (h basicHub) publishOnion() {
+  for {
+    err := h.onion.publish(h.config())
+    h.log.Warn("onion service failed", "err", err)
+    // cooldown
+    time.Sleep(10 * time.Second)
+  }
+}
+
+// accept inbound urc connections over i2p
+func (h basicHub) acceptI2P() {
+  for {
+    cfg := h.config()
+    s, err := h.sam.Listen(cfg.I2PSAM, cfg.I2PKeys)
+    if err == nil {
       for {
-        // cooldown
-        time.Sleep(time.Second)
-        log.Println("connecting to hub", addr)
-        // dial out
-        conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", addr, port))
-        log.Println("connected to", addr)
-        if err == nil {
-          // handle connection
-          h.handleURC(conn)
-        } else {
-          log.Println("cannot connect to", addr, err)
+        var conn Connection
+        conn, err = s.Accept()
+        if err != nil {
+          break
         }
+        h.log.Info("inbound connection", "kind", "i2p")
+        go h.handleURC(conn)
       }
-    }()
+      s.Close()
+    }
+    h.log.Warn("i2p session failed", "err", err)
+    // cooldown
+    time.Sleep(10 * time.Second)
   }
 }
 
+// write a whole message to a connection
+func (h basicHub) write(c Connection, b []byte) (err error) {
+  send := len(b)
+  sent := 0
+  for sent < send {
+    var n int
+    n, err = c.Write(b[sent:])
+    if err != nil {
+      break
+    }
+    sent += n
+  }
+  return
+}
+
 func (h basicHub) Run() {
-  log.Println("run hub")
+  h.log.Info("run hub")
+  cfg := h.config()
+  if h.book != nil {
+    go h.maintain()
+  }
+  if len(cfg.Bind) > 0 {
+    go h.listen()
+  }
+  if len(cfg.TLSBind) > 0 {
+    go h.listenTLS()
+  }
+  if len(cfg.I2PSAM) > 0 {
+    go h.acceptI2P()
+  }
+  if len(cfg.TorControl) > 0 {
+    go h.publishOnion()
+  }
   // connection -> is inbound
   for {
     select {
     case c := <- h.registerConn:
       // register a connection
       // give it a new bloom filter
-      h.conns[c] = bloomFilter{}
+      h.conns[c] = new(bloomFilter)
     case c := <- h.deregisterConn:
       // deregeister a connection
       // delete it from the list of connections
       delete(h.conns, c)
       // close the connection
       c.Close()
+    case m := <- h.ib:
+      if f, ok := h.conns[m.conn]; ok {
+        // add the raw bytes of this message to its bloom filter
+        f.Add(m.msg.RawBytes())
+      }
+    case m := <- h.direct:
+      // send to just this connection
+      if _, ok := h.conns[m.conn]; ok {
+        err := h.write(m.conn, m.msg.RawBytes())
+        if err != nil {
+          h.log.Info("failed to write message", "peer", connAddr(m.conn), "err", err)
+          delete(h.conns, m.conn)
+          m.conn.Close()
+        }
+      }
     case m := <- h.broadcast:
       // we want to send a broadcast line
       b := m.RawBytes()
+      h.log.Debug("broadcast urc", "type", urcTypeName(m.Type()), "len", len(b))
       // for each connection
       for c, f := range h.conns {
         // check filter
@@ -152,26 +661,12 @@ func (h basicHub) Run() {
           // add to bloom filter
           f.Add(b)
           // relay it
-          send := len(b)
-          sent := 0
-          log.Println("broadcast urc")
-          for {
-            // TODO: go routine for each connection?
-            n, err := c.Write(b[sent:])
-            if err == nil {
-              sent += n
-              if sent < send {
-                // continue sending it's a short write
-                continue
-              } else {
-                break
-              }
-            } else {
-              // error writing
-              log.Println("failed to write message", err)
-              h.deregisterConn <- c
-              break
-            }
+          err := h.write(c, b)
+          if err != nil {
+            // error writing
+            h.log.Info("failed to write message", "peer", connAddr(c), "err", err)
+            delete(h.conns, c)
+            c.Close()
           }
         }
       }
@@ -181,17 +676,44 @@ func (h basicHub) Run() {
 
 
 // create a new hub
-// parameters are bind address and private key file
-func CreateHub(addr, keyfile string, r Router) Hub {
-  return basicHub{
-    bind: addr,
-    keyfile: keyfile,
+// uses the bind address, private key file and address book from local config
+func CreateHub(cfg LocalHubConfig, r Router, logger *slog.Logger) Hub {
+  logger = logger.With("hub", "urc")
+  h := basicHub{
+    bind: cfg.Bind,
+    keyfile: cfg.Keys,
     broadcast: make(chan Message),
+    direct: make(chan connMessage),
+    ib: make(chan connMessage),
     registerConn: make(chan Connection),
     deregisterConn: make(chan Connection),
-    conns: make(map[Connection]bloomFilter),
+    conns: make(map[Connection]*bloomFilter),
     router: r,
+    live: &hubLive{
+      cfg: cfg,
+      remotes: make(map[string]*persistedHub),
+      listeners: make(map[string]net.Listener),
+    },
+    sam: &samSessions{
+      sessions: make(map[string]*samSession),
+      log: logger,
+    },
+    onion: &onionService{
+      log: logger,
+    },
+    tls: &tlsIdentity{
+      keyfile: cfg.Keys,
+      log: logger,
+    },
+    log: logger,
   }
+  if len(cfg.AddrBook) > 0 {
+    var err error
+    h.book, err = loadAddrBook(cfg.AddrBook, logger)
+    if err != nil {
+      logger.Error("failed to load address book", "file", cfg.AddrBook, "err", err)
+      os.Exit(1)
+    }
+  }
+  return h
 }
-
-
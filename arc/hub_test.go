@@ -0,0 +1,154 @@
+//
+// hub_test.go -- tests for the link level message hub
+//
+
+package arc
+
+import (
+  "fmt"
+  "net"
+  "testing"
+  "time"
+)
+
+// without an address book reloading config keeps discovered hubs too
+func TestHubReloadKeepsDiscovered(t *testing.T) {
+  h := basicHub{
+    live: &hubLive{
+      remotes: make(map[string]*persistedHub),
+      listeners: make(map[string]net.Listener),
+    },
+    log: testLogger,
+  }
+  // nothing listens on port 1, the hubs never connect
+  kept := RemoteHubConfig{Addr: "127.0.0.1", Port: 1}
+  dropped := RemoteHubConfig{Addr: "127.0.0.2", Port: 1}
+  discovered := RemoteHubConfig{Addr: "127.0.0.3", Port: 1}
+  h.Persist(kept)
+  h.Persist(dropped)
+  h.persistDiscovered(discovered)
+  defer func() {
+    for _, c := range []RemoteHubConfig{kept, dropped, discovered} {
+      h.unpersist(remoteKey(c))
+    }
+  }()
+  h.Reload(Config{Remote: []RemoteHubConfig{kept}})
+  h.live.access.Lock()
+  defer h.live.access.Unlock()
+  for _, c := range []RemoteHubConfig{kept, discovered} {
+    if _, ok := h.live.remotes[remoteKey(c)]; ! ok {
+      t.Errorf("stopped persisting %s", c.Addr)
+    }
+  }
+  if _, ok := h.live.remotes[remoteKey(dropped)]; ok {
+    t.Error("still persisting a hub that was removed from config")
+  }
+}
+
+// a hub with an address book and no router, its run loop is faked until the test ends
+func newTestBookHub(t *testing.T) basicHub {
+  h := basicHub{
+    direct: make(chan connMessage),
+    ib: make(chan connMessage),
+    registerConn: make(chan Connection),
+    deregisterConn: make(chan Connection),
+    live: &hubLive{
+      remotes: make(map[string]*persistedHub),
+      listeners: make(map[string]net.Listener),
+    },
+    book: &addrBook{
+      entries: make(map[string]*addrEntry),
+      log: testLogger,
+    },
+    sam: &samSessions{
+      sessions: make(map[string]*samSession),
+      log: testLogger,
+    },
+    onion: &onionService{
+      log: testLogger,
+    },
+    log: testLogger,
+  }
+  done := make(chan struct{})
+  t.Cleanup(func() {
+    close(done)
+  })
+  go func() {
+    for {
+      select {
+      case <- h.registerConn:
+      case c := <- h.deregisterConn:
+        c.Close()
+      case <- h.direct:
+      case <- h.ib:
+      case <- done:
+        return
+      }
+    }
+  }()
+  return h
+}
+
+// a link only gets to fill our address book about once every pexInterval
+func TestHubPEXPerLink(t *testing.T) {
+  h := newTestBookHub(t)
+  ours, theirs := net.Pipe()
+  go func() {
+    for i := 1; i <= 3; i++ {
+      theirs.Write(newPEXMessage([]string{fmt.Sprintf("203.0.113.%d:6789", i)}).RawBytes())
+    }
+    theirs.Close()
+  }()
+  h.handleURC(ours)
+  if n := len(h.book.entries); n != 1 {
+    t.Errorf("book has %d hubs, want 1", n)
+  }
+  if _, ok := h.book.entries["203.0.113.1:6789"]; ! ok {
+    t.Error("first pex from the link was dropped")
+  }
+}
+
+// hubs a saved address book has from an older config go away at startup
+func TestHubPersistAllBook(t *testing.T) {
+  h := newTestBookHub(t)
+  old := RemoteHubConfig{Addr: "203.0.113.1", Port: 6789}
+  kept := RemoteHubConfig{Addr: "203.0.113.2", Port: 6789}
+  ws := RemoteHubConfig{Addr: "203.0.113.3", Port: 443, WebSocket: true}
+  h.book.Add(old, "config")
+  h.book.Add(kept, "config")
+  h.PersistAll([]RemoteHubConfig{kept, ws})
+  if _, ok := h.book.entries["203.0.113.1:6789"]; ok {
+    t.Error("kept a hub that is no longer configured")
+  }
+  if _, ok := h.book.entries["203.0.113.2:6789"]; ! ok {
+    t.Error("lost a configured hub")
+  }
+  if _, ok := h.book.entries["203.0.113.3:443"]; ok {
+    t.Error("websocket remote went into the address book")
+  }
+}
+
+// discovered hubs that never worked leave the address book, ones we know from elsewhere stay
+func TestHubForgetDiscovered(t *testing.T) {
+  h := newTestBookHub(t)
+  found := RemoteHubConfig{Addr: "192.168.1.1", Port: 6789}
+  exchanged := RemoteHubConfig{Addr: "192.168.1.2", Port: 6789}
+  worked := RemoteHubConfig{Addr: "192.168.1.3", Port: 6789}
+  h.book.Add(exchanged, "pex")
+  for _, c := range []RemoteHubConfig{found, exchanged, worked} {
+    h.persistDiscovered(c)
+  }
+  h.book.Good("192.168.1.3:6789", time.Millisecond, nil)
+  if h.discoveredConnected(found) || ! h.discoveredConnected(worked) {
+    t.Error("wrong hub counted as connected")
+  }
+  for _, c := range []RemoteHubConfig{found, exchanged, worked} {
+    h.forgetDiscovered(c)
+  }
+  if _, ok := h.book.entries["192.168.1.1:6789"]; ok {
+    t.Error("kept a discovered hub that never worked")
+  }
+  if n := len(h.book.entries); n != 2 {
+    t.Errorf("book has %d hubs, want 2", n)
+  }
+}
@@ -0,0 +1,136 @@
+//
+// identity.go -- node identity keys
+//
+
+package arc
+
+import (
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "sync"
+  "github.com/majestrate/arcd/nacl"
+)
+
+// identity used when we have no key file, lives as long as we run
+var ephemeral struct {
+  once sync.Once
+  kp *nacl.KeyPair
+}
+
+// identities loaded from key files so we only ask for a passphrase once
+var identities struct {
+  sync.Mutex
+  keys map[string]*nacl.KeyPair
+}
+
+// load our identity key now, asking for the passphrase if it is encrypted
+// call before starting hubs so we don't ask later on
+func UnlockIdentity(fname string) (err error) {
+  _, err = loadIdentity(fname)
+  return
+}
+
+// read a key file, using the passphrase func if it is encrypted
+func importIdentity(fname string, data []byte) (kp *nacl.KeyPair, err error) {
+  kp, err = nacl.ImportSignKey(data)
+  if err == nacl.ErrNeedPassphrase && keyPassphrase != nil {
+    var pass []byte
+    pass, err = keyPassphrase()
+    if err == nil {
+      kp, err = nacl.ImportSignKeyPassphrase(data, pass)
+    }
+  }
+  if err != nil {
+    err = fmt.Errorf("%s: %w", fname, err)
+  }
+  return
+}
+
+// generate a new identity key file, encrypted with passphrase unless it is empty
+// the key is never written in the clear when there is a passphrase
+func createIdentity(fname string, passphrase []byte) (err error) {
+  identities.Lock()
+  defer identities.Unlock()
+  if checkFile(fname) {
+    err = fmt.Errorf("%s already exists", fname)
+    return
+  }
+  var kp *nacl.KeyPair
+  kp, err = writeIdentity(fname, passphrase)
+  if err == nil {
+    if identities.keys == nil {
+      identities.keys = make(map[string]*nacl.KeyPair)
+    }
+    identities.keys[fname] = kp
+  }
+  return
+}
+
+// generate a new key and write it to a key file, call with identities locked
+func writeIdentity(fname string, passphrase []byte) (kp *nacl.KeyPair, err error) {
+  kp = nacl.GenSignKeypair()
+  if kp == nil {
+    err = errors.New("failed to generate identity key")
+    return
+  }
+  var data []byte
+  if len(passphrase) == 0 {
+    data = nacl.ExportSignKey(kp)
+  } else {
+    data, err = nacl.ExportSignKeyPassphrase(kp, passphrase, nacl.PwHashModerate())
+  }
+  if err == nil {
+    err = ioutil.WriteFile(fname, data, 0600)
+  }
+  if err != nil {
+    kp.Free()
+    kp = nil
+  }
+  return
+}
+
+// load our signing keypair from a file, generate a new one if it does not exist
+// a new key is encrypted with the passphrase from SetNewKeyPassphraseFunc if one is set
+// see nacl.ImportSignKey for the file format
+// an empty file name gives an identity that is never saved
+func loadIdentity(fname string) (kp *nacl.KeyPair, err error) {
+  if len(fname) > 0 {
+    identities.Lock()
+    defer identities.Unlock()
+    kp = identities.keys[fname]
+    if kp != nil {
+      return
+    }
+  }
+  if len(fname) == 0 {
+    ephemeral.once.Do(func() {
+      ephemeral.kp = nacl.GenSignKeypair()
+    })
+    kp = ephemeral.kp
+    if kp == nil {
+      err = errors.New("failed to generate identity key")
+    }
+  } else if checkFile(fname) {
+    var data []byte
+    data, err = ioutil.ReadFile(fname)
+    if err == nil {
+      kp, err = importIdentity(fname, data)
+    }
+  } else {
+    var pass []byte
+    if newKeyPassphrase != nil {
+      pass, err = newKeyPassphrase()
+    }
+    if err == nil {
+      kp, err = writeIdentity(fname, pass)
+    }
+  }
+  if err == nil && len(fname) > 0 {
+    if identities.keys == nil {
+      identities.keys = make(map[string]*nacl.KeyPair)
+    }
+    identities.keys[fname] = kp
+  }
+  return
+}
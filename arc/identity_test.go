@@ -0,0 +1,98 @@
+//
+// identity_test.go -- identity key file tests
+//
+
+package arc
+
+import (
+  "io/ioutil"
+  "path/filepath"
+  "testing"
+  "github.com/majestrate/arcd/nacl"
+)
+
+func TestInitConfigPassphrase(t *testing.T) {
+  dir := t.TempDir()
+  _, err := InitConfigPassphrase(filepath.Join(dir, "arcd.json"), []byte("arcd"), testLogger)
+  if err != nil {
+    t.Fatal(err)
+  }
+  data, err := ioutil.ReadFile(filepath.Join(dir, "privkey.dat"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if ! nacl.SignKeyEncrypted(data) {
+    t.Fatal("new key file is not encrypted")
+  }
+  kp, err := nacl.ImportSignKeyPassphrase(data, []byte("arcd"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer kp.Free()
+  cached, err := loadIdentity(filepath.Join(dir, "privkey.dat"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if string(cached.Public()) != string(kp.Public()) {
+    t.Error("loaded a different key than the one saved")
+  }
+  if _, err = InitConfigPassphrase(filepath.Join(dir, "arcd.json"), nil, testLogger); err == nil {
+    t.Error("overwrote an existing config")
+  }
+}
+
+func TestInitConfigPlain(t *testing.T) {
+  dir := t.TempDir()
+  _, err := InitConfig(filepath.Join(dir, "arcd.json"), testLogger)
+  if err != nil {
+    t.Fatal(err)
+  }
+  data, err := ioutil.ReadFile(filepath.Join(dir, "privkey.dat"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if nacl.SignKeyEncrypted(data) {
+    t.Error("key file is encrypted without a passphrase")
+  }
+}
+
+// with a passphrase source a key made for a missing key file is never written in the clear
+func TestLoadIdentityNewKeyPassphrase(t *testing.T) {
+  SetNewKeyPassphraseFunc(func() ([]byte, error) {
+    return []byte("arcd"), nil
+  })
+  defer SetNewKeyPassphraseFunc(nil)
+  keyfile := filepath.Join(t.TempDir(), "privkey.dat")
+  kp, err := loadIdentity(keyfile)
+  if err != nil {
+    t.Fatal(err)
+  }
+  data, err := ioutil.ReadFile(keyfile)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if ! nacl.SignKeyEncrypted(data) {
+    t.Fatal("new key file is not encrypted")
+  }
+  saved, err := nacl.ImportSignKeyPassphrase(data, []byte("arcd"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer saved.Free()
+  if string(saved.Public()) != string(kp.Public()) {
+    t.Error("saved a different key than the one loaded")
+  }
+}
+
+// a passphrase source that fails leaves no key file behind
+func TestLoadIdentityNewKeyPassphraseError(t *testing.T) {
+  SetNewKeyPassphraseFunc(PassphraseFromEnv("ARCD_TEST_UNSET_PASSPHRASE"))
+  defer SetNewKeyPassphraseFunc(nil)
+  keyfile := filepath.Join(t.TempDir(), "privkey.dat")
+  if _, err := loadIdentity(keyfile); err == nil {
+    t.Fatal("made a key without a passphrase")
+  }
+  if checkFile(keyfile) {
+    t.Error("wrote a key file")
+  }
+}
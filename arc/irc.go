@@ -24,6 +24,8 @@ type ircReader struct {
 // run the reader, send ircLines down a channel to be processed
 func (r ircReader) Process(chnl chan ircLine) (err error) {
   sc := bufio.NewScanner(r)
+  // lines longer than irc allows are an error
+  sc.Buffer(make([]byte, 4096), maxIRCTagsLen + maxIRCLineLen)
   for sc.Scan() {
     chnl <- ircLine(sc.Text())
   }
@@ -46,7 +48,7 @@ func (info ircAuthInfo) Pass() string {
 
 // write a line
 func (irc ircBridge) Line(format string, args ...interface{}) (err error) {
-  _, err = fmt.Fprintf(irc, format, args)
+  _, err = fmt.Fprintf(irc, format, args...)
   _, err = io.WriteString(irc, "\n")
   return
 }
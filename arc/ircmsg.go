@@ -0,0 +1,429 @@
+//
+// ircmsg.go -- irc message parser and serializer, rfc 1459 with ircv3 message tags
+//
+
+package arc
+
+import (
+  "errors"
+  "log/slog"
+  "strings"
+)
+
+// longest tags section including the @ and the space after it
+const maxIRCTagsLen = 8191
+
+// longest irc line after the tags including cr lf
+const maxIRCLineLen = 512
+
+// most params an irc message can have
+const maxIRCParams = 15
+
+// channel name prefixes
+const ircChannelPrefixes = "#&+!"
+
+var (
+  errIRCEmpty = errors.New("empty irc line")
+  errIRCTooLong = errors.New("irc line too long")
+  errIRCTagsTooLong = errors.New("irc message tags too long")
+  errIRCBadChars = errors.New("irc line has nul, cr or lf in it")
+  errIRCNoCommand = errors.New("irc line has no command")
+  errIRCBadCommand = errors.New("invalid irc command")
+  errIRCBadPrefix = errors.New("invalid irc prefix")
+  errIRCBadTag = errors.New("invalid irc message tag")
+  errIRCBadParam = errors.New("invalid irc param")
+  errIRCTooManyParams = errors.New("too many irc params")
+)
+
+// an ircv3 message tag, value is unescaped
+type ircTag struct {
+  key, value string
+}
+
+// a parsed irc message
+type ircMessage struct {
+  // message tags in the order they were given
+  tags []ircTag
+  // servername or nick!user@host, empty if none
+  prefix string
+  // upper case command or 3 digit numeric
+  command string
+  // params, the last one can have spaces in it
+  params []string
+}
+
+// return true if s is letters only or a 3 digit numeric
+func validIRCCommand(s string) bool {
+  if len(s) == 0 {
+    return false
+  }
+  if len(s) == 3 && s[0] >= '0' && s[0] <= '9' {
+    for i := 1; i < 3; i++ {
+      if s[i] < '0' || s[i] > '9' {
+        return false
+      }
+    }
+    return true
+  }
+  for i := 0; i < len(s); i++ {
+    c := s[i] | 0x20
+    if c < 'a' || c > 'z' {
+      return false
+    }
+  }
+  return true
+}
+
+// return true if s is an ircv3 tag key: [+][vendor/]name
+func validIRCTagKey(s string) bool {
+  s = strings.TrimPrefix(s, "+")
+  if idx := strings.LastIndexByte(s, '/'); idx >= 0 {
+    vendor := s[:idx]
+    if len(vendor) == 0 || strings.Trim(vendor, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-.") != "" {
+      return false
+    }
+    s = s[idx+1:]
+  }
+  return len(s) > 0 && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-") == ""
+}
+
+// unescape an ircv3 tag value
+func unescapeIRCTagValue(s string) string {
+  if strings.IndexByte(s, '\\') < 0 {
+    return s
+  }
+  var b strings.Builder
+  for i := 0; i < len(s); i++ {
+    c := s[i]
+    if c != '\\' {
+      b.WriteByte(c)
+      continue
+    }
+    i++
+    if i == len(s) {
+      // a lone backslash at the end is dropped
+      break
+    }
+    switch s[i] {
+    case ':':
+      b.WriteByte(';')
+    case 's':
+      b.WriteByte(' ')
+    case 'r':
+      b.WriteByte('\r')
+    case 'n':
+      b.WriteByte('\n')
+    default:
+      b.WriteByte(s[i])
+    }
+  }
+  return b.String()
+}
+
+// escape an ircv3 tag value
+func escapeIRCTagValue(s string) string {
+  return strings.NewReplacer("\\", "\\\\", ";", "\\:", " ", "\\s", "\r", "\\r", "\n", "\\n").Replace(s)
+}
+
+// parse the tags section of an irc line without the leading @
+func parseIRCTags(s string) (tags []ircTag, err error) {
+  for _, kv := range strings.Split(s, ";") {
+    if len(kv) == 0 {
+      continue
+    }
+    k, v, _ := strings.Cut(kv, "=")
+    if ! validIRCTagKey(k) {
+      err = errIRCBadTag
+      return
+    }
+    tags = append(tags, ircTag{k, unescapeIRCTagValue(v)})
+  }
+  return
+}
+
+// parse an irc line, a trailing cr lf is ignored
+// gives an empty message on error
+func parseIRCMessage(line string) (m ircMessage, err error) {
+  defer func() {
+    if err != nil {
+      m = ircMessage{}
+    }
+  }()
+  line = strings.TrimSuffix(line, "\n")
+  line = strings.TrimSuffix(line, "\r")
+  if strings.ContainsAny(line, "\x00\r\n") {
+    err = errIRCBadChars
+    return
+  }
+  if strings.HasPrefix(line, "@") {
+    idx := strings.IndexByte(line, ' ')
+    if idx < 0 {
+      err = errIRCNoCommand
+      return
+    }
+    if idx + 1 > maxIRCTagsLen {
+      err = errIRCTagsTooLong
+      return
+    }
+    m.tags, err = parseIRCTags(line[1:idx])
+    if err != nil {
+      return
+    }
+    line = line[idx+1:]
+  }
+  line = strings.TrimLeft(line, " ")
+  if len(line) == 0 {
+    err = errIRCEmpty
+    return
+  }
+  if len(line) + 2 > maxIRCLineLen {
+    err = errIRCTooLong
+    return
+  }
+  if line[0] == ':' {
+    idx := strings.IndexByte(line, ' ')
+    if idx < 0 {
+      err = errIRCNoCommand
+      return
+    }
+    m.prefix = line[1:idx]
+    if len(m.prefix) == 0 {
+      err = errIRCBadPrefix
+      return
+    }
+    line = strings.TrimLeft(line[idx+1:], " ")
+  }
+  m.command, line, _ = strings.Cut(line, " ")
+  if len(m.command) == 0 {
+    err = errIRCNoCommand
+    return
+  }
+  if ! validIRCCommand(m.command) {
+    err = errIRCBadCommand
+    return
+  }
+  m.command = strings.ToUpper(m.command)
+  for {
+    line = strings.TrimLeft(line, " ")
+    if len(line) == 0 {
+      break
+    }
+    if line[0] == ':' || len(m.params) == maxIRCParams - 1 {
+      // trailing takes the rest of the line
+      m.params = append(m.params, strings.TrimPrefix(line, ":"))
+      break
+    }
+    var param string
+    param, line, _ = strings.Cut(line, " ")
+    m.params = append(m.params, param)
+  }
+  // a trailing param that had no : can need one and push the line over the limit
+  _, err = m.Line()
+  return
+}
+
+// split a line like parseIRCMessage does but never fail, tags are skipped
+// filter rules and rate limits use it for lines that do not parse so they can't slip past
+func lenientIRCMessage(line string) (m ircMessage) {
+  line = strings.TrimRight(line, "\r\n")
+  if strings.HasPrefix(line, "@") {
+    _, line, _ = strings.Cut(line, " ")
+  }
+  line = strings.TrimLeft(line, " ")
+  if strings.HasPrefix(line, ":") {
+    m.prefix, line, _ = strings.Cut(line[1:], " ")
+    line = strings.TrimLeft(line, " ")
+  }
+  m.command, line, _ = strings.Cut(line, " ")
+  m.command = strings.ToUpper(m.command)
+  for {
+    line = strings.TrimLeft(line, " ")
+    if len(line) == 0 {
+      break
+    }
+    if line[0] == ':' || len(m.params) == maxIRCParams - 1 {
+      m.params = append(m.params, strings.TrimPrefix(line, ":"))
+      break
+    }
+    var param string
+    param, line, _ = strings.Cut(line, " ")
+    m.params = append(m.params, param)
+  }
+  return
+}
+
+// serialize an irc message without cr lf
+func (m ircMessage) Line() (line ircLine, err error) {
+  var b strings.Builder
+  if len(m.tags) > 0 {
+    b.WriteByte('@')
+    for i, t := range m.tags {
+      if ! validIRCTagKey(t.key) {
+        err = errIRCBadTag
+        return
+      }
+      if i > 0 {
+        b.WriteByte(';')
+      }
+      b.WriteString(t.key)
+      if len(t.value) > 0 {
+        b.WriteByte('=')
+        b.WriteString(escapeIRCTagValue(t.value))
+      }
+    }
+    b.WriteByte(' ')
+    if b.Len() > maxIRCTagsLen {
+      err = errIRCTagsTooLong
+      return
+    }
+  }
+  tagsLen := b.Len()
+  if len(m.prefix) > 0 {
+    if strings.ContainsAny(m.prefix, " \x00\r\n") {
+      err = errIRCBadPrefix
+      return
+    }
+    b.WriteByte(':')
+    b.WriteString(m.prefix)
+    b.WriteByte(' ')
+  }
+  if ! validIRCCommand(m.command) {
+    err = errIRCBadCommand
+    return
+  }
+  b.WriteString(m.command)
+  if len(m.params) > maxIRCParams {
+    err = errIRCTooManyParams
+    return
+  }
+  for i, p := range m.params {
+    if strings.ContainsAny(p, "\x00\r\n") {
+      err = errIRCBadParam
+      return
+    }
+    b.WriteByte(' ')
+    if i == len(m.params) - 1 {
+      if len(p) == 0 || p[0] == ':' || strings.IndexByte(p, ' ') >= 0 {
+        b.WriteByte(':')
+      }
+    } else if len(p) == 0 || p[0] == ':' || strings.IndexByte(p, ' ') >= 0 {
+      // only the last param can be empty or have spaces
+      err = errIRCBadParam
+      return
+    }
+    b.WriteString(p)
+  }
+  if b.Len() - tagsLen + 2 > maxIRCLineLen {
+    err = errIRCTooLong
+    return
+  }
+  line = ircLine(b.String())
+  return
+}
+
+// serialized message for logs
+func (m ircMessage) String() string {
+  line, err := m.Line()
+  if err != nil {
+    return "invalid irc message: " + err.Error()
+  }
+  return string(line)
+}
+
+// get the value of a tag, the last one wins if it is given twice
+func (m ircMessage) Tag(key string) (value string, ok bool) {
+  for _, t := range m.tags {
+    if t.key == key {
+      value, ok = t.value, true
+    }
+  }
+  return
+}
+
+// nick from a nick!user@host prefix, empty if there is no prefix or it is a server
+func (m ircMessage) Nick() string {
+  if idx := strings.IndexAny(m.prefix, "!@"); idx >= 0 {
+    return m.prefix[:idx]
+  }
+  if strings.IndexByte(m.prefix, '.') >= 0 {
+    return ""
+  }
+  return m.prefix
+}
+
+// the channel a message is for, the first one if the first param is a list of them
+// empty if the first param is not a channel
+func (m ircMessage) Channel() string {
+  if len(m.params) == 0 {
+    return ""
+  }
+  target, _, _ := strings.Cut(m.params[0], ",")
+  if len(target) > 1 && strings.IndexByte(ircChannelPrefixes, target[0]) >= 0 {
+    return target
+  }
+  return ""
+}
+
+// the last param, empty if there are none
+func (m ircMessage) Trailing() string {
+  if len(m.params) == 0 {
+    return ""
+  }
+  return m.params[len(m.params)-1]
+}
+
+// parse this line
+func (l ircLine) Parse() (ircMessage, error) {
+  return parseIRCMessage(string(l))
+}
+
+// parse this line, split it with lenientIRCMessage if it does not parse
+func (l ircLine) parts() ircMessage {
+  m, err := l.Parse()
+  if err != nil {
+    m = lenientIRCMessage(string(l))
+  }
+  return m
+}
+
+// the prefix this line claims to be from, empty if it has none
+// best effort for lines that do not parse
+func (l ircLine) Prefix() string {
+  return l.parts().prefix
+}
+
+// the command of this line, best effort for lines that do not parse
+func (l ircLine) Command() string {
+  return l.parts().command
+}
+
+// the nick this line claims to be from, empty if it has none
+// best effort for lines that do not parse
+func (l ircLine) Nick() string {
+  return l.parts().Nick()
+}
+
+// the channel this line is for, empty if it is not for one
+// best effort for lines that do not parse
+func (l ircLine) Channel() string {
+  return l.parts().Channel()
+}
+
+// log what a line is without what it says
+func (l ircLine) LogValue() slog.Value {
+  if len(l) == 0 {
+    return slog.GroupValue()
+  }
+  m, err := l.Parse()
+  if err != nil {
+    return slog.GroupValue(slog.String("invalid", err.Error()), slog.Int("len", len(l)))
+  }
+  attrs := []slog.Attr{slog.String("command", m.command)}
+  if len(m.prefix) > 0 {
+    attrs = append(attrs, slog.String("prefix", m.prefix))
+  }
+  if channel := m.Channel(); len(channel) > 0 {
+    attrs = append(attrs, slog.String("channel", channel))
+  }
+  return slog.GroupValue(attrs...)
+}
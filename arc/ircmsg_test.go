@@ -0,0 +1,217 @@
+//
+// ircmsg_test.go -- irc message parser tests
+//
+
+package arc
+
+import (
+  "reflect"
+  "strings"
+  "testing"
+)
+
+func TestParseIRCMessage(t *testing.T) {
+  tests := []struct {
+    name string
+    line string
+    want ircMessage
+  }{
+    {"command", "PING", ircMessage{command: "PING"}},
+    {"lower case command", "ping :x", ircMessage{command: "PING", params: []string{"x"}}},
+    {"numeric", ":irc.example 001 nick :welcome", ircMessage{prefix: "irc.example", command: "001", params: []string{"nick", "welcome"}}},
+    {"prefix", ":nick!user@host PRIVMSG #arcd :hi there", ircMessage{prefix: "nick!user@host", command: "PRIVMSG", params: []string{"#arcd", "hi there"}}},
+    {"cr lf", "PRIVMSG #arcd hi\r\n", ircMessage{command: "PRIVMSG", params: []string{"#arcd", "hi"}}},
+    {"extra spaces", ":nick  PRIVMSG   #arcd   hi", ircMessage{prefix: "nick", command: "PRIVMSG", params: []string{"#arcd", "hi"}}},
+    {"empty trailing", "TOPIC #arcd :", ircMessage{command: "TOPIC", params: []string{"#arcd", ""}}},
+    {"trailing colon", "PRIVMSG #arcd ::)", ircMessage{command: "PRIVMSG", params: []string{"#arcd", ":)"}}},
+    {"tags", "@time=2024-01-01T00:00:00Z;+draft/reply=abc;flag :nick PRIVMSG #arcd :hi", ircMessage{
+      tags: []ircTag{{"time", "2024-01-01T00:00:00Z"}, {"+draft/reply", "abc"}, {"flag", ""}},
+      prefix: "nick", command: "PRIVMSG", params: []string{"#arcd", "hi"}}},
+    {"escaped tag", `@a=semi\:space\sslash\\cr\rlf\n;b=x\q;c=end\ PING`, ircMessage{
+      tags: []ircTag{{"a", "semi;space slash\\cr\rlf\n"}, {"b", "xq"}, {"c", "end"}}, command: "PING"}},
+    {"empty tags", "@;; PING", ircMessage{command: "PING"}},
+    {"fifteen params", "CMD 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15", ircMessage{command: "CMD",
+      params: []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12", "13", "14", "15"}}},
+    {"sixteen params", "CMD 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16", ircMessage{command: "CMD",
+      params: []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12", "13", "14", "15 16"}}},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      m, err := parseIRCMessage(tt.line)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if ! reflect.DeepEqual(m, tt.want) {
+        t.Errorf("got %#v\nwant %#v", m, tt.want)
+      }
+    })
+  }
+}
+
+func TestParseIRCMessageErrors(t *testing.T) {
+  tests := []struct {
+    name string
+    line string
+    err error
+  }{
+    {"empty", "", errIRCEmpty},
+    {"spaces", "   ", errIRCEmpty},
+    {"nul", "PRIVMSG #arcd :a\x00b", errIRCBadChars},
+    {"inner lf", "PRIVMSG #arcd :a\nb", errIRCBadChars},
+    {"tags only", "@a=b", errIRCNoCommand},
+    {"tags and nothing", "@a=b ", errIRCEmpty},
+    {"prefix only", ":nick", errIRCNoCommand},
+    {"empty prefix", ": PING", errIRCBadPrefix},
+    {"no command", ":nick ", errIRCNoCommand},
+    {"bad command", "PRIV-MSG #arcd", errIRCBadCommand},
+    {"short numeric", "01 nick", errIRCBadCommand},
+    {"bad tag key", "@a!=b PING", errIRCBadTag},
+    {"empty vendor", "@/a=b PING", errIRCBadTag},
+    {"too long", "PRIVMSG #arcd :" + strings.Repeat("a", maxIRCLineLen), errIRCTooLong},
+    {"trailing needs a colon over the limit", "CMD" + strings.Repeat(" a", 14) + " b " + strings.Repeat("b", maxIRCLineLen - 36), errIRCTooLong},
+    {"tags too long", "@a=" + strings.Repeat("b", maxIRCTagsLen) + " PING", errIRCTagsTooLong},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      m, err := parseIRCMessage(tt.line)
+      if err != tt.err {
+        t.Errorf("gave %v, want %v", err, tt.err)
+      }
+      if err != nil && ! reflect.DeepEqual(m, ircMessage{}) {
+        t.Errorf("gave %#v with an error", m)
+      }
+    })
+  }
+}
+
+func TestIRCMessageLine(t *testing.T) {
+  tests := []struct {
+    name string
+    m ircMessage
+    line ircLine
+    err error
+  }{
+    {"trailing with spaces", ircMessage{prefix: "nick", command: "PRIVMSG", params: []string{"#arcd", "hi there"}}, ":nick PRIVMSG #arcd :hi there", nil},
+    {"plain trailing", ircMessage{command: "JOIN", params: []string{"#arcd"}}, "JOIN #arcd", nil},
+    {"empty trailing", ircMessage{command: "TOPIC", params: []string{"#arcd", ""}}, "TOPIC #arcd :", nil},
+    {"colon trailing", ircMessage{command: "PRIVMSG", params: []string{"#arcd", ":)"}}, "PRIVMSG #arcd ::)", nil},
+    {"escaped tags", ircMessage{tags: []ircTag{{"a", "x; y\\"}, {"b", ""}}, command: "PING"}, `@a=x\:\sy\\;b PING`, nil},
+    {"bad tag key", ircMessage{tags: []ircTag{{"a b", ""}}, command: "PING"}, "", errIRCBadTag},
+    {"bad prefix", ircMessage{prefix: "a b", command: "PING"}, "", errIRCBadPrefix},
+    {"bad command", ircMessage{command: "P NG"}, "", errIRCBadCommand},
+    {"empty middle param", ircMessage{command: "CMD", params: []string{"", "x"}}, "", errIRCBadParam},
+    {"middle param with space", ircMessage{command: "CMD", params: []string{"a b", "x"}}, "", errIRCBadParam},
+    {"param with lf", ircMessage{command: "CMD", params: []string{"a\nb"}}, "", errIRCBadParam},
+    {"sixteen params", ircMessage{command: "CMD", params: make([]string, maxIRCParams + 1)}, "", errIRCTooManyParams},
+    {"too long", ircMessage{command: "CMD", params: []string{strings.Repeat("a", maxIRCLineLen)}}, "", errIRCTooLong},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      line, err := tt.m.Line()
+      if err != tt.err || line != tt.line {
+        t.Errorf("gave %q %v, want %q %v", line, err, tt.line, tt.err)
+      }
+    })
+  }
+}
+
+func TestIRCMessageParts(t *testing.T) {
+  tests := []struct {
+    line ircLine
+    nick, channel string
+  }{
+    {":nick!user@host PRIVMSG #arcd :hi", "nick", "#arcd"},
+    {":nick@host JOIN &local,#arcd", "nick", "&local"},
+    {":irc.example NOTICE nick :hi", "", ""},
+    {"PRIVMSG # :hi", "", ""},
+  }
+  for _, tt := range tests {
+    if nick := tt.line.Nick(); nick != tt.nick {
+      t.Errorf("%q has nick %q, want %q", tt.line, nick, tt.nick)
+    }
+    if channel := tt.line.Channel(); channel != tt.channel {
+      t.Errorf("%q has channel %q, want %q", tt.line, channel, tt.channel)
+    }
+  }
+}
+
+func TestIRCLineLenient(t *testing.T) {
+  tests := []struct {
+    name string
+    line ircLine
+    prefix, command, nick, channel string
+  }{
+    {"nul", ":nick!user@host PRIVMSG #arcd :a\x00b", "nick!user@host", "PRIVMSG", "nick", "#arcd"},
+    {"bad command", ":nick!user@host PRIV-MSG #arcd :hi", "nick!user@host", "PRIV-MSG", "nick", "#arcd"},
+    {"bad tag", "@a!=b :nick!user@host PRIVMSG #arcd :hi", "nick!user@host", "PRIVMSG", "nick", "#arcd"},
+    {"too long", ircLine(":nick!user@host PRIVMSG #arcd :" + strings.Repeat("a", maxIRCLineLen)), "nick!user@host", "PRIVMSG", "nick", "#arcd"},
+    {"empty prefix", ": PRIVMSG #arcd :hi", "", "PRIVMSG", "", "#arcd"},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      if _, err := tt.line.Parse(); err == nil {
+        t.Fatal("line parses")
+      }
+      if p := tt.line.Prefix(); p != tt.prefix {
+        t.Errorf("prefix %q, want %q", p, tt.prefix)
+      }
+      if c := tt.line.Command(); c != tt.command {
+        t.Errorf("command %q, want %q", c, tt.command)
+      }
+      if n := tt.line.Nick(); n != tt.nick {
+        t.Errorf("nick %q, want %q", n, tt.nick)
+      }
+      if c := tt.line.Channel(); c != tt.channel {
+        t.Errorf("channel %q, want %q", c, tt.channel)
+      }
+    })
+  }
+}
+
+func FuzzParseIRCMessage(f *testing.F) {
+  for _, seed := range []string{
+    "PING",
+    ":nick!user@host PRIVMSG #arcd :hi there",
+    "@time=2024-01-01T00:00:00Z;+draft/reply=abc;flag :nick PRIVMSG #arcd :hi",
+    `@a=semi\:space\sslash\;b=x\q;c=end\ PING`,
+    "CMD 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16",
+    "PRIVMSG #arcd ::)\r\n",
+    ": PING",
+    "@a!=b PRIV-MSG #arcd :a\x00b",
+  } {
+    f.Add(seed)
+  }
+  f.Fuzz(func(t *testing.T, line string) {
+    // must not panic on anything
+    lenientIRCMessage(line)
+    m, err := parseIRCMessage(line)
+    if err != nil {
+      return
+    }
+    out, err := m.Line()
+    if err != nil {
+      t.Fatalf("parsed %q but can't serialize it: %v", line, err)
+    }
+    s := string(out)
+    tagsLen := 0
+    if strings.HasPrefix(s, "@") {
+      tagsLen = strings.IndexByte(s, ' ') + 1
+    }
+    if tagsLen > maxIRCTagsLen {
+      t.Fatalf("%q has %d bytes of tags", s, tagsLen)
+    }
+    if len(s) - tagsLen + 2 > maxIRCLineLen {
+      t.Fatalf("%q is %d bytes", s, len(s) - tagsLen + 2)
+    }
+    if len(m.params) > maxIRCParams {
+      t.Fatalf("%q has %d params", s, len(m.params))
+    }
+    again, err := parseIRCMessage(s)
+    if err != nil {
+      t.Fatalf("%q from %q does not parse: %v", s, line, err)
+    }
+    if ! reflect.DeepEqual(m, again) {
+      t.Fatalf("%q from %q parsed as %#v, first time %#v", s, line, again, m)
+    }
+  })
+}
@@ -0,0 +1,20 @@
+//
+// metrics.go -- expvar metrics over http
+//
+
+package arc
+
+import (
+  "expvar"
+  "log/slog"
+  "net/http"
+)
+
+// serve expvar metrics as json at /debug/vars on bind, runs until the listener fails
+func ServeMetrics(bind string, logger *slog.Logger) {
+  mux := http.NewServeMux()
+  mux.Handle("/debug/vars", expvar.Handler())
+  logger.Info("serving metrics", "bind", bind, "path", "/debug/vars")
+  err := http.ListenAndServe(bind, mux)
+  logger.Error("metrics server failed", "bind", bind, "err", err)
+}
@@ -0,0 +1,125 @@
+//
+// passphrase.go -- identity key file passphrases
+//
+
+package arc
+
+import (
+  "bufio"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "sync"
+  "github.com/majestrate/arcd/nacl"
+  "golang.org/x/term"
+)
+
+// gets a passphrase for an encrypted identity key file
+type PassphraseFunc func() ([]byte, error)
+
+// passphrase source for encrypted key files, nil means we can't unlock them
+var keyPassphrase PassphraseFunc
+
+// set where we get passphrases for encrypted key files from
+func SetPassphraseFunc(f PassphraseFunc) {
+  keyPassphrase = f
+}
+
+// passphrase source for identity keys we make because the key file is missing
+// nil writes them in the clear
+var newKeyPassphrase PassphraseFunc
+
+// set where we get the passphrase to encrypt an identity key made on first run with
+// set it when the user asked for encrypted keys, nil writes new keys in the clear
+func SetNewKeyPassphraseFunc(f PassphraseFunc) {
+  newKeyPassphrase = f
+}
+
+// passphrase from an environment variable
+func PassphraseFromEnv(name string) PassphraseFunc {
+  return func() ([]byte, error) {
+    s, ok := os.LookupEnv(name)
+    if ! ok {
+      return nil, fmt.Errorf("%s is not set", name)
+    }
+    return []byte(s), nil
+  }
+}
+
+// passphrase from an open file descriptor, one line per call
+func PassphraseFromFD(fd uintptr) PassphraseFunc {
+  var once sync.Once
+  var r *bufio.Reader
+  return func() ([]byte, error) {
+    once.Do(func() {
+      r = bufio.NewReader(os.NewFile(fd, fmt.Sprintf("fd %d", fd)))
+    })
+    line, err := r.ReadBytes('\n')
+    if len(line) == 0 && err != nil {
+      return nil, fmt.Errorf("reading passphrase from fd %d: %s", fd, err)
+    }
+    for len(line) > 0 && (line[len(line)-1] == '\n' || line[len(line)-1] == '\r') {
+      line = line[:len(line)-1]
+    }
+    return line, nil
+  }
+}
+
+// passphrase typed at the terminal
+// confirm asks twice, for picking a new passphrase
+func PassphrasePrompt(prompt string, confirm bool) PassphraseFunc {
+  return func() ([]byte, error) {
+    tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+    if err != nil {
+      return nil, fmt.Errorf("cannot ask for passphrase: %s", err)
+    }
+    defer tty.Close()
+    fmt.Fprintf(tty, "%s: ", prompt)
+    pass, err := term.ReadPassword(int(tty.Fd()))
+    fmt.Fprintln(tty)
+    if err != nil || ! confirm {
+      return pass, err
+    }
+    fmt.Fprintf(tty, "%s again: ", prompt)
+    again, err := term.ReadPassword(int(tty.Fd()))
+    fmt.Fprintln(tty)
+    if err != nil {
+      return nil, err
+    }
+    if string(again) != string(pass) {
+      return nil, errors.New("passphrases do not match")
+    }
+    return pass, nil
+  }
+}
+
+// re-encrypt an identity key file with a new passphrase, an empty passphrase stores it in the clear
+// the current passphrase comes from SetPassphraseFunc if the file is encrypted
+func ChangeKeyPassphrase(fname string, passphrase []byte) (err error) {
+  if ! checkFile(fname) {
+    err = fmt.Errorf("%s: no such key file", fname)
+    return
+  }
+  var kp *nacl.KeyPair
+  kp, err = loadIdentity(fname)
+  if err != nil {
+    return
+  }
+  var data []byte
+  if len(passphrase) == 0 {
+    data = nacl.ExportSignKey(kp)
+  } else {
+    data, err = nacl.ExportSignKeyPassphrase(kp, passphrase, nacl.PwHashModerate())
+    if err != nil {
+      return
+    }
+  }
+  // write next to it then rename so a crash can't lose the key
+  tmp := fname + ".new"
+  err = ioutil.WriteFile(tmp, data, 0600)
+  if err == nil {
+    err = os.Rename(tmp, fname)
+  }
+  return
+}
@@ -0,0 +1,83 @@
+//
+// pex.go -- peer exchange over urc links
+//
+
+package arc
+
+import (
+  "net"
+  "strings"
+)
+
+// max number of addresses in a pex message
+const maxPEXAddrs = 16
+
+// seconds between sending pex to connected hubs
+const pexInterval = 300
+
+// make a pex message
+// PEX <addr> [<addr> ...]
+func newPEXMessage(addrs []string) urcMessage {
+  if len(addrs) > maxPEXAddrs {
+    addrs = addrs[:maxPEXAddrs]
+  }
+  body := "PEX " + strings.Join(addrs, " ")
+  return newURCMessage(urcTypePEX, []byte(body))
+}
+
+// parse a pex message body into remote hub configs
+// onion and i2p addresses use the proxies we have, anything we can't reach is dropped
+// so are private, link local and multicast addresses, hubs on our own network come from discovery
+func parsePEX(body []byte, cfg LocalHubConfig) (remotes []RemoteHubConfig) {
+  parts := strings.Fields(string(body))
+  if len(parts) < 2 || parts[0] != "PEX" {
+    return
+  }
+  parts = parts[1:]
+  if len(parts) > maxPEXAddrs {
+    parts = parts[:maxPEXAddrs]
+  }
+  for _, addr := range parts {
+    host, port, err := splitHostPort(addr)
+    if err != nil {
+      continue
+    }
+    remote := RemoteHubConfig{
+      Addr: host,
+      Port: port,
+    }
+    if ip := net.ParseIP(host); ip != nil && ! pexRoutable(ip) {
+      continue
+    }
+    if strings.IndexByte(host, '%') >= 0 {
+      // scoped ipv6 addresses only mean something on the sender's link
+      continue
+    }
+    if strings.HasSuffix(host, ".onion") {
+      if len(cfg.SocksAddr) == 0 {
+        continue
+      }
+      remote.ProxyType = "socks"
+      remote.ProxyAddr = cfg.SocksAddr
+      remote.ProxyPort = cfg.SocksPort
+    } else if strings.HasSuffix(host, ".i2p") {
+      if len(cfg.I2PSAM) == 0 {
+        continue
+      }
+      bridge, bport, err := splitHostPort(cfg.I2PSAM)
+      if err != nil {
+        continue
+      }
+      remote.ProxyType = "i2p-sam"
+      remote.ProxyAddr = bridge
+      remote.ProxyPort = bport
+    }
+    remotes = append(remotes, remote)
+  }
+  return
+}
+
+// return true if a hub at ip could be reachable for anyone we pass it on to
+func pexRoutable(ip net.IP) bool {
+  return ! (ip.IsLoopback() || ip.IsUnspecified() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsMulticast())
+}
@@ -0,0 +1,61 @@
+//
+// pex_test.go -- tests for peer exchange parsing
+//
+
+package arc
+
+import (
+  "fmt"
+  "reflect"
+  "testing"
+)
+
+func TestParsePEX(t *testing.T) {
+  cfg := LocalHubConfig{
+    SocksAddr: "127.0.0.1",
+    SocksPort: 9050,
+    I2PSAM: "127.0.0.1:7656",
+  }
+  tests := []struct {
+    name, body string
+    cfg LocalHubConfig
+    want []RemoteHubConfig
+  }{
+    {"public ipv4", "PEX 203.0.113.7:6789", cfg, []RemoteHubConfig{{Addr: "203.0.113.7", Port: 6789}}},
+    {"public ipv6", "PEX [2001:db8::1]:6789", cfg, []RemoteHubConfig{{Addr: "2001:db8::1", Port: 6789}}},
+    {"hostname", "PEX hub.example.com:6789", cfg, []RemoteHubConfig{{Addr: "hub.example.com", Port: 6789}}},
+    {"onion", "PEX example.onion:6789", cfg, []RemoteHubConfig{{Addr: "example.onion", Port: 6789, ProxyType: "socks", ProxyAddr: "127.0.0.1", ProxyPort: 9050}}},
+    {"onion without socks", "PEX example.onion:6789", LocalHubConfig{}, nil},
+    {"i2p", "PEX example.i2p:6789", cfg, []RemoteHubConfig{{Addr: "example.i2p", Port: 6789, ProxyType: "i2p-sam", ProxyAddr: "127.0.0.1", ProxyPort: 7656}}},
+    {"i2p without sam", "PEX example.i2p:6789", LocalHubConfig{}, nil},
+    {"loopback", "PEX 127.0.0.1:6789 [::1]:6789", cfg, nil},
+    {"unspecified", "PEX 0.0.0.0:6789 [::]:6789", cfg, nil},
+    {"private", "PEX 10.0.0.1:6789 172.16.0.1:6789 192.168.1.1:6789 [fd00::1]:6789", cfg, nil},
+    {"private ipv4 in ipv6", "PEX [::ffff:192.168.1.1]:6789", cfg, nil},
+    {"link local", "PEX 169.254.1.1:6789 [fe80::1]:6789 [fe80::1%eth0]:6789", cfg, nil},
+    {"multicast", "PEX 224.0.0.1:6789 [ff02::1]:6789", cfg, nil},
+    {"bad port", "PEX 203.0.113.7:0 203.0.113.7:65536 203.0.113.7", cfg, nil},
+    {"not pex", "BEACON 203.0.113.7:6789", cfg, nil},
+    {"empty", "PEX", cfg, nil},
+    {"mixed", "PEX 10.0.0.1:6789 203.0.113.7:6789", cfg, []RemoteHubConfig{{Addr: "203.0.113.7", Port: 6789}}},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      got := parsePEX([]byte(tt.body), tt.cfg)
+      if ! reflect.DeepEqual(got, tt.want) {
+        t.Errorf("parsePEX(%q) = %+v, want %+v", tt.body, got, tt.want)
+      }
+    })
+  }
+}
+
+func TestParsePEXLimit(t *testing.T) {
+  var addrs []string
+  for i := 0; i < maxPEXAddrs * 2; i++ {
+    addrs = append(addrs, fmt.Sprintf("hub%d.example.com:6789", i))
+  }
+  m := newPEXMessage(addrs)
+  if got := parsePEX(m.body, LocalHubConfig{}); len(got) != maxPEXAddrs {
+    t.Errorf("got %d hubs, want %d", len(got), maxPEXAddrs)
+  }
+}
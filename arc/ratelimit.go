@@ -0,0 +1,293 @@
+//
+// ratelimit.go -- token bucket flood protection for inbound messages
+//
+// every hub link, every irc prefix that lines claim to come from and all links
+// together get a token bucket, a message needs a token from each to be relayed
+// anyone can claim any prefix so sender limits only slow down naive floods
+//
+
+package arc
+
+import (
+  "container/list"
+  "expvar"
+  "log/slog"
+  "sync"
+  "time"
+)
+
+// what to do with a message over a rate limit
+const (
+  // drop the message and keep the link
+  rateLimitDrop = "drop"
+  // stop reading from the link until it is under the limit again
+  rateLimitThrottle = "throttle"
+  // drop the message and close the link
+  rateLimitDisconnect = "disconnect"
+)
+
+// rate limit actions we know
+var knownRateLimitActions = []string{"", rateLimitDrop, rateLimitThrottle, rateLimitDisconnect}
+
+// longest we stop reading from a throttled link for one message, we drop it instead past this
+const maxThrottleWait = 10 * time.Second
+
+// forget sender buckets that have not been used for this long
+const senderBucketIdle = 10 * time.Minute
+
+// most sender buckets we keep, a new sender past this takes the bucket of the
+// sender we saw longest ago so made up prefixes can't lock new senders out
+const maxSenderBuckets = 10000
+
+// counts of limited messages by limit and action i.e. peer_drop, see ServeMetrics
+var rateLimitStats = expvar.NewMap("ratelimit")
+
+// messages a second and how many we allow at once, zero rate is no limit
+type rateLimit struct {
+  rate, burst float64
+}
+
+// make a limit from config, rate is messages a minute
+// burst defaults to a tenth of the rate, at least 1
+func newRateLimit(perMinute, burst int) rateLimit {
+  if burst <= 0 {
+    burst = perMinute / 10
+    if burst < 1 {
+      burst = 1
+    }
+  }
+  return rateLimit{
+    rate: float64(perMinute) / 60,
+    burst: float64(burst),
+  }
+}
+
+type tokenBucket struct {
+  tokens float64
+  last time.Time
+}
+
+// token bucket of one irc prefix
+type senderBucket struct {
+  tokenBucket
+  sender string
+}
+
+// add the tokens earned since we last looked
+func (b *tokenBucket) refill(now time.Time, l rateLimit) {
+  if b.last.IsZero() {
+    b.tokens = l.burst
+  } else {
+    b.tokens += now.Sub(b.last).Seconds() * l.rate
+    if b.tokens > l.burst {
+      b.tokens = l.burst
+    }
+  }
+  b.last = now
+}
+
+// how long until this bucket has a token, zero if it has one now
+func (b *tokenBucket) wait(l rateLimit) time.Duration {
+  if b.tokens >= 1 {
+    return 0
+  }
+  return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// what a hub does with a message after asking the rate limiter
+type rateVerdict int
+
+const (
+  // pass it to the router
+  ratePass rateVerdict = iota
+  // drop it
+  rateDrop
+  // drop it and close the link
+  rateDisconnect
+)
+
+// rate limits shared by all hubs of a router
+type rateLimiter struct {
+  access sync.Mutex
+  action string
+  peer, sender, global rateLimit
+  // sender buckets by prefix, their elements are in seen, most recently seen first
+  senders map[string]*list.Element
+  seen *list.List
+  all tokenBucket
+  // limited messages since the last report by limit and action
+  limited map[string]uint64
+}
+
+// make a rate limiter from local config
+func newRateLimiter(cfg LocalHubConfig) *rateLimiter {
+  l := &rateLimiter{
+    senders: make(map[string]*list.Element),
+    seen: list.New(),
+    limited: make(map[string]uint64),
+  }
+  l.configure(cfg)
+  return l
+}
+
+// apply new limits, buckets keep their tokens
+func (l *rateLimiter) configure(cfg LocalHubConfig) {
+  l.access.Lock()
+  defer l.access.Unlock()
+  l.action = cfg.RateLimitAction
+  if len(l.action) == 0 {
+    l.action = rateLimitDrop
+  }
+  l.peer = newRateLimit(cfg.PeerRate, cfg.PeerBurst)
+  l.sender = newRateLimit(cfg.SenderRate, cfg.SenderBurst)
+  l.global = newRateLimit(cfg.GlobalRate, cfg.GlobalBurst)
+}
+
+// a link we rate limit messages from
+type rateSource struct {
+  limiter *rateLimiter
+  bucket tokenBucket
+}
+
+// get a new rate limited source for a hub link, nil limiter gives a source that is never limited
+func (l *rateLimiter) source() *rateSource {
+  return &rateSource{
+    limiter: l,
+  }
+}
+
+// check a message from this link against our limits
+// takes tokens if it passes, sleeps first if we throttle
+func (s *rateSource) admit(m Message) rateVerdict {
+  l := s.limiter
+  if l == nil {
+    return ratePass
+  }
+  l.access.Lock()
+  now := time.Now()
+  l.sweep(now)
+  type limited struct {
+    name string
+    bucket *tokenBucket
+    limit rateLimit
+  }
+  var buckets []limited
+  if l.peer.rate > 0 {
+    buckets = append(buckets, limited{"peer", &s.bucket, l.peer})
+  }
+  if l.global.rate > 0 {
+    buckets = append(buckets, limited{"global", &l.all, l.global})
+  }
+  // the limit we have to wait longest on
+  var over string
+  var wait time.Duration
+  for _, b := range buckets {
+    b.bucket.refill(now, b.limit)
+    if w := b.bucket.wait(b.limit); w > wait {
+      over = b.name
+      wait = w
+    }
+  }
+  // only track senders of messages the link limits let through so drops can't grow the map
+  if sender := m.Line().Prefix(); l.sender.rate > 0 && len(sender) > 0 && ! l.drops(wait) {
+    b := l.senderBucket(sender)
+    b.refill(now, l.sender)
+    if w := b.wait(l.sender); w > wait {
+      over = "sender"
+      wait = w
+    }
+    buckets = append(buckets, limited{"sender", &b.tokenBucket, l.sender})
+  }
+  action := l.action
+  if l.drops(wait) {
+    if action == rateLimitThrottle {
+      action = rateLimitDrop
+    }
+    l.count(over, action)
+    l.access.Unlock()
+    if action == rateLimitDisconnect {
+      return rateDisconnect
+    }
+    return rateDrop
+  }
+  // throttled messages borrow tokens they will earn while we wait
+  for _, b := range buckets {
+    b.bucket.tokens--
+  }
+  if wait > 0 {
+    l.count(over, action)
+  }
+  l.access.Unlock()
+  time.Sleep(wait)
+  return ratePass
+}
+
+// return true if a message that has to wait this long is not let through, call with access held
+func (l *rateLimiter) drops(wait time.Duration) bool {
+  return wait > 0 && (l.action != rateLimitThrottle || wait > maxThrottleWait)
+}
+
+// count a limited message, call with access held
+func (l *rateLimiter) count(limit, action string) {
+  k := limit + "_" + action
+  l.limited[k]++
+  rateLimitStats.Add(k, 1)
+}
+
+// get the bucket of a sender and mark it seen, call with access held
+// a new sender past maxSenderBuckets takes the bucket we saw longest ago
+func (l *rateLimiter) senderBucket(sender string) *senderBucket {
+  if e, ok := l.senders[sender]; ok {
+    l.seen.MoveToFront(e)
+    return e.Value.(*senderBucket)
+  }
+  if l.seen.Len() >= maxSenderBuckets {
+    l.forget(l.seen.Back())
+  }
+  b := &senderBucket{sender: sender}
+  l.senders[sender] = l.seen.PushFront(b)
+  return b
+}
+
+// drop a sender bucket, call with access held
+func (l *rateLimiter) forget(e *list.Element) {
+  delete(l.senders, e.Value.(*senderBucket).sender)
+  l.seen.Remove(e)
+}
+
+// forget senders we have not seen for senderBucketIdle, call with access held
+func (l *rateLimiter) sweep(now time.Time) {
+  for e := l.seen.Back(); e != nil && now.Sub(e.Value.(*senderBucket).last) > senderBucketIdle; e = l.seen.Back() {
+    l.forget(e)
+  }
+}
+
+// log what we limited since the last report
+func (l *rateLimiter) report(logger *slog.Logger) {
+  if l == nil {
+    return
+  }
+  l.access.Lock()
+  var args []interface{}
+  for k, n := range l.limited {
+    args = append(args, k, n)
+    delete(l.limited, k)
+  }
+  l.access.Unlock()
+  if len(args) > 0 {
+    logger.Warn("rate limited messages", args...)
+  }
+}
+
+// a router that rate limits messages from hubs
+type rateLimitedRouter interface {
+  rateLimiter() *rateLimiter
+}
+
+// get the rate limiter of a router, nil if it does not limit
+func routerLimiter(r Router) *rateLimiter {
+  if rl, ok := r.(rateLimitedRouter); ok {
+    return rl.rateLimiter()
+  }
+  return nil
+}
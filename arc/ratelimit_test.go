@@ -0,0 +1,124 @@
+//
+// ratelimit_test.go -- rate limiter tests
+//
+
+package arc
+
+import (
+  "fmt"
+  "testing"
+  "time"
+)
+
+// a plain line from a sender
+func testLineFrom(sender string) Message {
+  return urcMessageFromURCLine(":" + sender + "!user@host PRIVMSG #arcd :hi")
+}
+
+func TestRateLimitPeerBeforeSender(t *testing.T) {
+  l := newRateLimiter(LocalHubConfig{PeerRate: 60, PeerBurst: 1, SenderRate: 60, SenderBurst: 10})
+  src := l.source()
+  if v := src.admit(testLineFrom("nick0")); v != ratePass {
+    t.Fatalf("first message gave %v", v)
+  }
+  for i := 1; i < 100; i++ {
+    if v := src.admit(testLineFrom(fmt.Sprintf("nick%d", i))); v != rateDrop {
+      t.Fatalf("message %d over the peer limit gave %v", i, v)
+    }
+  }
+  if n := len(l.senders); n != 1 {
+    t.Errorf("tracking %d senders, want 1", n)
+  }
+  if n := l.limited["peer_drop"]; n != 99 {
+    t.Errorf("counted %d peer drops, want 99", n)
+  }
+}
+
+func TestRateLimitSender(t *testing.T) {
+  l := newRateLimiter(LocalHubConfig{SenderRate: 60, SenderBurst: 2})
+  src := l.source()
+  for i, want := range []rateVerdict{ratePass, ratePass, rateDrop} {
+    if v := src.admit(testLineFrom("nick")); v != want {
+      t.Errorf("message %d gave %v, want %v", i, v, want)
+    }
+  }
+  if v := src.admit(testLineFrom("other")); v != ratePass {
+    t.Errorf("other sender gave %v", v)
+  }
+  if n := l.limited["sender_drop"]; n != 1 {
+    t.Errorf("counted %d sender drops, want 1", n)
+  }
+}
+
+func TestRateLimitSenderUnparseable(t *testing.T) {
+  l := newRateLimiter(LocalHubConfig{SenderRate: 60, SenderBurst: 1})
+  src := l.source()
+  if v := src.admit(testLineFrom("nick")); v != ratePass {
+    t.Fatalf("first message gave %v", v)
+  }
+  // a line that is not valid irc still counts against the prefix it claims
+  if v := src.admit(urcMessageFromURCLine(":nick!user@host PRIV-MSG #arcd :hi")); v != rateDrop {
+    t.Errorf("unparseable line gave %v", v)
+  }
+}
+
+func TestRateLimitSenderCap(t *testing.T) {
+  l := newRateLimiter(LocalHubConfig{RateLimitAction: rateLimitDisconnect, SenderRate: 60, SenderBurst: 1})
+  src := l.source()
+  for i := 0; i < maxSenderBuckets; i++ {
+    if v := src.admit(testLineFrom(fmt.Sprintf("nick%d", i))); v != ratePass {
+      t.Fatalf("sender %d gave %v", i, v)
+    }
+  }
+  // nick1 is now the sender we saw longest ago
+  if v := src.admit(testLineFrom("nick0")); v != rateDisconnect {
+    t.Errorf("known sender over its limit gave %v", v)
+  }
+  if v := src.admit(testLineFrom("onetoomany")); v != ratePass {
+    t.Errorf("sender past the cap gave %v", v)
+  }
+  if n := len(l.senders); n != maxSenderBuckets || l.seen.Len() != maxSenderBuckets {
+    t.Errorf("tracking %d senders, want %d", n, maxSenderBuckets)
+  }
+  if _, ok := l.senders["nick1!user@host"]; ok {
+    t.Error("kept the sender seen longest ago")
+  }
+  if _, ok := l.senders["nick0!user@host"]; ! ok {
+    t.Error("forgot a recently seen sender")
+  }
+  // nick1 gets a full bucket again
+  if v := src.admit(testLineFrom("nick1")); v != ratePass {
+    t.Errorf("forgotten sender gave %v", v)
+  }
+  if n := l.limited["sender_disconnect"]; n != 1 {
+    t.Errorf("counted %d sender disconnects, want 1", n)
+  }
+}
+
+func TestRateLimitSenderIdle(t *testing.T) {
+  l := newRateLimiter(LocalHubConfig{SenderRate: 60})
+  src := l.source()
+  src.admit(testLineFrom("old"))
+  src.admit(testLineFrom("new"))
+  l.senders["old!user@host"].Value.(*senderBucket).last = time.Now().Add(-senderBucketIdle - time.Second)
+  src.admit(testLineFrom("new"))
+  if _, ok := l.senders["old!user@host"]; ok {
+    t.Error("kept an idle sender")
+  }
+  if _, ok := l.senders["new!user@host"]; ! ok {
+    t.Error("forgot a sender in use")
+  }
+}
+
+func TestRateLimitDisconnect(t *testing.T) {
+  l := newRateLimiter(LocalHubConfig{RateLimitAction: rateLimitDisconnect, GlobalRate: 60, GlobalBurst: 1})
+  if v := l.source().admit(testLineFrom("nick")); v != ratePass {
+    t.Fatalf("first message gave %v", v)
+  }
+  if v := l.source().admit(testLineFrom("nick")); v != rateDisconnect {
+    t.Errorf("message over the global limit gave %v", v)
+  }
+  if n := l.limited["global_disconnect"]; n != 1 {
+    t.Errorf("counted %d global disconnects, want 1", n)
+  }
+}
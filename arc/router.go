@@ -4,9 +4,19 @@
 package arc
 
 import (
-  "log"
+  "expvar"
+  "log/slog"
+  "os"
+  "sync"
+  "time"
 )
 
+// how often we log what the rate limiter dropped
+const rateLimitReportInterval = time.Minute
+
+// counts of messages the router did not relay by reason, see ServeMetrics
+var routerStats = expvar.NewMap("router")
+
 // generic router interface
 // routes messages as needed
 type Router interface {
@@ -37,16 +47,93 @@ func NewKadRouter(keyfile string) Router {
 type broadcastRouter struct {
   bc, ib chan Message
   filter bloomFilter
+  // limits on what hubs give us
+  limits *rateLimiter
+  // config that can change at runtime
+  live *routerLive
+  log *slog.Logger
+}
+
+// router state that can change at runtime
+type routerLive struct {
+  access sync.Mutex
+  cfg LocalHubConfig
+  // content filter rules, nil relays everything
+  rules *ruleSet
+}
+
+// get current local config
+func (r broadcastRouter) config() LocalHubConfig {
+  r.live.access.Lock()
+  defer r.live.access.Unlock()
+  return r.live.cfg
+}
+
+// get current filter rules
+func (r broadcastRouter) rules() *ruleSet {
+  r.live.access.Lock()
+  defer r.live.access.Unlock()
+  return r.live.rules
 }
 
 func (r broadcastRouter) InboundChan() chan Message {
   return r.ib
 }
 
+func (r broadcastRouter) rateLimiter() *rateLimiter {
+  return r.limits
+}
+
+// apply new rate limits and stamp difficulty, reload filter rules
+// keeps the rules we have if the rules file is broken
+func (r broadcastRouter) Reload(cfg Config) {
+  var rules *ruleSet
+  var err error
+  if len(cfg.Local.FilterRules) > 0 {
+    rules, err = loadFilterRules(cfg.Local.FilterRules)
+  }
+  r.live.access.Lock()
+  r.live.cfg = cfg.Local
+  if err == nil {
+    r.live.rules = rules
+  }
+  r.live.access.Unlock()
+  if err != nil {
+    r.log.Error("not reloading filter rules", "file", cfg.Local.FilterRules, "err", err)
+  }
+  r.limits.configure(cfg.Local)
+  r.log.Info("router config reloaded")
+}
+
+// return true if a message carries as much work as we want to relay it and is fresh enough for it to count
+func (r broadcastRouter) stamped(m Message) bool {
+  want := r.config().StampBits
+  if want <= 0 {
+    return true
+  }
+  if ! stampFresh(m, timeNow()) {
+    r.log.Debug("dropped message with stale stamp", "type", urcTypeName(m.Type()), "sent", m.Sent())
+    routerStats.Add("stale_stamp", 1)
+    return false
+  }
+  n := stampBits(m)
+  if n < want {
+    r.log.Debug("dropped message with weak stamp", "type", urcTypeName(m.Type()), "bits", n, "want", want)
+    routerStats.Add("weak_stamp", 1)
+    return false
+  }
+  return true
+}
+
 func (r broadcastRouter) Run(hubs ...Hub) {
-  log.Println("run router")
+  r.log.Info("run router")
+  ticker := time.NewTicker(rateLimitReportInterval)
+  defer ticker.Stop()
   for {
     select {
+    case <- ticker.C:
+      r.limits.report(r.log)
+      r.rules().report(r.log)
     case m, ok := <- r.bc:
       if ok {
         for _, h := range hubs {
@@ -58,23 +145,54 @@ func (r broadcastRouter) Run(hubs ...Hub) {
     case m, ok := <- r.ib:
       if ok {
         b := m.RawBytes()
-        if r.filter.Contains(b) {
+        if urcLinkLocal(m.Type()) {
+          // not for relaying
+        } else if r.filter.Contains(b) {
           // filter hit
+        } else if ! r.stamped(m) {
+          // not enough proof of work or too old to count
         } else {
           // filter pass
           r.filter.Add(b)
-          r.bc <- m
+          key := messageKey(m)
+          if lm, ok := m.(linkMessage); ok {
+            m = lm.Message
+          }
+          if r.rules().apply(m, key) == ruleDrop {
+            r.log.Debug("dropped message by filter rule", "type", urcTypeName(m.Type()), "len", len(b), "irc", m.Line())
+          } else {
+            r.log.Debug("relay message", "type", urcTypeName(m.Type()), "len", len(b), "irc", m.Line())
+            r.bc <- m
+          }
         }
       }
     }
   }
-  log.Println("router exited")
+  r.log.Info("router exited")
 }
 
 // create broadcast style message 'router'
-func NewBroadcastRouter(keyfile string) Router {
-  return broadcastRouter{
+// hubs rate limit what they give it using the limits in local config
+// messages are checked against the filter rules file from local config before relaying
+func NewBroadcastRouter(cfg LocalHubConfig, logger *slog.Logger) Router {
+  logger = logger.With("router", "broadcast")
+  r := broadcastRouter{
     bc: make(chan Message, 16),
     ib: make(chan Message, 32),
+    limits: newRateLimiter(cfg),
+    live: &routerLive{
+      cfg: cfg,
+    },
+    log: logger,
+  }
+  if len(cfg.FilterRules) > 0 {
+    var err error
+    r.live.rules, err = loadFilterRules(cfg.FilterRules)
+    if err != nil {
+      logger.Error("failed to load filter rules", "file", cfg.FilterRules, "err", err)
+      os.Exit(1)
+    }
+    logger.Info("loaded filter rules", "file", cfg.FilterRules, "rules", len(r.live.rules.rules))
   }
+  return r
 }
@@ -0,0 +1,243 @@
+//
+// rules.go -- content filter rules the router applies before relaying
+//
+// rules are checked in order and the first one that matches drops the message
+//
+
+package arc
+
+import (
+  "bytes"
+  "encoding/json"
+  "expvar"
+  "fmt"
+  "io/ioutil"
+  "log/slog"
+  "regexp"
+  "strings"
+)
+
+// what a rule does with messages it matches
+const (
+  // don't relay it
+  ruleDrop = "drop"
+)
+
+// hits of each filter rule by name, see ServeMetrics
+var filterStats = expvar.NewMap("filter")
+
+// one content filter rule, every field that is set has to match
+type FilterRule struct {
+  // name for logs and hit counters, defaults to Rules[n]
+  Name string
+  // message type: plain, sealed or 8 hex digits, empty matches any
+  // beacon and pex are accepted but never match, the router drops link local types before rules
+  Type string
+  // regular expressions on the irc line, its command, channel, nick and prefix
+  // only plain messages match these, lines that are not valid irc are split as best we can
+  // empty matches any message
+  Line string
+  Command string
+  Channel string
+  Nick string
+  Prefix string
+  // hex encoded identity keys, matches messages from tls hub links with one of them
+  Keys []string
+  // matches messages that did not come from a tls hub link with one of these keys
+  NotKeys []string
+  // only drop for now
+  Action string
+}
+
+// a filter rules file, json, toml or yaml by extension
+type FilterRules struct {
+  Rules []FilterRule
+}
+
+type filterRule struct {
+  FilterRule
+  line, command, channel, nick, prefix *regexp.Regexp
+  keys, notKeys map[string]bool
+}
+
+// compiled filter rules
+type ruleSet struct {
+  rules []*filterRule
+  // hits by rule name since the last report
+  hits map[string]uint64
+}
+
+// compile a regular expression from a rule, empty gives nil
+func (c *configChecker) regexp(field, expr string) *regexp.Regexp {
+  if len(expr) == 0 {
+    return nil
+  }
+  re, err := regexp.Compile(expr)
+  if err != nil {
+    c.fail(field, "%s", err)
+  }
+  return re
+}
+
+// check a list of hex encoded identity keys and make a set of them
+func (c *configChecker) keySet(field string, keys []string) map[string]bool {
+  if len(keys) == 0 {
+    return nil
+  }
+  set := make(map[string]bool)
+  for n, k := range keys {
+    k = strings.ToLower(strings.TrimSpace(k))
+    c.pubkey(fmt.Sprintf("%s[%d]", field, n), k)
+    set[k] = true
+  }
+  return set
+}
+
+// compile filter rules, returns ConfigErrors naming the bad fields
+func compileFilterRules(rules FilterRules) (rs *ruleSet, err error) {
+  c := new(configChecker)
+  rs = &ruleSet{
+    hits: make(map[string]uint64),
+  }
+  for n, r := range rules.Rules {
+    field := fmt.Sprintf("Rules[%d]", n)
+    if len(r.Name) == 0 {
+      r.Name = field
+    }
+    if len(r.Type) > 0 {
+      if _, ok := urcTypeByName(r.Type); ! ok {
+        c.fail(field + ".Type", "unknown message type %q, want plain, sealed or 8 hex digits", r.Type)
+      }
+    }
+    switch r.Action {
+    case ruleDrop:
+    default:
+      c.fail(field + ".Action", "unknown action %q, want drop", r.Action)
+    }
+    rs.rules = append(rs.rules, &filterRule{
+      FilterRule: r,
+      line: c.regexp(field + ".Line", r.Line),
+      command: c.regexp(field + ".Command", r.Command),
+      channel: c.regexp(field + ".Channel", r.Channel),
+      nick: c.regexp(field + ".Nick", r.Nick),
+      prefix: c.regexp(field + ".Prefix", r.Prefix),
+      keys: c.keySet(field + ".Keys", r.Keys),
+      notKeys: c.keySet(field + ".NotKeys", r.NotKeys),
+    })
+  }
+  if len(c.errs) > 0 {
+    rs = nil
+    err = c.errs
+  }
+  return
+}
+
+// load and compile a filter rules file
+func loadFilterRules(fname string) (rs *ruleSet, err error) {
+  var data []byte
+  data, err = ioutil.ReadFile(fname)
+  if err != nil {
+    return
+  }
+  format := configFormat(fname)
+  if format != "json" {
+    data, err = configToJSON(format, data)
+    if err != nil {
+      err = fmt.Errorf("%s: %s", fname, err.Error())
+      return
+    }
+  }
+  var rules FilterRules
+  dec := json.NewDecoder(bytes.NewReader(data))
+  dec.DisallowUnknownFields()
+  err = dec.Decode(&rules)
+  if err != nil {
+    if format != "json" {
+      data = nil
+    }
+    err = jsonError(fname, data, err)
+    return
+  }
+  rs, err = compileFilterRules(rules)
+  return
+}
+
+// return true if a regular expression from a rule matches, nil matches anything
+func ruleMatch(re *regexp.Regexp, s string) bool {
+  return re == nil || re.MatchString(s)
+}
+
+// return true if a rule matches a message that came from a link with identity key
+func (r *filterRule) match(m Message, key string) bool {
+  if len(r.Type) > 0 {
+    if t, _ := urcTypeByName(r.Type); t != m.Type() {
+      return false
+    }
+  }
+  if r.line != nil || r.command != nil || r.channel != nil || r.nick != nil || r.prefix != nil {
+    line := m.Line()
+    if len(line) == 0 || ! ruleMatch(r.line, string(line)) {
+      return false
+    }
+  }
+  if r.command != nil || r.channel != nil || r.nick != nil || r.prefix != nil {
+    irc := m.Line().parts()
+    if ! ruleMatch(r.command, irc.command) || ! ruleMatch(r.channel, irc.Channel()) || ! ruleMatch(r.nick, irc.Nick()) || ! ruleMatch(r.prefix, irc.prefix) {
+      return false
+    }
+  }
+  if r.keys != nil && ! r.keys[key] {
+    return false
+  }
+  if r.notKeys != nil && r.notKeys[key] {
+    return false
+  }
+  return true
+}
+
+// apply rules to a message, returns the action of the first rule that matches
+// empty if none do, nil rules relay everything
+func (rs *ruleSet) apply(m Message, key string) (action string) {
+  if rs == nil {
+    return
+  }
+  for _, r := range rs.rules {
+    if r.match(m, key) {
+      rs.hits[r.Name]++
+      filterStats.Add(r.Name, 1)
+      action = r.Action
+      return
+    }
+  }
+  return
+}
+
+// log rule hits since the last report
+func (rs *ruleSet) report(logger *slog.Logger) {
+  if rs == nil {
+    return
+  }
+  var args []interface{}
+  for k, n := range rs.hits {
+    args = append(args, k, n)
+    delete(rs.hits, k)
+  }
+  if len(args) > 0 {
+    logger.Info("filter rule hits", args...)
+  }
+}
+
+// an inbound message from a hub link with a known identity key
+type linkMessage struct {
+  Message
+  // hex encoded identity key of the link
+  key string
+}
+
+// identity key of the link a message came from, empty if we don't know it
+func messageKey(m Message) string {
+  if lm, ok := m.(linkMessage); ok {
+    return lm.key
+  }
+  return ""
+}
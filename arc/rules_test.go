@@ -0,0 +1,104 @@
+//
+// rules_test.go -- content filter rule tests
+//
+
+package arc
+
+import (
+  "io/ioutil"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func TestCompileFilterRulesActions(t *testing.T) {
+  tests := []struct {
+    rule FilterRule
+    field string
+  }{
+    {FilterRule{Line: "spam", Action: ruleDrop}, ""},
+    {FilterRule{Channel: "^#local$", Action: "local"}, "Rules[0].Action"},
+    {FilterRule{NotKeys: []string{strings.Repeat("ab", 32)}, Action: "tag"}, "Rules[0].Action"},
+    {FilterRule{Action: "keep"}, "Rules[0].Action"},
+    {FilterRule{Line: "(", Action: ruleDrop}, "Rules[0].Line"},
+    {FilterRule{Type: "secret", Action: ruleDrop}, "Rules[0].Type"},
+    {FilterRule{Keys: []string{"abcd"}, Action: ruleDrop}, "Rules[0].Keys[0]"},
+  }
+  for _, tt := range tests {
+    rs, err := compileFilterRules(FilterRules{Rules: []FilterRule{tt.rule}})
+    fields := configErrorFields(err)
+    if len(tt.field) == 0 && (err != nil || rs == nil) {
+      t.Errorf("%+v failed: %v", tt.rule, err)
+    }
+    if len(tt.field) > 0 && (len(fields) != 1 || fields[0] != tt.field) {
+      t.Errorf("%+v failed on %v, want %s", tt.rule, fields, tt.field)
+    }
+  }
+}
+
+func TestFilterRulesApply(t *testing.T) {
+  key := strings.Repeat("ab", 32)
+  rs, err := compileFilterRules(FilterRules{Rules: []FilterRule{
+    {Name: "spam", Line: "(?i)buy now", Action: ruleDrop},
+    {Name: "strangers", Channel: "^#friends$", NotKeys: []string{key}, Action: ruleDrop},
+    {Name: "beacons", Type: "beacon", Action: ruleDrop},
+  }})
+  if err != nil {
+    t.Fatal(err)
+  }
+  tests := []struct {
+    m Message
+    key string
+    action string
+  }{
+    {urcMessageFromURCLine(":nick!u@h PRIVMSG #arcd :BUY NOW"), "", ruleDrop},
+    {urcMessageFromURCLine(":nick!u@h PRIVMSG #arcd :hi"), "", ""},
+    {urcMessageFromURCLine(":nick!u@h PRIVMSG #friends :hi"), "", ruleDrop},
+    {urcMessageFromURCLine(":nick!u@h PRIVMSG #friends :hi"), key, ""},
+    {newURCMessage(urcTypeBeacon, nil), "", ruleDrop},
+    {newURCMessage(urcTypeSealed, []byte("BUY NOW")), "", ""},
+  }
+  for n, tt := range tests {
+    if action := rs.apply(tt.m, tt.key); action != tt.action {
+      t.Errorf("message %d gave %q, want %q", n, action, tt.action)
+    }
+  }
+  if rs.hits["spam"] != 1 || rs.hits["strangers"] != 1 || rs.hits["beacons"] != 1 {
+    t.Errorf("hits %v", rs.hits)
+  }
+  var none *ruleSet
+  if action := none.apply(tests[0].m, ""); action != "" {
+    t.Errorf("nil rules gave %q", action)
+  }
+}
+
+func TestFilterRulesUnparseable(t *testing.T) {
+  rs, err := compileFilterRules(FilterRules{Rules: []FilterRule{
+    {Name: "troll", Nick: "^troll$", Action: ruleDrop},
+    {Name: "quiet", Channel: "^#quiet$", Command: "^PRIVMSG$", Action: ruleDrop},
+  }})
+  if err != nil {
+    t.Fatal(err)
+  }
+  for _, line := range []string{
+    ":troll!user@host PRIVMSG #arcd :a\x00b",
+    ":troll!user@host PRIV-MSG #arcd :hi",
+    ":nick!user@host PRIVMSG #quiet :" + strings.Repeat("a", maxIRCLineLen),
+  } {
+    if action := rs.apply(urcMessageFromURCLine(line), ""); action != ruleDrop {
+      t.Errorf("%q gave %q", line, action)
+    }
+  }
+}
+
+// rules files from when tag was planned fail instead of dropping the field
+func TestLoadFilterRulesUnknownField(t *testing.T) {
+  fname := filepath.Join(t.TempDir(), "rules.json")
+  err := ioutil.WriteFile(fname, []byte(`{"Rules": [{"Line": "spam", "Action": "drop", "Tag": "spam"}]}`), 0600)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err = loadFilterRules(fname); err == nil || ! strings.Contains(err.Error(), "Tag") {
+    t.Errorf("loaded rules with an unknown field: %v", err)
+  }
+}
@@ -0,0 +1,378 @@
+//
+// sam.go -- i2p sam v3 transport
+//
+
+package arc
+
+import (
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/base32"
+  "encoding/base64"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "log/slog"
+  "net"
+  "strings"
+  "sync"
+)
+
+// i2p uses its own base64 alphabet
+var i2pB64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-~")
+
+// lowercase unpadded base32 for .b32.i2p addresses
+var i2pB32 = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// longest line we accept from the sam bridge
+const samMaxLine = 8192
+
+// signature type for destinations we create, EdDSA_SHA512_Ed25519
+const samSignatureType = 7
+
+// a sam reply line split into its parts
+type samReply struct {
+  // first two words i.e. "HELLO REPLY"
+  topic string
+  // key=value pairs
+  args map[string]string
+}
+
+// result of this reply
+func (r samReply) result() string {
+  return r.args["RESULT"]
+}
+
+// error if result is not OK
+func (r samReply) err() error {
+  if r.result() == "OK" {
+    return nil
+  }
+  msg := r.args["MESSAGE"]
+  if len(msg) > 0 {
+    return fmt.Errorf("sam %s: %s %s", r.topic, r.result(), msg)
+  }
+  return fmt.Errorf("sam %s: %s", r.topic, r.result())
+}
+
+// read a single line without reading past it
+// connections are handed off as raw streams after the reply line so we can't buffer
+func samReadLine(r io.Reader) (line string, err error) {
+  var b [1]byte
+  var buff []byte
+  for len(buff) < samMaxLine {
+    _, err = io.ReadFull(r, b[:])
+    if err != nil {
+      return
+    }
+    if b[0] == '\n' {
+      line = string(buff)
+      return
+    }
+    buff = append(buff, b[0])
+  }
+  err = errors.New("sam line too long")
+  return
+}
+
+// parse a sam reply line
+func parseSAMReply(line string) (reply samReply, err error) {
+  reply.args = make(map[string]string)
+  var words []string
+  var word []byte
+  quoted := false
+  for i := 0; i < len(line); i++ {
+    c := line[i]
+    if c == '"' {
+      quoted = ! quoted
+    } else if c == ' ' && ! quoted {
+      if len(word) > 0 {
+        words = append(words, string(word))
+        word = nil
+      }
+    } else {
+      word = append(word, c)
+    }
+  }
+  if len(word) > 0 {
+    words = append(words, string(word))
+  }
+  if len(words) < 2 {
+    err = errors.New("short sam reply: "+line)
+    return
+  }
+  reply.topic = words[0] + " " + words[1]
+  for _, w := range words[2:] {
+    idx := strings.Index(w, "=")
+    if idx > 0 {
+      reply.args[w[:idx]] = w[idx+1:]
+    } else {
+      reply.args[w] = ""
+    }
+  }
+  return
+}
+
+// send a command and read the reply
+func samCommand(conn net.Conn, cmd string) (reply samReply, err error) {
+  _, err = io.WriteString(conn, cmd + "\n")
+  if err == nil {
+    var line string
+    line, err = samReadLine(conn)
+    if err == nil {
+      reply, err = parseSAMReply(line)
+    }
+  }
+  return
+}
+
+// connect to the sam bridge and say hello
+func samConnect(bridge string) (conn net.Conn, err error) {
+  conn, err = net.Dial("tcp", bridge)
+  if err == nil {
+    var reply samReply
+    reply, err = samCommand(conn, "HELLO VERSION MIN=3.0 MAX=3.1")
+    if err == nil {
+      err = reply.err()
+    }
+    if err != nil {
+      conn.Close()
+      conn = nil
+    }
+  }
+  return
+}
+
+// a sam streaming session
+// lives as long as the control connection stays open
+type samSession struct {
+  // sam bridge address
+  bridge string
+  // session id
+  id string
+  // control connection
+  ctl net.Conn
+  // our public destination in i2p base64
+  dest string
+}
+
+// create a new streaming session on a sam bridge
+// if keyfile is empty the destination is transient
+// otherwise the destination is loaded from keyfile or generated and saved to it
+func newSAMSession(bridge, keyfile string, logger *slog.Logger) (s *samSession, err error) {
+  var priv string
+  if len(keyfile) > 0 {
+    priv, err = samLoadDestination(bridge, keyfile, logger)
+    if err != nil {
+      return
+    }
+  } else {
+    priv = "TRANSIENT"
+  }
+  var id [8]byte
+  io.ReadFull(rand.Reader, id[:])
+  s = &samSession{
+    bridge: bridge,
+    id: "arcd-" + hex.EncodeToString(id[:]),
+  }
+  s.ctl, err = samConnect(bridge)
+  if err != nil {
+    return
+  }
+  var reply samReply
+  reply, err = samCommand(s.ctl, fmt.Sprintf("SESSION CREATE STYLE=STREAM ID=%s DESTINATION=%s SIGNATURE_TYPE=%d", s.id, priv, samSignatureType))
+  if err == nil {
+    err = reply.err()
+  }
+  if err == nil {
+    // find our public destination
+    s.dest, err = s.lookup("ME")
+  }
+  if err != nil {
+    s.ctl.Close()
+  }
+  return
+}
+
+// load a persistent private destination, generate one if it does not exist
+func samLoadDestination(bridge, keyfile string, logger *slog.Logger) (priv string, err error) {
+  if checkFile(keyfile) {
+    var data []byte
+    data, err = ioutil.ReadFile(keyfile)
+    if err == nil {
+      priv = strings.TrimSpace(string(data))
+    }
+    return
+  }
+  var conn net.Conn
+  conn, err = samConnect(bridge)
+  if err != nil {
+    return
+  }
+  defer conn.Close()
+  var reply samReply
+  reply, err = samCommand(conn, fmt.Sprintf("DEST GENERATE SIGNATURE_TYPE=%d", samSignatureType))
+  if _, failed := reply.args["RESULT"]; err == nil && failed {
+    // DEST REPLY has no result unless generating failed
+    err = reply.err()
+  }
+  if err == nil {
+    priv = reply.args["PRIV"]
+    if reply.topic != "DEST REPLY" || len(priv) == 0 {
+      err = errors.New("sam did not generate a destination")
+    } else {
+      logger.Info("saving new i2p destination", "file", keyfile)
+      err = ioutil.WriteFile(keyfile, []byte(priv), 0600)
+    }
+  }
+  return
+}
+
+// look up a name on the control connection
+func (s *samSession) lookup(name string) (dest string, err error) {
+  var reply samReply
+  reply, err = samCommand(s.ctl, "NAMING LOOKUP NAME=" + name)
+  if err == nil {
+    err = reply.err()
+  }
+  if err == nil {
+    dest = reply.args["VALUE"]
+  }
+  return
+}
+
+// get our .b32.i2p address
+func (s *samSession) Base32() string {
+  d, err := i2pB64.DecodeString(s.dest)
+  if err != nil {
+    return ""
+  }
+  h := sha256.Sum256(d)
+  return i2pB32.EncodeToString(h[:]) + ".b32.i2p"
+}
+
+// open a stream to a .i2p or .b32.i2p name
+func (s *samSession) Dial(name string) (conn Connection, err error) {
+  // use a fresh connection for lookup, the control connection is not safe to share
+  var c net.Conn
+  c, err = samConnect(s.bridge)
+  if err != nil {
+    return
+  }
+  var reply samReply
+  reply, err = samCommand(c, "NAMING LOOKUP NAME=" + name)
+  if err == nil {
+    err = reply.err()
+  }
+  if err == nil {
+    reply, err = samCommand(c, fmt.Sprintf("STREAM CONNECT ID=%s DESTINATION=%s SILENT=false", s.id, reply.args["VALUE"]))
+    if err == nil {
+      err = reply.err()
+    }
+  }
+  if err == nil {
+    conn = c
+  } else {
+    c.Close()
+  }
+  return
+}
+
+// wait for an inbound stream
+func (s *samSession) Accept() (conn Connection, err error) {
+  var c net.Conn
+  c, err = samConnect(s.bridge)
+  if err != nil {
+    return
+  }
+  var reply samReply
+  reply, err = samCommand(c, fmt.Sprintf("STREAM ACCEPT ID=%s SILENT=false", s.id))
+  if err == nil {
+    err = reply.err()
+  }
+  if err == nil {
+    // first line is the remote destination
+    _, err = samReadLine(c)
+  }
+  if err == nil {
+    conn = c
+  } else {
+    c.Close()
+  }
+  return
+}
+
+func (s *samSession) Close() error {
+  return s.ctl.Close()
+}
+
+// sam sessions by bridge address
+type samSessions struct {
+  access sync.Mutex
+  sessions map[string]*samSession
+  // our persistent session, nil if we don't accept i2p inbound
+  local *samSession
+  log *slog.Logger
+}
+
+// get a session on a bridge, create a transient one if we don't have one
+func (p *samSessions) get(bridge string) (s *samSession, err error) {
+  p.access.Lock()
+  defer p.access.Unlock()
+  s = p.sessions[bridge]
+  if s == nil {
+    p.log.Info("creating i2p session", "bridge", bridge)
+    s, err = newSAMSession(bridge, "", p.log)
+    if err == nil {
+      p.sessions[bridge] = s
+    }
+  }
+  return
+}
+
+// get our persistent session, nil if we don't accept i2p inbound
+func (p *samSessions) Local() (s *samSession) {
+  p.access.Lock()
+  s = p.local
+  p.access.Unlock()
+  return
+}
+
+// drop a session that stopped working
+func (p *samSessions) drop(s *samSession) {
+  p.access.Lock()
+  if p.sessions[s.bridge] == s && s != p.local {
+    delete(p.sessions, s.bridge)
+    s.Close()
+  }
+  p.access.Unlock()
+}
+
+// dial an i2p hub through a sam bridge
+func (p *samSessions) Dial(bridge, name string) (conn Connection, err error) {
+  var s *samSession
+  s, err = p.get(bridge)
+  if err == nil {
+    conn, err = s.Dial(name)
+    if err != nil && strings.Contains(err.Error(), "INVALID_ID") {
+      // bridge forgot our session
+      p.drop(s)
+    }
+  }
+  return
+}
+
+// create our persistent session for accepting i2p inbound
+func (p *samSessions) Listen(bridge, keyfile string) (s *samSession, err error) {
+  s, err = newSAMSession(bridge, keyfile, p.log)
+  if err == nil {
+    p.access.Lock()
+    p.sessions[bridge] = s
+    p.local = s
+    p.access.Unlock()
+    p.log.Info("i2p session ready", "dest", s.Base32())
+  }
+  return
+}
@@ -0,0 +1,497 @@
+//
+// sam_test.go -- tests for the i2p sam v3 transport against a fake sam bridge
+//
+
+package arc
+
+import (
+  "bufio"
+  "crypto/sha256"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "log/slog"
+  "net"
+  "path/filepath"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+// length of the public destinations our fake bridge makes
+const fakeSAMDestLen = 387
+
+// an in process sam v3 bridge that streams between its own sessions
+type fakeSAM struct {
+  t *testing.T
+  ln net.Listener
+  access sync.Mutex
+  // public destination of each session by id
+  sessions map[string]string
+  // .i2p names we resolve
+  names map[string]string
+  // connections waiting in STREAM ACCEPT by destination
+  accepting map[string]chan net.Conn
+  // destinations made so far
+  made int
+  // commands we got, in order
+  commands []string
+  // results to give instead of OK by command i.e. "SESSION CREATE": "DUPLICATED_ID"
+  fail map[string]string
+}
+
+// start a fake sam bridge, stopped when the test ends
+func newFakeSAM(t *testing.T) *fakeSAM {
+  ln, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  f := &fakeSAM{
+    t: t,
+    ln: ln,
+    sessions: make(map[string]string),
+    names: make(map[string]string),
+    accepting: make(map[string]chan net.Conn),
+    fail: make(map[string]string),
+  }
+  t.Cleanup(func() { ln.Close() })
+  go func() {
+    for {
+      conn, err := ln.Accept()
+      if err != nil {
+        return
+      }
+      go f.serve(conn)
+    }
+  }()
+  return f
+}
+
+func (f *fakeSAM) addr() string {
+  return f.ln.Addr().String()
+}
+
+// make a new destination, the private key is the public destination with 32 more bytes
+func (f *fakeSAM) newDest() (dest, priv string) {
+  f.made++
+  b := make([]byte, fakeSAMDestLen + 32)
+  for i := range b {
+    b[i] = byte(f.made)
+  }
+  return i2pB64.EncodeToString(b[:fakeSAMDestLen]), i2pB64.EncodeToString(b)
+}
+
+// public destination of a private one
+func fakeSAMPublic(priv string) string {
+  b, _ := i2pB64.DecodeString(priv)
+  return i2pB64.EncodeToString(b[:fakeSAMDestLen])
+}
+
+// sent commands that start with prefix
+func (f *fakeSAM) sent(prefix string) (cmds []string) {
+  f.access.Lock()
+  defer f.access.Unlock()
+  for _, cmd := range f.commands {
+    if strings.HasPrefix(cmd, prefix) {
+      cmds = append(cmds, cmd)
+    }
+  }
+  return
+}
+
+// reply to a command, returns false if we should hang up
+func (f *fakeSAM) reply(conn net.Conn, topic, result string, args ...string) bool {
+  line := topic + " RESULT=" + result
+  if len(args) > 0 {
+    line += " " + strings.Join(args, " ")
+  }
+  _, err := io.WriteString(conn, line + "\n")
+  return err == nil && result == "OK"
+}
+
+func (f *fakeSAM) serve(conn net.Conn) {
+  r := bufio.NewReader(conn)
+  // session made on this connection, NAMING LOOKUP NAME=ME gives its destination
+  var session string
+  for {
+    line, err := r.ReadString('\n')
+    if err != nil {
+      conn.Close()
+      return
+    }
+    line = strings.TrimSuffix(line, "\n")
+    cmd, err := parseSAMReply(line)
+    if err != nil {
+      f.t.Errorf("fake sam got bad command %q: %s", line, err)
+      conn.Close()
+      return
+    }
+    f.access.Lock()
+    f.commands = append(f.commands, line)
+    result := "OK"
+    if fail, ok := f.fail[cmd.topic]; ok {
+      result = fail
+    }
+    f.access.Unlock()
+    ok := true
+    switch cmd.topic {
+    case "HELLO VERSION":
+      ok = f.reply(conn, "HELLO REPLY", result, "VERSION=3.1")
+    case "DEST GENERATE":
+      f.access.Lock()
+      dest, priv := f.newDest()
+      f.access.Unlock()
+      if result == "OK" {
+        ok = f.reply(conn, "DEST REPLY", result, "PUB=" + dest, "PRIV=" + priv)
+      } else {
+        ok = f.reply(conn, "DEST REPLY", result)
+      }
+    case "SESSION CREATE":
+      id := cmd.args["ID"]
+      f.access.Lock()
+      if _, exists := f.sessions[id]; exists && result == "OK" {
+        result = "DUPLICATED_ID"
+      }
+      if result == "OK" {
+        var dest string
+        if cmd.args["DESTINATION"] == "TRANSIENT" {
+          dest, _ = f.newDest()
+        } else {
+          dest = fakeSAMPublic(cmd.args["DESTINATION"])
+        }
+        f.sessions[id] = dest
+        session = id
+      }
+      f.access.Unlock()
+      ok = f.reply(conn, "SESSION STATUS", result)
+    case "NAMING LOOKUP":
+      name := cmd.args["NAME"]
+      f.access.Lock()
+      value, known := f.names[name]
+      if name == "ME" {
+        value, known = f.sessions[session]
+      }
+      f.access.Unlock()
+      if ! known && result == "OK" {
+        result = "KEY_NOT_FOUND"
+      }
+      ok = f.reply(conn, "NAMING REPLY", result, "NAME=" + name, "VALUE=" + value)
+    case "STREAM ACCEPT":
+      f.access.Lock()
+      dest, known := f.sessions[cmd.args["ID"]]
+      f.access.Unlock()
+      if ! known && result == "OK" {
+        result = "INVALID_ID"
+      }
+      if f.reply(conn, "STREAM STATUS", result) {
+        // the connecting side takes over this connection
+        f.accepted(dest) <- conn
+        return
+      }
+      ok = false
+    case "STREAM CONNECT":
+      f.access.Lock()
+      from, known := f.sessions[cmd.args["ID"]]
+      f.access.Unlock()
+      if ! known && result == "OK" {
+        result = "INVALID_ID"
+      }
+      var peer net.Conn
+      if result == "OK" {
+        select {
+        case peer = <- f.accepted(cmd.args["DESTINATION"]):
+        case <- time.After(5 * time.Second):
+          result = "CANT_REACH_PEER"
+        }
+      }
+      if f.reply(conn, "STREAM STATUS", result) {
+        // tell the accepting side who we are then stream between them
+        io.WriteString(peer, from + "\n")
+        go func() {
+          io.Copy(peer, r)
+          peer.Close()
+        }()
+        io.Copy(conn, peer)
+        conn.Close()
+        return
+      }
+      ok = false
+    default:
+      ok = f.reply(conn, cmd.topic, "I2P_ERROR", "MESSAGE=\"unknown command\"")
+    }
+    if ! ok {
+      conn.Close()
+      return
+    }
+  }
+}
+
+// connections in STREAM ACCEPT on a destination
+func (f *fakeSAM) accepted(dest string) chan net.Conn {
+  f.access.Lock()
+  defer f.access.Unlock()
+  c, ok := f.accepting[dest]
+  if ! ok {
+    c = make(chan net.Conn, 8)
+    f.accepting[dest] = c
+  }
+  return c
+}
+
+// a logger for tests that says nothing
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestParseSAMReply(t *testing.T) {
+  tests := []struct {
+    line, topic string
+    args map[string]string
+    bad bool
+  }{
+    {line: "HELLO REPLY RESULT=OK VERSION=3.1", topic: "HELLO REPLY", args: map[string]string{"RESULT": "OK", "VERSION": "3.1"}},
+    {line: "SESSION STATUS RESULT=I2P_ERROR MESSAGE=\"no tunnels yet\"", topic: "SESSION STATUS", args: map[string]string{"RESULT": "I2P_ERROR", "MESSAGE": "no tunnels yet"}},
+    {line: "STREAM STATUS  RESULT=OK  SILENT", topic: "STREAM STATUS", args: map[string]string{"RESULT": "OK", "SILENT": ""}},
+    {line: "NAMING REPLY RESULT=OK VALUE=a=b", topic: "NAMING REPLY", args: map[string]string{"RESULT": "OK", "VALUE": "a=b"}},
+    {line: "HELLO", bad: true},
+    {line: "", bad: true},
+  }
+  for _, tt := range tests {
+    reply, err := parseSAMReply(tt.line)
+    if tt.bad {
+      if err == nil {
+        t.Errorf("parseSAMReply(%q) did not fail", tt.line)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("parseSAMReply(%q): %s", tt.line, err)
+      continue
+    }
+    if reply.topic != tt.topic || len(reply.args) != len(tt.args) {
+      t.Errorf("parseSAMReply(%q) = %q %v", tt.line, reply.topic, reply.args)
+      continue
+    }
+    for k, v := range tt.args {
+      if reply.args[k] != v {
+        t.Errorf("parseSAMReply(%q) %s=%q, want %q", tt.line, k, reply.args[k], v)
+      }
+    }
+  }
+}
+
+func TestSAMReadLine(t *testing.T) {
+  r := strings.NewReader("STREAM STATUS RESULT=OK\nraw stream")
+  line, err := samReadLine(r)
+  if err != nil || line != "STREAM STATUS RESULT=OK" {
+    t.Fatalf("samReadLine gave %q %v", line, err)
+  }
+  // nothing past the line was read
+  rest, _ := ioutil.ReadAll(r)
+  if string(rest) != "raw stream" {
+    t.Errorf("samReadLine read past the line, left %q", rest)
+  }
+  _, err = samReadLine(strings.NewReader(strings.Repeat("a", samMaxLine + 1)))
+  if err == nil {
+    t.Error("samReadLine took an endless line")
+  }
+}
+
+func TestSAMSession(t *testing.T) {
+  f := newFakeSAM(t)
+  s, err := newSAMSession(f.addr(), "", testLogger)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s.Close()
+  if hello := f.sent("HELLO"); len(hello) != 1 || hello[0] != "HELLO VERSION MIN=3.0 MAX=3.1" {
+    t.Errorf("sent %q", hello)
+  }
+  want := fmt.Sprintf("SESSION CREATE STYLE=STREAM ID=%s DESTINATION=TRANSIENT SIGNATURE_TYPE=%d", s.id, samSignatureType)
+  if create := f.sent("SESSION CREATE"); len(create) != 1 || create[0] != want {
+    t.Errorf("sent %q, want %q", create, want)
+  }
+  f.access.Lock()
+  dest := f.sessions[s.id]
+  f.access.Unlock()
+  if s.dest != dest {
+    t.Fatalf("session destination is %q, want %q", s.dest, dest)
+  }
+  d, _ := i2pB64.DecodeString(dest)
+  h := sha256.Sum256(d)
+  if b32 := s.Base32(); b32 != i2pB32.EncodeToString(h[:]) + ".b32.i2p" || len(b32) != 52 + len(".b32.i2p") {
+    t.Errorf("Base32 gave %q", b32)
+  }
+}
+
+// a persistent destination is generated once then loaded
+func TestSAMSessionKeyfile(t *testing.T) {
+  f := newFakeSAM(t)
+  keyfile := filepath.Join(t.TempDir(), "i2p.key")
+  first, err := newSAMSession(f.addr(), keyfile, testLogger)
+  if err != nil {
+    t.Fatal(err)
+  }
+  first.Close()
+  priv, err := ioutil.ReadFile(keyfile)
+  if err != nil {
+    t.Fatal(err)
+  }
+  second, err := newSAMSession(f.addr(), keyfile, testLogger)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer second.Close()
+  if n := len(f.sent("DEST GENERATE")); n != 1 {
+    t.Errorf("generated %d destinations, want 1", n)
+  }
+  if first.dest != second.dest || first.dest != fakeSAMPublic(string(priv)) {
+    t.Error("loaded a different destination than we saved")
+  }
+  for _, create := range f.sent("SESSION CREATE") {
+    if ! strings.Contains(create, " DESTINATION=" + string(priv) + " ") {
+      t.Errorf("session not created with the saved destination: %q", create)
+    }
+  }
+}
+
+// stream between two of our own sessions through the bridge
+func TestSAMStream(t *testing.T) {
+  f := newFakeSAM(t)
+  listener := &samSessions{sessions: make(map[string]*samSession), log: testLogger}
+  local, err := listener.Listen(f.addr(), "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer local.Close()
+  if listener.Local() != local {
+    t.Fatal("Listen did not make a local session")
+  }
+  f.access.Lock()
+  f.names["hub.i2p"] = local.dest
+  f.access.Unlock()
+  accepted := make(chan Connection, 1)
+  go func() {
+    conn, err := local.Accept()
+    if err != nil {
+      t.Error(err)
+    }
+    accepted <- conn
+  }()
+  dialer := &samSessions{sessions: make(map[string]*samSession), log: testLogger}
+  out, err := dialer.Dial(f.addr(), "hub.i2p")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer out.Close()
+  in := <- accepted
+  if in == nil {
+    t.FailNow()
+  }
+  defer in.Close()
+  exchange := []struct {
+    from, to Connection
+    msg string
+  }{
+    {out, in, "ping"},
+    {in, out, "pong"},
+  }
+  for _, e := range exchange {
+    _, err = io.WriteString(e.from, e.msg)
+    if err != nil {
+      t.Fatal(err)
+    }
+    got := make([]byte, len(e.msg))
+    _, err = io.ReadFull(e.to, got)
+    if err != nil || string(got) != e.msg {
+      t.Fatalf("read %q %v, want %q", got, err, e.msg)
+    }
+  }
+  if connect := f.sent("STREAM CONNECT"); len(connect) != 1 || ! strings.Contains(connect[0], "DESTINATION=" + local.dest) {
+    t.Errorf("sent %q", connect)
+  }
+}
+
+func TestSAMErrors(t *testing.T) {
+  tests := []struct {
+    name string
+    // command to fail and the result to fail it with
+    command, result string
+    // what to do against the bridge
+    call func(f *fakeSAM) error
+  }{
+    {"hello", "HELLO VERSION", "NOVERSION", func(f *fakeSAM) error {
+      _, err := newSAMSession(f.addr(), "", testLogger)
+      return err
+    }},
+    {"session create", "SESSION CREATE", "DUPLICATED_DEST", func(f *fakeSAM) error {
+      _, err := newSAMSession(f.addr(), "", testLogger)
+      return err
+    }},
+    {"dest generate", "DEST GENERATE", "I2P_ERROR", func(f *fakeSAM) error {
+      keyfile := filepath.Join(f.t.TempDir(), "i2p.key")
+      _, err := newSAMSession(f.addr(), keyfile, testLogger)
+      if checkFile(keyfile) {
+        f.t.Error("saved a destination the bridge did not generate")
+      }
+      return err
+    }},
+    {"unknown name", "", "", func(f *fakeSAM) error {
+      s, err := newSAMSession(f.addr(), "", testLogger)
+      if err != nil {
+        return nil
+      }
+      defer s.Close()
+      _, err = s.Dial("nowhere.i2p")
+      return err
+    }},
+    {"stream connect", "STREAM CONNECT", "CANT_REACH_PEER", func(f *fakeSAM) error {
+      s, err := newSAMSession(f.addr(), "", testLogger)
+      if err != nil {
+        return nil
+      }
+      defer s.Close()
+      f.access.Lock()
+      f.names["hub.i2p"] = s.dest
+      f.access.Unlock()
+      _, err = s.Dial("hub.i2p")
+      return err
+    }},
+    {"stream accept", "STREAM ACCEPT", "I2P_ERROR", func(f *fakeSAM) error {
+      s, err := newSAMSession(f.addr(), "", testLogger)
+      if err != nil {
+        return nil
+      }
+      defer s.Close()
+      _, err = s.Accept()
+      return err
+    }},
+    {"forgotten session", "STREAM CONNECT", "INVALID_ID", func(f *fakeSAM) error {
+      p := &samSessions{sessions: make(map[string]*samSession), log: testLogger}
+      f.access.Lock()
+      f.names["hub.i2p"] = "somewhere"
+      f.access.Unlock()
+      _, err := p.Dial(f.addr(), "hub.i2p")
+      p.access.Lock()
+      if p.sessions[f.addr()] != nil {
+        f.t.Error("kept a session the bridge forgot")
+      }
+      p.access.Unlock()
+      return err
+    }},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      f := newFakeSAM(t)
+      if len(tt.command) > 0 {
+        f.fail[tt.command] = tt.result
+      }
+      err := tt.call(f)
+      if err == nil {
+        t.Fatal("did not fail")
+      }
+      if len(tt.result) > 0 && ! strings.Contains(err.Error(), tt.result) {
+        t.Errorf("error %q does not say %s", err, tt.result)
+      }
+    })
+  }
+}
@@ -0,0 +1,57 @@
+//
+// stamp.go -- hashcash style proof of work stamps on urc messages
+//
+// the 8 random header bytes are the nonce, a message is stamped with n bits if
+// sha256(header || sha256(body)) starts with n zero bits
+// the hash covers the timestamp, type and body so a stamp can't be moved to
+// another message and hubs need nothing but the message to check it
+// stamps are only good within stampMaxAge of their timestamp so they can't be
+// made ahead of time or replayed once the seen filter forgets them
+//
+
+package arc
+
+import (
+  "crypto/sha256"
+  "encoding/binary"
+  "math/bits"
+)
+
+// most bits of work we will ask for
+const maxStampBits = 32
+
+// seconds a stamped message may be away from our clock, either way
+const stampMaxAge = 5 * 60
+
+// hash a stamp is checked against
+func stampHash(hdr urcHeader, bodyHash [32]byte) [32]byte {
+  var b [len(urcHeader{}) + 32]byte
+  copy(b[:], hdr[:])
+  copy(b[len(hdr):], bodyHash[:])
+  return sha256.Sum256(b[:])
+}
+
+// number of leading zero bits in a hash
+func zeroBits(h [32]byte) (n int) {
+  for i := 0; i < len(h); i += 8 {
+    z := bits.LeadingZeros64(binary.BigEndian.Uint64(h[i:]))
+    n += z
+    if z < 64 {
+      break
+    }
+  }
+  return
+}
+
+// how many bits of work a message carries
+func stampBits(m Message) int {
+  b := m.RawBytes()
+  var hdr urcHeader
+  copy(hdr[:], b)
+  return zeroBits(stampHash(hdr, sha256.Sum256(b[len(hdr):])))
+}
+
+// return true if a message was sent within stampMaxAge of now, in taia64 seconds as timeNow gives
+func stampFresh(m Message, now uint64) bool {
+  return sentWithin(m, now, stampMaxAge)
+}
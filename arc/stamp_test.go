@@ -0,0 +1,113 @@
+//
+// stamp_test.go -- proof of work stamp tests
+//
+
+package arc
+
+import (
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/binary"
+  "io"
+  "testing"
+)
+
+// stamp a message with at least n bits of work by picking its random header bytes
+func mintStamp(m *urcMessage, n int) {
+  bodyHash := sha256.Sum256(m.body)
+  io.ReadFull(rand.Reader, m.hdr[18:])
+  nonce := binary.BigEndian.Uint64(m.hdr[18:])
+  for {
+    binary.BigEndian.PutUint64(m.hdr[18:], nonce)
+    if zeroBits(stampHash(m.hdr, bodyHash)) >= n {
+      return
+    }
+    nonce++
+  }
+}
+
+func TestMintStamp(t *testing.T) {
+  for _, n := range []int{0, 1, 8, 12} {
+    m := urcMessageFromURCLine(":nick!user@host PRIVMSG #arcd :hi")
+    mintStamp(&m, n)
+    if got := stampBits(m); got < n {
+      t.Errorf("minted %d bits, want at least %d", got, n)
+    }
+  }
+}
+
+func TestStampCoversMessage(t *testing.T) {
+  m := urcMessageFromURCLine(":nick!user@host PRIVMSG #arcd :hi")
+  mintStamp(&m, 16)
+  moved := m
+  moved.body = []byte(":nick!user@host PRIVMSG #arcd :bye")
+  if stampBits(moved) >= 16 {
+    t.Error("stamp still holds on another body")
+  }
+  moved = m
+  moved.hdr[2]++
+  if stampBits(moved) >= 16 {
+    t.Error("stamp still holds with another timestamp")
+  }
+}
+
+func TestZeroBits(t *testing.T) {
+  var h [32]byte
+  if n := zeroBits(h); n != 256 {
+    t.Errorf("all zero hash has %d zero bits", n)
+  }
+  h[0] = 0x10
+  if n := zeroBits(h); n != 3 {
+    t.Errorf("got %d zero bits, want 3", n)
+  }
+  h[0] = 0
+  h[9] = 0x80
+  if n := zeroBits(h); n != 72 {
+    t.Errorf("got %d zero bits, want 72", n)
+  }
+}
+
+func TestStampFresh(t *testing.T) {
+  now := timeNow()
+  tests := []struct {
+    name string
+    sent uint64
+    fresh bool
+  }{
+    {"now", now, true},
+    {"a minute ago", now - 60, true},
+    {"at the edge", now - stampMaxAge, true},
+    {"too old", now - stampMaxAge - 1, false},
+    {"a minute ahead", now + 60, true},
+    {"too far ahead", now + stampMaxAge + 1, false},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      m := urcMessageFromURCLine(":nick!user@host PRIVMSG #arcd :hi")
+      binary.BigEndian.PutUint64(m.hdr[2:10], tt.sent)
+      if got := stampFresh(m, now); got != tt.fresh {
+        t.Errorf("fresh is %v, want %v", got, tt.fresh)
+      }
+    })
+  }
+}
+
+// a stamp made long ago does not count however much work it has
+func TestRouterStaleStamp(t *testing.T) {
+  r := broadcastRouter{
+    live: &routerLive{
+      cfg: LocalHubConfig{StampBits: 8},
+    },
+    log: testLogger,
+  }
+  m := urcMessageFromURCLine(":nick!user@host PRIVMSG #arcd :hi")
+  mintStamp(&m, 8)
+  if ! r.stamped(m) {
+    t.Error("dropped a fresh stamped message")
+  }
+  binary.BigEndian.PutUint64(m.hdr[2:10], timeNow() - 2 * stampMaxAge)
+  mintStamp(&m, 8)
+  if r.stamped(m) {
+    t.Error("relayed a stale stamped message")
+  }
+}
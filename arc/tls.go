@@ -0,0 +1,221 @@
+//
+// tls.go -- tls links authenticated by pinned identity keys
+//
+
+package arc
+
+import (
+  "bytes"
+  "context"
+  "crypto"
+  "crypto/ed25519"
+  "crypto/rand"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/hex"
+  "errors"
+  "io"
+  "log/slog"
+  "math/big"
+  "net"
+  "strings"
+  "sync"
+  "time"
+  "github.com/majestrate/arcd/nacl"
+)
+
+// self signed certificate made from our identity key
+type tlsIdentity struct {
+  once sync.Once
+  keyfile string
+  cert tls.Certificate
+  err error
+  log *slog.Logger
+}
+
+// get our certificate, made on first use
+func (t *tlsIdentity) Certificate() (tls.Certificate, error) {
+  t.once.Do(func() {
+    keys, err := loadIdentity(t.keyfile)
+    if err == nil {
+      t.cert, err = tlsCertificate(identitySigner{keys})
+    }
+    if err == nil {
+      t.log.Info("tls identity", "key", hex.EncodeToString(keys.Public()))
+    }
+    t.err = err
+  })
+  return t.cert, t.err
+}
+
+// signs with our identity key where nacl keeps it so tls never gets a copy
+type identitySigner struct {
+  kp *nacl.KeyPair
+}
+
+func (s identitySigner) Public() crypto.PublicKey {
+  return ed25519.PublicKey(s.kp.Public())
+}
+
+func (s identitySigner) Sign(rand io.Reader, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+  if opts.HashFunc() != crypto.Hash(0) {
+    return nil, errors.New("ed25519 signs whole messages, not hashes")
+  }
+  sig := s.kp.SignDetached(msg)
+  if sig == nil {
+    return nil, errors.New("failed to sign with identity key")
+  }
+  return sig, nil
+}
+
+// make a self signed certificate for an ed25519 key
+func tlsCertificate(sk crypto.Signer) (cert tls.Certificate, err error) {
+  pk := sk.Public().(ed25519.PublicKey)
+  var serial *big.Int
+  serial, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+  if err != nil {
+    return
+  }
+  now := time.Now()
+  tmpl := &x509.Certificate{
+    SerialNumber: serial,
+    Subject: pkix.Name{
+      CommonName: hex.EncodeToString(pk),
+    },
+    NotBefore: now.Add(-time.Hour),
+    NotAfter: now.Add(365 * 24 * time.Hour),
+    KeyUsage: x509.KeyUsageDigitalSignature,
+    ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+  }
+  var der []byte
+  der, err = x509.CreateCertificate(rand.Reader, tmpl, tmpl, pk, sk)
+  if err == nil {
+    cert = tls.Certificate{
+      Certificate: [][]byte{der},
+      PrivateKey: sk,
+    }
+  }
+  return
+}
+
+// get the identity key from a peer's certificate chain
+func tlsPeerKey(rawCerts [][]byte) (pk ed25519.PublicKey, err error) {
+  if len(rawCerts) == 0 {
+    err = errors.New("peer sent no certificate")
+    return
+  }
+  var cert *x509.Certificate
+  cert, err = x509.ParseCertificate(rawCerts[0])
+  if err != nil {
+    return
+  }
+  var ok bool
+  pk, ok = cert.PublicKey.(ed25519.PublicKey)
+  if ! ok {
+    err = errors.New("peer certificate is not ed25519")
+  }
+  return
+}
+
+// longest we wait for a tls handshake before giving up on the link, tests shorten it
+var tlsHandshakeTimeout = 10 * time.Second
+
+// do the handshake of a tls link if it has not been done, nothing for links that are not tls
+func tlsHandshake(c Connection) error {
+  tc, ok := c.(*tls.Conn)
+  if ! ok {
+    return nil
+  }
+  ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+  defer cancel()
+  return tc.HandshakeContext(ctx)
+}
+
+// hex encoded identity key of the hub on the other end of a tls link
+// empty for links that are not tls or have not done the handshake, see tlsHandshake
+func connKey(c Connection) string {
+  tc, ok := c.(*tls.Conn)
+  if ! ok {
+    return ""
+  }
+  state := tc.ConnectionState()
+  if ! state.HandshakeComplete {
+    return ""
+  }
+  certs := state.PeerCertificates
+  if len(certs) == 0 {
+    return ""
+  }
+  pk, ok := certs[0].PublicKey.(ed25519.PublicKey)
+  if ! ok {
+    return ""
+  }
+  return hex.EncodeToString(pk)
+}
+
+// make a certificate verifier that only accepts peers with one of the pinned keys
+// pins are hex encoded ed25519 public keys, no pins accepts any peer
+func tlsPinVerifier(pins []string) func([][]byte, [][]*x509.Certificate) error {
+  return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+    pk, err := tlsPeerKey(rawCerts)
+    if err != nil {
+      return err
+    }
+    if len(pins) == 0 {
+      return nil
+    }
+    for _, pin := range pins {
+      want, err := hex.DecodeString(strings.TrimSpace(pin))
+      if err == nil && bytes.Equal(want, pk) {
+        return nil
+      }
+    }
+    return errors.New("peer key " + hex.EncodeToString(pk) + " is not pinned")
+  }
+}
+
+// do tls client handshake over a connection to a remote hub
+func (t *tlsIdentity) Client(conn Connection, c RemoteHubConfig) (tconn Connection, err error) {
+  if len(c.PinKey) == 0 {
+    err = errors.New("tls hub has no PinKey")
+    return
+  }
+  nc, ok := conn.(net.Conn)
+  if ! ok {
+    err = errors.New("cannot do tls over this connection")
+    return
+  }
+  var cert tls.Certificate
+  cert, err = t.Certificate()
+  if err != nil {
+    return
+  }
+  cl := tls.Client(nc, &tls.Config{
+    MinVersion: tls.VersionTLS13,
+    Certificates: []tls.Certificate{cert},
+    // we check the pinned key instead of a ca chain
+    InsecureSkipVerify: true,
+    VerifyPeerCertificate: tlsPinVerifier([]string{c.PinKey}),
+  })
+  err = tlsHandshake(cl)
+  if err == nil {
+    tconn = cl
+  }
+  return
+}
+
+// make a tls listener that accepts peers with pinned keys, no pins accepts any peer
+func (t *tlsIdentity) Listen(addr string, pins []string) (ln net.Listener, err error) {
+  var cert tls.Certificate
+  cert, err = t.Certificate()
+  if err == nil {
+    ln, err = tls.Listen("tcp", addr, &tls.Config{
+      MinVersion: tls.VersionTLS13,
+      Certificates: []tls.Certificate{cert},
+      ClientAuth: tls.RequireAnyClientCert,
+      VerifyPeerCertificate: tlsPinVerifier(pins),
+    })
+  }
+  return
+}
@@ -0,0 +1,165 @@
+//
+// tls_test.go -- tests for tls links authenticated by pinned identity keys
+//
+
+package arc
+
+import (
+  "encoding/hex"
+  "net"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+// a tls identity with a new key, returns it and its hex encoded public key
+func newTestIdentity(t *testing.T) (*tlsIdentity, string) {
+  t.Helper()
+  keyfile := filepath.Join(t.TempDir(), "identity.key")
+  kp, err := loadIdentity(keyfile)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return &tlsIdentity{keyfile: keyfile, log: testLogger}, hex.EncodeToString(kp.Public())
+}
+
+// accept one link and do its handshake
+func acceptTLS(ln net.Listener) (chan Connection, chan error) {
+  conns := make(chan Connection, 1)
+  errs := make(chan error, 1)
+  go func() {
+    conn, err := ln.Accept()
+    if err == nil {
+      err = tlsHandshake(conn)
+      if err != nil {
+        conn.Close()
+      }
+    }
+    if err != nil {
+      errs <- err
+      return
+    }
+    conns <- conn
+  }()
+  return conns, errs
+}
+
+func TestTLSLink(t *testing.T) {
+  server, serverKey := newTestIdentity(t)
+  client, clientKey := newTestIdentity(t)
+  ln, err := server.Listen("127.0.0.1:0", []string{clientKey})
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer ln.Close()
+  conns, errs := acceptTLS(ln)
+  raw, err := net.Dial("tcp", ln.Addr().String())
+  if err != nil {
+    t.Fatal(err)
+  }
+  out, err := client.Client(raw, RemoteHubConfig{PinKey: serverKey})
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer out.Close()
+  if key := connKey(out); key != serverKey {
+    t.Errorf("client sees key %q, want %q", key, serverKey)
+  }
+  select {
+  case in := <- conns:
+    defer in.Close()
+    if key := connKey(in); key != clientKey {
+      t.Errorf("server sees key %q, want %q", key, clientKey)
+    }
+  case err := <- errs:
+    t.Fatal(err)
+  }
+}
+
+func TestTLSPins(t *testing.T) {
+  server, serverKey := newTestIdentity(t)
+  client, clientKey := newTestIdentity(t)
+  _, otherKey := newTestIdentity(t)
+  tests := []struct {
+    name string
+    // keys the server accepts and the key the client pins
+    serverPins []string
+    clientPin string
+  }{
+    {"server pins another key", []string{otherKey}, serverKey},
+    {"client pins another key", []string{clientKey}, otherKey},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      ln, err := server.Listen("127.0.0.1:0", tt.serverPins)
+      if err != nil {
+        t.Fatal(err)
+      }
+      defer ln.Close()
+      conns, errs := acceptTLS(ln)
+      raw, err := net.Dial("tcp", ln.Addr().String())
+      if err != nil {
+        t.Fatal(err)
+      }
+      out, clientErr := client.Client(raw, RemoteHubConfig{PinKey: tt.clientPin})
+      if clientErr == nil {
+        defer out.Close()
+      } else {
+        raw.Close()
+      }
+      select {
+      case in := <- conns:
+        in.Close()
+        if clientErr == nil {
+          t.Fatal("link came up")
+        }
+      case <- errs:
+      }
+      if clientErr == nil {
+        // tls 1.3 clients finish before the server checks their certificate, the link is dead anyway
+        out.Write([]byte{0})
+        if _, err := out.Read(make([]byte, 1)); err == nil {
+          t.Error("client link works")
+        }
+      }
+    })
+  }
+}
+
+// a peer that never finishes the handshake is dropped instead of holding a goroutine forever
+func TestTLSHandshakeTimeout(t *testing.T) {
+  defer func(d time.Duration) { tlsHandshakeTimeout = d }(tlsHandshakeTimeout)
+  tlsHandshakeTimeout = 100 * time.Millisecond
+  server, _ := newTestIdentity(t)
+  ln, err := server.Listen("127.0.0.1:0", nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer ln.Close()
+  conns, errs := acceptTLS(ln)
+  raw, err := net.Dial("tcp", ln.Addr().String())
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer raw.Close()
+  select {
+  case in := <- conns:
+    in.Close()
+    t.Fatal("handshake finished without a client")
+  case <- errs:
+  case <- time.After(5 * time.Second):
+    t.Fatal("handshake did not time out")
+  }
+}
+
+func TestConnKeyPlain(t *testing.T) {
+  a, b := net.Pipe()
+  defer a.Close()
+  defer b.Close()
+  if key := connKey(a); len(key) > 0 {
+    t.Errorf("plain link has key %q", key)
+  }
+  if err := tlsHandshake(a); err != nil {
+    t.Errorf("handshake on a plain link: %s", err)
+  }
+}
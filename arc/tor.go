@@ -0,0 +1,329 @@
+//
+// tor.go -- publish our hub as an onion service via the tor control port
+//
+
+package arc
+
+import (
+  "bufio"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "log/slog"
+  "net"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+)
+
+// hmac keys for safecookie auth
+const torSafeCookieServerKey = "Tor safe cookie authentication server-to-controller hash"
+const torSafeCookieClientKey = "Tor safe cookie authentication controller-to-server hash"
+
+// a connection to the tor control port
+type torControl struct {
+  conn net.Conn
+  r *bufio.Reader
+}
+
+// connect to the tor control port
+func dialTorControl(addr string) (t *torControl, err error) {
+  var conn net.Conn
+  conn, err = net.Dial("tcp", addr)
+  if err == nil {
+    t = &torControl{
+      conn: conn,
+      r: bufio.NewReader(conn),
+    }
+  }
+  return
+}
+
+func (t *torControl) Close() error {
+  return t.conn.Close()
+}
+
+// send a command, get the reply lines without status codes
+// returns an error if tor did not reply with 250
+func (t *torControl) command(cmd string) (lines []string, err error) {
+  _, err = io.WriteString(t.conn, cmd + "\r\n")
+  for err == nil {
+    var line string
+    line, err = t.r.ReadString('\n')
+    if err != nil {
+      break
+    }
+    line = strings.TrimRight(line, "\r\n")
+    if len(line) < 4 {
+      err = errors.New("short reply from tor: "+line)
+      break
+    }
+    code, sep, text := line[:3], line[3], line[4:]
+    if code != "250" {
+      err = fmt.Errorf("tor control error: %s", line)
+      break
+    }
+    if sep == '+' {
+      // data reply, read until lone dot
+      for err == nil {
+        var data string
+        data, err = t.r.ReadString('\n')
+        data = strings.TrimRight(data, "\r\n")
+        if data == "." {
+          break
+        }
+        text += "\n" + data
+      }
+    }
+    lines = append(lines, text)
+    if sep == ' ' {
+      // last line
+      break
+    }
+  }
+  return
+}
+
+// parse key=value pairs from a reply line, values can be quoted
+func torReplyArgs(line string) map[string]string {
+  args := make(map[string]string)
+  for len(line) > 0 {
+    line = strings.TrimLeft(line, " ")
+    idx := strings.IndexAny(line, "= ")
+    if idx < 0 {
+      args[line] = ""
+      break
+    }
+    if line[idx] == ' ' {
+      args[line[:idx]] = ""
+      line = line[idx:]
+      continue
+    }
+    k := line[:idx]
+    line = line[idx+1:]
+    if strings.HasPrefix(line, "\"") {
+      v, err := strconv.QuotedPrefix(line)
+      if err != nil {
+        break
+      }
+      line = line[len(v):]
+      v, _ = strconv.Unquote(v)
+      args[k] = v
+    } else {
+      end := strings.Index(line, " ")
+      if end < 0 {
+        end = len(line)
+      }
+      args[k] = line[:end]
+      line = line[end:]
+    }
+  }
+  return args
+}
+
+// authenticate with password if given, otherwise use the cookie tor tells us about
+func (t *torControl) authenticate(password, cookiefile string) (err error) {
+  if len(password) > 0 {
+    _, err = t.command("AUTHENTICATE " + strconv.Quote(password))
+    return
+  }
+  var lines []string
+  lines, err = t.command("PROTOCOLINFO 1")
+  if err != nil {
+    return
+  }
+  var methods string
+  for _, line := range lines {
+    if strings.HasPrefix(line, "AUTH ") {
+      args := torReplyArgs(line[5:])
+      methods = args["METHODS"]
+      if len(cookiefile) == 0 {
+        cookiefile = args["COOKIEFILE"]
+      }
+    }
+  }
+  has := func(m string) bool {
+    for _, method := range strings.Split(methods, ",") {
+      if method == m {
+        return true
+      }
+    }
+    return false
+  }
+  if has("NULL") {
+    _, err = t.command("AUTHENTICATE")
+    return
+  }
+  if ! has("SAFECOOKIE") && ! has("COOKIE") {
+    err = errors.New("tor wants a password, methods="+methods)
+    return
+  }
+  var cookie []byte
+  cookie, err = ioutil.ReadFile(cookiefile)
+  if err != nil {
+    return
+  }
+  if has("SAFECOOKIE") {
+    err = t.safeCookie(cookie)
+  } else {
+    _, err = t.command("AUTHENTICATE " + hex.EncodeToString(cookie))
+  }
+  return
+}
+
+// do safecookie challenge response
+func (t *torControl) safeCookie(cookie []byte) (err error) {
+  var clientNonce [32]byte
+  io.ReadFull(rand.Reader, clientNonce[:])
+  var lines []string
+  lines, err = t.command("AUTHCHALLENGE SAFECOOKIE " + hex.EncodeToString(clientNonce[:]))
+  if err != nil {
+    return
+  }
+  if len(lines) == 0 || ! strings.HasPrefix(lines[0], "AUTHCHALLENGE ") {
+    err = errors.New("bad authchallenge reply from tor")
+    return
+  }
+  args := torReplyArgs(lines[0][14:])
+  var serverHash, serverNonce []byte
+  serverHash, err = hex.DecodeString(args["SERVERHASH"])
+  if err == nil {
+    serverNonce, err = hex.DecodeString(args["SERVERNONCE"])
+  }
+  if err != nil {
+    return
+  }
+  msg := append(append(append([]byte{}, cookie...), clientNonce[:]...), serverNonce...)
+  mac := hmac.New(sha256.New, []byte(torSafeCookieServerKey))
+  mac.Write(msg)
+  if ! hmac.Equal(mac.Sum(nil), serverHash) {
+    err = errors.New("tor server hash mismatch")
+    return
+  }
+  mac = hmac.New(sha256.New, []byte(torSafeCookieClientKey))
+  mac.Write(msg)
+  _, err = t.command("AUTHENTICATE " + hex.EncodeToString(mac.Sum(nil)))
+  return
+}
+
+// add an onion service forwarding port to target
+// key is "NEW:ED25519-V3" or a key we got before
+// returns the service id and the private key, the private key is empty for an existing key
+func (t *torControl) addOnion(key string, port int, target string) (id, priv string, err error) {
+  var lines []string
+  lines, err = t.command(fmt.Sprintf("ADD_ONION %s Port=%d,%s", key, port, target))
+  for _, line := range lines {
+    if strings.HasPrefix(line, "ServiceID=") {
+      id = line[10:]
+    } else if strings.HasPrefix(line, "PrivateKey=") {
+      priv = line[11:]
+    }
+  }
+  if err == nil && len(id) == 0 {
+    err = errors.New("tor did not give us a service id")
+  }
+  return
+}
+
+// our onion service
+type onionService struct {
+  access sync.Mutex
+  // our .onion address, empty if not published
+  addr string
+  log *slog.Logger
+}
+
+// get our .onion address, empty if not published
+func (o *onionService) Addr() string {
+  o.access.Lock()
+  defer o.access.Unlock()
+  return o.addr
+}
+
+func (o *onionService) setAddr(addr string) {
+  o.access.Lock()
+  o.addr = addr
+  o.access.Unlock()
+}
+
+// default file for our onion service key, next to our identity key
+// empty if we have no key file, the service is new every run then
+func onionKeyFile(cfg LocalHubConfig) string {
+  if len(cfg.OnionKeys) > 0 {
+    return cfg.OnionKeys
+  }
+  if len(cfg.Keys) == 0 {
+    return ""
+  }
+  return filepath.Join(filepath.Dir(cfg.Keys), "onion.key")
+}
+
+// publish an onion service pointing at our bind address
+// blocks as long as the control connection is up, the service goes away when it closes
+func (o *onionService) publish(cfg LocalHubConfig) (err error) {
+  var host, p string
+  host, p, err = net.SplitHostPort(cfg.Bind)
+  if err != nil {
+    return
+  }
+  var port int
+  port, err = strconv.Atoi(p)
+  if err != nil {
+    return
+  }
+  ip := net.ParseIP(host)
+  if len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+    host = "127.0.0.1"
+  }
+  target := net.JoinHostPort(host, p)
+
+  keyfile := onionKeyFile(cfg)
+  key := "NEW:ED25519-V3"
+  if len(keyfile) > 0 && checkFile(keyfile) {
+    var data []byte
+    data, err = ioutil.ReadFile(keyfile)
+    if err != nil {
+      return
+    }
+    key = strings.TrimSpace(string(data))
+  }
+
+  var t *torControl
+  t, err = dialTorControl(cfg.TorControl)
+  if err != nil {
+    return
+  }
+  defer t.Close()
+  err = t.authenticate(cfg.TorPassword, cfg.TorCookie)
+  if err != nil {
+    return
+  }
+  var id, priv string
+  id, priv, err = t.addOnion(key, port, target)
+  if err != nil {
+    return
+  }
+  if len(priv) > 0 && len(keyfile) > 0 {
+    o.log.Info("saving new onion service key", "file", keyfile)
+    err = ioutil.WriteFile(keyfile, []byte(priv), 0600)
+    if err != nil {
+      return
+    }
+  }
+  addr := id + ".onion"
+  o.log.Info("onion service published", "addr", net.JoinHostPort(addr, p), "target", target)
+  o.setAddr(addr)
+  defer o.setAddr("")
+  // wait for the control connection to close
+  _, err = io.Copy(ioutil.Discard, t.r)
+  if err == nil {
+    err = errors.New("tor control connection closed")
+  }
+  return
+}
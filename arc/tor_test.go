@@ -0,0 +1,467 @@
+//
+// tor_test.go -- tests for onion services against a fake tor control port
+//
+
+package arc
+
+import (
+  "bufio"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/hex"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+// an in process tor control port
+type fakeTor struct {
+  t *testing.T
+  ln net.Listener
+  access sync.Mutex
+  // auth methods we offer in PROTOCOLINFO
+  methods string
+  // password for HASHEDPASSWORD
+  password string
+  // cookie for COOKIE and SAFECOOKIE, and the file we say it is in
+  cookie []byte
+  cookiefile string
+  // onion service ids by private key
+  keys map[string]string
+  // commands we got, in order
+  commands []string
+  // error replies to give instead of the real one by command word i.e. "ADD_ONION": "512 Bad arguments"
+  fail map[string]string
+  // open control connections
+  conns []net.Conn
+}
+
+// start a fake tor control port offering auth methods, stopped when the test ends
+func newFakeTor(t *testing.T, methods string) *fakeTor {
+  ln, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  f := &fakeTor{
+    t: t,
+    ln: ln,
+    methods: methods,
+    password: "hunter2",
+    cookie: make([]byte, 32),
+    cookiefile: filepath.Join(t.TempDir(), "control_auth_cookie"),
+    keys: make(map[string]string),
+    fail: make(map[string]string),
+  }
+  io.ReadFull(rand.Reader, f.cookie)
+  err = ioutil.WriteFile(f.cookiefile, f.cookie, 0600)
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() {
+    ln.Close()
+    f.hangup()
+  })
+  go func() {
+    for {
+      conn, err := ln.Accept()
+      if err != nil {
+        return
+      }
+      f.access.Lock()
+      f.conns = append(f.conns, conn)
+      f.access.Unlock()
+      go f.serve(conn)
+    }
+  }()
+  return f
+}
+
+func (f *fakeTor) addr() string {
+  return f.ln.Addr().String()
+}
+
+// close all control connections
+func (f *fakeTor) hangup() {
+  f.access.Lock()
+  for _, conn := range f.conns {
+    conn.Close()
+  }
+  f.conns = nil
+  f.access.Unlock()
+}
+
+// sent commands that start with prefix
+func (f *fakeTor) sent(prefix string) (cmds []string) {
+  f.access.Lock()
+  defer f.access.Unlock()
+  for _, cmd := range f.commands {
+    if strings.HasPrefix(cmd, prefix) {
+      cmds = append(cmds, cmd)
+    }
+  }
+  return
+}
+
+// safecookie hash with one of the hmac keys
+func torSafeCookieHash(key string, cookie, clientNonce, serverNonce []byte) []byte {
+  mac := hmac.New(sha256.New, []byte(key))
+  mac.Write(cookie)
+  mac.Write(clientNonce)
+  mac.Write(serverNonce)
+  return mac.Sum(nil)
+}
+
+func (f *fakeTor) serve(conn net.Conn) {
+  defer conn.Close()
+  r := bufio.NewReader(conn)
+  authed := false
+  // what AUTHENTICATE has to give after AUTHCHALLENGE
+  var clientHash []byte
+  reply := func(lines ...string) {
+    io.WriteString(conn, strings.Join(lines, "\r\n") + "\r\n")
+  }
+  for {
+    line, err := r.ReadString('\n')
+    if err != nil {
+      return
+    }
+    line = strings.TrimRight(line, "\r\n")
+    word, arg, _ := strings.Cut(line, " ")
+    f.access.Lock()
+    f.commands = append(f.commands, line)
+    fail, failed := f.fail[word]
+    f.access.Unlock()
+    if failed {
+      reply(fail)
+      continue
+    }
+    switch word {
+    case "PROTOCOLINFO":
+      reply("250-PROTOCOLINFO 1",
+        fmt.Sprintf("250-AUTH METHODS=%s COOKIEFILE=%s", f.methods, strconv.Quote(f.cookiefile)),
+        "250-VERSION Tor=\"0.4.8.9\"",
+        "250 OK")
+    case "AUTHCHALLENGE":
+      method, nonce, _ := strings.Cut(arg, " ")
+      clientNonce, err := hex.DecodeString(nonce)
+      if method != "SAFECOOKIE" || err != nil || len(clientNonce) != 32 {
+        reply("513 Invalid base16 client nonce")
+        continue
+      }
+      serverNonce := make([]byte, 32)
+      io.ReadFull(rand.Reader, serverNonce)
+      clientHash = torSafeCookieHash(torSafeCookieClientKey, f.cookie, clientNonce, serverNonce)
+      serverHash := torSafeCookieHash(torSafeCookieServerKey, f.cookie, clientNonce, serverNonce)
+      reply(fmt.Sprintf("250 AUTHCHALLENGE SERVERHASH=%X SERVERNONCE=%X", serverHash, serverNonce))
+    case "AUTHENTICATE":
+      methods := "," + f.methods + ","
+      ok := false
+      if strings.Contains(methods, ",NULL,") {
+        ok = true
+      } else if strings.HasPrefix(arg, "\"") {
+        password, err := strconv.Unquote(arg)
+        ok = err == nil && strings.Contains(methods, ",HASHEDPASSWORD,") && password == f.password
+      } else if b, err := hex.DecodeString(arg); err == nil {
+        if clientHash != nil {
+          ok = hmac.Equal(b, clientHash)
+        } else {
+          ok = strings.Contains(methods, ",COOKIE,") && hmac.Equal(b, f.cookie)
+        }
+      }
+      if ! ok {
+        reply("515 Authentication failed: Password did not match HashedControlPassword value from configuration")
+        return
+      }
+      authed = true
+      reply("250 OK")
+    case "GETINFO":
+      if ! authed {
+        reply("514 Authentication required.")
+        return
+      }
+      reply("250+" + arg + "=", "SocksPort 9050", "ControlPort 9051", ".", "250 OK")
+    case "ADD_ONION":
+      if ! authed {
+        reply("514 Authentication required.")
+        return
+      }
+      key, port, _ := strings.Cut(arg, " ")
+      if ! strings.HasPrefix(port, "Port=") {
+        reply("512 Bad arguments to ADD_ONION")
+        continue
+      }
+      if key == "NEW:ED25519-V3" {
+        b := make([]byte, 64)
+        io.ReadFull(rand.Reader, b)
+        priv := "ED25519-V3:" + base64.StdEncoding.EncodeToString(b)
+        id := i2pB32.EncodeToString(b[:35])
+        f.access.Lock()
+        f.keys[priv] = id
+        f.access.Unlock()
+        reply("250-ServiceID=" + id, "250-PrivateKey=" + priv, "250 OK")
+        continue
+      }
+      f.access.Lock()
+      id, known := f.keys[key]
+      f.access.Unlock()
+      if ! known {
+        reply("513 Invalid key blob")
+        continue
+      }
+      reply("250-ServiceID=" + id, "250 OK")
+    default:
+      reply(fmt.Sprintf("510 Unrecognized command \"%s\"", word))
+    }
+  }
+}
+
+// connect to a fake tor control port
+func dialFakeTor(t *testing.T, f *fakeTor) *torControl {
+  t.Helper()
+  ctl, err := dialTorControl(f.addr())
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { ctl.Close() })
+  return ctl
+}
+
+func TestTorReplyArgs(t *testing.T) {
+  tests := []struct {
+    line string
+    want map[string]string
+  }{
+    {`METHODS=COOKIE,SAFECOOKIE COOKIEFILE="/var/run/tor/control.authcookie"`, map[string]string{"METHODS": "COOKIE,SAFECOOKIE", "COOKIEFILE": "/var/run/tor/control.authcookie"}},
+    {`COOKIEFILE="C:\\tor\\cookie \"x\""`, map[string]string{"COOKIEFILE": `C:\tor\cookie "x"`}},
+    {`SERVERHASH=AB  SERVERNONCE=CD`, map[string]string{"SERVERHASH": "AB", "SERVERNONCE": "CD"}},
+    {`FLAG KEY=v`, map[string]string{"FLAG": "", "KEY": "v"}},
+    {`KEY=`, map[string]string{"KEY": ""}},
+    {``, map[string]string{}},
+  }
+  for _, tt := range tests {
+    got := torReplyArgs(tt.line)
+    if len(got) != len(tt.want) {
+      t.Errorf("torReplyArgs(%q) = %q, want %q", tt.line, got, tt.want)
+      continue
+    }
+    for k, v := range tt.want {
+      if got[k] != v {
+        t.Errorf("torReplyArgs(%q)[%s] = %q, want %q", tt.line, k, got[k], v)
+      }
+    }
+  }
+}
+
+func TestTorProtocolInfo(t *testing.T) {
+  f := newFakeTor(t, "COOKIE,SAFECOOKIE")
+  ctl := dialFakeTor(t, f)
+  lines, err := ctl.command("PROTOCOLINFO 1")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(lines) != 4 || lines[0] != "PROTOCOLINFO 1" || lines[3] != "OK" {
+    t.Fatalf("got %q", lines)
+  }
+  args := torReplyArgs(strings.TrimPrefix(lines[1], "AUTH "))
+  if args["METHODS"] != "COOKIE,SAFECOOKIE" || args["COOKIEFILE"] != f.cookiefile {
+    t.Errorf("got %q", args)
+  }
+}
+
+// data replies are joined into one line
+func TestTorDataReply(t *testing.T) {
+  f := newFakeTor(t, "NULL")
+  ctl := dialFakeTor(t, f)
+  err := ctl.authenticate("", "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  lines, err := ctl.command("GETINFO config-text")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(lines) != 2 || lines[0] != "config-text=\nSocksPort 9050\nControlPort 9051" || lines[1] != "OK" {
+    t.Errorf("got %q", lines)
+  }
+}
+
+func TestTorAuthenticate(t *testing.T) {
+  tests := []struct {
+    name, methods, password string
+    // cookie file to give, "-" for the wrong cookie
+    cookiefile string
+    // command we have to authenticate with, empty if it has to fail
+    auth string
+  }{
+    {name: "null", methods: "NULL", auth: "AUTHENTICATE"},
+    {name: "password", methods: "HASHEDPASSWORD", password: "hunter2", auth: "AUTHENTICATE \"hunter2\""},
+    {name: "wrong password", methods: "HASHEDPASSWORD", password: "hunter3"},
+    {name: "no password", methods: "HASHEDPASSWORD"},
+    {name: "cookie", methods: "COOKIE", auth: "AUTHENTICATE "},
+    {name: "safecookie", methods: "COOKIE,SAFECOOKIE", auth: "AUTHENTICATE "},
+    {name: "safecookie wrong cookie", methods: "COOKIE,SAFECOOKIE", cookiefile: "-"},
+    {name: "cookie wrong cookie", methods: "COOKIE", cookiefile: "-"},
+    {name: "missing cookie", methods: "SAFECOOKIE", cookiefile: "/nonexistent/cookie"},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      f := newFakeTor(t, tt.methods)
+      cookiefile := tt.cookiefile
+      if cookiefile == "-" {
+        cookiefile = filepath.Join(t.TempDir(), "wrong_cookie")
+        ioutil.WriteFile(cookiefile, make([]byte, 32), 0600)
+      }
+      ctl := dialFakeTor(t, f)
+      err := ctl.authenticate(tt.password, cookiefile)
+      if len(tt.auth) == 0 {
+        if err == nil {
+          t.Fatal("authenticated")
+        }
+        return
+      }
+      if err != nil {
+        t.Fatal(err)
+      }
+      auth := f.sent("AUTHENTICATE")
+      if len(auth) != 1 || ! strings.HasPrefix(auth[0], tt.auth) {
+        t.Errorf("sent %q, want %q", auth, tt.auth)
+      }
+      if strings.Contains(tt.methods, "SAFECOOKIE") && len(f.sent("AUTHCHALLENGE SAFECOOKIE ")) != 1 {
+        t.Error("did not use safecookie")
+      }
+      if auth[0] == "AUTHENTICATE " + hex.EncodeToString(f.cookie) && strings.Contains(tt.methods, "SAFECOOKIE") {
+        t.Error("sent the cookie itself when safecookie was offered")
+      }
+    })
+  }
+}
+
+// publish an onion service in the background, returns its error when the control connection closes
+func publishFakeTor(t *testing.T, f *fakeTor, keyfile string) (*onionService, chan error) {
+  t.Helper()
+  o := &onionService{log: testLogger}
+  done := make(chan error, 1)
+  go func() {
+    done <- o.publish(LocalHubConfig{
+      Bind: "[::]:6789",
+      TorControl: f.addr(),
+      OnionKeys: keyfile,
+    })
+  }()
+  deadline := time.Now().Add(5 * time.Second)
+  for len(o.Addr()) == 0 {
+    select {
+    case err := <- done:
+      t.Fatalf("publish failed: %v", err)
+    default:
+    }
+    if time.Now().After(deadline) {
+      t.Fatal("onion service not published")
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  return o, done
+}
+
+// stop a published onion service by closing its control connection
+func unpublishFakeTor(t *testing.T, f *fakeTor, o *onionService, done chan error) {
+  t.Helper()
+  f.hangup()
+  select {
+  case err := <- done:
+    if err == nil {
+      t.Error("publish returned without an error")
+    }
+  case <- time.After(5 * time.Second):
+    t.Fatal("publish did not return when tor went away")
+  }
+  if len(o.Addr()) > 0 {
+    t.Error("kept the onion address after tor went away")
+  }
+}
+
+// a new key is saved, then used again
+func TestOnionPublish(t *testing.T) {
+  f := newFakeTor(t, "COOKIE,SAFECOOKIE")
+  keyfile := filepath.Join(t.TempDir(), "onion.key")
+  o, done := publishFakeTor(t, f, keyfile)
+  addr := o.Addr()
+  add := f.sent("ADD_ONION")
+  if len(add) != 1 || add[0] != "ADD_ONION NEW:ED25519-V3 Port=6789,127.0.0.1:6789" {
+    t.Errorf("sent %q", add)
+  }
+  key, err := ioutil.ReadFile(keyfile)
+  if err != nil {
+    t.Fatal(err)
+  }
+  f.access.Lock()
+  id := f.keys[string(key)]
+  f.access.Unlock()
+  if len(id) == 0 || addr != id + ".onion" {
+    t.Errorf("saved key %q is not for %s", key, addr)
+  }
+  unpublishFakeTor(t, f, o, done)
+
+  o, done = publishFakeTor(t, f, keyfile)
+  if o.Addr() != addr {
+    t.Errorf("stored key gave %s, want %s", o.Addr(), addr)
+  }
+  add = f.sent("ADD_ONION")
+  if len(add) != 2 || add[1] != "ADD_ONION " + string(key) + " Port=6789,127.0.0.1:6789" {
+    t.Errorf("sent %q", add)
+  }
+  unpublishFakeTor(t, f, o, done)
+}
+
+func TestOnionPublishErrors(t *testing.T) {
+  tests := []struct {
+    name, methods, command, reply string
+    // stored key to start with
+    key string
+  }{
+    {name: "protocolinfo", methods: "SAFECOOKIE", command: "PROTOCOLINFO", reply: "551 Internal error"},
+    {name: "authchallenge", methods: "SAFECOOKIE", command: "AUTHCHALLENGE", reply: "513 Unrecognized authentication method"},
+    {name: "add onion", methods: "NULL", command: "ADD_ONION", reply: "512 Bad arguments to ADD_ONION"},
+    {name: "unknown stored key", methods: "NULL", key: "ED25519-V3:bm90IGEga2V5"},
+    {name: "needs password", methods: "HASHEDPASSWORD"},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      f := newFakeTor(t, tt.methods)
+      if len(tt.command) > 0 {
+        f.fail[tt.command] = tt.reply
+      }
+      keyfile := filepath.Join(t.TempDir(), "onion.key")
+      if len(tt.key) > 0 {
+        ioutil.WriteFile(keyfile, []byte(tt.key + "\n"), 0600)
+      }
+      o := &onionService{log: testLogger}
+      err := o.publish(LocalHubConfig{
+        Bind: "127.0.0.1:6789",
+        TorControl: f.addr(),
+        OnionKeys: keyfile,
+      })
+      if err == nil {
+        t.Fatal("published")
+      }
+      if len(tt.reply) > 0 && ! strings.Contains(err.Error(), tt.reply) {
+        t.Errorf("error %q does not say %q", err, tt.reply)
+      }
+      if len(o.Addr()) > 0 {
+        t.Error("has an onion address")
+      }
+      if len(tt.key) == 0 && checkFile(keyfile) {
+        t.Error("saved a key")
+      }
+    })
+  }
+}
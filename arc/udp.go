@@ -0,0 +1,205 @@
+//
+// udp.go -- udp broadcast / multicast hub
+//
+
+package arc
+
+import (
+  "errors"
+  "log/slog"
+  "net"
+  "os"
+  "time"
+)
+
+// default ipv4 broadcast address
+const defaultUDPBroadcast = "255.255.255.255"
+
+// default ipv6 link local multicast group
+const defaultUDPGroup = "ff02::d1ce"
+
+// largest urc message we will put in a single datagram
+const maxUDPMessageSize = 65507
+
+type udpHub struct {
+  // ipv4 broadcast socket
+  conn4 *net.UDPConn
+  // ipv6 multicast socket
+  conn6 *net.UDPConn
+  // ipv4 broadcast destination
+  bcast *net.UDPAddr
+  // ipv6 multicast destination
+  group *net.UDPAddr
+  send chan Message
+  ib chan Message
+  router Router
+  filter *bloomFilter
+  // one rate limit for the whole lan, datagram sources are easy to fake
+  limit *rateSource
+  log *slog.Logger
+}
+
+// bind ipv4 broadcast and ipv6 multicast sockets
+func (uh *udpHub) bind(port int, broadcast, group, iface string) (err error) {
+  if len(broadcast) == 0 {
+    broadcast = defaultUDPBroadcast
+  }
+  if len(group) == 0 {
+    group = defaultUDPGroup
+  }
+  var ifi *net.Interface
+  if len(iface) > 0 {
+    ifi, err = net.InterfaceByName(iface)
+    if err != nil {
+      return
+    }
+  }
+  bcast := net.ParseIP(broadcast)
+  if bcast == nil || bcast.To4() == nil {
+    err = errors.New("invalid ipv4 broadcast address "+broadcast)
+    return
+  }
+  mcast := net.ParseIP(group)
+  // 224.0.0.0/24 is link local multicast too but we only join the group over ipv6
+  if mcast == nil || mcast.To4() != nil || ! mcast.IsLinkLocalMulticast() {
+    err = errors.New("invalid ipv6 link local multicast group "+group)
+    return
+  }
+  uh.bcast = &net.UDPAddr{IP: bcast, Port: port}
+  uh.group = &net.UDPAddr{IP: mcast, Port: port}
+  if ifi != nil {
+    uh.group.Zone = ifi.Name
+  }
+  uh.log.Info("binding udp hub", "port", port, "broadcast", uh.bcast.String(), "group", uh.group.String())
+  uh.conn4, err = net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+  if err != nil {
+    return
+  }
+  uh.conn6, err = net.ListenMulticastUDP("udp6", ifi, uh.group)
+  if err != nil {
+    // ipv6 is optional, ipv4 broadcast still works without it
+    uh.log.Warn("cannot join ipv6 multicast group", "group", uh.group.String(), "err", err)
+    uh.conn6 = nil
+    err = nil
+  }
+  return
+}
+
+func (uh udpHub) Persist(_ RemoteHubConfig) {
+  return
+}
+
+func (uh udpHub) Send(m Message) {
+  uh.send <- m
+}
+
+// broadcast raw data over every bound socket
+func (uh *udpHub) broadcast(data []byte) (err error) {
+  if len(data) > maxUDPMessageSize {
+    err = errors.New("message too big for udp")
+    return
+  }
+  _, err = uh.conn4.WriteToUDP(data, uh.bcast)
+  if uh.conn6 != nil {
+    _, err6 := uh.conn6.WriteToUDP(data, uh.group)
+    if err == nil {
+      err = err6
+    }
+  }
+  return
+}
+
+// run main
+func (uh udpHub) Run() {
+  uh.log.Info("run udp hub")
+  go uh.sendLoop()
+  if uh.conn6 != nil {
+    go uh.recvLoop(uh.conn6)
+  }
+  uh.recvLoop(uh.conn4)
+}
+
+func (uh *udpHub) sendLoop() {
+  for {
+    select {
+    case msg, ok := <- uh.ib:
+      if ok {
+        // don't echo this back onto the lan
+        uh.filter.Add(msg.RawBytes())
+        uh.router.InboundChan() <- msg
+      }
+    case msg, ok := <- uh.send:
+      if ok {
+        data := msg.RawBytes()
+        if uh.filter.Contains(data) {
+          // filter hit
+        } else {
+          // add to filter
+          uh.filter.Add(data)
+
+          // broadcast
+          uh.log.Debug("broadcast urc", "type", urcTypeName(msg.Type()), "len", len(data))
+          err := uh.broadcast(data)
+          if err != nil {
+            uh.log.Warn("failed to broadcast over udp", "err", err)
+          }
+        }
+      }
+    }
+  }
+}
+
+// run recv loop on a udp socket
+func (uh *udpHub) recvLoop(conn *net.UDPConn) {
+  buff := make([]byte, maxUDPMessageSize)
+  for {
+    n, addr, err := conn.ReadFromUDP(buff)
+    if err != nil {
+      uh.log.Warn("udp recv failed", "err", err)
+      time.Sleep(time.Second)
+      continue
+    }
+    msg, err := urcMessageFromBytes(buff[:n])
+    if err == nil {
+      // we got inbound
+      uh.log.Debug("got urc", "peer", addr.String(), "type", urcTypeName(msg.Type()), "len", n)
+      if uh.limit.admit(msg) != ratePass {
+        // no link to disconnect
+        uh.log.Debug("dropped urc over rate limit", "peer", addr.String(), "type", urcTypeName(msg.Type()))
+        continue
+      }
+      uh.ib <- msg
+    } else {
+      uh.log.Debug("invalid urc datagram", "peer", addr.String(), "err", err)
+    }
+  }
+}
+
+func (uh udpHub) Close() {
+  uh.conn4.Close()
+  if uh.conn6 != nil {
+    uh.conn6.Close()
+  }
+}
+
+// create a hub that uses ipv4 broadcast and ipv6 link local multicast
+// does not require any special privileges
+func CreateUDPHub(port int, broadcast, group, iface string, r Router, logger *slog.Logger) Hub {
+  logger = logger.With("hub", "udp")
+  logger.Info("create udp hub")
+  h := udpHub{
+    send: make(chan Message),
+    ib: make(chan Message),
+    router: r,
+    filter: new(bloomFilter),
+    limit: routerLimiter(r).source(),
+    log: logger,
+  }
+  err := h.bind(port, broadcast, group, iface)
+  if err == nil {
+    return h
+  }
+  logger.Error("failed to create udp hub", "err", err)
+  os.Exit(1)
+  return nil
+}
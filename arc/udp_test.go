@@ -0,0 +1,126 @@
+//
+// udp_test.go -- udp broadcast hub tests
+//
+
+package arc
+
+import (
+  "net"
+  "testing"
+  "time"
+)
+
+// a udp port nothing is bound to right now
+func freeUDPPort(t *testing.T) int {
+  t.Helper()
+  conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer conn.Close()
+  return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// wait for a message on a router
+func recvTestRouter(t *testing.T, r testRouter) Message {
+  t.Helper()
+  select {
+  case m := <- r.ib:
+    return m
+  case <- time.After(5 * time.Second):
+    t.Fatal("router got nothing")
+  }
+  return nil
+}
+
+// frames we broadcast and frames others send us both reach the router
+func TestUDPHubLoopback(t *testing.T) {
+  port := freeUDPPort(t)
+  r := newTestRouter()
+  // broadcast to loopback so the test needs no network
+  h := CreateUDPHub(port, "127.0.0.1", "", "", r, testLogger).(udpHub)
+  defer h.Close()
+  go h.Run()
+
+  sent := urcMessageFromURCLine(":nick!user@host PRIVMSG #arcd :hi")
+  h.Send(sent)
+  if got := recvTestRouter(t, r); string(got.RawBytes()) != string(sent.RawBytes()) {
+    t.Errorf("got %q", got.RawBytes())
+  }
+
+  conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer conn.Close()
+  // not urc, dropped
+  conn.Write([]byte("hello"))
+  theirs := urcMessageFromURCLine(":other!user@host PRIVMSG #arcd :hey")
+  conn.Write(theirs.RawBytes())
+  if got := recvTestRouter(t, r); string(got.RawBytes()) != string(theirs.RawBytes()) {
+    t.Errorf("got %q", got.RawBytes())
+  }
+  // what came in is not sent back out
+  if ! h.filter.Contains(theirs.RawBytes()) {
+    t.Error("inbound frame not in the send filter")
+  }
+}
+
+func TestUDPHubBind(t *testing.T) {
+  tests := []struct {
+    name, broadcast, group, iface string
+    ok bool
+  }{
+    {"defaults", "", "", "", true},
+    {"broadcast address", "127.255.255.255", "", "", true},
+    {"group", "", "ff02::1234", "", true},
+    {"ipv6 broadcast", "ff02::1", "", "", false},
+    {"broadcast hostname", "broadcast", "", "", false},
+    {"global multicast group", "", "ff0e::1234", "", false},
+    {"ipv4 link local group", "", "224.0.0.1", "", false},
+    {"unicast group", "", "fe80::1", "", false},
+    {"no such interface", "", "", "nosuchif0", false},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      h := &udpHub{log: testLogger}
+      err := h.bind(freeUDPPort(t), tt.broadcast, tt.group, tt.iface)
+      if h.conn4 != nil {
+        h.Close()
+      }
+      if tt.ok != (err == nil) {
+        t.Errorf("got %v", err)
+      }
+    })
+  }
+}
+
+func TestValidateUDP(t *testing.T) {
+  tests := []struct {
+    name, broadcast, group string
+    field string
+  }{
+    {"defaults", "", "", ""},
+    {"broadcast and group", "192.168.1.255", "ff02::d1ce", ""},
+    {"ipv6 broadcast", "ff02::1", "", "Local.UDPBroadcast"},
+    {"bad broadcast", "192.168.1", "", "Local.UDPBroadcast"},
+    {"global group", "", "ff0e::1", "Local.UDPGroup"},
+    {"ipv4 group", "", "224.0.0.1", "Local.UDPGroup"},
+    {"bad group", "", "ff02::d1ce::1", "Local.UDPGroup"},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      cfg := DefaultConfig()
+      cfg.Local.UDPPort = 6789
+      cfg.Local.UDPBroadcast = tt.broadcast
+      cfg.Local.UDPGroup = tt.group
+      fields := configErrorFields(cfg.Validate())
+      if len(tt.field) == 0 && len(fields) > 0 {
+        t.Errorf("failed on %v", fields)
+      }
+      if len(tt.field) > 0 && (len(fields) != 1 || fields[0] != tt.field) {
+        t.Errorf("failed on %v, want %s", fields, tt.field)
+      }
+    })
+  }
+}
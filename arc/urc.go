@@ -6,9 +6,69 @@ package arc
 import (
   "crypto/rand"
   "encoding/binary"
+  "errors"
+  "fmt"
   "io"
+  "strconv"
 )
 
+// plaintext irc line
+const urcTypePlain = uint32(0x00000000)
+// arcd lan discovery beacon, never relayed past the local link
+const urcTypeBeacon = uint32(0xd1ce0001)
+// arcd peer exchange, never relayed past the link it came in on
+const urcTypePEX = uint32(0xd1ce0002)
+// sealed box to one identity key, relayed like plain lines
+// the body is a nacl crypto_box_seal to the box key of the recipient's identity key,
+// hubs do not open them, clients seal and open them with the nacl package
+const urcTypeSealed = uint32(0xd1ce0003)
+
+// name of a message type for logging
+func urcTypeName(t uint32) string {
+  switch t {
+  case urcTypePlain:
+    return "plain"
+  case urcTypeBeacon:
+    return "beacon"
+  case urcTypePEX:
+    return "pex"
+  case urcTypeSealed:
+    return "sealed"
+  }
+  return fmt.Sprintf("%08x", t)
+}
+
+// get a message type from its name as urcTypeName gives it
+func urcTypeByName(name string) (t uint32, ok bool) {
+  for _, known := range []uint32{urcTypePlain, urcTypeBeacon, urcTypePEX, urcTypeSealed} {
+    if name == urcTypeName(known) {
+      return known, true
+    }
+  }
+  if len(name) != 8 {
+    return
+  }
+  n, err := strconv.ParseUint(name, 16, 32)
+  if err == nil {
+    t, ok = uint32(n), true
+  }
+  return
+}
+
+// return true if a message was sent within age seconds of now either way, in taia64 seconds as timeNow gives
+func sentWithin(m Message, now, age uint64) bool {
+  sent := m.Sent()
+  if sent > now {
+    return sent - now <= age
+  }
+  return now - sent <= age
+}
+
+// return true if messages of this type must not be relayed
+func urcLinkLocal(t uint32) bool {
+  return t == urcTypeBeacon || t == urcTypePEX
+}
+
 type urcHeader [26]byte
 
 func (h urcHeader) Length() uint16 {
@@ -57,17 +117,40 @@ func (urc urcProtocol) ReadMessage(r io.Reader) (msg urcMessage, err error) {
   return
 }
 
+// parse a urc message from a single datagram
+func urcMessageFromBytes(b []byte) (msg urcMessage, err error) {
+  if len(b) < len(msg.hdr) {
+    err = errors.New("urc message too short")
+    return
+  }
+  copy(msg.hdr[:], b)
+  l := int(msg.hdr.Length())
+  if l != len(b) - len(msg.hdr) {
+    err = errors.New("urc message length mismatch")
+    return
+  }
+  msg.body = make([]byte, l)
+  copy(msg.body, b[len(msg.hdr):])
+  return
+}
 
 type urcConnection io.ReadWriteCloser
 
-func urcMessageFromURCLine(line string) urcMessage {
-  var hdr urcHeader
-  // random bytes
-  io.ReadFull(rand.Reader, hdr[18:])
+// create a new urc message of a given type
+func newURCMessage(t uint32, body []byte) (msg urcMessage) {
   // length
-  binary.BigEndian.PutUint16(hdr[:2], uint16(len(line)))
-  return urcMessage{
-    body: []byte(line),
-    hdr: hdr,
-  }
+  binary.BigEndian.PutUint16(msg.hdr[:2], uint16(len(body)))
+  // timestamp
+  binary.BigEndian.PutUint64(msg.hdr[2:10], timeNow())
+  // type
+  binary.BigEndian.PutUint32(msg.hdr[14:18], t)
+  // random bytes
+  io.ReadFull(rand.Reader, msg.hdr[18:])
+  msg.body = body
+  return
+}
+
+// create a new plaintext irc line message
+func urcMessageFromURCLine(line string) urcMessage {
+  return newURCMessage(urcTypePlain, []byte(line))
 }
@@ -4,7 +4,9 @@
 package arc
 
 import (
+  "io/ioutil"
   "os"
+  "path/filepath"
   "time"
 )
 
@@ -16,6 +18,33 @@ func checkFile(fname string) bool {
   return true
 }
 
+// write a file through a temp file next to it so a crash leaves the old or the new file, never half of one
+func writeFileAtomic(fname string, data []byte, perm os.FileMode) (err error) {
+  var f *os.File
+  f, err = ioutil.TempFile(filepath.Dir(fname), filepath.Base(fname) + ".")
+  if err != nil {
+    return
+  }
+  tmp := f.Name()
+  _, err = f.Write(data)
+  if err == nil {
+    err = f.Sync()
+  }
+  if cerr := f.Close(); err == nil {
+    err = cerr
+  }
+  if err == nil {
+    err = os.Chmod(tmp, perm)
+  }
+  if err == nil {
+    err = os.Rename(tmp, fname)
+  }
+  if err != nil {
+    os.Remove(tmp)
+  }
+  return
+}
+
 func timeNow() uint64 {
   // because taia96
   return uint64(time.Now().Unix() + 4611686018427387914)
@@ -0,0 +1,310 @@
+//
+// validate.go -- config validation
+//
+
+package arc
+
+import (
+  "bytes"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "net"
+  "reflect"
+  "strings"
+)
+
+// proxy types we know how to use
+var knownProxyTypes = []string{"", "socks", "i2p-sam"}
+
+// local config fields that can change without a restart
+var reloadableFields = []string{"Bind", "TLSBind", "TLSPeers", "Announce", "TargetOutbound", "SocksAddr", "SocksPort", "LogLevel",
+  "RateLimitAction", "PeerRate", "PeerBurst", "SenderRate", "SenderBurst", "GlobalRate", "GlobalBurst", "StampBits", "FilterRules"}
+
+// a problem with one config field
+type ConfigError struct {
+  // field path i.e. Remote[0].Port
+  Field string
+  // what is wrong with it
+  Reason string
+}
+
+func (e ConfigError) Error() string {
+  return e.Field + ": " + e.Reason
+}
+
+// all problems found in a config
+type ConfigErrors []ConfigError
+
+func (errs ConfigErrors) Error() string {
+  var lines []string
+  for _, e := range errs {
+    lines = append(lines, e.Error())
+  }
+  return "invalid config:\n  " + strings.Join(lines, "\n  ")
+}
+
+// collects config errors
+type configChecker struct {
+  errs ConfigErrors
+}
+
+func (c *configChecker) fail(field, format string, args ...interface{}) {
+  c.errs = append(c.errs, ConfigError{
+    Field: field,
+    Reason: fmt.Sprintf(format, args...),
+  })
+}
+
+// check a port number, zero is allowed if optional
+func (c *configChecker) port(field string, port int, optional bool) {
+  if optional && port == 0 {
+    return
+  }
+  if port <= 0 || port > 65535 {
+    c.fail(field, "port %d out of range 1-65535", port)
+  }
+}
+
+// check a host:port address, empty is allowed if optional
+func (c *configChecker) addr(field, addr string, optional bool) {
+  if optional && len(addr) == 0 {
+    return
+  }
+  _, port, err := net.SplitHostPort(addr)
+  if err != nil {
+    c.fail(field, "cannot parse address %q: %s, want host:port or [ipv6]:port", addr, err)
+    return
+  }
+  _, err = net.LookupPort("tcp", port)
+  if err != nil {
+    c.fail(field, "bad port in %q", addr)
+  }
+}
+
+// check a network interface exists, empty is allowed
+func (c *configChecker) iface(field, name string) {
+  if len(name) == 0 {
+    return
+  }
+  _, err := net.InterfaceByName(name)
+  if err != nil {
+    var names []string
+    ifaces, _ := net.Interfaces()
+    for _, ifi := range ifaces {
+      names = append(names, ifi.Name)
+    }
+    c.fail(field, "no network interface %q, have: %s", name, strings.Join(names, ", "))
+  }
+}
+
+// check a hex encoded ed25519 public key
+func (c *configChecker) pubkey(field, key string) {
+  k, err := hex.DecodeString(key)
+  if err != nil || len(k) != 32 {
+    c.fail(field, "%q is not a hex encoded 32 byte public key", key)
+  }
+}
+
+// check a remote hub
+func (c *configChecker) remote(field string, r RemoteHubConfig) {
+  if len(r.Addr) == 0 {
+    c.fail(field + ".Addr", "no address given")
+  }
+  known := false
+  for _, t := range knownProxyTypes {
+    if r.ProxyType == t {
+      known = true
+    }
+  }
+  if ! known {
+    c.fail(field + ".ProxyType", "unknown proxy type %q, want one of: socks, i2p-sam or empty for direct", r.ProxyType)
+  }
+  if len(r.ProxyType) > 0 {
+    if len(r.ProxyAddr) == 0 {
+      c.fail(field + ".ProxyAddr", "%s proxy needs an address", r.ProxyType)
+    }
+    c.port(field + ".ProxyPort", r.ProxyPort, false)
+  }
+  if r.ProxyType == "i2p-sam" {
+    if ! strings.HasSuffix(r.Addr, ".i2p") {
+      c.fail(field + ".Addr", "%q is not an .i2p address", r.Addr)
+    }
+  } else {
+    c.port(field + ".Port", r.Port, false)
+  }
+  if strings.HasSuffix(r.Addr, ".onion") && r.ProxyType != "socks" {
+    c.fail(field + ".ProxyType", "onion address %q needs a socks proxy", r.Addr)
+  }
+  if r.TLS {
+    c.pubkey(field + ".PinKey", r.PinKey)
+  }
+  if len(r.WebSocketPath) > 0 {
+    if ! r.WebSocket {
+      c.fail(field + ".WebSocketPath", "only websocket links have a path")
+    } else if ! strings.HasPrefix(r.WebSocketPath, "/") {
+      c.fail(field + ".WebSocketPath", "%q must start with /", r.WebSocketPath)
+    }
+  }
+}
+
+// check all config fields
+func (cfg Config) Validate() error {
+  c := new(configChecker)
+  for n, r := range cfg.Remote {
+    c.remote(fmt.Sprintf("Remote[%d]", n), r)
+  }
+  l := cfg.Local
+  c.addr("Local.Bind", l.Bind, true)
+  c.iface("Local.EtherBind", l.EtherBind)
+  c.port("Local.UDPPort", l.UDPPort, true)
+  c.iface("Local.UDPInterface", l.UDPInterface)
+  if len(l.UDPBroadcast) > 0 {
+    ip := net.ParseIP(l.UDPBroadcast)
+    if ip == nil || ip.To4() == nil {
+      c.fail("Local.UDPBroadcast", "%q is not an ipv4 address", l.UDPBroadcast)
+    }
+  }
+  if len(l.UDPGroup) > 0 {
+    ip := net.ParseIP(l.UDPGroup)
+    if ip == nil || ip.To4() != nil || ! ip.IsLinkLocalMulticast() {
+      c.fail("Local.UDPGroup", "%q is not an ipv6 link local multicast group", l.UDPGroup)
+    }
+  }
+  if l.DiscoveryInterval < 0 {
+    c.fail("Local.DiscoveryInterval", "must not be negative")
+  }
+  if l.MaxAutoPeers < 0 {
+    c.fail("Local.MaxAutoPeers", "must not be negative")
+  }
+  if l.TargetOutbound < 0 {
+    c.fail("Local.TargetOutbound", "must not be negative")
+  }
+  if len(l.SocksAddr) > 0 {
+    c.port("Local.SocksPort", l.SocksPort, false)
+  }
+  for n, a := range l.Announce {
+    c.addr(fmt.Sprintf("Local.Announce[%d]", n), a, false)
+  }
+  c.addr("Local.I2PSAM", l.I2PSAM, true)
+  if len(l.I2PSAM) > 0 && len(l.I2PKeys) == 0 {
+    c.fail("Local.I2PKeys", "accepting i2p inbound needs a destination key file")
+  }
+  c.addr("Local.TorControl", l.TorControl, true)
+  c.addr("Local.TLSBind", l.TLSBind, true)
+  for n, k := range l.TLSPeers {
+    c.pubkey(fmt.Sprintf("Local.TLSPeers[%d]", n), k)
+  }
+  c.addr("Local.WebSocketBind", l.WebSocketBind, true)
+  if len(l.WebSocketPath) > 0 && ! strings.HasPrefix(l.WebSocketPath, "/") {
+    c.fail("Local.WebSocketPath", "%q must start with /", l.WebSocketPath)
+  }
+  if _, err := ParseLogLevel(l.LogLevel); err != nil {
+    c.fail("Local.LogLevel", "unknown log level %q, want debug, info, warn or error", l.LogLevel)
+  }
+  known := false
+  for _, a := range knownRateLimitActions {
+    if l.RateLimitAction == a {
+      known = true
+    }
+  }
+  if ! known {
+    c.fail("Local.RateLimitAction", "unknown action %q, want drop, throttle or disconnect", l.RateLimitAction)
+  }
+  limits := []struct{
+    field string
+    n int
+  }{
+    {"Local.PeerRate", l.PeerRate},
+    {"Local.PeerBurst", l.PeerBurst},
+    {"Local.SenderRate", l.SenderRate},
+    {"Local.SenderBurst", l.SenderBurst},
+    {"Local.GlobalRate", l.GlobalRate},
+    {"Local.GlobalBurst", l.GlobalBurst},
+  }
+  for _, limit := range limits {
+    if limit.n < 0 {
+      c.fail(limit.field, "must not be negative")
+    }
+  }
+  c.addr("Local.MetricsBind", l.MetricsBind, true)
+  if l.StampBits < 0 || l.StampBits > maxStampBits {
+    c.fail("Local.StampBits", "%d out of range 0-%d", l.StampBits, maxStampBits)
+  }
+  if len(l.FilterRules) > 0 {
+    _, err := loadFilterRules(l.FilterRules)
+    if errs, ok := err.(ConfigErrors); ok {
+      for _, e := range errs {
+        c.fail("Local.FilterRules", "%s: %s: %s", l.FilterRules, e.Field, e.Reason)
+      }
+    } else if err != nil {
+      c.fail("Local.FilterRules", "%s", err)
+    }
+  }
+  if len(c.errs) > 0 {
+    return c.errs
+  }
+  return nil
+}
+
+// get the config fields that changed but need a restart to take effect
+func (cfg Config) RestartNeeded(next Config) (fields []string) {
+  // websocket links belong to the websocket hub which can't reload
+  ws := func(c Config) (remotes []RemoteHubConfig) {
+    for _, r := range c.Remote {
+      if r.WebSocket {
+        remotes = append(remotes, r)
+      }
+    }
+    return
+  }
+  if ! reflect.DeepEqual(ws(cfg), ws(next)) {
+    fields = append(fields, "Remote with WebSocket")
+  }
+  cur := reflect.ValueOf(cfg.Local)
+  nxt := reflect.ValueOf(next.Local)
+  t := cur.Type()
+  for i := 0; i < t.NumField(); i++ {
+    name := t.Field(i).Name
+    reloadable := false
+    for _, f := range reloadableFields {
+      if f == name {
+        reloadable = true
+      }
+    }
+    if ! reloadable && ! reflect.DeepEqual(cur.Field(i).Interface(), nxt.Field(i).Interface()) {
+      fields = append(fields, "Local." + name)
+    }
+  }
+  return
+}
+
+// turn a json decode error into something that says where the problem is
+// data is nil if we don't have the json the user wrote
+func jsonError(fname string, data []byte, err error) error {
+  // find line and column of a byte offset
+  pos := func(offset int64) string {
+    if data == nil {
+      return fname
+    }
+    if offset > int64(len(data)) {
+      offset = int64(len(data))
+    }
+    before := data[:offset]
+    line := bytes.Count(before, []byte("\n")) + 1
+    col := int(offset) - bytes.LastIndex(before, []byte("\n"))
+    return fmt.Sprintf("%s:%d:%d", fname, line, col)
+  }
+  switch e := err.(type) {
+  case *json.SyntaxError:
+    return fmt.Errorf("%s: %s", pos(e.Offset), e.Error())
+  case *json.UnmarshalTypeError:
+    return ConfigErrors{
+      ConfigError{
+        Field: e.Field,
+        Reason: fmt.Sprintf("%s: want %s, got %s", pos(e.Offset), e.Type.String(), e.Value),
+      },
+    }
+  }
+  return fmt.Errorf("%s: %s", fname, err.Error())
+}
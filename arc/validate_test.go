@@ -0,0 +1,167 @@
+//
+// validate_test.go -- config validation tests
+//
+
+package arc
+
+import (
+  "os"
+  "path/filepath"
+  "reflect"
+  "strings"
+  "testing"
+)
+
+// fields a config failed validation on
+func configErrorFields(err error) (fields []string) {
+  errs, _ := err.(ConfigErrors)
+  for _, e := range errs {
+    fields = append(fields, e.Field)
+  }
+  return
+}
+
+func TestValidateStampBits(t *testing.T) {
+  tests := []struct {
+    name string
+    stamp int
+    field string
+  }{
+    {"defaults", 0, ""},
+    {"stamp bits", 16, ""},
+    {"too many stamp bits", maxStampBits + 1, "Local.StampBits"},
+    {"negative stamp bits", -1, "Local.StampBits"},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      cfg := DefaultConfig()
+      cfg.Local.StampBits = tt.stamp
+      fields := configErrorFields(cfg.Validate())
+      if len(tt.field) == 0 && len(fields) > 0 {
+        t.Errorf("failed on %v", fields)
+      }
+      if len(tt.field) > 0 && (len(fields) != 1 || fields[0] != tt.field) {
+        t.Errorf("failed on %v, want %s", fields, tt.field)
+      }
+    })
+  }
+}
+
+func TestValidateRemote(t *testing.T) {
+  pin := strings.Repeat("ab", 32)
+  tests := []struct {
+    name string
+    remote RemoteHubConfig
+    fields []string
+  }{
+    {"direct", RemoteHubConfig{Addr: "192.0.2.1", Port: 6789}, nil},
+    {"no address", RemoteHubConfig{Port: 6789}, []string{"Remote[0].Addr"}},
+    {"no port", RemoteHubConfig{Addr: "192.0.2.1"}, []string{"Remote[0].Port"}},
+    {"port too big", RemoteHubConfig{Addr: "192.0.2.1", Port: 65536}, []string{"Remote[0].Port"}},
+    {"socks", RemoteHubConfig{Addr: "example.onion", Port: 6789, ProxyType: "socks", ProxyAddr: "127.0.0.1", ProxyPort: 9050}, nil},
+    {"unknown proxy", RemoteHubConfig{Addr: "192.0.2.1", Port: 6789, ProxyType: "http", ProxyAddr: "127.0.0.1", ProxyPort: 8080}, []string{"Remote[0].ProxyType"}},
+    {"proxy without address", RemoteHubConfig{Addr: "example.onion", Port: 6789, ProxyType: "socks", ProxyPort: 9050}, []string{"Remote[0].ProxyAddr"}},
+    {"proxy without port", RemoteHubConfig{Addr: "example.onion", Port: 6789, ProxyType: "socks", ProxyAddr: "127.0.0.1"}, []string{"Remote[0].ProxyPort"}},
+    {"onion without socks", RemoteHubConfig{Addr: "example.onion", Port: 6789}, []string{"Remote[0].ProxyType"}},
+    {"i2p needs no port", RemoteHubConfig{Addr: "example.i2p", ProxyType: "i2p-sam", ProxyAddr: "127.0.0.1", ProxyPort: 7656}, nil},
+    {"i2p without .i2p", RemoteHubConfig{Addr: "192.0.2.1", ProxyType: "i2p-sam", ProxyAddr: "127.0.0.1", ProxyPort: 7656}, []string{"Remote[0].Addr"}},
+    {"tls", RemoteHubConfig{Addr: "192.0.2.1", Port: 6697, TLS: true, PinKey: pin}, nil},
+    {"tls without pin", RemoteHubConfig{Addr: "192.0.2.1", Port: 6697, TLS: true}, []string{"Remote[0].PinKey"}},
+    {"tls with short pin", RemoteHubConfig{Addr: "192.0.2.1", Port: 6697, TLS: true, PinKey: "abcd"}, []string{"Remote[0].PinKey"}},
+    {"tls with bad pin", RemoteHubConfig{Addr: "192.0.2.1", Port: 6697, TLS: true, PinKey: strings.Repeat("zz", 32)}, []string{"Remote[0].PinKey"}},
+    {"websocket path", RemoteHubConfig{Addr: "hub.example", Port: 80, WebSocket: true, WebSocketPath: "/ws"}, nil},
+    {"path without websocket", RemoteHubConfig{Addr: "192.0.2.1", Port: 6789, WebSocketPath: "/ws"}, []string{"Remote[0].WebSocketPath"}},
+    {"relative websocket path", RemoteHubConfig{Addr: "hub.example", Port: 80, WebSocket: true, WebSocketPath: "ws"}, []string{"Remote[0].WebSocketPath"}},
+    {"everything wrong", RemoteHubConfig{ProxyType: "http", TLS: true}, []string{"Remote[0].Addr", "Remote[0].ProxyType", "Remote[0].ProxyAddr", "Remote[0].ProxyPort", "Remote[0].Port", "Remote[0].PinKey"}},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      cfg := DefaultConfig()
+      cfg.Remote = []RemoteHubConfig{tt.remote}
+      if fields := configErrorFields(cfg.Validate()); ! reflect.DeepEqual(fields, tt.fields) {
+        t.Errorf("failed on %v, want %v", fields, tt.fields)
+      }
+    })
+  }
+}
+
+func TestValidateLocal(t *testing.T) {
+  badRules := filepath.Join(t.TempDir(), "rules.json")
+  err := os.WriteFile(badRules, []byte(`{"Rules": [{"Line": "(", "Action": "drop"}]}`), 0600)
+  if err != nil {
+    t.Fatal(err)
+  }
+  tests := []struct {
+    name string
+    set func(*LocalHubConfig)
+    field string
+  }{
+    {"defaults", func(l *LocalHubConfig) {}, ""},
+    {"bind", func(l *LocalHubConfig) { l.Bind = "[::]:6789" }, ""},
+    {"bind without port", func(l *LocalHubConfig) { l.Bind = "0.0.0.0" }, "Local.Bind"},
+    {"bind with bad port", func(l *LocalHubConfig) { l.Bind = ":irc-ish" }, "Local.Bind"},
+    {"no such ether interface", func(l *LocalHubConfig) { l.EtherBind = "nosuchif0" }, "Local.EtherBind"},
+    {"udp port too big", func(l *LocalHubConfig) { l.UDPPort = 70000 }, "Local.UDPPort"},
+    {"negative udp port", func(l *LocalHubConfig) { l.UDPPort = -1 }, "Local.UDPPort"},
+    {"no such udp interface", func(l *LocalHubConfig) { l.UDPInterface = "nosuchif0" }, "Local.UDPInterface"},
+    {"negative discovery interval", func(l *LocalHubConfig) { l.DiscoveryInterval = -1 }, "Local.DiscoveryInterval"},
+    {"negative auto peers", func(l *LocalHubConfig) { l.MaxAutoPeers = -1 }, "Local.MaxAutoPeers"},
+    {"negative outbound", func(l *LocalHubConfig) { l.TargetOutbound = -1 }, "Local.TargetOutbound"},
+    {"socks", func(l *LocalHubConfig) { l.SocksAddr = "127.0.0.1"; l.SocksPort = 9050 }, ""},
+    {"socks without port", func(l *LocalHubConfig) { l.SocksPort = 0 }, "Local.SocksPort"},
+    {"no socks", func(l *LocalHubConfig) { l.SocksAddr = ""; l.SocksPort = 0 }, ""},
+    {"announce", func(l *LocalHubConfig) { l.Announce = []string{"example.onion:6789"} }, ""},
+    {"announce without port", func(l *LocalHubConfig) { l.Announce = []string{"example.onion:6789", "example.i2p"} }, "Local.Announce[1]"},
+    {"i2p", func(l *LocalHubConfig) { l.I2PSAM = "127.0.0.1:7656"; l.I2PKeys = "i2p.key" }, ""},
+    {"bad i2p sam", func(l *LocalHubConfig) { l.I2PSAM = "127.0.0.1"; l.I2PKeys = "i2p.key" }, "Local.I2PSAM"},
+    {"i2p without keys", func(l *LocalHubConfig) { l.I2PSAM = "127.0.0.1:7656" }, "Local.I2PKeys"},
+    {"bad tor control", func(l *LocalHubConfig) { l.TorControl = "9051" }, "Local.TorControl"},
+    {"bad tls bind", func(l *LocalHubConfig) { l.TLSBind = "6697" }, "Local.TLSBind"},
+    {"tls peers", func(l *LocalHubConfig) { l.TLSPeers = []string{strings.Repeat("ab", 32)} }, ""},
+    {"bad tls peer", func(l *LocalHubConfig) { l.TLSPeers = []string{strings.Repeat("ab", 32), "ab"} }, "Local.TLSPeers[1]"},
+    {"bad websocket bind", func(l *LocalHubConfig) { l.WebSocketBind = "localhost" }, "Local.WebSocketBind"},
+    {"websocket path", func(l *LocalHubConfig) { l.WebSocketPath = "/ws" }, ""},
+    {"relative websocket path", func(l *LocalHubConfig) { l.WebSocketPath = "ws" }, "Local.WebSocketPath"},
+    {"log level", func(l *LocalHubConfig) { l.LogLevel = "debug" }, ""},
+    {"unknown log level", func(l *LocalHubConfig) { l.LogLevel = "loud" }, "Local.LogLevel"},
+    {"rate limit action", func(l *LocalHubConfig) { l.RateLimitAction = rateLimitThrottle }, ""},
+    {"unknown rate limit action", func(l *LocalHubConfig) { l.RateLimitAction = "ban" }, "Local.RateLimitAction"},
+    {"negative peer rate", func(l *LocalHubConfig) { l.PeerRate = -1 }, "Local.PeerRate"},
+    {"negative peer burst", func(l *LocalHubConfig) { l.PeerBurst = -1 }, "Local.PeerBurst"},
+    {"negative sender rate", func(l *LocalHubConfig) { l.SenderRate = -1 }, "Local.SenderRate"},
+    {"negative sender burst", func(l *LocalHubConfig) { l.SenderBurst = -1 }, "Local.SenderBurst"},
+    {"negative global rate", func(l *LocalHubConfig) { l.GlobalRate = -1 }, "Local.GlobalRate"},
+    {"negative global burst", func(l *LocalHubConfig) { l.GlobalBurst = -1 }, "Local.GlobalBurst"},
+    {"bad metrics bind", func(l *LocalHubConfig) { l.MetricsBind = "localhost" }, "Local.MetricsBind"},
+    {"missing filter rules", func(l *LocalHubConfig) { l.FilterRules = filepath.Join(t.TempDir(), "none.json") }, "Local.FilterRules"},
+    {"bad filter rule", func(l *LocalHubConfig) { l.FilterRules = badRules }, "Local.FilterRules"},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      cfg := DefaultConfig()
+      tt.set(&cfg.Local)
+      fields := configErrorFields(cfg.Validate())
+      if len(tt.field) == 0 && len(fields) > 0 {
+        t.Errorf("failed on %v", fields)
+      }
+      if len(tt.field) > 0 && (len(fields) != 1 || fields[0] != tt.field) {
+        t.Errorf("failed on %v, want %s", fields, tt.field)
+      }
+    })
+  }
+}
+
+// the field a filter rule fails on is part of the reason
+func TestValidateFilterRuleReason(t *testing.T) {
+  fname := filepath.Join(t.TempDir(), "rules.json")
+  err := os.WriteFile(fname, []byte(`{"Rules": [{"Action": "drop"}, {"Action": "keep"}]}`), 0600)
+  if err != nil {
+    t.Fatal(err)
+  }
+  cfg := DefaultConfig()
+  cfg.Local.FilterRules = fname
+  errs, ok := cfg.Validate().(ConfigErrors)
+  if ! ok || len(errs) != 1 || ! strings.Contains(errs[0].Reason, "Rules[1].Action") {
+    t.Errorf("got %v", errs)
+  }
+}
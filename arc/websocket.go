@@ -0,0 +1,292 @@
+//
+// websocket.go -- websocket hub for browser clients
+//
+
+package arc
+
+import (
+  "crypto/tls"
+  "errors"
+  "log/slog"
+  "net"
+  "net/http"
+  "net/url"
+  "strconv"
+  "time"
+  "golang.org/x/net/websocket"
+)
+
+// default http path we serve urc on
+const defaultWebSocketPath = "/urc"
+
+// how long we wait on a slow websocket before dropping it
+const webSocketWriteTimeout = 5 * time.Second
+
+type wsHub struct {
+  // http listen address
+  bind string
+  // http path
+  path string
+  // allowed origins, empty allows any
+  origins []string
+  // send broadcast message channel
+  broadcast chan Message
+  // inbound message seen channel
+  ib chan connMessage
+  // register connection channel
+  registerConn chan *websocket.Conn
+  // deregister connection channel
+  deregisterConn chan *websocket.Conn
+  // connection map
+  conns map[*websocket.Conn]*bloomFilter
+  // http server
+  server *http.Server
+  // message router
+  router Router
+  // closed when the hub closes
+  stop chan struct{}
+  log *slog.Logger
+}
+
+func (h wsHub) Send(m Message) {
+  h.broadcast <- m
+}
+
+// websocket config for a link to a remote hub
+// the origin is the hub itself so the link is a same origin request
+// wss links only accept the hub with the pinned identity key, not a ca signed certificate
+func webSocketConfig(c RemoteHubConfig) (cfg *websocket.Config, err error) {
+  host := net.JoinHostPort(c.Addr, strconv.Itoa(c.Port))
+  path := c.WebSocketPath
+  if len(path) == 0 {
+    path = defaultWebSocketPath
+  }
+  u := url.URL{Scheme: "ws", Host: host, Path: path}
+  origin := url.URL{Scheme: "http", Host: host}
+  if c.TLS {
+    u.Scheme = "wss"
+    origin.Scheme = "https"
+  }
+  cfg, err = websocket.NewConfig(u.String(), origin.String())
+  if err == nil && c.TLS {
+    if len(c.PinKey) == 0 {
+      err = errors.New("wss hub has no PinKey")
+      return
+    }
+    cfg.TlsConfig = &tls.Config{
+      MinVersion: tls.VersionTLS13,
+      // we check the pinned key instead of a ca chain
+      InsecureSkipVerify: true,
+      VerifyPeerCertificate: tlsPinVerifier([]string{c.PinKey}),
+    }
+  }
+  return
+}
+
+// persist an outbound websocket link to a remote hub until the hub closes
+func (h wsHub) Persist(c RemoteHubConfig) {
+  cfg, err := webSocketConfig(c)
+  if err != nil {
+    h.log.Error("cannot persist websocket hub", "peer", c.Addr, "err", err)
+    return
+  }
+  plog := h.log.With("peer", cfg.Location.String())
+  plog.Info("persist websocket hub")
+  go func() {
+    for {
+      // cooldown
+      select {
+      case <- h.stop:
+        return
+      case <- time.After(time.Second):
+      }
+      conn, err := websocket.DialConfig(cfg)
+      if err == nil {
+        plog.Info("connected to websocket hub")
+        done := make(chan struct{})
+        go func() {
+          // hang up when the hub closes
+          select {
+          case <- h.stop:
+            conn.Close()
+          case <- done:
+          }
+        }()
+        h.handleWS(conn)
+        close(done)
+      } else {
+        plog.Warn("cannot connect to websocket hub", "err", err)
+      }
+    }
+  }()
+}
+
+// check origin of a browser, non browser clients don't send one
+// same origin requests are always allowed, that is what other hubs send
+func (h wsHub) handshake(cfg *websocket.Config, r *http.Request) error {
+  origin := r.Header.Get("Origin")
+  if len(origin) == 0 || len(h.origins) == 0 {
+    return nil
+  }
+  for _, o := range h.origins {
+    if o == origin {
+      return nil
+    }
+  }
+  if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+    return nil
+  }
+  return errors.New("origin not allowed: "+origin)
+}
+
+// handle a websocket connection inbound outbound doesn't matter
+func (h wsHub) handleWS(conn *websocket.Conn) {
+  conn.MaxPayloadBytes = len(urcHeader{}) + 65535
+  conn.PayloadType = websocket.BinaryFrame
+  select {
+  case h.registerConn <- conn:
+  case <- h.stop:
+    conn.Close()
+    return
+  }
+  // the remote address of a server side conn is the origin, nil if it sent none
+  var peer string
+  if conn.IsServerConn() {
+    peer = conn.Request().RemoteAddr
+  } else {
+    peer = conn.RemoteAddr().String()
+  }
+  clog := h.log.With("peer", peer)
+  limit := routerLimiter(h.router).source()
+  for {
+    var data []byte
+    err := websocket.Message.Receive(conn, &data)
+    if err != nil {
+      clog.Info("error in websocket handler", "err", err)
+      break
+    }
+    msg, err := urcMessageFromBytes(data)
+    if err != nil {
+      clog.Info("invalid urc frame from websocket", "err", err)
+      break
+    }
+    clog.Debug("got urc", "type", urcTypeName(msg.Type()), "len", len(data))
+    verdict := limit.admit(msg)
+    if verdict == rateDisconnect {
+      clog.Warn("disconnecting peer over rate limit")
+      break
+    } else if verdict == rateDrop {
+      clog.Debug("dropped urc over rate limit", "type", urcTypeName(msg.Type()))
+      continue
+    }
+    // mark it as seen on this connection before the router can relay it back
+    select {
+    case h.ib <- connMessage{conn, msg}:
+    case <- h.stop:
+      conn.Close()
+      return
+    }
+    h.router.InboundChan() <- msg
+  }
+  select {
+  case h.deregisterConn <- conn:
+  case <- h.stop:
+    conn.Close()
+  }
+}
+
+// write a message to a websocket
+func (h wsHub) write(conn *websocket.Conn, b []byte) error {
+  conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+  return websocket.Message.Send(conn, b)
+}
+
+// http handler serving urc on our path
+func (h wsHub) handler() http.Handler {
+  mux := http.NewServeMux()
+  mux.Handle(h.path, websocket.Server{
+    Handshake: h.handshake,
+    Handler: h.handleWS,
+  })
+  return mux
+}
+
+func (h wsHub) Run() {
+  h.log.Info("run websocket hub", "bind", h.bind, "path", h.path)
+  h.server.Handler = h.handler()
+  go func() {
+    err := h.server.ListenAndServe()
+    if err != http.ErrServerClosed {
+      h.log.Error("websocket server failed", "err", err)
+    }
+  }()
+  h.relay()
+}
+
+// relay messages between our websockets until the hub closes
+func (h wsHub) relay() {
+  for {
+    select {
+    case c := <- h.registerConn:
+      h.conns[c] = new(bloomFilter)
+    case c := <- h.deregisterConn:
+      delete(h.conns, c)
+      c.Close()
+    case m := <- h.ib:
+      if f, ok := h.conns[m.conn.(*websocket.Conn)]; ok {
+        // don't send it back the way it came
+        f.Add(m.msg.RawBytes())
+      }
+    case m, ok := <- h.broadcast:
+      if ! ok {
+        return
+      }
+      b := m.RawBytes()
+      h.log.Debug("broadcast urc", "type", urcTypeName(m.Type()), "len", len(b))
+      for c, f := range h.conns {
+        if f.Contains(b) {
+          // filter hit
+        } else {
+          f.Add(b)
+          err := h.write(c, b)
+          if err != nil {
+            h.log.Info("failed to write to websocket", "err", err)
+            delete(h.conns, c)
+            c.Close()
+          }
+        }
+      }
+    }
+  }
+}
+
+func (h wsHub) Close() {
+  close(h.stop)
+  h.server.Close()
+  close(h.broadcast)
+}
+
+// create a hub serving urc frames over websocket
+// bind is the http listen address, path the http path to serve on
+// origins are the allowed browser origins, empty allows any
+func CreateWebSocketHub(bind, path string, origins []string, r Router, logger *slog.Logger) Hub {
+  if len(path) == 0 {
+    path = defaultWebSocketPath
+  }
+  return wsHub{
+    bind: bind,
+    path: path,
+    origins: origins,
+    broadcast: make(chan Message),
+    ib: make(chan connMessage),
+    registerConn: make(chan *websocket.Conn),
+    deregisterConn: make(chan *websocket.Conn),
+    conns: make(map[*websocket.Conn]*bloomFilter),
+    server: &http.Server{
+      Addr: bind,
+    },
+    router: r,
+    stop: make(chan struct{}),
+    log: logger.With("hub", "websocket"),
+  }
+}
@@ -0,0 +1,193 @@
+//
+// websocket_test.go -- tests for the websocket hub
+//
+
+package arc
+
+import (
+  "crypto/tls"
+  "encoding/hex"
+  "io"
+  "log"
+  "net"
+  "net/http/httptest"
+  "net/url"
+  "strconv"
+  "testing"
+  "time"
+  "github.com/majestrate/arcd/nacl"
+  "golang.org/x/net/websocket"
+)
+
+// a router that only collects what hubs give it
+type testRouter struct {
+  ib chan Message
+}
+
+func (r testRouter) InboundChan() chan Message {
+  return r.ib
+}
+
+func (r testRouter) Run(hubs ...Hub) {
+}
+
+func newTestRouter() testRouter {
+  return testRouter{make(chan Message, 64)}
+}
+
+// a websocket hub served on a loopback test server, closed when the test ends
+func newTestWSHub(t *testing.T, origins []string, serverTLS *tls.Config) (wsHub, testRouter, *httptest.Server) {
+  r := newTestRouter()
+  h := CreateWebSocketHub("", "", origins, r, testLogger).(wsHub)
+  ts := httptest.NewUnstartedServer(h.handler())
+  // refused handshakes are what some tests want
+  ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+  if serverTLS == nil {
+    ts.Start()
+  } else {
+    ts.TLS = serverTLS
+    ts.StartTLS()
+  }
+  go h.relay()
+  t.Cleanup(func() {
+    h.Close()
+    ts.Close()
+  })
+  return h, r, ts
+}
+
+// remote config for a test server
+func testWSRemote(t *testing.T, ts *httptest.Server) RemoteHubConfig {
+  u, err := url.Parse(ts.URL)
+  if err != nil {
+    t.Fatal(err)
+  }
+  host, port, err := net.SplitHostPort(u.Host)
+  if err != nil {
+    t.Fatal(err)
+  }
+  c := RemoteHubConfig{Addr: host, WebSocket: true}
+  c.Port, _ = strconv.Atoi(port)
+  return c
+}
+
+// keep sending new messages on a hub until a router gets one of them
+func relayUntil(t *testing.T, from wsHub, to testRouter) {
+  t.Helper()
+  deadline := time.After(10 * time.Second)
+  for {
+    m := urcMessageFromURCLine(":nick!user@host PRIVMSG #arcd :hi")
+    from.Send(m)
+    select {
+    case got := <- to.ib:
+      if string(got.RawBytes()) != string(m.RawBytes()) {
+        // an earlier one that was still on its way is fine too
+        if got.Line() != m.Line() {
+          t.Fatalf("relayed %q", got.Line())
+        }
+      }
+      return
+    case <- time.After(100 * time.Millisecond):
+    case <- deadline:
+      t.Fatal("message never relayed")
+    }
+  }
+}
+
+func TestWebSocketRelay(t *testing.T) {
+  server, serverRouter, ts := newTestWSHub(t, []string{"https://allowed.example"}, nil)
+  client, clientRouter, _ := newTestWSHub(t, nil, nil)
+  // the link sends its own origin which is allowed even with an origin list
+  client.Persist(testWSRemote(t, ts))
+  relayUntil(t, server, clientRouter)
+  relayUntil(t, client, serverRouter)
+}
+
+func TestWebSocketOrigins(t *testing.T) {
+  _, _, ts := newTestWSHub(t, []string{"https://allowed.example"}, nil)
+  location := "ws" + ts.URL[len("http"):] + defaultWebSocketPath
+  tests := []struct {
+    origin string
+    ok bool
+  }{
+    {"https://allowed.example", true},
+    {ts.URL, true},
+    {"https://evil.example", false},
+    {"http://allowed.example", false},
+  }
+  for _, tt := range tests {
+    conn, err := websocket.Dial(location, "", tt.origin)
+    if err == nil {
+      conn.Close()
+    }
+    if (err == nil) != tt.ok {
+      t.Errorf("origin %s gave %v", tt.origin, err)
+    }
+  }
+  conn, err := websocket.Dial("ws" + ts.URL[len("http"):] + "/elsewhere", "", ts.URL)
+  if err == nil {
+    conn.Close()
+    t.Error("connected on another path")
+  }
+}
+
+func TestWebSocketPins(t *testing.T) {
+  kp := nacl.GenSignKeypair()
+  defer kp.Free()
+  cert, err := tlsCertificate(identitySigner{kp})
+  if err != nil {
+    t.Fatal(err)
+  }
+  _, _, ts := newTestWSHub(t, nil, &tls.Config{Certificates: []tls.Certificate{cert}})
+  other := nacl.GenSignKeypair()
+  defer other.Free()
+  tests := []struct {
+    name, pin string
+    ok bool
+  }{
+    {"pinned key", hex.EncodeToString(kp.Public()), true},
+    {"wrong key", hex.EncodeToString(other.Public()), false},
+    {"no key", "", false},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      c := testWSRemote(t, ts)
+      c.TLS = true
+      c.PinKey = tt.pin
+      cfg, err := webSocketConfig(c)
+      if err == nil {
+        var conn *websocket.Conn
+        conn, err = websocket.DialConfig(cfg)
+        if err == nil {
+          conn.Close()
+        }
+      }
+      if (err == nil) != tt.ok {
+        t.Errorf("gave %v", err)
+      }
+    })
+  }
+}
+
+func TestWebSocketConfig(t *testing.T) {
+  cfg, err := webSocketConfig(RemoteHubConfig{Addr: "2001:db8::1", Port: 8080, WebSocket: true, WebSocketPath: "/arcd"})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if s := cfg.Location.String(); s != "ws://[2001:db8::1]:8080/arcd" {
+    t.Errorf("location %s", s)
+  }
+  if s := cfg.Origin.String(); s != "http://[2001:db8::1]:8080" {
+    t.Errorf("origin %s", s)
+  }
+  cfg, err = webSocketConfig(RemoteHubConfig{Addr: "hub.example", Port: 443, WebSocket: true, TLS: true, PinKey: "00"})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if s := cfg.Location.String(); s != "wss://hub.example:443/urc" {
+    t.Errorf("location %s", s)
+  }
+  if cfg.TlsConfig == nil || cfg.TlsConfig.VerifyPeerCertificate == nil {
+    t.Error("wss link does not check the pinned key")
+  }
+}
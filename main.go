@@ -1,35 +1,352 @@
 package main
 
 import (
+  "errors"
+  "flag"
+  "fmt"
   "github.com/majestrate/arcd/arc"
+  "github.com/majestrate/arcd/nacl"
+  "log/slog"
+  "net"
   "os"
+  "os/signal"
+  "strconv"
+  "syscall"
 )
 
+// command line flags, these override the config file and environment
+var (
+  configFile = flag.String("config", "config.json", "config file, format by extension: .json, .toml, .yaml")
+  bind = flag.String("bind", "", "hub listen address")
+  keys = flag.String("keys", "", "identity key file")
+  etherBind = flag.String("ether", "", "network interface for the ethernet hub")
+  udpPort = flag.Int("udp-port", 0, "udp hub port")
+  addrBook = flag.String("addrbook", "", "address book file")
+  tlsBind = flag.String("tls-bind", "", "tls listen address")
+  wsBind = flag.String("ws-bind", "", "websocket listen address")
+  noDiscovery = flag.Bool("no-discovery", false, "don't announce or discover hubs on the local link")
+  defaults = flag.Bool("defaults", false, "run from built in defaults if the config file does not exist")
+  logLevelName = flag.String("log-level", "", "log level: debug, info, warn or error")
+  passphraseFD = flag.Int("passphrase-fd", -1, "read key file passphrases from this file descriptor, one per line")
+  encrypt = flag.Bool("encrypt", false, "init: encrypt the new identity key with a passphrase")
+  remotes []arc.RemoteHubConfig
+)
+
+// current log level, set from config and flags
+var logLevel = new(slog.LevelVar)
+
+func init() {
+  flag.Func("remote", "add a direct `host:port` remote hub, can be given more than once", func(s string) error {
+    host, p, err := net.SplitHostPort(s)
+    if err != nil {
+      return err
+    }
+    port, err := strconv.Atoi(p)
+    if err != nil {
+      return err
+    }
+    remotes = append(remotes, arc.RemoteHubConfig{
+      Addr: host,
+      Port: port,
+    })
+    return nil
+  })
+  flag.Usage = func() {
+    out := flag.CommandLine.Output()
+    fmt.Fprintf(out, "usage: %s [flags] [init | peers | passwd] [flags]\n\n", os.Args[0])
+    fmt.Fprintln(out, "init writes a new config file and identity key using the flags given")
+    fmt.Fprintln(out, "peers shows known hubs ranked best first")
+    fmt.Fprintln(out, "passwd changes the identity key passphrase, an empty one stores it in the clear")
+    fmt.Fprintln(out, "config fields can be overridden with ARCD_* environment variables")
+    fmt.Fprintln(out, "i.e. ARCD_LOCAL_BIND or ARCD_REMOTE_0_ADDR")
+    fmt.Fprintln(out, "key file passphrases come from -passphrase-fd, ARCD_PASSPHRASE or the terminal")
+    fmt.Fprint(out, "new ones from -passphrase-fd, ARCD_NEW_PASSPHRASE or the terminal\n\n")
+    flag.PrintDefaults()
+  }
+}
+
+// apply the flags given on the command line to a config
+func overrides() func(*arc.Config) {
+  set := make(map[string]bool)
+  flag.Visit(func(f *flag.Flag) {
+    set[f.Name] = true
+  })
+  return func(cfg *arc.Config) {
+    if set["bind"] {
+      cfg.Local.Bind = *bind
+    }
+    if set["keys"] {
+      cfg.Local.Keys = *keys
+    }
+    if set["ether"] {
+      cfg.Local.EtherBind = *etherBind
+    }
+    if set["udp-port"] {
+      cfg.Local.UDPPort = *udpPort
+    }
+    if set["addrbook"] {
+      cfg.Local.AddrBook = *addrBook
+    }
+    if set["tls-bind"] {
+      cfg.Local.TLSBind = *tlsBind
+    }
+    if set["ws-bind"] {
+      cfg.Local.WebSocketBind = *wsBind
+    }
+    if set["no-discovery"] {
+      cfg.Local.NoDiscovery = *noDiscovery
+    }
+    if set["log-level"] {
+      cfg.Local.LogLevel = *logLevelName
+    }
+    cfg.Remote = append(cfg.Remote, remotes...)
+  }
+}
+
+// print an error for the user and exit
+func die(err interface{}) {
+  fmt.Fprintln(os.Stderr, err)
+  os.Exit(1)
+}
+
+// set the log level from config, it was validated already
+func setLogLevel(cfg arc.Config) {
+  level, _ := arc.ParseLogLevel(cfg.Local.LogLevel)
+  logLevel.Set(level)
+}
+
+// where we get the identity key passphrase from
+func passphraseFunc() arc.PassphraseFunc {
+  if *passphraseFD >= 0 {
+    return arc.PassphraseFromFD(uintptr(*passphraseFD))
+  }
+  if _, ok := os.LookupEnv("ARCD_PASSPHRASE"); ok {
+    return arc.PassphraseFromEnv("ARCD_PASSPHRASE")
+  }
+  return arc.PassphrasePrompt("identity key passphrase", false)
+}
+
+// return true if the user gave us a passphrase source instead of leaving us to prompt
+func explicitPassphrase() bool {
+  _, ok := os.LookupEnv("ARCD_PASSPHRASE")
+  return *passphraseFD >= 0 || ok
+}
+
+// where we get a new identity key passphrase from
+// reads the line after the current passphrase when using -passphrase-fd
+func newPassphraseFunc(current arc.PassphraseFunc) arc.PassphraseFunc {
+  if *passphraseFD >= 0 {
+    return current
+  }
+  if _, ok := os.LookupEnv("ARCD_NEW_PASSPHRASE"); ok {
+    return arc.PassphraseFromEnv("ARCD_NEW_PASSPHRASE")
+  }
+  return arc.PassphrasePrompt("new identity key passphrase", true)
+}
+
+// set a new identity key passphrase
+func passwd(cfg arc.Config, newPassphrase arc.PassphraseFunc) {
+  if len(cfg.Local.Keys) == 0 {
+    die("no identity key file configured")
+  }
+  // check the current passphrase before asking for a new one
+  err := arc.UnlockIdentity(cfg.Local.Keys)
+  if err != nil {
+    die(err)
+  }
+  pass, err := newPassphrase()
+  if err != nil {
+    die(err)
+  }
+  err = arc.ChangeKeyPassphrase(cfg.Local.Keys, pass)
+  if err != nil {
+    die(err)
+  }
+}
+
+// print known hubs ranked best first
+func peers(cfg arc.Config) {
+  if len(cfg.Local.AddrBook) == 0 {
+    die("no address book configured")
+  }
+  err := arc.PrintAddrBook(cfg.Local.AddrBook, os.Stdout)
+  if err != nil {
+    die(err)
+  }
+}
+
+// reload config on SIGHUP
+func reload(fname string, cfg arc.Config, hub arc.Hub, router arc.Router, logger *slog.Logger, override func(*arc.Config)) {
+  hup := make(chan os.Signal, 1)
+  signal.Notify(hup, syscall.SIGHUP)
+  for range hup {
+    logger.Info("reloading config", "file", fname)
+    next, err := arc.LoadConfig(fname, logger, override)
+    if errs, ok := err.(arc.ConfigErrors); ok {
+      for _, e := range errs {
+        logger.Error("not reloading invalid config", "field", e.Field, "reason", e.Reason)
+      }
+      continue
+    } else if err != nil {
+      logger.Error("not reloading config", "err", err)
+      continue
+    }
+    setLogLevel(next)
+    for _, field := range cfg.RestartNeeded(next) {
+      logger.Warn("config change needs a restart", "field", field)
+    }
+    if r, ok := hub.(arc.Reloader); ok {
+      r.Reload(next)
+    }
+    if r, ok := router.(arc.Reloader); ok {
+      r.Reload(next)
+    }
+    cfg = next
+  }
+}
+
 func main() {
-  fname := "config.json"
-  if len(os.Args) > 1 {
-    fname = os.Args[1]
+  flag.Parse()
+  cmd := flag.Arg(0)
+  if len(cmd) > 0 {
+    // flags can come after the command too
+    flag.CommandLine.Parse(flag.Args()[1:])
+  }
+  if flag.NArg() > 0 || (len(cmd) > 0 && cmd != "peers" && cmd != "init" && cmd != "passwd") {
+    flag.Usage()
+    os.Exit(2)
+  }
+  fname := *configFile
+  override := overrides()
+
+  logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+  slog.SetDefault(logger)
+  nacl.SetLogger(logger)
+  if level, err := arc.ParseLogLevel(*logLevelName); err == nil {
+    // so we see config loading at debug
+    logLevel.Set(level)
+  } else {
+    die(err)
+  }
+
+  current := passphraseFunc()
+  arc.SetPassphraseFunc(current)
+  if explicitPassphrase() {
+    // a key made because the key file is missing is encrypted too
+    arc.SetNewKeyPassphraseFunc(current)
+  }
+
+  if cmd == "init" {
+    // ask first so the new key is never written in the clear
+    var pass []byte
+    if *encrypt {
+      var err error
+      pass, err = newPassphraseFunc(current)()
+      if err != nil {
+        die(err)
+      }
+    }
+    _, err := arc.InitConfigPassphrase(fname, pass, logger, override)
+    if err != nil {
+      die(err)
+    }
+    return
   }
   
-  cfg := arc.LoadConfig(fname)
+  cfg, err := arc.LoadConfig(fname, logger, override)
+  if errors.Is(err, arc.ErrNoConfig) {
+    if ! *defaults {
+      die(fmt.Sprintf("%s, run %s init to make one or use -defaults", err, os.Args[0]))
+    }
+    logger.Warn("no config file, using defaults", "file", fname)
+    fname = ""
+    cfg, err = arc.LoadConfig(fname, logger, override)
+  }
+  if err != nil {
+    die(err)
+  }
+  setLogLevel(cfg)
+  nacl.SetSecureMemory(cfg.Local.SecureMemory)
+
+  if cmd == "peers" {
+    peers(cfg)
+    return
+  }
+  if cmd == "passwd" {
+    passwd(cfg, newPassphraseFunc(current))
+    return
+  }
+
+  // ask for the passphrase now rather than when a hub first needs the key
+  if len(cfg.Local.Keys) > 0 {
+    err = arc.UnlockIdentity(cfg.Local.Keys)
+    if err != nil {
+      die(err)
+    }
+  }
+
+  router := arc.NewBroadcastRouter(cfg.Local, logger)
 
-  router := arc.NewBroadcastRouter(cfg.Local.Keys)
+  hub := arc.CreateHub(cfg.Local, router, logger)
 
-  var eth arc.Hub
+  var ws arc.Hub
+  if len(cfg.Local.WebSocketBind) > 0 {
+    ws = arc.CreateWebSocketHub(cfg.Local.WebSocketBind, cfg.Local.WebSocketPath, cfg.Local.WebSocketOrigins, router, logger)
+  }
+
+  // persisting them all at once drops configured hubs an older config left in the address book
+  all, persistAll := hub.(arc.RemotesPersister)
+  if persistAll {
+    all.PersistAll(cfg.Remote)
+  }
+  for _, remote := range cfg.Remote {
+    if remote.WebSocket {
+      if ws == nil {
+        logger.Warn("websocket hub needs WebSocketBind", "peer", remote.Addr)
+      } else {
+        ws.Persist(remote)
+      }
+    } else if ! persistAll {
+      hub.Persist(remote)
+    }
+  }
+
+  // local link hubs
+  var lan []arc.Hub
+  // router for local link hubs
+  lanRouter := router
+  
+  discover := ! cfg.Local.NoDiscovery && (len(cfg.Local.EtherBind) > 0 || cfg.Local.UDPPort > 0)
+  if discover {
+    lanRouter = arc.NewDiscoveryRouter(cfg.Local, hub, router, logger)
+  }
   
   if len(cfg.Local.EtherBind) > 0 {
-    eth = arc.CreateEthernetHub(cfg.Local.EtherBind, router)
+    eth := arc.CreateEthernetHub(cfg.Local.EtherBind, lanRouter, logger)
+    lan = append(lan, eth)
+  }
+
+  if cfg.Local.UDPPort > 0 {
+    udp := arc.CreateUDPHub(cfg.Local.UDPPort, cfg.Local.UDPBroadcast, cfg.Local.UDPGroup, cfg.Local.UDPInterface, lanRouter, logger)
+    lan = append(lan, udp)
   }
   
-  hub := arc.CreateHub(cfg.Local.Bind, cfg.Local.Keys, router)
-  for _, remote := range cfg.Remote {
-    hub.Persist(remote)
+  for _, h := range lan {
+    go h.Run()
   }
-  go hub.Run()
-  if eth == nil {
-    router.Run(hub)
-  } else {
-    go eth.Run()
-    router.Run(hub, eth)
+  if discover {
+    go lanRouter.Run(lan...)
   }
+  go reload(fname, cfg, hub, router, logger, override)
+  if len(cfg.Local.MetricsBind) > 0 {
+    go arc.ServeMetrics(cfg.Local.MetricsBind, logger)
+  }
+
+  hubs := append(lan, hub)
+  if ws != nil {
+    go ws.Run()
+    hubs = append(hubs, ws)
+  }
+  go hub.Run()
+  router.Run(hubs...)
 }
@@ -1,89 +1,205 @@
+//go:build cgo && !nosodium
+
 package nacl
 
 // #include <sodium.h>
 // #cgo pkg-config: libsodium
 import "C"
 
-import (
-  "log"
-)
+// check key and nonce sizes for crypto_box
+func checkBoxArgs(nonce, pk, sk []byte) (err error) {
+  err = checkSize("public key", pk, C.crypto_box_publickeybytes())
+  if err == nil {
+    err = checkSize("secret key", sk, C.crypto_box_secretkeybytes())
+  }
+  if err == nil {
+    err = checkSize("nonce", nonce, C.crypto_box_noncebytes())
+  }
+  return
+}
 
 // encrypts a message to a user given their public key is known
-// returns an encrypted box
-func CryptoBox(msg, nounce, pk, sk []byte) []byte {
-  msgbuff := NewBuffer(msg)
-  defer msgbuff.Free()
-
-  // check sizes
-  if len(pk) != int(C.crypto_box_publickeybytes()) {
-    log.Println("len(pk) != crypto_box_publickey_bytes")
-    return nil
+// returns an encrypted box CryptoBoxOverhead() bytes longer than msg
+// nonce must be CryptoBoxNonceSize() bytes and never used twice with the same keys
+func CryptoBox(msg, nonce, pk, sk []byte) ([]byte, error) {
+  err := checkBoxArgs(nonce, pk, sk)
+  if err != nil {
+    return nil, err
   }
-  if len(sk) != int(C.crypto_box_secretkeybytes()) {
-    log.Println("len(sk) != crypto_box_secretkey_bytes")
-    return nil
-  }
-  if len(nounce) != int(C.crypto_box_macbytes()) {
-    log.Println("len(nounce) != crypto_box_macbytes()")
-    return nil
+  skbuff := NewBuffer(sk)
+  defer skbuff.Free()
+  return cryptoBox(msg, nonce, pk, skbuff)
+}
+
+// box a message to pk with our secret key without copying it out, same as CryptoBox
+func (self *KeyPair) Box(msg, nonce, pk []byte) ([]byte, error) {
+  err := checkBoxArgs(nonce, pk, self.sk.Data())
+  if err != nil {
+    return nil, err
   }
-  
+  return cryptoBox(msg, nonce, pk, self.sk)
+}
+
+func cryptoBox(msg, nonce, pk []byte, sk *Buffer) ([]byte, error) {
+  msgbuff := NewBuffer(msg)
+  defer msgbuff.Free()
   pkbuff := NewBuffer(pk)
   defer pkbuff.Free()
-  skbuff := NewBuffer(sk)
-  defer skbuff.Free()
-  nouncebuff := NewBuffer(nounce)
-  defer nouncebuff.Free()
+  noncebuff := NewBuffer(nonce)
+  defer noncebuff.Free()
   
-  resultbuff := malloc(msgbuff.size + nouncebuff.size)
+  resultbuff := malloc(msgbuff.size + C.crypto_box_macbytes())
   defer resultbuff.Free()
-  res := C.crypto_box_easy(resultbuff.uchar(), msgbuff.uchar(), C.ulonglong(msgbuff.size), nouncebuff.uchar(), pkbuff.uchar(), skbuff.uchar())
+  res := C.crypto_box_easy(resultbuff.uchar(), msgbuff.uchar(), C.ulonglong(msgbuff.size), noncebuff.uchar(), pkbuff.uchar(), sk.uchar())
   if res != 0 {
-    log.Println("crypto_box_easy failed:", res)
-    return nil
+    return nil, ErrFailed
   }
-  return resultbuff.Bytes()
+  return resultbuff.Bytes(), nil
 }
 
-// open an encrypted box
-func CryptoBoxOpen(box, nounce, sk, pk []byte) []byte {
-  boxbuff := NewBuffer(box)
-  defer boxbuff.Free()
-
-  // check sizes
-  if len(pk) != int(C.crypto_box_publickeybytes()) {
-    log.Println("len(pk) != crypto_box_publickey_bytes")
-    return nil
+// open an encrypted box from the holder of pk
+// returns ErrOpen if the key or nonce is wrong or the box was tampered with
+func CryptoBoxOpen(box, nonce, sk, pk []byte) ([]byte, error) {
+  err := checkBoxArgs(nonce, pk, sk)
+  if err != nil {
+    return nil, err
   }
-  if len(sk) != int(C.crypto_box_secretkeybytes()) {
-    log.Println("len(sk) != crypto_box_secretkey_bytes")
-    return nil
+  skbuff := NewBuffer(sk)
+  defer skbuff.Free()
+  return cryptoBoxOpen(box, nonce, pk, skbuff)
+}
+
+// open a box from the holder of pk with our secret key without copying it out, same as CryptoBoxOpen
+func (self *KeyPair) BoxOpen(box, nonce, pk []byte) ([]byte, error) {
+  err := checkBoxArgs(nonce, pk, self.sk.Data())
+  if err != nil {
+    return nil, err
   }
-  if len(nounce) != int(C.crypto_box_macbytes()) {
-    log.Println("len(nounce) != crypto_box_macbytes()")
-    return nil
+  return cryptoBoxOpen(box, nonce, pk, self.sk)
+}
+
+func cryptoBoxOpen(box, nonce, pk []byte, sk *Buffer) ([]byte, error) {
+  if len(box) < CryptoBoxOverhead() {
+    return nil, ErrOpen
   }
-    
+  boxbuff := NewBuffer(box)
+  defer boxbuff.Free()
   pkbuff := NewBuffer(pk)
   defer pkbuff.Free()
-  skbuff := NewBuffer(sk)
-  defer skbuff.Free()
-  nouncebuff := NewBuffer(nounce)
-  defer nouncebuff.Free()
-  resultbuff := malloc(boxbuff.size - nouncebuff.size)
+  noncebuff := NewBuffer(nonce)
+  defer noncebuff.Free()
+  resultbuff := malloc(boxbuff.size - C.crypto_box_macbytes())
   defer resultbuff.Free()
   
   // decrypt
-  res := C.crypto_box_open_easy(resultbuff.uchar(), boxbuff.uchar(), C.ulonglong(boxbuff.size), nouncebuff.uchar(), pkbuff.uchar(), skbuff.uchar())
+  res := C.crypto_box_open_easy(resultbuff.uchar(), boxbuff.uchar(), C.ulonglong(boxbuff.size), noncebuff.uchar(), pkbuff.uchar(), sk.uchar())
   if res != 0 {
-    log.Println("crypto_box_open_easy() failed:", res)
-    return nil
+    return nil, ErrOpen
   }
   // return result
-  return resultbuff.Bytes()
+  return resultbuff.Bytes(), nil
 }
 
-// generate a new nounce
+// generate a new random nonce for CryptoBox
+func NewBoxNonce() []byte {
+  return RandBytes(CryptoBoxNonceSize())
+}
+
+// Deprecated: use NewBoxNonce
 func NewBoxNounce() []byte {
-  return RandBytes(int(C.crypto_box_macbytes()))
+  return NewBoxNonce()
+}
+
+// a key shared with one peer made with crypto_box_beforenm
+// boxing with it skips the key exchange so it is faster when we box to the same peer a lot
+type BoxSharedKey struct {
+  k *Buffer
+}
+
+// precompute the shared key for boxing to pk from sk or opening boxes from pk
+func CryptoBoxBeforeNM(pk, sk []byte) (*BoxSharedKey, error) {
+  err := checkSize("public key", pk, C.crypto_box_publickeybytes())
+  if err == nil {
+    err = checkSize("secret key", sk, C.crypto_box_secretkeybytes())
+  }
+  if err != nil {
+    return nil, err
+  }
+  skbuff := NewBuffer(sk)
+  defer skbuff.Free()
+  return beforeNM(pk, skbuff)
+}
+
+// precompute the shared key with pk from our secret key without copying it out
+func (self *KeyPair) BeforeNM(pk []byte) (*BoxSharedKey, error) {
+  err := checkSize("public key", pk, C.crypto_box_publickeybytes())
+  if err == nil {
+    err = checkSize("secret key", self.sk.Data(), C.crypto_box_secretkeybytes())
+  }
+  if err != nil {
+    return nil, err
+  }
+  return beforeNM(pk, self.sk)
+}
+
+func beforeNM(pk []byte, sk *Buffer) (*BoxSharedKey, error) {
+  pkbuff := NewBuffer(pk)
+  defer pkbuff.Free()
+  k := secretMalloc(C.crypto_box_beforenmbytes())
+  res := C.crypto_box_beforenm(k.uchar(), pkbuff.uchar(), sk.uchar())
+  if res != 0 {
+    // pk is a low order point
+    k.Free()
+    return nil, ErrFailed
+  }
+  if k.Guarded() {
+    k.ReadOnly()
+  }
+  return &BoxSharedKey{k}, nil
+}
+
+// make a box with a precomputed key, same as CryptoBox
+func (self *BoxSharedKey) Box(msg, nonce []byte) ([]byte, error) {
+  err := checkSize("nonce", nonce, C.crypto_box_noncebytes())
+  if err != nil {
+    return nil, err
+  }
+  msgbuff := NewBuffer(msg)
+  defer msgbuff.Free()
+  noncebuff := NewBuffer(nonce)
+  defer noncebuff.Free()
+  resultbuff := malloc(msgbuff.size + C.crypto_box_macbytes())
+  defer resultbuff.Free()
+  res := C.crypto_box_easy_afternm(resultbuff.uchar(), msgbuff.uchar(), C.ulonglong(msgbuff.size), noncebuff.uchar(), self.k.uchar())
+  if res != 0 {
+    return nil, ErrFailed
+  }
+  return resultbuff.Bytes(), nil
+}
+
+// open a box with a precomputed key, same as CryptoBoxOpen
+func (self *BoxSharedKey) Open(box, nonce []byte) ([]byte, error) {
+  err := checkSize("nonce", nonce, C.crypto_box_noncebytes())
+  if err != nil {
+    return nil, err
+  }
+  if len(box) < CryptoBoxOverhead() {
+    return nil, ErrOpen
+  }
+  boxbuff := NewBuffer(box)
+  defer boxbuff.Free()
+  noncebuff := NewBuffer(nonce)
+  defer noncebuff.Free()
+  resultbuff := malloc(boxbuff.size - C.crypto_box_macbytes())
+  defer resultbuff.Free()
+  res := C.crypto_box_open_easy_afternm(resultbuff.uchar(), boxbuff.uchar(), C.ulonglong(boxbuff.size), noncebuff.uchar(), self.k.uchar())
+  if res != 0 {
+    return nil, ErrOpen
+  }
+  return resultbuff.Bytes(), nil
+}
+
+// zero and free the shared key
+func (self *BoxSharedKey) Free() {
+  self.k.Free()
 }
@@ -0,0 +1,163 @@
+//go:build !cgo || nosodium
+
+package nacl
+
+import (
+  "golang.org/x/crypto/curve25519"
+  "golang.org/x/crypto/nacl/secretbox"
+  "golang.org/x/crypto/salsa20/salsa"
+)
+
+// check key and nonce sizes for crypto_box
+func checkBoxArgs(nonce, pk, sk []byte) (err error) {
+  err = checkSize("public key", pk, CryptoBoxPubKeySize())
+  if err == nil {
+    err = checkSize("secret key", sk, CryptoBoxPrivKeySize())
+  }
+  if err == nil {
+    err = checkSize("nonce", nonce, CryptoBoxNonceSize())
+  }
+  return
+}
+
+// crypto_box_beforenm: hsalsa20 of the x25519 shared secret
+// fails like libsodium if pk is a low order point
+func sharedKey(pk, sk []byte) (*[32]byte, error) {
+  s, err := curve25519.X25519(sk, pk)
+  if err != nil {
+    return nil, ErrFailed
+  }
+  defer wipe(s)
+  k := new([32]byte)
+  salsa.HSalsa20(k, new([16]byte), (*[32]byte)(s), &salsa.Sigma)
+  return k, nil
+}
+
+// encrypts a message to a user given their public key is known
+// returns an encrypted box CryptoBoxOverhead() bytes longer than msg
+// nonce must be CryptoBoxNonceSize() bytes and never used twice with the same keys
+func CryptoBox(msg, nonce, pk, sk []byte) ([]byte, error) {
+  err := checkBoxArgs(nonce, pk, sk)
+  if err != nil {
+    return nil, err
+  }
+  return cryptoBox(msg, nonce, pk, sk)
+}
+
+// box a message to pk with our secret key without copying it out, same as CryptoBox
+func (self *KeyPair) Box(msg, nonce, pk []byte) ([]byte, error) {
+  return CryptoBox(msg, nonce, pk, self.sk.Data())
+}
+
+func cryptoBox(msg, nonce, pk, sk []byte) ([]byte, error) {
+  k, err := sharedKey(pk, sk)
+  if err != nil {
+    return nil, err
+  }
+  defer wipe(k[:])
+  return secretbox.Seal(make([]byte, 0, len(msg) + secretbox.Overhead), msg, (*[24]byte)(nonce), k), nil
+}
+
+// open an encrypted box from the holder of pk
+// returns ErrOpen if the key or nonce is wrong or the box was tampered with
+func CryptoBoxOpen(box, nonce, sk, pk []byte) ([]byte, error) {
+  err := checkBoxArgs(nonce, pk, sk)
+  if err != nil {
+    return nil, err
+  }
+  return cryptoBoxOpen(box, nonce, pk, sk)
+}
+
+// open a box from the holder of pk with our secret key without copying it out, same as CryptoBoxOpen
+func (self *KeyPair) BoxOpen(box, nonce, pk []byte) ([]byte, error) {
+  return CryptoBoxOpen(box, nonce, self.sk.Data(), pk)
+}
+
+func cryptoBoxOpen(box, nonce, pk, sk []byte) ([]byte, error) {
+  if len(box) < CryptoBoxOverhead() {
+    return nil, ErrOpen
+  }
+  k, err := sharedKey(pk, sk)
+  if err != nil {
+    return nil, ErrOpen
+  }
+  defer wipe(k[:])
+  return secretBoxOpen(box, nonce, k)
+}
+
+// open a secretbox, the caller checked sizes
+func secretBoxOpen(box, nonce []byte, k *[32]byte) ([]byte, error) {
+  msg, ok := secretbox.Open(make([]byte, 0, len(box) - secretbox.Overhead), box, (*[24]byte)(nonce), k)
+  if ! ok {
+    return nil, ErrOpen
+  }
+  return msg, nil
+}
+
+// generate a new random nonce for CryptoBox
+func NewBoxNonce() []byte {
+  return RandBytes(CryptoBoxNonceSize())
+}
+
+// Deprecated: use NewBoxNonce
+func NewBoxNounce() []byte {
+  return NewBoxNonce()
+}
+
+// a key shared with one peer made with crypto_box_beforenm
+// boxing with it skips the key exchange so it is faster when we box to the same peer a lot
+type BoxSharedKey struct {
+  k *Buffer
+}
+
+// precompute the shared key for boxing to pk from sk or opening boxes from pk
+func CryptoBoxBeforeNM(pk, sk []byte) (*BoxSharedKey, error) {
+  err := checkSize("public key", pk, CryptoBoxPubKeySize())
+  if err == nil {
+    err = checkSize("secret key", sk, CryptoBoxPrivKeySize())
+  }
+  if err != nil {
+    return nil, err
+  }
+  k, err := sharedKey(pk, sk)
+  if err != nil {
+    return nil, err
+  }
+  defer wipe(k[:])
+  return &BoxSharedKey{newSecret(k[:])}, nil
+}
+
+// precompute the shared key with pk from our secret key without copying it out
+func (self *KeyPair) BeforeNM(pk []byte) (*BoxSharedKey, error) {
+  return CryptoBoxBeforeNM(pk, self.sk.Data())
+}
+
+func (self *BoxSharedKey) key() *[32]byte {
+  return (*[32]byte)(self.k.Data())
+}
+
+// make a box with a precomputed key, same as CryptoBox
+func (self *BoxSharedKey) Box(msg, nonce []byte) ([]byte, error) {
+  err := checkSize("nonce", nonce, CryptoBoxNonceSize())
+  if err != nil {
+    return nil, err
+  }
+  return secretbox.Seal(make([]byte, 0, len(msg) + secretbox.Overhead), msg, (*[24]byte)(nonce), self.key()), nil
+}
+
+// open a box with a precomputed key, same as CryptoBoxOpen
+func (self *BoxSharedKey) Open(box, nonce []byte) ([]byte, error) {
+  err := checkSize("nonce", nonce, CryptoBoxNonceSize())
+  if err != nil {
+    return nil, err
+  }
+  if len(box) < CryptoBoxOverhead() {
+    return nil, ErrOpen
+  }
+  return secretBoxOpen(box, nonce, self.key())
+}
+
+// zero and free the shared key
+func (self *BoxSharedKey) Free() {
+  self.k.Free()
+}
@@ -0,0 +1,175 @@
+package nacl
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "testing"
+)
+
+// crypto_box known answers, keys are the x25519 pairs from rfc 7748 section 6.1
+// boxes were made with an independent implementation
+var boxVectors = []struct {
+  sk, pk, peersk, peerpk, nonce, msg, box string
+}{
+  {
+    sk: "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a",
+    pk: "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a",
+    peersk: "5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb",
+    peerpk: "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f",
+    nonce: "69696ee955b62b73cd62bda875fc73d68219e0036b7a0b37",
+    msg: "",
+    box: "2539121d8e234e652d651fa4c8cff880",
+  },
+  {
+    sk: "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a",
+    pk: "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a",
+    peersk: "5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb",
+    peerpk: "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f",
+    nonce: "69696ee955b62b73cd62bda875fc73d68219e0036b7a0b37",
+    // "arcd urc relay chat"
+    msg: "61726364207572632072656c61792063686174",
+    box: "b64934966fd7314ba726db43195985c451ec073e549c92c52df026c0b86e5ad6727a9f",
+  },
+}
+
+func TestBoxVectors(t *testing.T) {
+  for n, v := range boxVectors {
+    t.Run(fmt.Sprint(n), func(t *testing.T) {
+      sk, pk, peersk, peerpk := unhex(t, v.sk), unhex(t, v.pk), unhex(t, v.peersk), unhex(t, v.peerpk)
+      nonce, msg, box := unhex(t, v.nonce), unhex(t, v.msg), unhex(t, v.box)
+      if got := GetBoxPubkey(sk); ! bytes.Equal(got, pk) {
+        t.Errorf("GetBoxPubkey gave %x", got)
+      }
+      got, err := CryptoBox(msg, nonce, peerpk, sk)
+      if err != nil || ! bytes.Equal(got, box) {
+        t.Errorf("wrong box %x %v", got, err)
+      }
+      got, err = CryptoBoxOpen(box, nonce, peersk, pk)
+      if err != nil || ! bytes.Equal(got, msg) {
+        t.Errorf("wrong message %x %v", got, err)
+      }
+      k, err := CryptoBoxBeforeNM(peerpk, sk)
+      if err != nil {
+        t.Fatal(err)
+      }
+      defer k.Free()
+      got, err = k.Box(msg, nonce)
+      if err != nil || ! bytes.Equal(got, box) {
+        t.Errorf("wrong precomputed box %x %v", got, err)
+      }
+      peerk, err := CryptoBoxBeforeNM(pk, peersk)
+      if err != nil {
+        t.Fatal(err)
+      }
+      defer peerk.Free()
+      got, err = peerk.Open(box, nonce)
+      if err != nil || ! bytes.Equal(got, msg) {
+        t.Errorf("wrong precomputed message %x %v", got, err)
+      }
+    })
+  }
+}
+
+func TestBoxOpenErrors(t *testing.T) {
+  to, from, other := genBoxKeypair(t), genBoxKeypair(t), genBoxKeypair(t)
+  msg := []byte("arcd")
+  nonce := NewBoxNonce()
+  box, err := CryptoBox(msg, nonce, to.Public(), from.Secret())
+  if err != nil {
+    t.Fatal(err)
+  }
+  tampered := append([]byte{}, box...)
+  tampered[len(tampered) - 1] ^= 1
+  wrongNonce := append([]byte{}, nonce...)
+  wrongNonce[0] ^= 1
+  tests := []struct {
+    name string
+    box, nonce, sk, pk []byte
+  }{
+    {"wrong secret key", box, nonce, other.Secret(), from.Public()},
+    {"wrong public key", box, nonce, to.Secret(), other.Public()},
+    {"wrong nonce", box, wrongNonce, to.Secret(), from.Public()},
+    {"tampered box", tampered, nonce, to.Secret(), from.Public()},
+    {"short box", box[:CryptoBoxOverhead() - 1], nonce, to.Secret(), from.Public()},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      if _, err := CryptoBoxOpen(tt.box, tt.nonce, tt.sk, tt.pk); err != ErrOpen {
+        t.Errorf("CryptoBoxOpen gave %v, want ErrOpen", err)
+      }
+      k, err := CryptoBoxBeforeNM(tt.pk, tt.sk)
+      if err != nil {
+        t.Fatal(err)
+      }
+      defer k.Free()
+      if _, err := k.Open(tt.box, tt.nonce); err != ErrOpen {
+        t.Errorf("BoxSharedKey.Open gave %v, want ErrOpen", err)
+      }
+    })
+  }
+}
+
+func TestBoxSizeErrors(t *testing.T) {
+  to, from := genBoxKeypair(t), genBoxKeypair(t)
+  msg := []byte("arcd")
+  nonce := NewBoxNonce()
+  box, err := CryptoBox(msg, nonce, to.Public(), from.Secret())
+  if err != nil {
+    t.Fatal(err)
+  }
+  tests := []struct {
+    name string
+    call func() error
+  }{
+    {"box with short nonce", func() error {
+      _, err := CryptoBox(msg, nonce[:16], to.Public(), from.Secret())
+      return err
+    }},
+    {"box with short public key", func() error {
+      _, err := CryptoBox(msg, nonce, to.Public()[1:], from.Secret())
+      return err
+    }},
+    {"open with short secret key", func() error {
+      _, err := CryptoBoxOpen(box, nonce, to.Secret()[1:], from.Public())
+      return err
+    }},
+    {"open with long nonce", func() error {
+      _, err := CryptoBoxOpen(box, append(nonce, 0), to.Secret(), from.Public())
+      return err
+    }},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      var sizeErr *SizeError
+      if err := tt.call(); ! errors.As(err, &sizeErr) {
+        t.Errorf("gave %v, want SizeError", err)
+      }
+    })
+  }
+}
+
+func TestBoxRoundTrip(t *testing.T) {
+  for _, size := range testSizes {
+    t.Run(fmt.Sprint(size), func(t *testing.T) {
+      to, from := genBoxKeypair(t), genBoxKeypair(t)
+      msg := RandBytes(size)
+      nonce := NewBoxNonce()
+      box, err := from.Box(msg, nonce, to.Public())
+      if err != nil {
+        t.Fatal(err)
+      }
+      if len(box) != size + CryptoBoxOverhead() {
+        t.Fatalf("box of %d bytes is %d bytes", size, len(box))
+      }
+      got, err := CryptoBoxOpen(box, nonce, to.Secret(), from.Public())
+      if err != nil || ! bytes.Equal(got, msg) {
+        t.Errorf("CryptoBoxOpen failed: %v", err)
+      }
+      got, err = to.BoxOpen(box, nonce, from.Public())
+      if err != nil || ! bytes.Equal(got, msg) {
+        t.Errorf("KeyPair.BoxOpen failed: %v", err)
+      }
+    })
+  }
+}
@@ -1,16 +1,18 @@
+//go:build cgo && !nosodium
+
 package nacl
 
 // #include <sodium.h>
 // #cgo pkg-config: libsodium
 //
 // unsigned char * deref_uchar(void * ptr) { return (unsigned char*) ptr; }
+// char * deref_char(void * ptr) { return (char*) ptr; }
 //
 //
 import "C"
 
 import (
   "encoding/hex"
-  "log"
   "reflect"
   "unsafe"
 )
@@ -20,7 +22,21 @@ type Buffer struct {
   ptr unsafe.Pointer;
   length C.int;
   size C.size_t;
-  
+  // from sodium_malloc, between guard pages and locked in memory
+  guarded bool
+  // locked in memory with sodium_mlock
+  locked bool
+}
+
+// back secret keys with guarded memory
+var secureMemory bool
+
+// back secret keys made from now on with sodium_malloc'd memory
+// it sits between guard pages, is locked so it never goes to swap and is
+// made read only once the key is set up
+// it is a limited resource, RLIMIT_MEMLOCK caps how much we can lock
+func SetSecureMemory(on bool) {
+  secureMemory = on
 }
 
 // wrapper arround nacl.malloc
@@ -39,15 +55,79 @@ func malloc(size C.size_t) *Buffer {
   return buffer
 }
 
-// create a new buffer copying from a byteslice
-func NewBuffer(buff []byte) *Buffer {
-  buffer := Malloc(len(buff))
+// allocate a guarded buffer with sodium_malloc
+// returns nil if sodium_malloc fails, i.e. we hit the locked memory limit
+func secureMalloc(size C.size_t) *Buffer {
+  ptr := C.sodium_malloc(size)
+  if ptr == nil {
+    return nil
+  }
+  C.sodium_memzero(ptr, size)
+  return &Buffer{ptr: ptr, size: size, length: C.int(size), guarded: true}
+}
+
+// allocate a buffer for a secret key, guarded if SetSecureMemory is on
+func secretMalloc(size C.size_t) *Buffer {
+  if secureMemory {
+    buff := secureMalloc(size)
+    if buff != nil {
+      return buff
+    }
+    logger.Warn("nacl: sodium_malloc failed, secret key is not in guarded memory", "size", size)
+  }
+  return malloc(size)
+}
+
+// create a guarded buffer copying from a byteslice, see SetSecureMemory
+// falls back to a plain buffer if sodium_malloc fails
+func NewSecureBuffer(buff []byte) *Buffer {
+  buffer := secureMalloc(C.size_t(len(buff)))
   if buffer == nil {
-    log.Println("nacl.NewBuffer() nacl.Malloc() failed")
+    buffer = malloc(C.size_t(len(buff)))
+  }
+  copy(buffer.Data(), buff)
+  return buffer
+}
+
+// true if this buffer came from sodium_malloc
+func (self *Buffer) Guarded() bool {
+  return self.guarded
+}
+
+// make a guarded buffer read only, writing to it after this crashes
+func (self *Buffer) ReadOnly() error {
+  if ! self.guarded || C.sodium_mprotect_readonly(self.ptr) != 0 {
+    return ErrFailed
+  }
+  return nil
+}
+
+// make a guarded buffer writable again
+func (self *Buffer) ReadWrite() error {
+  if ! self.guarded || C.sodium_mprotect_readwrite(self.ptr) != 0 {
+    return ErrFailed
+  }
+  return nil
+}
+
+// lock a plain buffer into memory so it is never swapped, guarded buffers already are
+func (self *Buffer) Lock() error {
+  if self.guarded || self.locked {
     return nil
   }
+  if C.sodium_mlock(self.ptr, self.size) != 0 {
+    return ErrFailed
+  }
+  self.locked = true
+  return nil
+}
+
+// create a new buffer copying from a byteslice
+func NewBuffer(buff []byte) *Buffer {
+  // empty is fine, cgo gives us a valid pointer for malloc(0)
+  buffer := malloc(C.size_t(len(buff)))
   if copy(buffer.Data(), buff) != len(buff) {
-    log.Println("nacl.NewBuffer() did not copy all bytes")
+    logger.Warn("nacl.NewBuffer() did not copy all bytes")
     return nil
   }
   return buffer
@@ -57,11 +137,16 @@ func (self *Buffer) uchar() *C.uchar {
   return C.deref_uchar(self.ptr)
 }
 
+func (self *Buffer) char() *C.char {
+  return C.deref_char(self.ptr)
+}
+
 func (self *Buffer) Length() int {
   return int(self.length)
 }
 
 // get immutable byte slice
+// this copies into go memory we can't wipe, keep secrets in the buffer
 func (self *Buffer) Bytes() []byte {
   buff := make([]byte, self.Length())
   copy(buff, self.Data())
@@ -84,6 +169,16 @@ func (self *Buffer) String() string {
 
 // zero out memory and then free
 func (self *Buffer) Free() {
-  C.sodium_memzero(self.ptr, self.size)
-  C.free(self.ptr)
+  if self.guarded {
+    // sodium_free zeros it
+    C.sodium_mprotect_readwrite(self.ptr)
+    C.sodium_free(self.ptr)
+  } else if self.locked {
+    // sodium_munlock zeros it
+    C.sodium_munlock(self.ptr, self.size)
+    C.free(self.ptr)
+  } else {
+    C.sodium_memzero(self.ptr, self.size)
+    C.free(self.ptr)
+  }
 }
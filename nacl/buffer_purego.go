@@ -0,0 +1,98 @@
+//go:build !cgo || nosodium
+
+package nacl
+
+import (
+  "encoding/hex"
+)
+
+// secret bytes, in go memory with this backend
+// it can't be guarded or locked, Free still zeros it
+type Buffer struct {
+  b []byte
+}
+
+// back secret keys with guarded memory
+var secureMemory bool
+
+// guarded memory needs libsodium, this only warns
+func SetSecureMemory(on bool) {
+  if on && ! secureMemory {
+    logger.Warn("nacl: guarded memory needs libsodium, secret keys stay in go memory")
+  }
+  secureMemory = on
+}
+
+// wrapper arround nacl.malloc
+func Malloc(size int) *Buffer {
+  if size > 0 {
+    return malloc(size)
+  }
+  return nil
+}
+
+func malloc(size int) *Buffer {
+  return &Buffer{make([]byte, size)}
+}
+
+// secret keys get the same memory as everything else here
+func secretMalloc(size int) *Buffer {
+  return malloc(size)
+}
+
+// same as NewBuffer with this backend
+func NewSecureBuffer(buff []byte) *Buffer {
+  return NewBuffer(buff)
+}
+
+// create a new buffer copying from a byteslice
+func NewBuffer(buff []byte) *Buffer {
+  buffer := malloc(len(buff))
+  copy(buffer.b, buff)
+  return buffer
+}
+
+// never guarded with this backend
+func (self *Buffer) Guarded() bool {
+  return false
+}
+
+// needs libsodium, always fails
+func (self *Buffer) ReadOnly() error {
+  return ErrFailed
+}
+
+// needs libsodium, always fails
+func (self *Buffer) ReadWrite() error {
+  return ErrFailed
+}
+
+// needs libsodium, always fails
+func (self *Buffer) Lock() error {
+  return ErrFailed
+}
+
+func (self *Buffer) Length() int {
+  return len(self.b)
+}
+
+// get immutable byte slice
+func (self *Buffer) Bytes() []byte {
+  buff := make([]byte, len(self.b))
+  copy(buff, self.b)
+  return buff
+}
+
+// get underlying byte slice
+func (self *Buffer) Data() []byte {
+  return self.b
+}
+
+func (self *Buffer) String() string {
+  return hex.EncodeToString(self.b)
+}
+
+// zero out memory
+func (self *Buffer) Free() {
+  wipe(self.b)
+}
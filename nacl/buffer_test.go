@@ -0,0 +1,69 @@
+package nacl
+
+import (
+  "bytes"
+  "testing"
+)
+
+// keys in guarded memory and the KeyPair methods that use them in place
+func TestSecureMemory(t *testing.T) {
+  defer SetSecureMemory(secureMemory)
+  SetSecureMemory(true)
+  id := genSignKeypair(t)
+  if ! id.sk.Guarded() {
+    // no libsodium, or sodium_malloc failed likely on RLIMIT_MEMLOCK, the methods still work
+    t.Log("secret keys are not in guarded memory")
+  }
+  msg := []byte("arcd")
+  sig := id.SignDetached(msg)
+  if ! bytes.Equal(sig, CryptoSignDetached(msg, id.Secret())) || ! CryptoVerifyDetached(msg, sig, id.Public()) {
+    t.Error("KeyPair.SignDetached gave a bad signature")
+  }
+  got, err := CryptoSignOpen(id.Sign(msg), id.Public())
+  if err != nil || ! bytes.Equal(got, msg) {
+    t.Errorf("KeyPair.Sign gave a bad signed message: %v", err)
+  }
+  to := toBox(t, id)
+  from := genBoxKeypair(t)
+  nonce := NewBoxNonce()
+  box, err := from.Box(msg, nonce, to.Public())
+  if err != nil {
+    t.Fatal(err)
+  }
+  got, err = to.BoxOpen(box, nonce, from.Public())
+  if err != nil || ! bytes.Equal(got, msg) {
+    t.Errorf("KeyPair.BoxOpen failed: %v", err)
+  }
+  k, err := to.BeforeNM(from.Public())
+  if err != nil {
+    t.Fatal(err)
+  }
+  got, err = k.Open(box, nonce)
+  k.Free()
+  if err != nil || ! bytes.Equal(got, msg) {
+    t.Errorf("open with KeyPair.BeforeNM key failed: %v", err)
+  }
+  sealed, err := CryptoBoxSeal(msg, to.Public())
+  if err != nil {
+    t.Fatal(err)
+  }
+  got, err = to.SealOpen(sealed)
+  if err != nil || ! bytes.Equal(got, msg) {
+    t.Errorf("KeyPair.SealOpen failed: %v", err)
+  }
+}
+
+func TestSecureBuffer(t *testing.T) {
+  msg := []byte("arcd")
+  buff := NewSecureBuffer(msg)
+  defer buff.Free()
+  if buff.Guarded() && (buff.ReadOnly() != nil || buff.ReadWrite() != nil) {
+    t.Error("cannot change guarded buffer protection")
+  }
+  if ! bytes.Equal(buff.Data(), msg) || ! bytes.Equal(buff.Bytes(), msg) {
+    t.Error("secure buffer lost its contents")
+  }
+  if buff.Length() != len(msg) {
+    t.Errorf("secure buffer is %d bytes, want %d", buff.Length(), len(msg))
+  }
+}
@@ -0,0 +1,24 @@
+package nacl
+
+import (
+  "errors"
+  "fmt"
+)
+
+// a box could not be opened, wrong key, wrong nonce or it was tampered with
+var ErrOpen = errors.New("nacl: cannot open box")
+
+// the crypto backend failed for some other reason
+var ErrFailed = errors.New("nacl: operation failed")
+
+// a key, nonce or message had the wrong size
+type SizeError struct {
+  // what had the wrong size i.e. "public key"
+  What string
+  Got int
+  Want int
+}
+
+func (e *SizeError) Error() string {
+  return fmt.Sprintf("nacl: %s is %d bytes, want %d", e.What, e.Got, e.Want)
+}
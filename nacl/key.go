@@ -1,3 +1,4 @@
+//go:build cgo && !nosodium
 
 package nacl
 
@@ -7,7 +8,6 @@ import "C"
 import (
   "encoding/hex"
   "fmt"
-  "log"
 )
 
 type KeyPair struct {
@@ -15,12 +15,29 @@ type KeyPair struct {
   sk *Buffer
 }
 
+// make a keypair, the secret key is made read only if it is guarded
+func newKeyPair(pk, sk *Buffer) *KeyPair {
+  if sk.Guarded() {
+    sk.ReadOnly()
+  }
+  return &KeyPair{pk, sk}
+}
+
+// copy a secret key into a buffer from secretMalloc
+func newSecret(b []byte) *Buffer {
+  buff := secretMalloc(C.size_t(len(b)))
+  copy(buff.Data(), b)
+  return buff
+}
+
 // free this keypair from memory
 func (self *KeyPair) Free() {
   self.pk.Free()
   self.sk.Free()
 }
 
+// copy of the secret key in go memory we can't wipe
+// prefer the KeyPair methods that use the key where it is
 func (self *KeyPair) Secret() []byte {
   return self.sk.Bytes()
 }
@@ -32,14 +49,14 @@ func (self *KeyPair) Public() []byte {
 // generate a keypair
 func GenSignKeypair() *KeyPair {
   sk_len := C.crypto_sign_secretkeybytes()
-  sk := malloc(sk_len)
+  sk := secretMalloc(sk_len)
   pk_len := C.crypto_sign_publickeybytes()
   pk := malloc(pk_len)
   res := C.crypto_sign_keypair(pk.uchar(), sk.uchar())
   if res == 0 {
-    return &KeyPair{pk,sk}
+    return newKeyPair(pk, sk)
   }
-  log.Println("nacl.GenSignKeypair() failed to generate keypair")
+  logger.Warn("nacl.GenSignKeypair() failed to generate keypair")
   pk.Free()
   sk.Free()
   return nil
@@ -49,7 +66,7 @@ func GenSignKeypair() *KeyPair {
 func GetSignPubkey(sk []byte) []byte {
   sk_len := C.crypto_sign_secretkeybytes()
   if C.size_t(len(sk)) != sk_len {
-    log.Printf("nacl.GetSignPubkey() invalid secret key size %d != %d", len(sk), sk_len)
+    logger.Warn("nacl.GetSignPubkey() invalid secret key size", "len", len(sk), "want", sk_len)
     return nil
   }
   
@@ -59,11 +76,11 @@ func GetSignPubkey(sk []byte) []byte {
 
   skbuff := NewBuffer(sk)
   defer skbuff.Free()
-  //XXX: hack
-  res := C.crypto_sign_seed_keypair(pkbuff.uchar(), skbuff.uchar(), skbuff.uchar())
+  // the public key is the second half of the secret key
+  res := C.crypto_sign_ed25519_sk_to_pk(pkbuff.uchar(), skbuff.uchar())
   
   if res != 0 {
-    log.Printf("nacl.GetSignPubkey() failed to get public key from secret key: %d", res)
+    logger.Warn("nacl.GetSignPubkey() failed to get public key from secret key", "res", res)
     return nil
   }
   
@@ -74,19 +91,19 @@ func GetSignPubkey(sk []byte) []byte {
 func LoadSignKey(sk []byte) *KeyPair {
   pk := GetSignPubkey(sk)
   if pk == nil {
-    log.Println("nacl.LoadSignKey() failed to load keypair")
+    logger.Warn("nacl.LoadSignKey() failed to load keypair")
     return nil
   }
   pkbuff := NewBuffer(pk)
-  skbuff := NewBuffer(sk)
-  return &KeyPair{pkbuff, skbuff}
+  skbuff := newSecret(sk)
+  return newKeyPair(pkbuff, skbuff)
 }
 
 // make keypair from seed
 func SeedSignKey(seed []byte) *KeyPair {
   seed_len := C.crypto_sign_seedbytes()
   if C.size_t(len(seed)) != seed_len {
-    log.Println("nacl.SeedSignKey() invalid seed size", len(seed))
+    logger.Warn("nacl.SeedSignKey() invalid seed size", "len", len(seed))
     return nil
   }
   seedbuff := NewBuffer(seed)
@@ -94,27 +111,35 @@ func SeedSignKey(seed []byte) *KeyPair {
   pk_len := C.crypto_sign_publickeybytes()
   sk_len := C.crypto_sign_secretkeybytes()
   pkbuff := malloc(pk_len)
-  skbuff := malloc(sk_len)
+  skbuff := secretMalloc(sk_len)
   res := C.crypto_sign_seed_keypair(pkbuff.uchar(), skbuff.uchar(), seedbuff.uchar())
   if res != 0 {
-    log.Println("nacl.SeedSignKey cannot derive keys from seed", res)
+    logger.Warn("nacl.SeedSignKey cannot derive keys from seed", "res", res)
     pkbuff.Free()
     skbuff.Free()
     return nil
   }
-  return &KeyPair{pkbuff, skbuff}
+  return newKeyPair(pkbuff, skbuff)
+}
+
+// get the seed a signing keypair was made from
+func (self *KeyPair) Seed() []byte {
+  seed := malloc(C.crypto_sign_seedbytes())
+  defer seed.Free()
+  C.crypto_sign_ed25519_sk_to_seed(seed.uchar(), self.sk.uchar())
+  return seed.Bytes()
 }
 
 func GenBoxKeypair() *KeyPair {
   sk_len := C.crypto_box_secretkeybytes()
-  sk := malloc(sk_len)
+  sk := secretMalloc(sk_len)
   pk_len := C.crypto_box_publickeybytes()
   pk := malloc(pk_len)
   res := C.crypto_box_keypair(pk.uchar(), sk.uchar())
   if res == 0 {
-    return &KeyPair{pk,sk}
+    return newKeyPair(pk, sk)
   }
-  log.Println("nacl.GenBoxKeyPair() failed to generate keypair")
+  logger.Warn("nacl.GenBoxKeyPair() failed to generate keypair")
   pk.Free()
   sk.Free()
   return nil  
@@ -125,7 +150,7 @@ func GenBoxKeypair() *KeyPair {
 func GetBoxPubkey(sk []byte) []byte {
   sk_len := C.crypto_box_secretkeybytes()
   if C.size_t(len(sk)) != sk_len {
-    log.Printf("nacl.GetBoxPubkey() invalid secret key size %d != %d", len(sk), sk_len)
+    logger.Warn("nacl.GetBoxPubkey() invalid secret key size", "len", len(sk), "want", sk_len)
     return nil
   }
   
@@ -146,19 +171,19 @@ func GetBoxPubkey(sk []byte) []byte {
 func LoadBoxKey(sk []byte) *KeyPair {
   pk := GetBoxPubkey(sk)
   if pk == nil {
-    log.Println("nacl.LoadBoxKey() failed to load keypair")
+    logger.Warn("nacl.LoadBoxKey() failed to load keypair")
     return nil
   }
   pkbuff := NewBuffer(pk)
-  skbuff := NewBuffer(sk)
-  return &KeyPair{pkbuff, skbuff}
+  skbuff := newSecret(sk)
+  return newKeyPair(pkbuff, skbuff)
 }
 
 // make keypair from seed
 func SeedBoxKey(seed []byte) *KeyPair {
   seed_len := C.crypto_box_seedbytes()
   if C.size_t(len(seed)) != seed_len {
-    log.Println("nacl.SeedBoxKey() invalid seed size", len(seed))
+    logger.Warn("nacl.SeedBoxKey() invalid seed size", "len", len(seed))
     return nil
   }
   seedbuff := NewBuffer(seed)
@@ -166,17 +191,57 @@ func SeedBoxKey(seed []byte) *KeyPair {
   pk_len := C.crypto_box_publickeybytes()
   sk_len := C.crypto_box_secretkeybytes()
   pkbuff := malloc(pk_len)
-  skbuff := malloc(sk_len)
+  skbuff := secretMalloc(sk_len)
   res := C.crypto_box_seed_keypair(pkbuff.uchar(), skbuff.uchar(), seedbuff.uchar())
   if res != 0 {
     pkbuff.Free()
     skbuff.Free()
-    log.Println("nacl.SeedBoxKey cannot derive keys from seed:", res)
+    logger.Warn("nacl.SeedBoxKey cannot derive keys from seed", "res", res)
     return nil
   }
-  return &KeyPair{pkbuff, skbuff}
+  return newKeyPair(pkbuff, skbuff)
 }
 
+// only the public key, so logging a keypair can't leak the secret key
 func (self *KeyPair) String() string {
-  return fmt.Sprintf("pk=%s sk=%s", hex.EncodeToString(self.pk.Data()), hex.EncodeToString(self.sk.Data()))
+  return fmt.Sprintf("pk=%s", hex.EncodeToString(self.pk.Data()))
+}
+
+// convert an ed25519 public key to the x25519 public key for boxing to its owner
+func SignPubkeyToBox(pk []byte) ([]byte, error) {
+  err := checkSize("public key", pk, C.crypto_sign_publickeybytes())
+  if err != nil {
+    return nil, err
+  }
+  pkbuff := NewBuffer(pk)
+  defer pkbuff.Free()
+  boxpk := malloc(C.crypto_box_publickeybytes())
+  defer boxpk.Free()
+  res := C.crypto_sign_ed25519_pk_to_curve25519(boxpk.uchar(), pkbuff.uchar())
+  if res != 0 {
+    // not a valid point
+    return nil, ErrFailed
+  }
+  return boxpk.Bytes(), nil
+}
+
+// convert a signing keypair to a box keypair
+// others get our box public key from our signing public key with SignPubkeyToBox
+// so one identity key can both sign and receive boxes
+func (self *KeyPair) ToBox() (*KeyPair, error) {
+  err := checkSize("secret key", self.sk.Data(), C.crypto_sign_secretkeybytes())
+  if err != nil {
+    return nil, err
+  }
+  pk, err := SignPubkeyToBox(self.pk.Data())
+  if err != nil {
+    return nil, err
+  }
+  sk := secretMalloc(C.crypto_box_secretkeybytes())
+  res := C.crypto_sign_ed25519_sk_to_curve25519(sk.uchar(), self.sk.uchar())
+  if res != 0 {
+    sk.Free()
+    return nil, ErrFailed
+  }
+  return newKeyPair(NewBuffer(pk), sk), nil
 }
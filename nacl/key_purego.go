@@ -0,0 +1,202 @@
+//go:build !cgo || nosodium
+
+package nacl
+
+import (
+  "crypto/sha512"
+  "encoding/hex"
+  "fmt"
+  "filippo.io/edwards25519"
+  "golang.org/x/crypto/curve25519"
+  "golang.org/x/crypto/ed25519"
+)
+
+type KeyPair struct {
+  pk *Buffer
+  sk *Buffer
+}
+
+func newKeyPair(pk, sk []byte) *KeyPair {
+  return &KeyPair{NewBuffer(pk), newSecret(sk)}
+}
+
+// copy a secret key into a buffer from secretMalloc
+func newSecret(b []byte) *Buffer {
+  return NewBuffer(b)
+}
+
+// free this keypair from memory
+func (self *KeyPair) Free() {
+  self.pk.Free()
+  self.sk.Free()
+}
+
+// copy of the secret key
+// prefer the KeyPair methods that use the key where it is
+func (self *KeyPair) Secret() []byte {
+  return self.sk.Bytes()
+}
+
+func (self *KeyPair) Public() []byte {
+  return self.pk.Bytes()
+}
+
+// generate a keypair
+func GenSignKeypair() *KeyPair {
+  pk, sk, err := ed25519.GenerateKey(nil)
+  if err != nil {
+    logger.Warn("nacl.GenSignKeypair() failed to generate keypair", "err", err)
+    return nil
+  }
+  defer wipe(sk)
+  return newKeyPair(pk, sk)
+}
+
+// get public key from secret key
+func GetSignPubkey(sk []byte) []byte {
+  if len(sk) != ed25519.PrivateKeySize {
+    logger.Warn("nacl.GetSignPubkey() invalid secret key size", "len", len(sk), "want", ed25519.PrivateKeySize)
+    return nil
+  }
+  // the public key is the second half of the secret key
+  pk := make([]byte, ed25519.PublicKeySize)
+  copy(pk, sk[ed25519.SeedSize:])
+  return pk
+}
+
+// load keypair from secret key
+func LoadSignKey(sk []byte) *KeyPair {
+  pk := GetSignPubkey(sk)
+  if pk == nil {
+    logger.Warn("nacl.LoadSignKey() failed to load keypair")
+    return nil
+  }
+  return newKeyPair(pk, sk)
+}
+
+// make keypair from seed
+func SeedSignKey(seed []byte) *KeyPair {
+  if len(seed) != ed25519.SeedSize {
+    logger.Warn("nacl.SeedSignKey() invalid seed size", "len", len(seed))
+    return nil
+  }
+  sk := ed25519.NewKeyFromSeed(seed)
+  defer wipe(sk)
+  return newKeyPair(sk[ed25519.SeedSize:], sk)
+}
+
+// get the seed a signing keypair was made from
+func (self *KeyPair) Seed() []byte {
+  seed := make([]byte, ed25519.SeedSize)
+  copy(seed, self.sk.Data())
+  return seed
+}
+
+func GenBoxKeypair() *KeyPair {
+  sk := RandBytes(curve25519.ScalarSize)
+  defer wipe(sk)
+  pk := GetBoxPubkey(sk)
+  if pk == nil {
+    logger.Warn("nacl.GenBoxKeyPair() failed to generate keypair")
+    return nil
+  }
+  return newKeyPair(pk, sk)
+}
+
+// get public key from secret key
+func GetBoxPubkey(sk []byte) []byte {
+  if len(sk) != curve25519.ScalarSize {
+    logger.Warn("nacl.GetBoxPubkey() invalid secret key size", "len", len(sk), "want", curve25519.ScalarSize)
+    return nil
+  }
+  // compute the public key
+  pk, err := curve25519.X25519(sk, curve25519.Basepoint)
+  if err != nil {
+    return nil
+  }
+  return pk
+}
+
+// load keypair from secret key
+func LoadBoxKey(sk []byte) *KeyPair {
+  pk := GetBoxPubkey(sk)
+  if pk == nil {
+    logger.Warn("nacl.LoadBoxKey() failed to load keypair")
+    return nil
+  }
+  return newKeyPair(pk, sk)
+}
+
+// make keypair from seed, the secret key is the first half of its sha512 like libsodium
+func SeedBoxKey(seed []byte) *KeyPair {
+  if len(seed) != 32 {
+    logger.Warn("nacl.SeedBoxKey() invalid seed size", "len", len(seed))
+    return nil
+  }
+  h := sha512.Sum512(seed)
+  defer wipe(h[:])
+  sk := h[:curve25519.ScalarSize]
+  pk := GetBoxPubkey(sk)
+  if pk == nil {
+    logger.Warn("nacl.SeedBoxKey cannot derive keys from seed")
+    return nil
+  }
+  return newKeyPair(pk, sk)
+}
+
+// only the public key, so logging a keypair can't leak the secret key
+func (self *KeyPair) String() string {
+  return fmt.Sprintf("pk=%s", hex.EncodeToString(self.pk.Data()))
+}
+
+// order of the ed25519 prime order subgroup less one, it fits in a canonical scalar
+var subgroupOrderLessOne = []byte{
+  0xec, 0xd3, 0xf5, 0x5c, 0x1a, 0x63, 0x12, 0x58, 0xd6, 0x9c, 0xf7, 0xa2, 0xde, 0xf9, 0xde, 0x14,
+  0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10,
+}
+
+// convert an ed25519 public key to the x25519 public key for boxing to its owner
+// rejects the keys libsodium does: bad points, small order points and points
+// outside the prime order subgroup
+func SignPubkeyToBox(pk []byte) ([]byte, error) {
+  err := checkSize("public key", pk, ed25519.PublicKeySize)
+  if err != nil {
+    return nil, err
+  }
+  p, err := new(edwards25519.Point).SetBytes(pk)
+  if err != nil {
+    // not a valid point
+    return nil, ErrFailed
+  }
+  identity := edwards25519.NewIdentityPoint()
+  if new(edwards25519.Point).MultByCofactor(p).Equal(identity) == 1 {
+    return nil, ErrFailed
+  }
+  l1, _ := edwards25519.NewScalar().SetCanonicalBytes(subgroupOrderLessOne)
+  q := new(edwards25519.Point).ScalarMult(l1, p)
+  if q.Add(q, p).Equal(identity) != 1 {
+    return nil, ErrFailed
+  }
+  return p.BytesMontgomery(), nil
+}
+
+// convert a signing keypair to a box keypair
+// others get our box public key from our signing public key with SignPubkeyToBox
+// so one identity key can both sign and receive boxes
+func (self *KeyPair) ToBox() (*KeyPair, error) {
+  err := checkSize("secret key", self.sk.Data(), ed25519.PrivateKeySize)
+  if err != nil {
+    return nil, err
+  }
+  pk, err := SignPubkeyToBox(self.pk.Data())
+  if err != nil {
+    return nil, err
+  }
+  // the x25519 scalar is the clamped first half of the hashed seed, same as ed25519 uses
+  h := sha512.Sum512(self.sk.Data()[:ed25519.SeedSize])
+  defer wipe(h[:])
+  h[0] &= 248
+  h[31] &= 127
+  h[31] |= 64
+  return newKeyPair(pk, h[:curve25519.ScalarSize]), nil
+}
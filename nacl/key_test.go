@@ -0,0 +1,71 @@
+package nacl
+
+import (
+  "bytes"
+  "encoding/hex"
+  "fmt"
+  "testing"
+)
+
+// signing keys converted to box keys work for boxing
+func TestSignKeyToBox(t *testing.T) {
+  alice, bob := genSignKeypair(t), genSignKeypair(t)
+  alicebox, bobbox := toBox(t, alice), toBox(t, bob)
+  if ! bytes.Equal(GetBoxPubkey(alicebox.Secret()), alicebox.Public()) {
+    t.Fatal("converted box keys don't match")
+  }
+  // bob only knows alice's signing public key
+  alicepk, err := SignPubkeyToBox(alice.Public())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if ! bytes.Equal(alicepk, alicebox.Public()) {
+    t.Fatal("converted public key differs from the converted key pair")
+  }
+  msg := []byte("arcd")
+  nonce := NewBoxNonce()
+  box, err := CryptoBox(msg, nonce, alicepk, bobbox.Secret())
+  if err != nil {
+    t.Fatal(err)
+  }
+  bobpk, err := SignPubkeyToBox(bob.Public())
+  if err != nil {
+    t.Fatal(err)
+  }
+  got, err := CryptoBoxOpen(box, nonce, alicebox.Secret(), bobpk)
+  if err != nil || ! bytes.Equal(got, msg) {
+    t.Errorf("box to converted key failed: %v", err)
+  }
+}
+
+func TestSignPubkeyToBoxErrors(t *testing.T) {
+  tests := []struct {
+    name string
+    pk []byte
+  }{
+    {"short key", make([]byte, 31)},
+    {"long key", make([]byte, 33)},
+    {"small order point", make([]byte, 32)},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      if _, err := SignPubkeyToBox(tt.pk); err == nil {
+        t.Error("converted a bad key")
+      }
+    })
+  }
+  box := genBoxKeypair(t)
+  if _, err := box.ToBox(); err == nil {
+    t.Error("converted box keys as sign keys")
+  }
+}
+
+// printing a keypair shows the public key and never the secret one
+func TestKeyPairString(t *testing.T) {
+  kp := genSignKeypair(t)
+  for _, s := range []string{kp.String(), fmt.Sprint(kp), fmt.Sprintf("%v", kp), fmt.Sprintf("%s", kp)} {
+    if s != "pk=" + hex.EncodeToString(kp.Public()) {
+      t.Errorf("printed %q", s)
+    }
+  }
+}
@@ -0,0 +1,220 @@
+package nacl
+
+import (
+  "bytes"
+  "encoding/hex"
+  "encoding/pem"
+  "errors"
+  "fmt"
+  "strconv"
+)
+
+// key files
+//
+// a signing key is stored as its 32 byte ed25519 seed in a pem block:
+//
+//   -----BEGIN ARCD ED25519 SEED-----
+//   Version: 1
+//
+//   <base64 seed>
+//   -----END ARCD ED25519 SEED-----
+//
+// the public key is derived from the seed so it is not stored.
+// ImportSignKey also takes a raw 32 byte seed or a raw 64 byte libsodium
+// secret key, which is what older versions wrote.
+//
+// a key file can be encrypted with a passphrase instead:
+//
+//   -----BEGIN ARCD ENCRYPTED ED25519 SEED-----
+//   Version: 1
+//   KDF: argon2id
+//   Ops: <argon2id passes>
+//   Mem: <argon2id memory in bytes>
+//   Salt: <hex salt>
+//   Nonce: <hex secretbox nonce>
+//
+//   <base64 secretbox of the seed>
+//   -----END ARCD ENCRYPTED ED25519 SEED-----
+//
+// the secretbox key is derived from the passphrase with DeriveKey.
+
+// pem block type of a signing key file
+const signKeyPEMType = "ARCD ED25519 SEED"
+
+// version of the key file format we write
+const signKeyVersion = "1"
+
+// pem block type of a passphrase encrypted signing key file
+const encryptedSignKeyPEMType = "ARCD ENCRYPTED ED25519 SEED"
+
+// most argon2id passes and memory a key file may ask for
+// a crafted file could otherwise tie up the cpu or all our memory before the passphrase is checked
+const maxKeyFileOps = 16
+const maxKeyFileMem = 1 << 30
+
+// a key file we can't read
+var ErrKeyFormat = errors.New("nacl: unknown key file format")
+
+// the key file is encrypted and we were not given a passphrase
+var ErrNeedPassphrase = errors.New("nacl: key file is encrypted, passphrase needed")
+
+// the passphrase does not open the key file
+var ErrPassphrase = errors.New("nacl: wrong passphrase")
+
+// export a signing key in the key file format
+func ExportSignKey(kp *KeyPair) []byte {
+  return pem.EncodeToMemory(&pem.Block{
+    Type: signKeyPEMType,
+    Headers: map[string]string{
+      "Version": signKeyVersion,
+    },
+    Bytes: kp.Seed(),
+  })
+}
+
+// export a signing key in the key file format encrypted with a passphrase
+// limits set how hard the passphrase is to guess, PwHashModerate() is a good default
+func ExportSignKeyPassphrase(kp *KeyPair, passphrase []byte, limits PwHashLimits) ([]byte, error) {
+  salt := NewPwHashSalt()
+  key, err := DeriveKey(passphrase, salt, CryptoSecretBoxKeySize(), limits)
+  if err != nil {
+    return nil, err
+  }
+  defer key.Free()
+  nonce := NewSecretBoxNonce()
+  seed := kp.Seed()
+  box, err := CryptoSecretBox(seed, nonce, key.Data())
+  wipe(seed)
+  if err != nil {
+    return nil, err
+  }
+  return pem.EncodeToMemory(&pem.Block{
+    Type: encryptedSignKeyPEMType,
+    Headers: map[string]string{
+      "Version": signKeyVersion,
+      "KDF": "argon2id",
+      "Ops": strconv.FormatUint(limits.Ops, 10),
+      "Mem": strconv.FormatUint(limits.Mem, 10),
+      "Salt": hex.EncodeToString(salt),
+      "Nonce": hex.EncodeToString(nonce),
+    },
+    Bytes: box,
+  }), nil
+}
+
+// return true if a key file is encrypted with a passphrase
+func SignKeyEncrypted(data []byte) bool {
+  block, _ := pem.Decode(data)
+  return block != nil && block.Type == encryptedSignKeyPEMType
+}
+
+// import a signing key from a key file
+// returns ErrNeedPassphrase if it is encrypted, use ImportSignKeyPassphrase
+func ImportSignKey(data []byte) (*KeyPair, error) {
+  return ImportSignKeyPassphrase(data, nil)
+}
+
+// import a signing key from a key file that may be encrypted
+// the passphrase is only used if the key file is encrypted
+// returns ErrPassphrase if the passphrase is wrong
+func ImportSignKeyPassphrase(data, passphrase []byte) (*KeyPair, error) {
+  block, _ := pem.Decode(data)
+  if block == nil {
+    // raw keys
+    switch len(data) {
+    case CryptoSignSeedSize():
+      return signKeyFromSeed(data)
+    case CryptoSignPrivKeySize():
+      kp := LoadSignKey(data)
+      if kp == nil {
+        return nil, ErrKeyFormat
+      }
+      // the public key half must match the seed half
+      seeded, err := signKeyFromSeed(kp.Seed())
+      if err != nil {
+        kp.Free()
+        return nil, err
+      }
+      defer seeded.Free()
+      if ! bytes.Equal(seeded.Public(), kp.Public()) {
+        kp.Free()
+        return nil, errors.New("nacl: secret key does not match its public key")
+      }
+      return kp, nil
+    }
+    return nil, ErrKeyFormat
+  }
+  if block.Type == encryptedSignKeyPEMType {
+    if passphrase == nil {
+      return nil, ErrNeedPassphrase
+    }
+    return decryptSignKey(block, passphrase)
+  }
+  if block.Type != signKeyPEMType {
+    return nil, fmt.Errorf("%w: pem block is %q", ErrKeyFormat, block.Type)
+  }
+  if v := block.Headers["Version"]; v != signKeyVersion {
+    return nil, fmt.Errorf("%w: version %q", ErrKeyFormat, v)
+  }
+  return signKeyFromSeed(block.Bytes)
+}
+
+// open an encrypted key file pem block
+func decryptSignKey(block *pem.Block, passphrase []byte) (*KeyPair, error) {
+  if v := block.Headers["Version"]; v != signKeyVersion {
+    return nil, fmt.Errorf("%w: version %q", ErrKeyFormat, v)
+  }
+  if kdf := block.Headers["KDF"]; kdf != "argon2id" {
+    return nil, fmt.Errorf("%w: kdf %q", ErrKeyFormat, kdf)
+  }
+  var limits PwHashLimits
+  var err error
+  limits.Ops, err = strconv.ParseUint(block.Headers["Ops"], 10, 64)
+  if err == nil {
+    limits.Mem, err = strconv.ParseUint(block.Headers["Mem"], 10, 64)
+  }
+  if err == nil && (limits.Ops > maxKeyFileOps || limits.Mem > maxKeyFileMem) {
+    err = fmt.Errorf("argon2id limits %d passes %d bytes are too high", limits.Ops, limits.Mem)
+  }
+  var salt, nonce []byte
+  if err == nil {
+    salt, err = hex.DecodeString(block.Headers["Salt"])
+  }
+  if err == nil {
+    nonce, err = hex.DecodeString(block.Headers["Nonce"])
+  }
+  if err != nil {
+    return nil, fmt.Errorf("%w: %s", ErrKeyFormat, err)
+  }
+  key, err := DeriveKey(passphrase, salt, CryptoSecretBoxKeySize(), limits)
+  if err != nil {
+    return nil, err
+  }
+  defer key.Free()
+  seed, err := CryptoSecretBoxOpen(block.Bytes, nonce, key.Data())
+  if err == ErrOpen {
+    return nil, ErrPassphrase
+  } else if err != nil {
+    return nil, err
+  }
+  defer wipe(seed)
+  return signKeyFromSeed(seed)
+}
+
+// zero a go copy of a secret
+func wipe(b []byte) {
+  for i := range b {
+    b[i] = 0
+  }
+}
+
+func signKeyFromSeed(seed []byte) (*KeyPair, error) {
+  if len(seed) != CryptoSignSeedSize() {
+    return nil, &SizeError{What: "seed", Got: len(seed), Want: CryptoSignSeedSize()}
+  }
+  kp := SeedSignKey(seed)
+  if kp == nil {
+    return nil, ErrFailed
+  }
+  return kp, nil
+}
@@ -0,0 +1,97 @@
+package nacl
+
+import (
+  "bytes"
+  "errors"
+  "strconv"
+  "testing"
+)
+
+func TestEncryptedKeyFile(t *testing.T) {
+  kp := genSignKeypair(t)
+  data, err := ExportSignKeyPassphrase(kp, []byte("arcd"), testPwHashLimits)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if ! SignKeyEncrypted(data) {
+    t.Error("encrypted key file is not SignKeyEncrypted")
+  }
+  if SignKeyEncrypted(ExportSignKey(kp)) {
+    t.Error("plain key file is SignKeyEncrypted")
+  }
+  tests := []struct {
+    name string
+    passphrase []byte
+    err error
+  }{
+    {"no passphrase", nil, ErrNeedPassphrase},
+    {"wrong passphrase", []byte("arcD"), ErrPassphrase},
+    {"right passphrase", []byte("arcd"), nil},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      imported, err := ImportSignKeyPassphrase(data, tt.passphrase)
+      if err != tt.err {
+        t.Fatalf("gave %v, want %v", err, tt.err)
+      }
+      if err != nil {
+        return
+      }
+      defer imported.Free()
+      if ! bytes.Equal(imported.Public(), kp.Public()) {
+        t.Error("imported the wrong key")
+      }
+    })
+  }
+  if _, err = ImportSignKey(data); err != ErrNeedPassphrase {
+    t.Errorf("ImportSignKey gave %v, want ErrNeedPassphrase", err)
+  }
+}
+
+func TestImportSignKeyErrors(t *testing.T) {
+  tests := []struct {
+    name string
+    data []byte
+  }{
+    {"empty", nil},
+    {"short raw key", make([]byte, 31)},
+    {"unknown pem", []byte("-----BEGIN ARCD KEY-----\n\n-----END ARCD KEY-----\n")},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      if kp, err := ImportSignKey(tt.data); err == nil {
+        kp.Free()
+        t.Error("imported a key")
+      }
+    })
+  }
+}
+
+func TestEncryptedKeyFileLimits(t *testing.T) {
+  kp := genSignKeypair(t)
+  tests := []struct {
+    name string
+    limits PwHashLimits
+  }{
+    {"too many passes", PwHashLimits{Ops: maxKeyFileOps + 1, Mem: testPwHashLimits.Mem}},
+    {"too much memory", PwHashLimits{Ops: testPwHashLimits.Ops, Mem: maxKeyFileMem + 1}},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      data, err := ExportSignKeyPassphrase(kp, []byte("arcd"), testPwHashLimits)
+      if err != nil {
+        t.Fatal(err)
+      }
+      // rewrite the headers as a crafted file would
+      data = bytes.Replace(data, []byte("Ops: 2\n"), []byte("Ops: " + strconv.FormatUint(tt.limits.Ops, 10) + "\n"), 1)
+      data = bytes.Replace(data, []byte("Mem: 65536\n"), []byte("Mem: " + strconv.FormatUint(tt.limits.Mem, 10) + "\n"), 1)
+      imported, err := ImportSignKeyPassphrase(data, []byte("arcd"))
+      if err == nil {
+        imported.Free()
+      }
+      if ! errors.Is(err, ErrKeyFormat) {
+        t.Errorf("gave %v, want ErrKeyFormat", err)
+      }
+    })
+  }
+}
@@ -0,0 +1,20 @@
+package nacl
+
+import (
+  "log/slog"
+  "os"
+)
+
+// logger for this package, bad arguments are warnings and everything else is debug
+var logger = slog.Default()
+
+// set the logger this package uses
+func SetLogger(l *slog.Logger) {
+  logger = l
+}
+
+// log an error and exit
+func fatal(msg string, args ...interface{}) {
+  logger.Error(msg, args...)
+  os.Exit(1)
+}
@@ -0,0 +1,65 @@
+//go:build !cgo || nosodium
+
+package nacl
+
+import (
+  "golang.org/x/crypto/curve25519"
+  "golang.org/x/crypto/ed25519"
+  "golang.org/x/crypto/nacl/box"
+)
+
+// pure go backend, built with the nosodium tag or without cgo
+// it gives the same bytes as libsodium for everything, sodium_test.go checks that
+// against vectors made with libsodium
+
+// return how many bytes overhead does CryptoBox have
+func CryptoBoxOverhead() int {
+  return box.Overhead
+}
+
+// return how many bytes overhead does CryptoBoxSeal have
+func CryptoBoxSealOverhead() int {
+  return curve25519.PointSize + box.Overhead
+}
+
+// size of crypto_box nonces
+func CryptoBoxNonceSize() int {
+  return 24
+}
+
+// size of crypto_box public keys
+func CryptoBoxPubKeySize() int {
+  return curve25519.PointSize
+}
+
+// size of crypto_box private keys
+func CryptoBoxPrivKeySize() int {
+  return curve25519.ScalarSize
+}
+
+// size of crypto_sign public keys
+func CryptoSignPubKeySize() int {
+  return ed25519.PublicKeySize
+}
+
+// size of crypto_sign seeds
+func CryptoSignSeedSize() int {
+  return ed25519.SeedSize
+}
+
+// size of crypto_sign private keys
+func CryptoSignPrivKeySize() int {
+  return ed25519.PrivateKeySize
+}
+
+// check b is exactly want bytes
+func checkSize(what string, b []byte, want int) error {
+  if len(b) != want {
+    return &SizeError{What: what, Got: len(b), Want: want}
+  }
+  return nil
+}
+
+func init() {
+  logger.Debug("using pure go crypto")
+}
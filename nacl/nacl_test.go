@@ -0,0 +1,51 @@
+package nacl
+
+import (
+  "encoding/hex"
+  "testing"
+)
+
+// message sizes for round trips with random keys
+var testSizes = []int{0, 1, 64, 4096}
+
+func unhex(t testing.TB, s string) []byte {
+  t.Helper()
+  b, err := hex.DecodeString(s)
+  if err != nil {
+    t.Fatalf("bad hex in test vector %q: %s", s, err)
+  }
+  return b
+}
+
+// generate sign keys or give up
+func genSignKeypair(t testing.TB) *KeyPair {
+  t.Helper()
+  kp := GenSignKeypair()
+  if kp == nil {
+    t.Fatal("cannot generate sign keys")
+  }
+  t.Cleanup(kp.Free)
+  return kp
+}
+
+// generate box keys or give up
+func genBoxKeypair(t testing.TB) *KeyPair {
+  t.Helper()
+  kp := GenBoxKeypair()
+  if kp == nil {
+    t.Fatal("cannot generate box keys")
+  }
+  t.Cleanup(kp.Free)
+  return kp
+}
+
+// convert sign keys to box keys or give up
+func toBox(t testing.TB, kp *KeyPair) *KeyPair {
+  t.Helper()
+  box, err := kp.ToBox()
+  if err != nil {
+    t.Fatalf("converting sign keys: %s", err)
+  }
+  t.Cleanup(box.Free)
+  return box
+}
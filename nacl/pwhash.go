@@ -0,0 +1,93 @@
+//go:build cgo && !nosodium
+
+package nacl
+
+// #include <sodium.h>
+// #cgo pkg-config: libsodium
+import "C"
+
+// cpu and memory cost of argon2id password hashing
+// more is slower for us and for anyone guessing passwords
+type PwHashLimits struct {
+  // number of passes
+  Ops uint64
+  // bytes of memory used
+  Mem uint64
+}
+
+// limits for passwords checked while a user waits
+func PwHashInteractive() PwHashLimits {
+  return PwHashLimits{uint64(C.crypto_pwhash_opslimit_interactive()), uint64(C.crypto_pwhash_memlimit_interactive())}
+}
+
+// limits for passwords checked now and then, i.e. unlocking a key file
+func PwHashModerate() PwHashLimits {
+  return PwHashLimits{uint64(C.crypto_pwhash_opslimit_moderate()), uint64(C.crypto_pwhash_memlimit_moderate())}
+}
+
+// limits for secrets that are rarely unlocked and must hold up for a long time
+func PwHashSensitive() PwHashLimits {
+  return PwHashLimits{uint64(C.crypto_pwhash_opslimit_sensitive()), uint64(C.crypto_pwhash_memlimit_sensitive())}
+}
+
+// size of salts for DeriveKey
+func PwHashSaltSize() int {
+  return int(C.crypto_pwhash_saltbytes())
+}
+
+// generate a new random salt for DeriveKey
+func NewPwHashSalt() []byte {
+  return RandBytes(PwHashSaltSize())
+}
+
+// derive a size byte key from a password with argon2id
+// the same password, salt and limits always give the same key
+// caller frees the returned buffer
+func DeriveKey(passwd, salt []byte, size int, limits PwHashLimits) (*Buffer, error) {
+  err := checkSize("salt", salt, C.crypto_pwhash_saltbytes())
+  if err != nil {
+    return nil, err
+  }
+  if size <= 0 {
+    return nil, &SizeError{What: "derived key", Got: size, Want: CryptoSecretBoxKeySize()}
+  }
+  passbuff := NewBuffer(passwd)
+  defer passbuff.Free()
+  saltbuff := NewBuffer(salt)
+  defer saltbuff.Free()
+  key := secretMalloc(C.size_t(size))
+  res := C.crypto_pwhash(key.uchar(), C.ulonglong(size), passbuff.char(), C.ulonglong(passbuff.size), saltbuff.uchar(), C.ulonglong(limits.Ops), C.size_t(limits.Mem), C.crypto_pwhash_alg_argon2id13())
+  if res != 0 {
+    // out of memory or limits out of range
+    key.Free()
+    return nil, ErrFailed
+  }
+  return key, nil
+}
+
+// hash a password for storage, the result holds the salt and limits
+// check it later with PwHashVerify
+func PwHash(passwd []byte, limits PwHashLimits) (string, error) {
+  passbuff := NewBuffer(passwd)
+  defer passbuff.Free()
+  out := malloc(C.crypto_pwhash_strbytes())
+  defer out.Free()
+  res := C.crypto_pwhash_str(out.char(), passbuff.char(), C.ulonglong(passbuff.size), C.ulonglong(limits.Ops), C.size_t(limits.Mem))
+  if res != 0 {
+    return "", ErrFailed
+  }
+  return C.GoString(out.char()), nil
+}
+
+// check a password against a hash from PwHash
+func PwHashVerify(hash string, passwd []byte) bool {
+  if len(hash) >= int(C.crypto_pwhash_strbytes()) {
+    return false
+  }
+  hashbuff := malloc(C.crypto_pwhash_strbytes())
+  defer hashbuff.Free()
+  copy(hashbuff.Data(), hash)
+  passbuff := NewBuffer(passwd)
+  defer passbuff.Free()
+  return C.crypto_pwhash_str_verify(hashbuff.char(), passbuff.char(), C.ulonglong(passbuff.size)) == 0
+}
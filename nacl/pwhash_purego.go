@@ -0,0 +1,124 @@
+//go:build !cgo || nosodium
+
+package nacl
+
+import (
+  "crypto/subtle"
+  "encoding/base64"
+  "fmt"
+  "strings"
+  "golang.org/x/crypto/argon2"
+)
+
+// cpu and memory cost of argon2id password hashing
+// more is slower for us and for anyone guessing passwords
+type PwHashLimits struct {
+  // number of passes
+  Ops uint64
+  // bytes of memory used
+  Mem uint64
+}
+
+// limits for passwords checked while a user waits
+func PwHashInteractive() PwHashLimits {
+  return PwHashLimits{2, 64 << 20}
+}
+
+// limits for passwords checked now and then, i.e. unlocking a key file
+func PwHashModerate() PwHashLimits {
+  return PwHashLimits{3, 256 << 20}
+}
+
+// limits for secrets that are rarely unlocked and must hold up for a long time
+func PwHashSensitive() PwHashLimits {
+  return PwHashLimits{4, 1 << 30}
+}
+
+// size of salts for DeriveKey
+func PwHashSaltSize() int {
+  return 16
+}
+
+// generate a new random salt for DeriveKey
+func NewPwHashSalt() []byte {
+  return RandBytes(PwHashSaltSize())
+}
+
+// size of the hash in PwHash strings
+const pwHashStrSize = 32
+
+// the limits libsodium takes for argon2id
+func (l PwHashLimits) ok() bool {
+  return l.Ops >= 1 && l.Ops <= 0xffffffff && l.Mem >= 8192 && l.Mem / 1024 <= 0xffffffff
+}
+
+// derive a size byte key from a password with argon2id
+// the same password, salt and limits always give the same key
+// caller frees the returned buffer
+func DeriveKey(passwd, salt []byte, size int, limits PwHashLimits) (*Buffer, error) {
+  err := checkSize("salt", salt, PwHashSaltSize())
+  if err != nil {
+    return nil, err
+  }
+  if size <= 0 {
+    return nil, &SizeError{What: "derived key", Got: size, Want: CryptoSecretBoxKeySize()}
+  }
+  if size < 16 || ! limits.ok() {
+    // limits out of range
+    return nil, ErrFailed
+  }
+  key := argon2.IDKey(passwd, salt, uint32(limits.Ops), uint32(limits.Mem / 1024), 1, uint32(size))
+  defer wipe(key)
+  return newSecret(key), nil
+}
+
+// hash a password for storage, the result holds the salt and limits
+// check it later with PwHashVerify
+func PwHash(passwd []byte, limits PwHashLimits) (string, error) {
+  if ! limits.ok() {
+    return "", ErrFailed
+  }
+  salt := NewPwHashSalt()
+  mem := uint32(limits.Mem / 1024)
+  hash := argon2.IDKey(passwd, salt, uint32(limits.Ops), mem, 1, pwHashStrSize)
+  return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=1$%s$%s", argon2.Version, mem, limits.Ops,
+    base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+// check a password against a hash from PwHash
+// takes argon2i hashes too, like libsodium
+func PwHashVerify(hash string, passwd []byte) bool {
+  parts := strings.Split(hash, "$")
+  if len(parts) != 6 || parts[0] != "" {
+    return false
+  }
+  var version int
+  var mem, ops uint32
+  var threads uint8
+  _, err := fmt.Sscanf(parts[2], "v=%d", &version)
+  if err != nil || version != argon2.Version {
+    return false
+  }
+  _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &mem, &ops, &threads)
+  if err != nil || ops < 1 || threads < 1 {
+    return false
+  }
+  salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+  if err != nil || len(salt) < 8 {
+    return false
+  }
+  want, err := base64.RawStdEncoding.DecodeString(parts[5])
+  if err != nil || len(want) < 16 {
+    return false
+  }
+  var got []byte
+  switch parts[1] {
+  case "argon2id":
+    got = argon2.IDKey(passwd, salt, ops, mem, threads, uint32(len(want)))
+  case "argon2i":
+    got = argon2.Key(passwd, salt, ops, mem, threads, uint32(len(want)))
+  default:
+    return false
+  }
+  return subtle.ConstantTimeCompare(got, want) == 1
+}
@@ -0,0 +1,80 @@
+package nacl
+
+import (
+  "bytes"
+  "fmt"
+  "testing"
+)
+
+// the smallest limits libsodium takes, keeps the tests fast
+var testPwHashLimits = PwHashLimits{Ops: 2, Mem: 64 * 1024}
+
+// argon2id with the smallest limits libsodium takes, keys computed with golang.org/x/crypto/argon2
+var pwHashVectors = []struct {
+  passwd, salt, key string
+  limits PwHashLimits
+}{
+  {
+    passwd: "636f727265637420686f727365206261747465727920737461706c65",
+    salt: "617263642073616c7420313662797465",
+    key: "6bdfdfa4aeb53f22b6bd8900906c5b58a0b6b25780c25ff677b88ecf12348621",
+    limits: testPwHashLimits,
+  },
+}
+
+func TestDeriveKeyVectors(t *testing.T) {
+  for n, v := range pwHashVectors {
+    t.Run(fmt.Sprint(n), func(t *testing.T) {
+      want := unhex(t, v.key)
+      key, err := DeriveKey(unhex(t, v.passwd), unhex(t, v.salt), len(want), v.limits)
+      if err != nil {
+        t.Fatal(err)
+      }
+      defer key.Free()
+      if ! bytes.Equal(key.Data(), want) {
+        t.Errorf("wrong key %x", key.Data())
+      }
+    })
+  }
+}
+
+func TestDeriveKeyErrors(t *testing.T) {
+  tests := []struct {
+    name string
+    salt []byte
+    size int
+  }{
+    {"short salt", make([]byte, PwHashSaltSize() - 1), 32},
+    {"no key", NewPwHashSalt(), 0},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      if key, err := DeriveKey([]byte("arcd"), tt.salt, tt.size, testPwHashLimits); err == nil {
+        key.Free()
+        t.Error("derived a key")
+      }
+    })
+  }
+}
+
+func TestPwHash(t *testing.T) {
+  hash, err := PwHash([]byte("arcd"), testPwHashLimits)
+  if err != nil {
+    t.Fatal(err)
+  }
+  tests := []struct {
+    hash, passwd string
+    ok bool
+  }{
+    {hash, "arcd", true},
+    {hash, "arcD", false},
+    {hash, "", false},
+    {"", "arcd", false},
+    {hash[:len(hash)-1], "arcd", false},
+  }
+  for n, tt := range tests {
+    if got := PwHashVerify(tt.hash, []byte(tt.passwd)); got != tt.ok {
+      t.Errorf("%d: PwHashVerify(%q, %q) = %v, want %v", n, tt.hash, tt.passwd, got, tt.ok)
+    }
+  }
+}
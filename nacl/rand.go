@@ -1,3 +1,5 @@
+//go:build cgo && !nosodium
+
 package nacl
 
 // #include <sodium.h>
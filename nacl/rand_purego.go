@@ -0,0 +1,20 @@
+//go:build !cgo || nosodium
+
+package nacl
+
+import (
+  "crypto/rand"
+  "io"
+)
+
+func RandBytes(size int) []byte {
+  if size > 0 {
+    buff := make([]byte, size)
+    _, err := io.ReadFull(rand.Reader, buff)
+    if err != nil {
+      fatal("cannot read random bytes", "err", err)
+    }
+    return buff
+  }
+  return nil
+}
@@ -0,0 +1,75 @@
+//go:build cgo && !nosodium
+
+package nacl
+
+// #include <sodium.h>
+// #cgo pkg-config: libsodium
+import "C"
+
+// encrypts a message anonymously to the holder of pk
+// the sender needs no keys of its own and cannot open the box afterwards
+// returns a sealed box CryptoBoxSealOverhead() bytes longer than msg
+func CryptoBoxSeal(msg, pk []byte) ([]byte, error) {
+  err := checkSize("public key", pk, C.crypto_box_publickeybytes())
+  if err != nil {
+    return nil, err
+  }
+  msgbuff := NewBuffer(msg)
+  defer msgbuff.Free()
+  pkbuff := NewBuffer(pk)
+  defer pkbuff.Free()
+
+  resultbuff := malloc(msgbuff.size + C.crypto_box_sealbytes())
+  defer resultbuff.Free()
+  res := C.crypto_box_seal(resultbuff.uchar(), msgbuff.uchar(), C.ulonglong(msgbuff.size), pkbuff.uchar())
+  if res != 0 {
+    return nil, ErrFailed
+  }
+  return resultbuff.Bytes(), nil
+}
+
+// open a sealed box sent to our box keypair pk, sk
+// returns ErrOpen if the box is not for us or was tampered with
+func CryptoBoxSealOpen(box, pk, sk []byte) ([]byte, error) {
+  err := checkSize("public key", pk, C.crypto_box_publickeybytes())
+  if err == nil {
+    err = checkSize("secret key", sk, C.crypto_box_secretkeybytes())
+  }
+  if err != nil {
+    return nil, err
+  }
+  skbuff := NewBuffer(sk)
+  defer skbuff.Free()
+  return sealOpen(box, pk, skbuff)
+}
+
+// open a sealed box sent to this box keypair without copying the secret key out
+func (self *KeyPair) SealOpen(box []byte) ([]byte, error) {
+  pk := self.pk.Data()
+  err := checkSize("public key", pk, C.crypto_box_publickeybytes())
+  if err == nil {
+    err = checkSize("secret key", self.sk.Data(), C.crypto_box_secretkeybytes())
+  }
+  if err != nil {
+    return nil, err
+  }
+  return sealOpen(box, pk, self.sk)
+}
+
+func sealOpen(box, pk []byte, sk *Buffer) ([]byte, error) {
+  if len(box) < CryptoBoxSealOverhead() {
+    return nil, ErrOpen
+  }
+  boxbuff := NewBuffer(box)
+  defer boxbuff.Free()
+  pkbuff := NewBuffer(pk)
+  defer pkbuff.Free()
+  resultbuff := malloc(boxbuff.size - C.crypto_box_sealbytes())
+  defer resultbuff.Free()
+
+  res := C.crypto_box_seal_open(resultbuff.uchar(), boxbuff.uchar(), C.ulonglong(boxbuff.size), pkbuff.uchar(), sk.uchar())
+  if res != 0 {
+    return nil, ErrOpen
+  }
+  return resultbuff.Bytes(), nil
+}
@@ -0,0 +1,68 @@
+//go:build !cgo || nosodium
+
+package nacl
+
+import (
+  "golang.org/x/crypto/blake2b"
+  "golang.org/x/crypto/curve25519"
+  "golang.org/x/crypto/nacl/secretbox"
+)
+
+// crypto_box_seal nonce: blake2b of the ephemeral public key then the recipient's
+func sealNonce(epk, pk []byte) []byte {
+  h, _ := blake2b.New(CryptoBoxNonceSize(), nil)
+  h.Write(epk)
+  h.Write(pk)
+  return h.Sum(nil)
+}
+
+// encrypts a message anonymously to the holder of pk
+// the sender needs no keys of its own and cannot open the box afterwards
+// returns a sealed box CryptoBoxSealOverhead() bytes longer than msg
+func CryptoBoxSeal(msg, pk []byte) ([]byte, error) {
+  err := checkSize("public key", pk, CryptoBoxPubKeySize())
+  if err != nil {
+    return nil, err
+  }
+  eph := GenBoxKeypair()
+  if eph == nil {
+    return nil, ErrFailed
+  }
+  defer eph.Free()
+  epk := eph.pk.Data()
+  k, err := sharedKey(pk, eph.sk.Data())
+  if err != nil {
+    return nil, err
+  }
+  defer wipe(k[:])
+  out := make([]byte, 0, len(msg) + CryptoBoxSealOverhead())
+  out = append(out, epk...)
+  return secretbox.Seal(out, msg, (*[24]byte)(sealNonce(epk, pk)), k), nil
+}
+
+// open a sealed box sent to our box keypair pk, sk
+// returns ErrOpen if the box is not for us or was tampered with
+func CryptoBoxSealOpen(box, pk, sk []byte) ([]byte, error) {
+  err := checkSize("public key", pk, CryptoBoxPubKeySize())
+  if err == nil {
+    err = checkSize("secret key", sk, CryptoBoxPrivKeySize())
+  }
+  if err != nil {
+    return nil, err
+  }
+  if len(box) < CryptoBoxSealOverhead() {
+    return nil, ErrOpen
+  }
+  epk := box[:curve25519.PointSize]
+  k, err := sharedKey(epk, sk)
+  if err != nil {
+    return nil, ErrOpen
+  }
+  defer wipe(k[:])
+  return secretBoxOpen(box[curve25519.PointSize:], sealNonce(epk, pk), k)
+}
+
+// open a sealed box sent to this box keypair without copying the secret key out
+func (self *KeyPair) SealOpen(box []byte) ([]byte, error) {
+  return CryptoBoxSealOpen(box, self.pk.Data(), self.sk.Data())
+}
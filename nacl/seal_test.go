@@ -0,0 +1,75 @@
+package nacl
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "testing"
+)
+
+// sealed boxes open only for their recipient
+func TestSeal(t *testing.T) {
+  to, other := genBoxKeypair(t), genBoxKeypair(t)
+  for _, size := range testSizes {
+    t.Run(fmt.Sprint(size), func(t *testing.T) {
+      msg := RandBytes(size)
+      box, err := CryptoBoxSeal(msg, to.Public())
+      if err != nil {
+        t.Fatal(err)
+      }
+      if len(box) != size + CryptoBoxSealOverhead() {
+        t.Fatalf("sealed box of %d bytes is %d bytes", size, len(box))
+      }
+      got, err := CryptoBoxSealOpen(box, to.Public(), to.Secret())
+      if err != nil || ! bytes.Equal(got, msg) {
+        t.Errorf("CryptoBoxSealOpen failed: %v", err)
+      }
+      got, err = to.SealOpen(box)
+      if err != nil || ! bytes.Equal(got, msg) {
+        t.Errorf("KeyPair.SealOpen failed: %v", err)
+      }
+      if _, err = CryptoBoxSealOpen(box, other.Public(), other.Secret()); err != ErrOpen {
+        t.Errorf("opened with wrong keys: %v", err)
+      }
+      if _, err = other.SealOpen(box); err != ErrOpen {
+        t.Errorf("KeyPair.SealOpen with wrong keys gave %v, want ErrOpen", err)
+      }
+      box[len(box)-1] ^= 1
+      if _, err = CryptoBoxSealOpen(box, to.Public(), to.Secret()); err != ErrOpen {
+        t.Errorf("tampered sealed box gave %v, want ErrOpen", err)
+      }
+    })
+  }
+}
+
+func TestSealErrors(t *testing.T) {
+  to := genBoxKeypair(t)
+  _, err := CryptoBoxSealOpen(make([]byte, CryptoBoxSealOverhead()-1), to.Public(), to.Secret())
+  if err != ErrOpen {
+    t.Errorf("short sealed box gave %v, want ErrOpen", err)
+  }
+  var sizeErr *SizeError
+  _, err = CryptoBoxSeal([]byte("arcd"), to.Public()[1:])
+  if ! errors.As(err, &sizeErr) {
+    t.Errorf("seal with short key gave %v, want SizeError", err)
+  }
+}
+
+// seal to someone we only know the identity key of
+func TestSealToIdentity(t *testing.T) {
+  id := genSignKeypair(t)
+  idbox := toBox(t, id)
+  pk, err := SignPubkeyToBox(id.Public())
+  if err != nil {
+    t.Fatal(err)
+  }
+  msg := []byte("arcd")
+  box, err := CryptoBoxSeal(msg, pk)
+  if err != nil {
+    t.Fatal(err)
+  }
+  got, err := idbox.SealOpen(box)
+  if err != nil || ! bytes.Equal(got, msg) {
+    t.Errorf("seal to converted key failed: %v", err)
+  }
+}
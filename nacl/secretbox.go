@@ -0,0 +1,86 @@
+//go:build cgo && !nosodium
+
+package nacl
+
+// #include <sodium.h>
+// #cgo pkg-config: libsodium
+import "C"
+
+// size of crypto_secretbox keys
+func CryptoSecretBoxKeySize() int {
+  return int(C.crypto_secretbox_keybytes())
+}
+
+// size of crypto_secretbox nonces
+func CryptoSecretBoxNonceSize() int {
+  return int(C.crypto_secretbox_noncebytes())
+}
+
+// return how many bytes overhead does CryptoSecretBox have
+func CryptoSecretBoxOverhead() int {
+  return int(C.crypto_secretbox_macbytes())
+}
+
+// check key and nonce sizes for crypto_secretbox
+func checkSecretBoxArgs(nonce, key []byte) (err error) {
+  err = checkSize("secret key", key, C.crypto_secretbox_keybytes())
+  if err == nil {
+    err = checkSize("nonce", nonce, C.crypto_secretbox_noncebytes())
+  }
+  return
+}
+
+// encrypt a message with a shared secret key
+// returns a box CryptoSecretBoxOverhead() bytes longer than msg
+// nonce must be CryptoSecretBoxNonceSize() bytes and never used twice with the same key
+func CryptoSecretBox(msg, nonce, key []byte) ([]byte, error) {
+  err := checkSecretBoxArgs(nonce, key)
+  if err != nil {
+    return nil, err
+  }
+  msgbuff := NewBuffer(msg)
+  defer msgbuff.Free()
+  keybuff := NewBuffer(key)
+  defer keybuff.Free()
+  noncebuff := NewBuffer(nonce)
+  defer noncebuff.Free()
+
+  resultbuff := malloc(msgbuff.size + C.crypto_secretbox_macbytes())
+  defer resultbuff.Free()
+  res := C.crypto_secretbox_easy(resultbuff.uchar(), msgbuff.uchar(), C.ulonglong(msgbuff.size), noncebuff.uchar(), keybuff.uchar())
+  if res != 0 {
+    return nil, ErrFailed
+  }
+  return resultbuff.Bytes(), nil
+}
+
+// open a box made with CryptoSecretBox
+// returns ErrOpen if the key or nonce is wrong or the box was tampered with
+func CryptoSecretBoxOpen(box, nonce, key []byte) ([]byte, error) {
+  err := checkSecretBoxArgs(nonce, key)
+  if err != nil {
+    return nil, err
+  }
+  if len(box) < CryptoSecretBoxOverhead() {
+    return nil, ErrOpen
+  }
+  boxbuff := NewBuffer(box)
+  defer boxbuff.Free()
+  keybuff := NewBuffer(key)
+  defer keybuff.Free()
+  noncebuff := NewBuffer(nonce)
+  defer noncebuff.Free()
+  resultbuff := malloc(boxbuff.size - C.crypto_secretbox_macbytes())
+  defer resultbuff.Free()
+
+  res := C.crypto_secretbox_open_easy(resultbuff.uchar(), boxbuff.uchar(), C.ulonglong(boxbuff.size), noncebuff.uchar(), keybuff.uchar())
+  if res != 0 {
+    return nil, ErrOpen
+  }
+  return resultbuff.Bytes(), nil
+}
+
+// generate a new random nonce for CryptoSecretBox
+func NewSecretBoxNonce() []byte {
+  return RandBytes(CryptoSecretBoxNonceSize())
+}
@@ -0,0 +1,64 @@
+//go:build !cgo || nosodium
+
+package nacl
+
+import (
+  "golang.org/x/crypto/nacl/secretbox"
+)
+
+// size of crypto_secretbox keys
+func CryptoSecretBoxKeySize() int {
+  return 32
+}
+
+// size of crypto_secretbox nonces
+func CryptoSecretBoxNonceSize() int {
+  return 24
+}
+
+// return how many bytes overhead does CryptoSecretBox have
+func CryptoSecretBoxOverhead() int {
+  return secretbox.Overhead
+}
+
+// check key and nonce sizes for crypto_secretbox
+func checkSecretBoxArgs(nonce, key []byte) (err error) {
+  err = checkSize("secret key", key, CryptoSecretBoxKeySize())
+  if err == nil {
+    err = checkSize("nonce", nonce, CryptoSecretBoxNonceSize())
+  }
+  return
+}
+
+// encrypt a message with a shared secret key
+// returns a box CryptoSecretBoxOverhead() bytes longer than msg
+// nonce must be CryptoSecretBoxNonceSize() bytes and never used twice with the same key
+func CryptoSecretBox(msg, nonce, key []byte) ([]byte, error) {
+  err := checkSecretBoxArgs(nonce, key)
+  if err != nil {
+    return nil, err
+  }
+  return secretbox.Seal(make([]byte, 0, len(msg) + secretbox.Overhead), msg, (*[24]byte)(nonce), (*[32]byte)(key)), nil
+}
+
+// open a box made with CryptoSecretBox
+// returns ErrOpen if the key or nonce is wrong or the box was tampered with
+func CryptoSecretBoxOpen(box, nonce, key []byte) ([]byte, error) {
+  err := checkSecretBoxArgs(nonce, key)
+  if err != nil {
+    return nil, err
+  }
+  if len(box) < CryptoSecretBoxOverhead() {
+    return nil, ErrOpen
+  }
+  msg, ok := secretbox.Open(make([]byte, 0, len(box) - secretbox.Overhead), box, (*[24]byte)(nonce), (*[32]byte)(key))
+  if ! ok {
+    return nil, ErrOpen
+  }
+  return msg, nil
+}
+
+// generate a new random nonce for CryptoSecretBox
+func NewSecretBoxNonce() []byte {
+  return RandBytes(CryptoSecretBoxNonceSize())
+}
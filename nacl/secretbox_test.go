@@ -0,0 +1,68 @@
+package nacl
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "testing"
+)
+
+// crypto_secretbox_easy, boxes computed with golang.org/x/crypto/nacl/secretbox
+var secretBoxVectors = []struct {
+  key, nonce, msg, box string
+}{
+  {
+    key: "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+    nonce: "404142434445464748494a4b4c4d4e4f5051525354555657",
+    msg: "61726364207572632072656c61792063686174",
+    box: "020d7c48484f942f4b22d9abf48072912b65361d1a24c949e62b140d09f07a92a65632",
+  },
+}
+
+func TestSecretBoxVectors(t *testing.T) {
+  for n, v := range secretBoxVectors {
+    t.Run(fmt.Sprint(n), func(t *testing.T) {
+      key, nonce, msg, box := unhex(t, v.key), unhex(t, v.nonce), unhex(t, v.msg), unhex(t, v.box)
+      got, err := CryptoSecretBox(msg, nonce, key)
+      if err != nil || ! bytes.Equal(got, box) {
+        t.Errorf("wrong box %x %v", got, err)
+      }
+      got, err = CryptoSecretBoxOpen(box, nonce, key)
+      if err != nil || ! bytes.Equal(got, msg) {
+        t.Errorf("open failed: %v", err)
+      }
+    })
+  }
+}
+
+func TestSecretBoxOpenErrors(t *testing.T) {
+  v := secretBoxVectors[0]
+  key, nonce, box := unhex(t, v.key), unhex(t, v.nonce), unhex(t, v.box)
+  tampered := append([]byte{}, box...)
+  tampered[0] ^= 1
+  wrongNonce := append([]byte{}, nonce...)
+  wrongNonce[0] ^= 1
+  tests := []struct {
+    name string
+    box, nonce, key []byte
+  }{
+    {"wrong key", box, nonce, RandBytes(CryptoSecretBoxKeySize())},
+    {"wrong nonce", box, wrongNonce, key},
+    {"tampered box", tampered, nonce, key},
+    {"short box", box[:CryptoSecretBoxOverhead() - 1], nonce, key},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      if _, err := CryptoSecretBoxOpen(tt.box, tt.nonce, tt.key); err != ErrOpen {
+        t.Errorf("gave %v, want ErrOpen", err)
+      }
+    })
+  }
+  var sizeErr *SizeError
+  if _, err := CryptoSecretBox([]byte("arcd"), NewSecretBoxNonce(), RandBytes(16)); ! errors.As(err, &sizeErr) {
+    t.Errorf("short key gave %v, want SizeError", err)
+  }
+  if _, err := CryptoSecretBoxOpen(box, nonce[1:], key); ! errors.As(err, &sizeErr) {
+    t.Errorf("short nonce gave %v, want SizeError", err)
+  }
+}
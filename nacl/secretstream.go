@@ -0,0 +1,162 @@
+//go:build cgo && !nosodium
+
+package nacl
+
+// #include <sodium.h>
+// #cgo pkg-config: libsodium
+//
+// crypto_secretstream_xchacha20poly1305_state * deref_secretstream(void * ptr) { return (crypto_secretstream_xchacha20poly1305_state*) ptr; }
+//
+import "C"
+
+// tags on secretstream messages
+var (
+  // a plain message
+  SecretStreamTagMessage = byte(C.crypto_secretstream_xchacha20poly1305_tag_message())
+  // end of a set of messages, the stream goes on
+  SecretStreamTagPush = byte(C.crypto_secretstream_xchacha20poly1305_tag_push())
+  // both sides rekey after this message
+  SecretStreamTagRekey = byte(C.crypto_secretstream_xchacha20poly1305_tag_rekey())
+  // last message of the stream
+  SecretStreamTagFinal = byte(C.crypto_secretstream_xchacha20poly1305_tag_final())
+)
+
+// size of secretstream keys
+func SecretStreamKeySize() int {
+  return int(C.crypto_secretstream_xchacha20poly1305_keybytes())
+}
+
+// size of the header that starts a secretstream
+func SecretStreamHeaderSize() int {
+  return int(C.crypto_secretstream_xchacha20poly1305_headerbytes())
+}
+
+// return how many bytes overhead each secretstream message has
+func SecretStreamOverhead() int {
+  return int(C.crypto_secretstream_xchacha20poly1305_abytes())
+}
+
+// generate a new random secretstream key
+func NewSecretStreamKey() *Buffer {
+  k := secretMalloc(C.crypto_secretstream_xchacha20poly1305_keybytes())
+  C.crypto_secretstream_xchacha20poly1305_keygen(k.uchar())
+  return k
+}
+
+// stream state, it holds key material so it lives in secret memory
+type secretStreamState struct {
+  s *Buffer
+}
+
+func newSecretStreamState() secretStreamState {
+  return secretStreamState{secretMalloc(C.crypto_secretstream_xchacha20poly1305_statebytes())}
+}
+
+func (self secretStreamState) state() *C.crypto_secretstream_xchacha20poly1305_state {
+  return C.deref_secretstream(self.s.ptr)
+}
+
+// rekey now, the other side must rekey at the same message
+// tag a message SecretStreamTagRekey to have both sides do it for you
+func (self secretStreamState) Rekey() {
+  C.crypto_secretstream_xchacha20poly1305_rekey(self.state())
+}
+
+// zero and free the stream state
+func (self secretStreamState) Free() {
+  self.s.Free()
+}
+
+// encrypting end of a secretstream
+type SecretStreamPush struct {
+  secretStreamState
+}
+
+// start encrypting a stream with key
+// the header must reach the other side before any messages
+func NewSecretStreamPush(key []byte) (push *SecretStreamPush, header []byte, err error) {
+  err = checkSize("secret key", key, C.crypto_secretstream_xchacha20poly1305_keybytes())
+  if err != nil {
+    return
+  }
+  keybuff := NewBuffer(key)
+  defer keybuff.Free()
+  hdr := malloc(C.crypto_secretstream_xchacha20poly1305_headerbytes())
+  defer hdr.Free()
+  st := newSecretStreamState()
+  res := C.crypto_secretstream_xchacha20poly1305_init_push(st.state(), hdr.uchar(), keybuff.uchar())
+  if res != 0 {
+    st.Free()
+    err = ErrFailed
+    return
+  }
+  push = &SecretStreamPush{st}
+  header = hdr.Bytes()
+  return
+}
+
+// encrypt the next message of the stream
+// returns a message SecretStreamOverhead() bytes longer than msg
+func (self *SecretStreamPush) Push(msg []byte, tag byte) ([]byte, error) {
+  msgbuff := NewBuffer(msg)
+  defer msgbuff.Free()
+  resultbuff := malloc(msgbuff.size + C.crypto_secretstream_xchacha20poly1305_abytes())
+  defer resultbuff.Free()
+  clen := C.ulonglong(0)
+  res := C.crypto_secretstream_xchacha20poly1305_push(self.state(), resultbuff.uchar(), &clen, msgbuff.uchar(), C.ulonglong(msgbuff.size), nil, 0, C.uchar(tag))
+  if res != 0 {
+    return nil, ErrFailed
+  }
+  return resultbuff.Bytes()[:clen], nil
+}
+
+// decrypting end of a secretstream
+type SecretStreamPull struct {
+  secretStreamState
+}
+
+// start decrypting a stream with key and the header from the pushing side
+func NewSecretStreamPull(key, header []byte) (*SecretStreamPull, error) {
+  err := checkSize("secret key", key, C.crypto_secretstream_xchacha20poly1305_keybytes())
+  if err == nil {
+    err = checkSize("header", header, C.crypto_secretstream_xchacha20poly1305_headerbytes())
+  }
+  if err != nil {
+    return nil, err
+  }
+  keybuff := NewBuffer(key)
+  defer keybuff.Free()
+  hdr := NewBuffer(header)
+  defer hdr.Free()
+  st := newSecretStreamState()
+  res := C.crypto_secretstream_xchacha20poly1305_init_pull(st.state(), hdr.uchar(), keybuff.uchar())
+  if res != 0 {
+    // bad header
+    st.Free()
+    return nil, ErrOpen
+  }
+  return &SecretStreamPull{st}, nil
+}
+
+// decrypt the next message of the stream
+// returns ErrOpen if it was tampered with, reordered, replayed or the key is wrong
+func (self *SecretStreamPull) Pull(c []byte) (msg []byte, tag byte, err error) {
+  if len(c) < SecretStreamOverhead() {
+    err = ErrOpen
+    return
+  }
+  cbuff := NewBuffer(c)
+  defer cbuff.Free()
+  resultbuff := malloc(cbuff.size - C.crypto_secretstream_xchacha20poly1305_abytes())
+  defer resultbuff.Free()
+  mlen := C.ulonglong(0)
+  ctag := C.uchar(0)
+  res := C.crypto_secretstream_xchacha20poly1305_pull(self.state(), resultbuff.uchar(), &mlen, &ctag, cbuff.uchar(), C.ulonglong(cbuff.size), nil, 0)
+  if res != 0 {
+    err = ErrOpen
+    return
+  }
+  msg = resultbuff.Bytes()[:mlen]
+  tag = byte(ctag)
+  return
+}
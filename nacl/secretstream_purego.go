@@ -0,0 +1,217 @@
+//go:build !cgo || nosodium
+
+package nacl
+
+import (
+  "crypto/subtle"
+  "encoding/binary"
+  "golang.org/x/crypto/chacha20"
+  "golang.org/x/crypto/poly1305"
+)
+
+// crypto_secretstream_xchacha20poly1305 as libsodium does it, down to the
+// odd padding after the message, so either end can be libsodium
+
+// tags on secretstream messages
+var (
+  // a plain message
+  SecretStreamTagMessage = byte(0)
+  // end of a set of messages, the stream goes on
+  SecretStreamTagPush = byte(1)
+  // both sides rekey after this message
+  SecretStreamTagRekey = byte(2)
+  // last message of the stream
+  SecretStreamTagFinal = SecretStreamTagPush | SecretStreamTagRekey
+)
+
+// size of secretstream keys
+func SecretStreamKeySize() int {
+  return chacha20.KeySize
+}
+
+// size of the header that starts a secretstream
+func SecretStreamHeaderSize() int {
+  return chacha20.NonceSizeX
+}
+
+// return how many bytes overhead each secretstream message has
+func SecretStreamOverhead() int {
+  return 1 + poly1305.TagSize
+}
+
+// generate a new random secretstream key
+func NewSecretStreamKey() *Buffer {
+  k := RandBytes(SecretStreamKeySize())
+  defer wipe(k)
+  return newSecret(k)
+}
+
+// stream state: chacha20 key then a 4 byte counter and 8 byte nonce, like libsodium
+type secretStreamState struct {
+  s *Buffer
+}
+
+func newSecretStreamState(key, header []byte) (secretStreamState, error) {
+  k, err := chacha20.HChaCha20(key, header[:16])
+  if err != nil {
+    return secretStreamState{}, ErrFailed
+  }
+  defer wipe(k)
+  st := secretStreamState{secretMalloc(chacha20.KeySize + chacha20.NonceSize)}
+  copy(st.key(), k)
+  copy(st.nonce()[4:], header[16:])
+  st.resetCounter()
+  return st, nil
+}
+
+func (self secretStreamState) key() []byte {
+  return self.s.Data()[:chacha20.KeySize]
+}
+
+func (self secretStreamState) nonce() []byte {
+  return self.s.Data()[chacha20.KeySize:]
+}
+
+func (self secretStreamState) resetCounter() {
+  n := self.nonce()
+  binary.LittleEndian.PutUint32(n[:4], 1)
+}
+
+// rekey now, the other side must rekey at the same message
+// tag a message SecretStreamTagRekey to have both sides do it for you
+func (self secretStreamState) Rekey() {
+  n := self.nonce()
+  buff := make([]byte, chacha20.KeySize + 8)
+  defer wipe(buff)
+  copy(buff, self.key())
+  copy(buff[chacha20.KeySize:], n[4:])
+  c, _ := chacha20.NewUnauthenticatedCipher(self.key(), n)
+  c.XORKeyStream(buff, buff)
+  copy(self.key(), buff)
+  copy(n[4:], buff[chacha20.KeySize:])
+  self.resetCounter()
+}
+
+// zero and free the stream state
+func (self secretStreamState) Free() {
+  self.s.Free()
+}
+
+// start a message: the cipher at block 1 and the mac keyed from block 0
+func (self secretStreamState) begin() (*chacha20.Cipher, *poly1305.MAC) {
+  c, _ := chacha20.NewUnauthenticatedCipher(self.key(), self.nonce())
+  var block [64]byte
+  c.XORKeyStream(block[:], block[:])
+  mac := poly1305.New((*[32]byte)(block[:32]))
+  wipe(block[:])
+  return c, mac
+}
+
+// mac the encrypted tag block and message with libsodium's padding and lengths
+func (self secretStreamState) auth(mac *poly1305.MAC, block, c []byte) []byte {
+  var pad [16]byte
+  mac.Write(block)
+  mac.Write(c)
+  mac.Write(pad[:(0x10 - len(block) + len(c)) & 0xf])
+  var lens [16]byte
+  // no additional data
+  binary.LittleEndian.PutUint64(lens[8:], uint64(len(block) + len(c)))
+  mac.Write(lens[:])
+  return mac.Sum(nil)
+}
+
+// move the state on past a message
+func (self secretStreamState) next(tag byte, sum []byte) {
+  n := self.nonce()
+  subtle.XORBytes(n[4:], n[4:], sum[:8])
+  counter := binary.LittleEndian.Uint32(n[:4]) + 1
+  binary.LittleEndian.PutUint32(n[:4], counter)
+  if tag & SecretStreamTagRekey != 0 || counter == 0 {
+    self.Rekey()
+  }
+}
+
+// encrypting end of a secretstream
+type SecretStreamPush struct {
+  secretStreamState
+}
+
+// start encrypting a stream with key
+// the header must reach the other side before any messages
+func NewSecretStreamPush(key []byte) (push *SecretStreamPush, header []byte, err error) {
+  err = checkSize("secret key", key, SecretStreamKeySize())
+  if err != nil {
+    return
+  }
+  header = RandBytes(SecretStreamHeaderSize())
+  var st secretStreamState
+  st, err = newSecretStreamState(key, header)
+  if err != nil {
+    header = nil
+    return
+  }
+  push = &SecretStreamPush{st}
+  return
+}
+
+// encrypt the next message of the stream
+// returns a message SecretStreamOverhead() bytes longer than msg
+func (self *SecretStreamPush) Push(msg []byte, tag byte) ([]byte, error) {
+  c, mac := self.begin()
+  out := make([]byte, 1 + len(msg) + poly1305.TagSize)
+  var block [64]byte
+  block[0] = tag
+  c.XORKeyStream(block[:], block[:])
+  out[0] = block[0]
+  c.XORKeyStream(out[1:1 + len(msg)], msg)
+  sum := self.auth(mac, block[:], out[1:1 + len(msg)])
+  copy(out[1 + len(msg):], sum)
+  self.next(tag, sum)
+  return out, nil
+}
+
+// decrypting end of a secretstream
+type SecretStreamPull struct {
+  secretStreamState
+}
+
+// start decrypting a stream with key and the header from the pushing side
+func NewSecretStreamPull(key, header []byte) (*SecretStreamPull, error) {
+  err := checkSize("secret key", key, SecretStreamKeySize())
+  if err == nil {
+    err = checkSize("header", header, SecretStreamHeaderSize())
+  }
+  if err != nil {
+    return nil, err
+  }
+  st, err := newSecretStreamState(key, header)
+  if err != nil {
+    return nil, ErrOpen
+  }
+  return &SecretStreamPull{st}, nil
+}
+
+// decrypt the next message of the stream
+// returns ErrOpen if it was tampered with, reordered, replayed or the key is wrong
+func (self *SecretStreamPull) Pull(in []byte) (msg []byte, tag byte, err error) {
+  if len(in) < SecretStreamOverhead() {
+    err = ErrOpen
+    return
+  }
+  mlen := len(in) - SecretStreamOverhead()
+  c, mac := self.begin()
+  var block [64]byte
+  block[0] = in[0]
+  c.XORKeyStream(block[:], block[:])
+  tag = block[0]
+  block[0] = in[0]
+  sum := self.auth(mac, block[:], in[1:1 + mlen])
+  if subtle.ConstantTimeCompare(sum, in[1 + mlen:]) != 1 {
+    err = ErrOpen
+    return
+  }
+  msg = make([]byte, mlen)
+  c.XORKeyStream(msg, in[1:1 + mlen])
+  self.next(tag, sum)
+  return
+}
@@ -0,0 +1,163 @@
+package nacl
+
+import (
+  "bytes"
+  "io"
+  "testing"
+)
+
+// push and pull a secretstream pair with a fresh key
+func newTestSecretStream(t *testing.T) (key *Buffer, push *SecretStreamPush, pull *SecretStreamPull) {
+  t.Helper()
+  key = NewSecretStreamKey()
+  t.Cleanup(key.Free)
+  push, header, err := NewSecretStreamPush(key.Data())
+  if err != nil {
+    t.Fatalf("init_push: %s", err)
+  }
+  t.Cleanup(push.Free)
+  pull, err = NewSecretStreamPull(key.Data(), header)
+  if err != nil {
+    t.Fatalf("init_pull: %s", err)
+  }
+  t.Cleanup(pull.Free)
+  return
+}
+
+// messages, tags and rekeying
+func TestSecretStream(t *testing.T) {
+  _, push, pull := newTestSecretStream(t)
+  msgs := []struct {
+    msg []byte
+    tag byte
+  }{
+    {[]byte("arcd"), SecretStreamTagMessage},
+    {nil, SecretStreamTagPush},
+    {RandBytes(4096), SecretStreamTagRekey},
+    {[]byte("after rekey"), SecretStreamTagMessage},
+    {[]byte("bye"), SecretStreamTagFinal},
+  }
+  var cs [][]byte
+  for n, m := range msgs {
+    c, err := push.Push(m.msg, m.tag)
+    if err != nil {
+      t.Fatalf("push %d: %s", n, err)
+    }
+    if len(c) != len(m.msg) + SecretStreamOverhead() {
+      t.Fatalf("message of %d bytes is %d bytes", len(m.msg), len(c))
+    }
+    cs = append(cs, c)
+  }
+  if _, _, err := pull.Pull(cs[1]); err != ErrOpen {
+    t.Fatalf("pull out of order gave %v, want ErrOpen", err)
+  }
+  for n, c := range cs {
+    msg, tag, err := pull.Pull(c)
+    if err != nil || ! bytes.Equal(msg, msgs[n].msg) || tag != msgs[n].tag {
+      t.Fatalf("pull %d gave tag %d %v", n, tag, err)
+    }
+  }
+}
+
+func TestSecretStreamRekey(t *testing.T) {
+  _, push, pull := newTestSecretStream(t)
+  push.Rekey()
+  pull.Rekey()
+  c, err := push.Push([]byte("arcd"), SecretStreamTagMessage)
+  if err != nil {
+    t.Fatal(err)
+  }
+  tampered := append([]byte{}, c...)
+  tampered[0] ^= 1
+  if _, _, err = pull.Pull(tampered); err != ErrOpen {
+    t.Fatalf("tampered message gave %v, want ErrOpen", err)
+  }
+  // a failed pull leaves the state alone
+  msg, _, err := pull.Pull(c)
+  if err != nil || string(msg) != "arcd" {
+    t.Fatalf("pull after rekey failed: %v", err)
+  }
+}
+
+func TestSecretStreamPullErrors(t *testing.T) {
+  key, push, _ := newTestSecretStream(t)
+  c, err := push.Push([]byte("arcd"), SecretStreamTagMessage)
+  if err != nil {
+    t.Fatal(err)
+  }
+  _, header, err := NewSecretStreamPush(key.Data())
+  if err != nil {
+    t.Fatal(err)
+  }
+  tests := []struct {
+    name string
+    key, header, c []byte
+  }{
+    {"wrong key", RandBytes(SecretStreamKeySize()), header, c},
+    {"wrong header", key.Data(), header, c},
+    {"short message", key.Data(), header, c[:SecretStreamOverhead() - 1]},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      pull, err := NewSecretStreamPull(tt.key, tt.header)
+      if err != nil {
+        t.Fatal(err)
+      }
+      defer pull.Free()
+      if _, _, err := pull.Pull(tt.c); err != ErrOpen {
+        t.Errorf("gave %v, want ErrOpen", err)
+      }
+    })
+  }
+}
+
+// the io wrappers
+func TestSecretStreamIO(t *testing.T) {
+  key := NewSecretStreamKey()
+  defer key.Free()
+  var wire bytes.Buffer
+  w, err := NewSecretStreamWriter(&wire, key.Data())
+  if err != nil {
+    t.Fatal(err)
+  }
+  data := RandBytes(3 * SecretStreamChunkSize + 100)
+  _, err = w.Write(data[:100])
+  if err == nil {
+    err = w.Rekey()
+  }
+  if err == nil {
+    _, err = w.Write(data[100:])
+  }
+  if err == nil {
+    err = w.Close()
+  }
+  if err != nil {
+    t.Fatalf("writer: %s", err)
+  }
+  stream := wire.Bytes()
+  tests := []struct {
+    name string
+    stream, key []byte
+    err error
+  }{
+    {"whole stream", stream, key.Data(), nil},
+    {"truncated", stream[:len(stream)-1], key.Data(), ErrTruncated},
+    {"wrong key", stream, RandBytes(SecretStreamKeySize()), ErrOpen},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      r, err := NewSecretStreamReader(bytes.NewReader(tt.stream), tt.key)
+      if err != nil {
+        t.Fatal(err)
+      }
+      got, err := io.ReadAll(r)
+      r.Close()
+      if err != tt.err {
+        t.Fatalf("gave %v, want %v", err, tt.err)
+      }
+      if err == nil && ! bytes.Equal(got, data) {
+        t.Error("read back different data")
+      }
+    })
+  }
+}
@@ -0,0 +1,55 @@
+package nacl
+
+import (
+  "bytes"
+  "encoding/hex"
+  "errors"
+  "fmt"
+)
+
+// rfc 8032 section 7.1 test 1, the full known answer tests are in the _test.go files
+const (
+  selfTestSeed = "9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60"
+  selfTestSig = "e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e065224901555fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b"
+)
+
+// check the crypto we use works on this machine, returns the first failure
+// not run automatically, call it if you want to know the backend behaves
+// go test ./nacl checks much more, run it with and without -tags nosodium
+func SelfTest() error {
+  seed, _ := hex.DecodeString(selfTestSeed)
+  sig, _ := hex.DecodeString(selfTestSig)
+  kp := SeedSignKey(seed)
+  if kp == nil {
+    return errors.New("cannot make sign keys from seed")
+  }
+  defer kp.Free()
+  if got := kp.SignDetached(nil); ! bytes.Equal(got, sig) {
+    return fmt.Errorf("wrong signature %x", got)
+  }
+  if ! CryptoVerifyDetached(nil, sig, kp.Public()) {
+    return errors.New("valid signature did not verify")
+  }
+  to, from := GenBoxKeypair(), GenBoxKeypair()
+  if to == nil || from == nil {
+    return errors.New("cannot generate box keys")
+  }
+  defer to.Free()
+  defer from.Free()
+  msg := RandBytes(64)
+  nonce := NewBoxNonce()
+  box, err := CryptoBox(msg, nonce, to.Public(), from.Secret())
+  if err != nil {
+    return err
+  }
+  got, err := CryptoBoxOpen(box, nonce, to.Secret(), from.Public())
+  if err != nil || ! bytes.Equal(got, msg) {
+    return fmt.Errorf("box/box_open failed: %v", err)
+  }
+  box[0] ^= 1
+  if _, err = CryptoBoxOpen(box, nonce, to.Secret(), from.Public()); err != ErrOpen {
+    return fmt.Errorf("tampered box gave %v, want ErrOpen", err)
+  }
+  logger.Debug("crypto self test passed")
+  return nil
+}
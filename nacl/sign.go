@@ -1,36 +1,81 @@
+//go:build cgo && !nosodium
+
 package nacl
 
 // #include <sodium.h>
 // #cgo pkg-config: libsodium
 import "C"
 
-import (
-  "log"
-)
-
 // sign data detached with secret key sk 
 func CryptoSignDetached(msg, sk []byte) []byte {
-  msgbuff := NewBuffer(msg)
-  defer msgbuff.Free()
   skbuff := NewBuffer(sk)
   defer skbuff.Free()
-  if skbuff.size != C.crypto_sign_bytes() {
-    log.Println("nacl.CryptoSign() invalid secret key size", len(sk))
+  if skbuff.size != C.crypto_sign_secretkeybytes() {
+    logger.Warn("nacl.CryptoSignDetached() invalid secret key size", "len", len(sk))
+    return nil
+  }
+  return signDetached(msg, skbuff)
+}
+
+// sign data detached with our secret key without copying it out
+func (self *KeyPair) SignDetached(msg []byte) []byte {
+  if self.sk.size != C.crypto_sign_secretkeybytes() {
+    logger.Warn("nacl.KeyPair.SignDetached() not a signing key", "len", self.sk.Length())
     return nil
   }
+  return signDetached(msg, self.sk)
+}
+
+func signDetached(msg []byte, sk *Buffer) []byte {
+  msgbuff := NewBuffer(msg)
+  defer msgbuff.Free()
   
   // allocate the signature buffer
   sig := malloc(C.crypto_sign_bytes())
   defer sig.Free()
   // compute signature
   siglen := C.ulonglong(0)
-  res := C.crypto_sign_detached(sig.uchar(), &siglen, msgbuff.uchar(), C.ulonglong(msgbuff.size), skbuff.uchar())
+  res := C.crypto_sign_detached(sig.uchar(), &siglen, msgbuff.uchar(), C.ulonglong(msgbuff.size), sk.uchar())
   if res == 0 && siglen == C.ulonglong(C.crypto_sign_bytes()) {
     // return copy of signature buffer
     return sig.Bytes()
   }
   // failure to sign
-  log.Println("nacl.CryptoSign() failed")
+  logger.Warn("nacl.CryptoSignDetached() failed")
   return nil
 }
 
+
+// sign data with secret key sk, returns the signature followed by the data
+func CryptoSign(msg, sk []byte) []byte {
+  if len(sk) != int(C.crypto_sign_secretkeybytes()) {
+    logger.Warn("nacl.CryptoSign() invalid secret key size", "len", len(sk))
+    return nil
+  }
+  skbuff := NewBuffer(sk)
+  defer skbuff.Free()
+  return sign(msg, skbuff)
+}
+
+// sign data with our secret key without copying it out, same as CryptoSign
+func (self *KeyPair) Sign(msg []byte) []byte {
+  if self.sk.size != C.crypto_sign_secretkeybytes() {
+    logger.Warn("nacl.KeyPair.Sign() not a signing key", "len", self.sk.Length())
+    return nil
+  }
+  return sign(msg, self.sk)
+}
+
+func sign(msg []byte, sk *Buffer) []byte {
+  msgbuff := NewBuffer(msg)
+  defer msgbuff.Free()
+  smsg := malloc(msgbuff.size + C.crypto_sign_bytes())
+  defer smsg.Free()
+  smsglen := C.ulonglong(0)
+  res := C.crypto_sign(smsg.uchar(), &smsglen, msgbuff.uchar(), C.ulonglong(msgbuff.size), sk.uchar())
+  if res != 0 {
+    logger.Warn("nacl.CryptoSign() failed")
+    return nil
+  }
+  return smsg.Bytes()[:smsglen]
+}
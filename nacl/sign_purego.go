@@ -0,0 +1,43 @@
+//go:build !cgo || nosodium
+
+package nacl
+
+import (
+  "golang.org/x/crypto/ed25519"
+)
+
+// sign data detached with secret key sk 
+func CryptoSignDetached(msg, sk []byte) []byte {
+  if len(sk) != ed25519.PrivateKeySize {
+    logger.Warn("nacl.CryptoSignDetached() invalid secret key size", "len", len(sk))
+    return nil
+  }
+  return ed25519.Sign(ed25519.PrivateKey(sk), msg)
+}
+
+// sign data detached with our secret key without copying it out
+func (self *KeyPair) SignDetached(msg []byte) []byte {
+  if self.sk.Length() != ed25519.PrivateKeySize {
+    logger.Warn("nacl.KeyPair.SignDetached() not a signing key", "len", self.sk.Length())
+    return nil
+  }
+  return ed25519.Sign(ed25519.PrivateKey(self.sk.Data()), msg)
+}
+
+// sign data with secret key sk, returns the signature followed by the data
+func CryptoSign(msg, sk []byte) []byte {
+  sig := CryptoSignDetached(msg, sk)
+  if sig == nil {
+    return nil
+  }
+  return append(sig, msg...)
+}
+
+// sign data with our secret key without copying it out, same as CryptoSign
+func (self *KeyPair) Sign(msg []byte) []byte {
+  sig := self.SignDetached(msg)
+  if sig == nil {
+    return nil
+  }
+  return append(sig, msg...)
+}
@@ -0,0 +1,149 @@
+package nacl
+
+import (
+  "bytes"
+  "fmt"
+  "testing"
+)
+
+// ed25519 known answers from rfc 8032 section 7.1
+var signVectors = []struct {
+  seed, pk, msg, sig string
+}{
+  {
+    seed: "9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60",
+    pk: "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a",
+    msg: "",
+    sig: "e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e065224901555fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b",
+  },
+  {
+    seed: "4ccd089b28ff96da9db6c346ec114e0f5b8a319f35aba624da8cf6ed4fb8a6fb",
+    pk: "3d4017c3e843895a92b70aa74d1b7ebc9c982ccf2ec4968cc0cd55f12af4660c",
+    msg: "72",
+    sig: "92a009a9f0d4cab8720e820b5f642540a2b27b5416503f8fb3762223ebdb69da085ac1e43e15996e458f3613d0f11d8c387b2eaeb4302aeeb00d291612bb0c00",
+  },
+  {
+    seed: "c5aa8df43f9f837bedb7442f31dcb7b166d38535076f094b85ce3a2e0b4458f7",
+    pk: "fc51cd8e6218a1a38da47ed00230f0580816ed13ba3303ac5deb911548908025",
+    msg: "af82",
+    sig: "6291d657deec24024827e69c3abe01a30ce548a284743a445e3680d7db5ac3ac18ff9b538d16f290ae67f760984dc6594a7c15e9716ed28dc027beceea1ec40a",
+  },
+}
+
+func TestSignVectors(t *testing.T) {
+  for n, v := range signVectors {
+    t.Run(fmt.Sprint(n), func(t *testing.T) {
+      seed, pk, msg, sig := unhex(t, v.seed), unhex(t, v.pk), unhex(t, v.msg), unhex(t, v.sig)
+      kp := SeedSignKey(seed)
+      if kp == nil {
+        t.Fatal("cannot make keys from seed")
+      }
+      defer kp.Free()
+      if ! bytes.Equal(kp.Public(), pk) {
+        t.Fatalf("wrong public key %x", kp.Public())
+      }
+      if got := GetSignPubkey(kp.Secret()); ! bytes.Equal(got, pk) {
+        t.Errorf("GetSignPubkey gave %x", got)
+      }
+      if ! bytes.Equal(kp.Seed(), seed) {
+        t.Errorf("wrong seed %x", kp.Seed())
+      }
+      if got := CryptoSignDetached(msg, kp.Secret()); ! bytes.Equal(got, sig) {
+        t.Errorf("wrong signature %x", got)
+      }
+      if got := kp.SignDetached(msg); ! bytes.Equal(got, sig) {
+        t.Errorf("KeyPair.SignDetached gave %x", got)
+      }
+      if ! CryptoVerifyDetached(msg, sig, pk) {
+        t.Error("valid signature did not verify")
+      }
+      smsg := CryptoSign(msg, kp.Secret())
+      if ! bytes.Equal(smsg, append(append([]byte{}, sig...), msg...)) {
+        t.Errorf("wrong signed message %x", smsg)
+      }
+      if got := kp.Sign(msg); ! bytes.Equal(got, smsg) {
+        t.Errorf("KeyPair.Sign gave %x", got)
+      }
+      if got, err := CryptoSignOpen(smsg, pk); err != nil || ! bytes.Equal(got, msg) {
+        t.Errorf("CryptoSignOpen gave %x %v", got, err)
+      }
+    })
+  }
+}
+
+func TestSignBadSignature(t *testing.T) {
+  v := signVectors[2]
+  pk, msg, sig := unhex(t, v.pk), unhex(t, v.msg), unhex(t, v.sig)
+  other := genSignKeypair(t)
+  badSig := append([]byte{}, sig...)
+  badSig[0] ^= 1
+  badMsg := append([]byte{}, msg...)
+  badMsg[0] ^= 1
+  tests := []struct {
+    name string
+    msg, sig, pk []byte
+  }{
+    {"tampered signature", msg, badSig, pk},
+    {"tampered message", badMsg, sig, pk},
+    {"wrong public key", msg, sig, other.Public()},
+    {"short signature", msg, sig[1:], pk},
+    {"short public key", msg, sig, pk[1:]},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      if CryptoVerifyDetached(tt.msg, tt.sig, tt.pk) {
+        t.Error("CryptoVerifyDetached verified")
+      }
+      smsg := append(append([]byte{}, tt.sig...), tt.msg...)
+      if _, err := CryptoSignOpen(smsg, tt.pk); err == nil {
+        t.Error("CryptoSignOpen opened")
+      }
+    })
+  }
+}
+
+func TestImportSignKey(t *testing.T) {
+  v := signVectors[1]
+  seed, pk := unhex(t, v.seed), unhex(t, v.pk)
+  kp := SeedSignKey(seed)
+  if kp == nil {
+    t.Fatal("cannot make keys from seed")
+  }
+  defer kp.Free()
+  formats := []struct {
+    name string
+    data []byte
+  }{
+    {"exported", ExportSignKey(kp)},
+    {"seed", seed},
+    {"secret key", kp.Secret()},
+  }
+  for _, f := range formats {
+    t.Run(f.name, func(t *testing.T) {
+      imported, err := ImportSignKey(f.data)
+      if err != nil {
+        t.Fatal(err)
+      }
+      defer imported.Free()
+      if ! bytes.Equal(imported.Public(), pk) {
+        t.Errorf("imported wrong key %x", imported.Public())
+      }
+    })
+  }
+}
+
+func TestSignRoundTrip(t *testing.T) {
+  for _, size := range testSizes {
+    t.Run(fmt.Sprint(size), func(t *testing.T) {
+      msg := RandBytes(size)
+      if len(msg) != size {
+        t.Fatalf("RandBytes(%d) gave %d bytes", size, len(msg))
+      }
+      kp := genSignKeypair(t)
+      sig := CryptoSignDetached(msg, kp.Secret())
+      if ! CryptoVerifyDetached(msg, sig, kp.Public()) {
+        t.Error("sign/verify failed")
+      }
+    })
+  }
+}
@@ -0,0 +1,120 @@
+package nacl
+
+import (
+  "bytes"
+  "testing"
+)
+
+// output of libsodium that the pure go backend has to match byte for byte,
+// and libsodium itself has to keep reading
+// no build tag, go test ./nacl and go test -tags nosodium ./nacl both run these
+var sodiumVectors = struct {
+  // secretstream: key, header then messages pushed in order
+  streamKey, streamHeader string
+  stream []struct {
+    tag byte
+    msg, c string
+  }
+  // box keys from SeedBoxKey(seed), the sign keys from SeedSignKey(seed) converted with ToBox
+  seed, boxSK, boxPK, signPK, convertedSK string
+  // CryptoBoxSeal of msg to boxPK
+  msg, sealed string
+  // PwHash of "arcd" with 2 passes and 64KiB
+  pwhash string
+}{
+  streamKey: "808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f",
+  streamHeader: "d9c196452a6c12058b23f53752f2b6498b77364ff53a00e2",
+  stream: []struct {
+    tag byte
+    msg, c string
+  }{
+    {0, "61726364", "0e323bc19e06b4ac7d2040c0d663e6a6e500881ced"},
+    {1, "", "46f5d79da09b76915944eda422f4fce84f"},
+    {2, "61726364207572632072656c61792063686174", "4bfa7e49a5d409884b04454c466982e95533e61dc77c3da6e69d4682e4dac4cb0f6f279a"},
+    {0, "61667465722072656b6579", "fabf406b3360af4868d404dbd5d26563e65418d9038ba626cb921017"},
+    {3, "627965", "267179cd3efd2596a600cb23e03757738e0fa26e"},
+  },
+  seed: "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f",
+  boxSK: "887af58a36202e05c4c1cfec5bf6c61fad66bca851536004074b31f1b56e4ac9",
+  boxPK: "5730800ab340fcb18ce5111eda9d705f91388b41e4544cbd103ba5942db2233e",
+  signPK: "29acbae141bccaf0b22e1a94d34d0bc7361e526d0bfe12c89794bc9322966dd7",
+  convertedSK: "887af58a36202e05c4c1cfec5bf6c61fad66bca851536004074b31f1b56e4a49",
+  msg: "61726364207572632072656c61792063686174",
+  sealed: "ebf7bfd78f98898b556543ee89664ca8203457a5822775087ea9a3bef8236a0b964cd082ad5bc8e757ea535006905eb0288cdadd807a74147ed49f0f8a871ea28ec6af",
+  pwhash: "$argon2id$v=19$m=64,t=2,p=1$gK/nJOdDdhx1Hok2bTh9Eg$pmRYQ1PG1kLi8kbu3gvhvo6vwaItK1g7VWjZIzzur/w",
+}
+
+func TestSodiumSecretStream(t *testing.T) {
+  v := sodiumVectors
+  pull, err := NewSecretStreamPull(unhex(t, v.streamKey), unhex(t, v.streamHeader))
+  if err != nil {
+    t.Fatalf("init_pull: %s", err)
+  }
+  defer pull.Free()
+  for n, m := range v.stream {
+    msg, tag, err := pull.Pull(unhex(t, m.c))
+    if err != nil || tag != m.tag || ! bytes.Equal(msg, unhex(t, m.msg)) {
+      t.Fatalf("message %d gave %x tag %d %v", n, msg, tag, err)
+    }
+  }
+}
+
+func TestSodiumKeys(t *testing.T) {
+  v := sodiumVectors
+  seed := unhex(t, v.seed)
+  boxkp := SeedBoxKey(seed)
+  if boxkp == nil {
+    t.Fatal("cannot seed box keys")
+  }
+  defer boxkp.Free()
+  signkp := SeedSignKey(seed)
+  if signkp == nil {
+    t.Fatal("cannot seed sign keys")
+  }
+  defer signkp.Free()
+  converted := toBox(t, signkp)
+  convertedPK, err := SignPubkeyToBox(signkp.Public())
+  if err != nil {
+    t.Fatal(err)
+  }
+  keys := []struct {
+    name string
+    got []byte
+    want string
+  }{
+    {"seeded box secret key", boxkp.Secret(), v.boxSK},
+    {"seeded box public key", boxkp.Public(), v.boxPK},
+    {"seeded sign public key", signkp.Public(), v.signPK},
+    {"converted secret key", converted.Secret(), v.convertedSK},
+    {"converted public key", converted.Public(), v.boxPK},
+    {"converted sign public key", convertedPK, v.boxPK},
+  }
+  for _, k := range keys {
+    if ! bytes.Equal(k.got, unhex(t, k.want)) {
+      t.Errorf("%s is %x, libsodium gives %s", k.name, k.got, k.want)
+    }
+  }
+}
+
+func TestSodiumSealed(t *testing.T) {
+  v := sodiumVectors
+  boxkp := SeedBoxKey(unhex(t, v.seed))
+  if boxkp == nil {
+    t.Fatal("cannot seed box keys")
+  }
+  defer boxkp.Free()
+  msg, err := boxkp.SealOpen(unhex(t, v.sealed))
+  if err != nil || ! bytes.Equal(msg, unhex(t, v.msg)) {
+    t.Errorf("cannot open libsodium sealed box: %v", err)
+  }
+}
+
+func TestSodiumPwHash(t *testing.T) {
+  v := sodiumVectors
+  if ! PwHashVerify(v.pwhash, []byte("arcd")) {
+    t.Error("libsodium password hash does not verify")
+  }
+  if PwHashVerify(v.pwhash, []byte("arcD")) {
+    t.Error("libsodium password hash verifies the wrong password")
+  }
+}
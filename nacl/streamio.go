@@ -0,0 +1,188 @@
+package nacl
+
+import (
+  "encoding/binary"
+  "errors"
+  "io"
+)
+
+// secretstream over an io.Writer / io.Reader
+//
+// the stream starts with the secretstream header, sent with the first chunk
+// so making a writer never blocks, then each Write is sent as one or more
+// chunks:
+//
+//   <4 byte big endian length> <secretstream message>
+//
+// Close sends an empty chunk tagged SecretStreamTagFinal so the reader can
+// tell the end of the stream from a truncated one.
+
+// most plaintext bytes in one chunk
+const SecretStreamChunkSize = 64 * 1024
+
+// the stream ended before its final chunk
+var ErrTruncated = errors.New("nacl: secretstream truncated")
+
+// encrypts everything written to it onto w
+type SecretStreamWriter struct {
+  w io.Writer
+  push *SecretStreamPush
+  // header not sent yet, it goes out with the first chunk
+  header []byte
+  closed bool
+}
+
+// start an encrypted stream on w with key
+func NewSecretStreamWriter(w io.Writer, key []byte) (*SecretStreamWriter, error) {
+  push, header, err := NewSecretStreamPush(key)
+  if err != nil {
+    return nil, err
+  }
+  return &SecretStreamWriter{w: w, push: push, header: header}, nil
+}
+
+// encrypt and write one chunk
+func (self *SecretStreamWriter) writeChunk(msg []byte, tag byte) error {
+  c, err := self.push.Push(msg, tag)
+  if err != nil {
+    return err
+  }
+  frame := make([]byte, len(self.header) + 4 + len(c))
+  copy(frame, self.header)
+  binary.BigEndian.PutUint32(frame[len(self.header):], uint32(len(c)))
+  copy(frame[len(self.header) + 4:], c)
+  _, err = self.w.Write(frame)
+  if err == nil {
+    self.header = nil
+  }
+  return err
+}
+
+func (self *SecretStreamWriter) Write(p []byte) (n int, err error) {
+  if self.closed {
+    return 0, io.ErrClosedPipe
+  }
+  for len(p) > 0 {
+    chunk := p
+    if len(chunk) > SecretStreamChunkSize {
+      chunk = chunk[:SecretStreamChunkSize]
+    }
+    err = self.writeChunk(chunk, SecretStreamTagMessage)
+    if err != nil {
+      return
+    }
+    n += len(chunk)
+    p = p[len(chunk):]
+  }
+  return
+}
+
+// have both ends switch to a new key from here on
+func (self *SecretStreamWriter) Rekey() error {
+  if self.closed {
+    return io.ErrClosedPipe
+  }
+  return self.writeChunk(nil, SecretStreamTagRekey)
+}
+
+// end the stream and free its state, does not close the underlying writer
+func (self *SecretStreamWriter) Close() error {
+  if self.closed {
+    return nil
+  }
+  err := self.writeChunk(nil, SecretStreamTagFinal)
+  self.closed = true
+  self.push.Free()
+  return err
+}
+
+// decrypts a stream written by SecretStreamWriter from r
+type SecretStreamReader struct {
+  r io.Reader
+  key *Buffer
+  pull *SecretStreamPull
+  // decrypted bytes not read yet
+  buff []byte
+  err error
+}
+
+// decrypt a stream from r with key, the header is read on the first Read
+func NewSecretStreamReader(r io.Reader, key []byte) (*SecretStreamReader, error) {
+  if len(key) != SecretStreamKeySize() {
+    return nil, &SizeError{What: "secret key", Got: len(key), Want: SecretStreamKeySize()}
+  }
+  return &SecretStreamReader{r: r, key: newSecret(key)}, nil
+}
+
+// running out of input before the final chunk means someone cut the stream short
+func truncated(err error) error {
+  if err == io.EOF || err == io.ErrUnexpectedEOF {
+    return ErrTruncated
+  }
+  return err
+}
+
+// read and decrypt the next chunk into buff
+func (self *SecretStreamReader) readChunk() error {
+  if self.pull == nil {
+    header := make([]byte, SecretStreamHeaderSize())
+    _, err := io.ReadFull(self.r, header)
+    if err != nil {
+      return truncated(err)
+    }
+    self.pull, err = NewSecretStreamPull(self.key.Data(), header)
+    self.key.Free()
+    self.key = nil
+    if err != nil {
+      return err
+    }
+  }
+  var l [4]byte
+  _, err := io.ReadFull(self.r, l[:])
+  if err != nil {
+    return truncated(err)
+  }
+  size := binary.BigEndian.Uint32(l[:])
+  if size > uint32(SecretStreamChunkSize + SecretStreamOverhead()) {
+    return ErrOpen
+  }
+  c := make([]byte, size)
+  _, err = io.ReadFull(self.r, c)
+  if err != nil {
+    return truncated(err)
+  }
+  var tag byte
+  self.buff, tag, err = self.pull.Pull(c)
+  if err == nil && tag == SecretStreamTagFinal {
+    err = io.EOF
+  }
+  return err
+}
+
+func (self *SecretStreamReader) Read(p []byte) (n int, err error) {
+  for len(self.buff) == 0 && self.err == nil {
+    self.err = self.readChunk()
+  }
+  if len(self.buff) > 0 {
+    n = copy(p, self.buff)
+    self.buff = self.buff[n:]
+    return
+  }
+  return 0, self.err
+}
+
+// free the stream state, does not close the underlying reader
+func (self *SecretStreamReader) Close() error {
+  if self.key != nil {
+    self.key.Free()
+    self.key = nil
+  }
+  if self.pull != nil {
+    self.pull.Free()
+    self.pull = nil
+  }
+  if self.err == nil {
+    self.err = io.ErrClosedPipe
+  }
+  return nil
+}
@@ -1,28 +1,39 @@
+//go:build cgo && !nosodium
+
 package nacl
 
 // #include <sodium.h>
 // #cgo pkg-config: libsodium
 import "C"
 
-import (
-  "log"
-)
-
 // verify a signed message
 func CryptoVerify(smsg, pk []byte) bool {
+  _, err := CryptoSignOpen(smsg, pk)
+  return err == nil
+}
+
+// check a signed message made with CryptoSign and get the message out of it
+// returns ErrOpen if the signature is not valid
+func CryptoSignOpen(smsg, pk []byte) ([]byte, error) {
+  err := checkSize("public key", pk, C.crypto_sign_publickeybytes())
+  if err != nil {
+    return nil, err
+  }
+  if len(smsg) < int(C.crypto_sign_bytes()) {
+    return nil, ErrOpen
+  }
   smsg_buff := NewBuffer(smsg)
   defer smsg_buff.Free()
   pk_buff := NewBuffer(pk)
   defer pk_buff.Free()
-
-  if pk_buff.size != C.crypto_sign_publickeybytes() {
-    log.Println("nacl.CryptoVerify() invalid public key size", len(pk))
-    return false
-  }
   mlen := C.ulonglong(0)
-  msg := malloc(C.size_t(len(smsg)))
+  msg := malloc(smsg_buff.size - C.crypto_sign_bytes())
   defer msg.Free()
-  return C.crypto_sign_open(msg.uchar(), &mlen, smsg_buff.uchar(), C.ulonglong(len(smsg)), pk_buff.uchar()) == 0
+  res := C.crypto_sign_open(msg.uchar(), &mlen, smsg_buff.uchar(), C.ulonglong(smsg_buff.size), pk_buff.uchar())
+  if res != 0 {
+    return nil, ErrOpen
+  }
+  return msg.Bytes()[:mlen], nil
 }
 
 // verfiy a detached signature
@@ -36,13 +47,13 @@ func CryptoVerifyDetached(msg, sig, pk []byte) bool {
   defer pk_buff.Free()
 
   if pk_buff.size != C.crypto_sign_publickeybytes() {
-    log.Println("nacl.CryptoVerifyDetached() invalid public key size", len(pk))
+    logger.Warn("nacl.CryptoVerifyDetached() invalid public key size", "len", len(pk))
     return false
   }
   
   // invalid sig size
   if sig_buff.size != C.crypto_sign_bytes() {
-    log.Println("nacl.CryptoVerifyDetached() invalid signature length", len(sig))
+    logger.Warn("nacl.CryptoVerifyDetached() invalid signature length", "len", len(sig))
     return false
   }
   return C.crypto_sign_verify_detached(sig_buff.uchar(), msg_buff.uchar(), C.ulonglong(len(msg)), pk_buff.uchar()) == 0
@@ -0,0 +1,46 @@
+//go:build !cgo || nosodium
+
+package nacl
+
+import (
+  "golang.org/x/crypto/ed25519"
+)
+
+// verify a signed message
+func CryptoVerify(smsg, pk []byte) bool {
+  _, err := CryptoSignOpen(smsg, pk)
+  return err == nil
+}
+
+// check a signed message made with CryptoSign and get the message out of it
+// returns ErrOpen if the signature is not valid
+func CryptoSignOpen(smsg, pk []byte) ([]byte, error) {
+  err := checkSize("public key", pk, ed25519.PublicKeySize)
+  if err != nil {
+    return nil, err
+  }
+  if len(smsg) < ed25519.SignatureSize {
+    return nil, ErrOpen
+  }
+  msg := smsg[ed25519.SignatureSize:]
+  if ! ed25519.Verify(ed25519.PublicKey(pk), msg, smsg[:ed25519.SignatureSize]) {
+    return nil, ErrOpen
+  }
+  return append([]byte{}, msg...), nil
+}
+
+// verfiy a detached signature
+// return true on valid otherwise false
+func CryptoVerifyDetached(msg, sig, pk []byte) bool {
+  if len(pk) != ed25519.PublicKeySize {
+    logger.Warn("nacl.CryptoVerifyDetached() invalid public key size", "len", len(pk))
+    return false
+  }
+  
+  // invalid sig size
+  if len(sig) != ed25519.SignatureSize {
+    logger.Warn("nacl.CryptoVerifyDetached() invalid signature length", "len", len(sig))
+    return false
+  }
+  return ed25519.Verify(ed25519.PublicKey(pk), msg, sig)
+}